@@ -2,13 +2,20 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"path/filepath"
 
 	"io"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/epsniff/gozeekstd/src/gzstd"
 	"github.com/klauspost/compress/zstd"
@@ -16,12 +23,33 @@ import (
 
 const (
 	defaultCompressionLevel = 6
+	maxZstdLevel            = 22
 	defaultFrameSize        = "512K"
+	autoFrameCount          = 1000            // frames --frame-size=auto aims for
+	minAutoFrameSize        = 64 * 1024       // smallest frame size auto picks
+	maxAutoFrameSize        = 8 * 1024 * 1024 // largest frame size auto picks
+	defaultDictSize         = 110 * 1024      // the zstd tool's default
 	programName             = "gzstd"
 	fileExtension           = ".zst"
+	gzipExtension           = ".gz"
 	version                 = "1.0.0"
+	streamChecksumFrameSize = gzstd.SKIPPABLE_HEADER_SIZE + 8
 )
 
+// gzipMagic starts every gzip member
+var gzipMagic = [2]byte{0x1f, 0x8b}
+
+// nameMagic marks the skippable frame holding the original file name and
+// modification time
+const nameMagic uint32 = 0x184D2A5A
+
+// originalFile is the name and modification time of a compressed file, as
+// saved with -N
+type originalFile struct {
+	Name    string
+	ModTime time.Time
+}
+
 // Options holds command-line options
 type Options struct {
 	Decompress   bool
@@ -35,15 +63,35 @@ type Options struct {
 	Verbose      bool
 	Test         bool
 	Level        int
+	ZstdLevel    int // numeric zstd level, overriding Level when non-zero
+	Fast         int // zstd --fast level, overriding both levels when non-zero
 	FrameSize    string
+	Rsyncable    bool // content-defined frame boundaries
 	StartFrame   uint32
 	EndFrame     uint32
+	EndFrameSet  bool // --end-frame was given, so EndFrame 0 means frame 0
+	StartByte    uint64
+	EndByte      uint64
+	EndByteSet   bool // --end-byte was given, so EndByte 0 means no output
 	Recursive    bool
 	Suffix       string
 	NoName       bool
 	Name         bool
+	NameSet      bool // -N was given, so decompression restores the saved name and time
 	Help         bool
 	Version      bool
+	ProgressFD   int
+	NameTemplate string
+	TempDir      string
+	JSON         bool   // list output as JSON
+	Debug        bool   // list every frame's offsets with -l -v
+	Jobs         int    // files processed concurrently
+	TrainDict    string // train a dictionary from the file arguments into this path
+
+	progress     *os.File          // progress output opened from ProgressFD
+	outputNames  map[string]string // templated output paths claimed so far
+	inputNumbers map[string]int    // {n} of each input named so far
+	mu           sync.Mutex        // guards progress, outputNames and inputNumbers across jobs
 }
 
 func main() {
@@ -59,23 +107,136 @@ func main() {
 		os.Exit(0)
 	}
 
+	if err := setupProgress(opts); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", programName, err)
+		os.Exit(1)
+	}
+
+	if opts.TrainDict != "" {
+		if err := trainDictionary(opts.TrainDict, args, opts); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", programName, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	files := args
 	if len(files) == 0 {
 		files = []string{"-"} // Default to stdin
 	}
 
-	// Process files
+	os.Exit(processFiles(files, opts))
+}
+
+// processFiles processes each file, up to opts.Jobs at a time, reporting
+// failures to stderr. It returns the exit code: 1 if any file failed.
+func processFiles(files []string, opts *Options) int {
+	if opts.Jobs <= 1 || writesStdout(files, opts) {
+		var exitCode int
+		for _, file := range files {
+			if err := processFile(file, opts); err != nil {
+				reportError(file, err, opts)
+				exitCode = 1
+			}
+		}
+		return exitCode
+	}
+
+	// Expand directories up front so their files are spread across jobs
 	var exitCode int
+	var work []string
 	for _, file := range files {
-		if err := processFile(file, opts); err != nil {
-			if !opts.Quiet {
-				fmt.Fprintf(os.Stderr, "%s: %s: %v\n", programName, file, err)
-			}
+		expanded, err := expandFile(file, opts)
+		if err != nil {
+			reportError(file, err, opts)
 			exitCode = 1
 		}
+		work = append(work, expanded...)
+	}
+	// Number the inputs in argument order, as a serial run would, before
+	// jobs pick them up in any order
+	if opts.NameTemplate != "" {
+		for _, file := range work {
+			inputNumber(opts, file)
+		}
 	}
 
-	os.Exit(exitCode)
+	jobs := make(chan string)
+	failed := make(chan struct{}, len(work))
+	var wg sync.WaitGroup
+	for i := 0; i < opts.Jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for file := range jobs {
+				if err := processFile(file, opts); err != nil {
+					reportError(file, err, opts)
+					failed <- struct{}{}
+				}
+			}
+		}()
+	}
+	for _, file := range work {
+		jobs <- file
+	}
+	close(jobs)
+	wg.Wait()
+
+	if len(failed) > 0 {
+		exitCode = 1
+	}
+	return exitCode
+}
+
+// writesStdout reports whether processing files writes compressed or
+// decompressed data to stdout, where output from parallel jobs would
+// interleave, so files are then processed one at a time
+func writesStdout(files []string, opts *Options) bool {
+	if opts.List || opts.Test {
+		return false
+	}
+	return opts.Stdout || opts.DecompressTo == "-" || slices.Contains(files, "-")
+}
+
+// reportError prints a file's error to stderr unless --quiet is set. Each
+// message is a single write, so messages from parallel jobs do not interleave.
+func reportError(file string, err error, opts *Options) {
+	if !opts.Quiet {
+		fmt.Fprintf(os.Stderr, "%s: %s: %v\n", programName, file, err)
+	}
+}
+
+// expandFile returns the files processFile would handle for file: with
+// --recursive, the matching files under a directory, otherwise file itself
+func expandFile(file string, opts *Options) ([]string, error) {
+	if !opts.Recursive || file == "-" {
+		return []string{file}, nil
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{file}, nil
+	}
+
+	var files []string
+	err = filepath.Walk(file, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && selectFile(path, opts) {
+			files = append(files, path)
+		}
+		return nil
+	})
+	return files, err
+}
+
+// selectFile reports whether a file found in a directory walk is processed:
+// compressed files when decompressing, uncompressed ones otherwise
+func selectFile(path string, opts *Options) bool {
+	return strings.HasSuffix(path, opts.Suffix) == opts.Decompress
 }
 
 func processFile(file string, opts *Options) error {
@@ -114,17 +275,10 @@ func processDirectory(dir string, opts *Options) error {
 			return nil
 		}
 		
-		// Process based on operation
-		if opts.Decompress {
-			// Only process files with compression suffix
-			if strings.HasSuffix(path, opts.Suffix) {
-				return processFile(path, opts)
-			}
-		} else {
-			// Skip already compressed files
-			if !strings.HasSuffix(path, opts.Suffix) {
-				return processFile(path, opts)
-			}
+		// Only compressed files are decompressed, and only
+		// uncompressed ones compressed
+		if selectFile(path, opts) {
+			return processFile(path, opts)
 		}
 		
 		return nil
@@ -147,6 +301,8 @@ func parseOptions() (*Options, []string) {
 
 	// Compression level (removed -c short flag to avoid conflict)
 	flagSet.IntVar(&opts.Level, "compression", defaultCompressionLevel, "compression level (1-9)")
+	flagSet.IntVar(&opts.ZstdLevel, "zstd-level", 0, "numeric zstd compression level (1-22)")
+	flagSet.IntVar(&opts.Fast, "fast", 0, "faster than level 1, trading compression ratio for speed")
 	
 	// Keep/no-keep flags
 	flagSet.BoolVar(&opts.NoKeep, "nk", false, "don't keep original files")
@@ -167,6 +323,8 @@ func parseOptions() (*Options, []string) {
 	flagSet.BoolVar(&opts.List, "list", false, "list compressed file contents")
 	flagSet.BoolVar(&opts.Test, "t", false, "test compressed file integrity")
 	flagSet.BoolVar(&opts.Test, "test", false, "test compressed file integrity")
+	flagSet.BoolVar(&opts.JSON, "json", false, "list output as JSON")
+	flagSet.BoolVar(&opts.Debug, "debug", false, "with --list --verbose, dump every frame's offsets")
 	flagSet.BoolVar(&opts.Verbose, "v", false, "verbose mode")
 	flagSet.BoolVar(&opts.Verbose, "verbose", false, "verbose mode")
 	flagSet.BoolVar(&opts.Quiet, "q", false, "suppress warnings")
@@ -189,9 +347,18 @@ func parseOptions() (*Options, []string) {
 
 	// Extended options
 	flagSet.StringVar(&opts.FrameSize, "frame-size", defaultFrameSize, "seekable frame size")
+	flagSet.BoolVar(&opts.Rsyncable, "rsyncable", false, "end frames at content-defined boundaries")
 	var startFrame, endFrame uint
 	flagSet.UintVar(&startFrame, "start-frame", 0, "start decompression at frame")
 	flagSet.UintVar(&endFrame, "end-frame", 0, "end decompression at frame")
+	flagSet.Uint64Var(&opts.StartByte, "start-byte", 0, "start decompression at decompressed byte offset")
+	flagSet.Uint64Var(&opts.EndByte, "end-byte", 0, "stop decompression before decompressed byte offset")
+	flagSet.IntVar(&opts.ProgressFD, "progress-fd", -1, "write JSON progress lines to file descriptor")
+	flagSet.StringVar(&opts.NameTemplate, "name-template", "", "output name template for compression")
+	flagSet.IntVar(&opts.Jobs, "j", 1, "number of files to process in parallel")
+	flagSet.IntVar(&opts.Jobs, "jobs", 1, "number of files to process in parallel")
+	flagSet.StringVar(&opts.TrainDict, "train-dict", "", "train a dictionary from sample files")
+	flagSet.StringVar(&opts.TempDir, "temp-dir", "", "directory for temporary spool files")
 
 	// Add compression level shortcuts (1-9) before parsing
 	for i := 1; i <= 9; i++ {
@@ -228,9 +395,42 @@ func parseOptions() (*Options, []string) {
 		}
 	}
 
+	if err := validateNameTemplate(opts.NameTemplate); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", programName, err)
+		os.Exit(1)
+	}
+
+	if err := validateTempDir(opts.TempDir); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", programName, err)
+		os.Exit(1)
+	}
+
+	if opts.ZstdLevel < 0 || opts.ZstdLevel > maxZstdLevel {
+		fmt.Fprintf(os.Stderr, "%s: invalid zstd level %d, must be 1-%d\n", programName, opts.ZstdLevel, maxZstdLevel)
+		os.Exit(1)
+	}
+	if same := sameZstdLevel(opts.ZstdLevel); same != opts.ZstdLevel && !opts.Quiet {
+		fmt.Fprintf(os.Stderr, "%s: warning: zstd level %d compresses the same as level %d\n",
+			programName, opts.ZstdLevel, same)
+	}
+	if opts.Fast < 0 {
+		fmt.Fprintf(os.Stderr, "%s: invalid fast level %d, must be at least 1\n", programName, opts.Fast)
+		os.Exit(1)
+	}
+
 	// Convert uint to uint32
 	opts.StartFrame = uint32(startFrame)
 	opts.EndFrame = uint32(endFrame)
+	flagSet.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "end-frame":
+			opts.EndFrameSet = true
+		case "end-byte":
+			opts.EndByteSet = true
+		case "N", "name":
+			opts.NameSet = true
+		}
+	})
 
 	// Set keep behavior
 	opts.Keep = !opts.NoKeep
@@ -255,9 +455,9 @@ func parseOptions() (*Options, []string) {
 		}
 	}
 
-	// If name flags weren't explicitly set, default to true
-	if !opts.NoName {
-		opts.Name = true
+	// -n overrides the -N default
+	if opts.NoName {
+		opts.Name = false
 	}
 
 	return opts, flagSet.Args()
@@ -275,6 +475,12 @@ Basic Usage:
 Compression Options:
   -1 to -9                 Compression level (1=fastest, 9=best compression, 6=default)
   --compression=LEVEL      Set compression level (1-9)
+  --zstd-level=LEVEL       Set a numeric zstd level (1-22) instead; levels 1-2
+                           use the fastest encoder, 3-5 the default, 6-9 better
+                           compression and 10-22 the best, with a warning for
+                           levels that compress the same as a lower one
+  --fast=N                 Compress faster than level 1 by skipping entropy
+                           coding, with a smaller window as N grows (1-3)
   -nk, --no-keep           Don't keep the original files (The default is to keep files)
 
 Output Control:
@@ -284,6 +490,9 @@ Output Control:
 
 Information and Testing:
   -l, --list               List compressed file contents
+  --json                   With --list, print the listing and every frame as JSON
+  --debug                  With --list --verbose, summarize the seek table and
+                           print every frame's offsets, sizes and checksum
   -t, --test               Test compressed file integrity
   -v, --verbose            Display compression ratio and other info
   -q, --quiet              Suppress warnings
@@ -296,9 +505,23 @@ Other Options:
   -f, --force              Force overwrite of output files
 
 Extended Options:
-  --frame-size=SIZE        Set seekable frame size (default: %s)
+  --frame-size=SIZE        Set seekable frame size (default: %s); auto picks
+                           one giving about %d frames for the input file
+  --rsyncable              End frames at content-defined boundaries, between half
+                           and twice the frame size of input, so edits only
+                           change nearby frames (friendlier to rsync and dedup)
   --start-frame=N          Start decompression at frame N
   --end-frame=N            End decompression at frame N
+  --start-byte=N           Start decompression at decompressed byte N
+  --end-byte=N             Stop decompression before decompressed byte N
+  --progress-fd=N          Write JSON progress lines to file descriptor N
+  --name-template=TMPL     Name compressed outputs from TMPL using {dir}, {base},
+                           {n} (the input's number in the run) and {suffix},
+                           e.g. "compressed/{dir}/{base}{suffix}"
+  -j, --jobs=N             Process up to N files in parallel (default: 1)
+  --train-dict=FILE        Train a zstd dictionary from the sample files given
+                           as arguments and write it to FILE
+  --temp-dir=DIR           Spool stdin to temporary files in DIR (default: system temp dir)
 
 Examples:
   %s file.txt              # Compress file.txt to file.txt%s
@@ -308,7 +531,7 @@ Examples:
   %s -r directory          # Recursively compress files in directory
 
 `, programName, programName, fileExtension, programName, fileExtension, programName,
-		fileExtension, defaultFrameSize,
+		programName, fileExtension, defaultFrameSize, autoFrameCount,
 		programName, fileExtension,
 		programName, fileExtension,
 		programName, fileExtension,
@@ -317,12 +540,6 @@ Examples:
 }
 
 func compressFile(inputFile string, opts *Options) error {
-	// Parse frame size
-	frameSize, err := parseByteSize(opts.FrameSize)
-	if err != nil {
-		return fmt.Errorf("invalid frame size: %v", err)
-	}
-
 	// Open input
 	input, inputInfo, err := openInput(inputFile)
 	if err != nil {
@@ -330,9 +547,27 @@ func compressFile(inputFile string, opts *Options) error {
 	}
 	defer input.Close()
 
+	frameSize, err := frameSizeFor(opts.FrameSize, inputInfo)
+	if err != nil {
+		return fmt.Errorf("invalid frame size: %v", err)
+	}
+
 	// Determine output
 	outputFile := getOutputFileName(inputFile, opts.Suffix, opts.Stdout)
 
+	if opts.NameTemplate != "" && outputFile != "-" {
+		outputFile, err = expandNameTemplate(opts.NameTemplate, inputFile, opts.Suffix, inputNumber(opts, inputFile))
+		if err != nil {
+			return err
+		}
+		if err := claimOutputName(opts, inputFile, outputFile); err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(outputFile), 0755); err != nil {
+			return err
+		}
+	}
+
 	// Open output
 	output, err := openOutput(outputFile, opts.Force)
 	if err != nil {
@@ -353,14 +588,48 @@ func compressFile(inputFile string, opts *Options) error {
 
 	// Create encoder
 	encoderOpts := gzstd.DefaultEncoderOptions()
-	encoderOpts.Level = getZstdLevel(opts.Level)
+	encoderOpts.Level = encoderLevel(opts)
 	encoderOpts.FramePolicy = gzstd.CompressedFrameSize{Size: uint32(frameSize)}
+	if opts.FrameSize == "auto" {
+		// auto is derived from the input size, so it bounds the input
+		// each frame takes rather than its compressed size
+		encoderOpts.FramePolicy = gzstd.UncompressedFrameSize{Size: uint32(frameSize)}
+	}
+	// Like gzip's CRC32, a checksum of the whole content for --test
+	encoderOpts.StreamChecksum = true
+	if opts.Rsyncable {
+		encoderOpts.FramePolicy = gzstd.ContentDefinedFrameSize{Min: uint32(frameSize / 2), Max: uint32(frameSize * 2)}
+	}
+
+	// --verbose shows a running total, unless parallel jobs would garble it
+	showTotal := opts.Verbose && opts.Jobs <= 1
+	if opts.progress != nil || showTotal {
+		var total uint64
+		if inputInfo != nil {
+			total = uint64(inputInfo.Size())
+		}
+		encoderOpts.OnFrame = func(frameIndex uint32, compressed, decompressed uint64) {
+			reportProgress(opts, decompressed, total, frameIndex+1)
+			if showTotal {
+				fmt.Fprintf(os.Stderr, "\r%s: %d frames, %d bytes compressed to %d",
+					inputFile, frameIndex+1, decompressed, compressed)
+			}
+		}
+	}
 
 	encoder, err := gzstd.NewEncoder(output, encoderOpts)
 	if err != nil {
 		return err
 	}
 
+	// Save the original name and timestamp ahead of the data
+	if opts.Name && inputInfo != nil {
+		original := originalFile{Name: filepath.Base(inputFile), ModTime: inputInfo.ModTime()}
+		if err := encoder.WriteSkippableMetadata(nameMagic, original.encode()); err != nil {
+			return err
+		}
+	}
+
 	// Compress data
 	written, err := io.Copy(encoder, input)
 	if err != nil {
@@ -371,6 +640,9 @@ func compressFile(inputFile string, opts *Options) error {
 	if err := encoder.Finish(); err != nil {
 		return err
 	}
+	if showTotal && encoder.Stats().NumFrames > 0 {
+		fmt.Fprintln(os.Stderr)
+	}
 
 	// Close output
 	output.Close()
@@ -378,13 +650,22 @@ func compressFile(inputFile string, opts *Options) error {
 
 	// Print statistics
 	if opts.Verbose && outputFile != "-" {
-		compressedSize := encoder.WrittenCompressed()
-		ratio := float64(written) / float64(compressedSize) * 100
+		stats := encoder.Stats()
+		ratio := 0.0
+		if stats.TotalCompressed > 0 {
+			ratio = float64(written) / float64(stats.TotalCompressed) * 100
+		}
+		action := "compressed to"
 		if !opts.Keep {
-			fmt.Printf("%s:\t%.1f%% -- replaced with %s\n", inputFile, ratio, outputFile)
-		} else {
-			fmt.Printf("%s:\t%.1f%% -- compressed to %s\n", inputFile, ratio, outputFile)
+			action = "replaced with"
+		}
+		// One write per file, so parallel jobs do not interleave
+		summary := fmt.Sprintf("%s:\t%.1f%% -- %s %s\n", inputFile, ratio, action, outputFile)
+		if stats.NumFrames > 0 {
+			summary += fmt.Sprintf("\t%d frames, %d to %d bytes decompressed, mean ratio %.2f\n",
+				stats.NumFrames, stats.MinFrameDecomp, stats.MaxFrameDecomp, stats.MeanCompressionRatio)
 		}
+		fmt.Print(summary)
 	}
 
 	// Remove original file if no-keep is set
@@ -411,18 +692,46 @@ func decompressFile(inputFile string, opts *Options) error {
 	defer input.Close()
 
 	// Check if file has correct extension
-	if inputFile != "-" && !strings.HasSuffix(inputFile, opts.Suffix) {
+	if inputFile != "-" && !strings.HasSuffix(inputFile, opts.Suffix) && !strings.HasSuffix(inputFile, gzipExtension) {
 		return fmt.Errorf("unknown suffix -- ignored")
 	}
 
+	// Create seekable reader if needed
+	var seekableInput gzstd.Seekable
+	if inputFile == "-" {
+		// For stdin, we need to spool the entire input
+		spool, cleanup, err := spoolInput(input, opts)
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+		seekableInput = spool
+	} else {
+		seekableInput = input.(*os.File)
+	}
+
+	reader, original, err := decompressReader(seekableInput, opts)
+	if err != nil {
+		return err
+	}
+	// Like gzip, the saved name and time are only restored with -N
+	if !opts.Name || !opts.NameSet {
+		original = nil
+	}
+
 	// Determine output
 	var outputFile string
 	if opts.DecompressTo != "" {
 		outputFile = opts.DecompressTo
 	} else {
 		outputFile = getOutputFileName(inputFile, "", opts.Stdout)
+		if original != nil && outputFile != "-" {
+			if name := original.restoredName(inputFile); name != "" {
+				outputFile = name
+			}
+		}
 	}
-	
+
 	// Check if we would overwrite the input file
 	if outputFile == inputFile && inputFile != "-" {
 		return fmt.Errorf("would overwrite input file")
@@ -446,31 +755,8 @@ func decompressFile(inputFile string, opts *Options) error {
 		}
 	}()
 
-	// Create decoder
-	decoderOpts := gzstd.DefaultDecoderOptions()
-	decoderOpts.LowerFrame = opts.StartFrame
-	decoderOpts.UpperFrame = opts.EndFrame
-
-	// Create seekable reader if needed
-	var seekableInput gzstd.Seekable
-	if inputFile == "-" {
-		// For stdin, we need to buffer the entire input
-		data, err := io.ReadAll(input)
-		if err != nil {
-			return err
-		}
-		seekableInput = bytes.NewReader(data)
-	} else {
-		seekableInput = input.(*os.File)
-	}
-
-	decoder, err := gzstd.NewDecoder(seekableInput, decoderOpts)
-	if err != nil {
-		return err
-	}
-
 	// Decompress data
-	_, err = io.Copy(output, decoder)
+	_, err = io.Copy(output, reader)
 	if err != nil {
 		return err
 	}
@@ -491,24 +777,200 @@ func decompressFile(inputFile string, opts *Options) error {
 		}
 	}
 
-	// Preserve file times if name preservation is enabled
-	if opts.Name && inputInfo != nil && outputFile != "-" {
+	// Restore the saved timestamp, or else preserve the archive's
+	if original != nil && !original.ModTime.IsZero() && outputFile != "-" {
+		os.Chtimes(outputFile, original.ModTime, original.ModTime)
+	} else if opts.Name && inputInfo != nil && outputFile != "-" {
 		os.Chtimes(outputFile, inputInfo.ModTime(), inputInfo.ModTime())
 	}
 
 	return nil
 }
 
-func listFile(inputFile string, opts *Options) error {
-	if inputFile == "-" {
-		return fmt.Errorf("cannot list from stdin")
+// decompressReader returns a reader of the decompressed content of input,
+// restricted to the requested frame and byte range, and the original file
+// saved in the archive, if any. The format is detected from the magic bytes:
+// gzip input is decoded with compress/gzip, including concatenated members,
+// and zstd input by a gzstd decoder, sequentially if it has no seek table.
+func decompressReader(input gzstd.Seekable, opts *Options) (io.Reader, *originalFile, error) {
+	var magic [2]byte
+	n, err := io.ReadFull(input, magic[:])
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, nil, err
+	}
+	if _, err := input.Seek(0, io.SeekStart); err != nil {
+		return nil, nil, err
+	}
+
+	if n == len(magic) && magic == gzipMagic {
+		if opts.StartFrame > 0 || opts.EndFrameSet || opts.StartByte > 0 || opts.EndByteSet {
+			return nil, nil, fmt.Errorf("frame and byte ranges are not supported for gzip input")
+		}
+		reader, err := gzip.NewReader(input)
+		if err != nil {
+			return nil, nil, err
+		}
+		var original *originalFile
+		if reader.Name != "" || !reader.ModTime.IsZero() {
+			original = &originalFile{Name: reader.Name, ModTime: reader.ModTime}
+		}
+		return reader, original, nil
 	}
 
-	f, err := os.Open(inputFile)
+	// Create decoder
+	decoderOpts := gzstd.DefaultDecoderOptions()
+	decoderOpts.LowerFrame = opts.StartFrame
+	decoderOpts.UpperFrame = opts.EndFrame
+	decoderOpts.UpperFrameSet = opts.EndFrameSet
+	// Plain zstd files from other tools decode sequentially
+	decoderOpts.AllowNonSeekable = true
+
+	var total uint64
+	if opts.progress != nil {
+		decoderOpts.OnFrame = func(frameIndex uint32, decompressed uint64) {
+			reportProgress(opts, decompressed, total, frameIndex+1)
+		}
+	}
+
+	decoder, err := gzstd.NewDecoder(input, decoderOpts)
 	if err != nil {
+		return nil, nil, err
+	}
+
+	var original *originalFile
+	for _, frame := range decoder.SkippableFrames() {
+		if frame.Magic == nameMagic {
+			original, _ = decodeOriginalFile(frame.Data)
+		}
+	}
+
+	if n := decoder.SeekTable().NumFrames(); n > 0 {
+		total, _ = decoder.SeekTable().FrameEndDecomp(n - 1)
+	}
+
+	// Restrict output to the requested byte range
+	if opts.StartByte > 0 || opts.EndByteSet {
+		reader, err := byteRange(decoder, total, opts)
+		return reader, original, err
+	}
+	return decoder, original, nil
+}
+
+// encode serializes f as the modification time in Unix nanoseconds,
+// little-endian, followed by the name
+func (f originalFile) encode() []byte {
+	data := make([]byte, 8, 8+len(f.Name))
+	binary.LittleEndian.PutUint64(data, uint64(f.ModTime.UnixNano()))
+	return append(data, f.Name...)
+}
+
+// decodeOriginalFile parses the metadata written by originalFile.encode
+func decodeOriginalFile(data []byte) (*originalFile, error) {
+	if len(data) < 8 {
+		return nil, fmt.Errorf("original file metadata too short: %d bytes", len(data))
+	}
+	return &originalFile{
+		Name:    string(data[8:]),
+		ModTime: time.Unix(0, int64(binary.LittleEndian.Uint64(data))),
+	}, nil
+}
+
+// restoredName returns the saved name placed next to inputFile, or "" if no
+// usable name was saved. Directory components are dropped so an archive
+// cannot write outside the input's directory.
+func (f *originalFile) restoredName(inputFile string) string {
+	name := filepath.Base(f.Name)
+	if f.Name == "" || name == "." || name == ".." || name == string(filepath.Separator) {
+		return ""
+	}
+	return filepath.Join(filepath.Dir(inputFile), name)
+}
+
+// byteRange seeks the decoder to --start-byte and returns a reader that stops
+// before --end-byte. Offsets past the end of the content are clamped to total,
+// and offsets outside --start-frame and --end-frame to those frames.
+func byteRange(decoder *gzstd.Decoder, total uint64, opts *Options) (io.Reader, error) {
+	st := decoder.SeekTable()
+	first := uint64(0)
+	if opts.StartFrame > 0 {
+		first, _ = st.FrameStartDecomp(opts.StartFrame)
+	}
+	if opts.EndFrameSet && opts.EndFrame < st.NumFrames() {
+		total, _ = st.FrameEndDecomp(opts.EndFrame)
+	}
+
+	start := min(max(opts.StartByte, first), total)
+	end := total
+	if opts.EndByteSet {
+		end = min(opts.EndByte, total)
+	}
+	if end <= start {
+		return strings.NewReader(""), nil
+	}
+
+	if start > first {
+		if _, err := decoder.Seek(int64(start), io.SeekStart); err != nil {
+			return nil, err
+		}
+	}
+	return io.LimitReader(decoder, int64(end-start)), nil
+}
+
+// trainDictionary trains a zstd dictionary with each sample file as one
+// sample and writes it to output
+func trainDictionary(output string, sampleFiles []string, opts *Options) error {
+	if len(sampleFiles) == 0 {
+		return fmt.Errorf("--train-dict needs sample files")
+	}
+
+	samples := make([][]byte, 0, len(sampleFiles))
+	for _, file := range sampleFiles {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		samples = append(samples, data)
+	}
+
+	dict, err := gzstd.TrainDictionary(samples, defaultDictSize)
+	if err != nil {
+		return err
+	}
+
+	out, err := openOutput(output, opts.Force)
+	if err != nil {
+		return err
+	}
+	if _, err := out.Write(dict); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
 		return err
 	}
-	defer f.Close()
+
+	if opts.Verbose {
+		fmt.Printf("%s:\t%d byte dictionary from %d samples\n", output, len(dict), len(samples))
+	}
+	return nil
+}
+
+func listFile(inputFile string, opts *Options) error {
+	var f *os.File
+	if inputFile == "-" {
+		spool, cleanup, err := spoolInput(os.Stdin, opts)
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+		f = spool
+	} else {
+		var err error
+		if f, err = os.Open(inputFile); err != nil {
+			return err
+		}
+		defer f.Close()
+	}
 
 	// Get file info
 	info, err := f.Stat()
@@ -522,16 +984,9 @@ func listFile(inputFile string, opts *Options) error {
 		return err
 	}
 
-	// Calculate totals
-	totalCompressed := uint64(0)
-	totalDecompressed := uint64(0)
-	if seekTable.NumFrames() > 0 {
-		totalCompressed, _ = seekTable.FrameEndComp(seekTable.NumFrames() - 1)
-		totalDecompressed, _ = seekTable.FrameEndDecomp(seekTable.NumFrames() - 1)
-	}
-
-	// Add seek table overhead to compressed size
-	totalCompressed = uint64(info.Size())
+	// Calculate totals, with the seek table overhead in the compressed size
+	totalDecompressed := seekTable.TotalDecompressed()
+	totalCompressed := uint64(info.Size())
 
 	// Print in gzip-like format
 	ratio := 0.0
@@ -539,37 +994,103 @@ func listFile(inputFile string, opts *Options) error {
 		ratio = float64(totalCompressed) / float64(totalDecompressed) * 100
 	}
 
-	if opts.Verbose {
+	// The report is written in one piece, so parallel jobs do not interleave
+	var out bytes.Buffer
+	switch {
+	case opts.JSON:
+		if err := writeListJSON(&out, seekTable, totalCompressed, totalDecompressed, ratio); err != nil {
+			return err
+		}
+	case opts.Verbose:
 		// Verbose format with frame details
-		fmt.Printf("method  crc     date  time  compressed uncompressed  ratio uncompressed_name\n")
-		fmt.Printf("defla 00000000 %s %12d %12d %5.1f%% %s\n",
+		fmt.Fprintf(&out, "method  crc     date  time  compressed uncompressed  ratio uncompressed_name\n")
+		fmt.Fprintf(&out, "defla 00000000 %s %12d %12d %5.1f%% %s\n",
 			info.ModTime().Format("Jan _2 15:04"),
 			totalCompressed,
 			totalDecompressed,
 			ratio,
 			strings.TrimSuffix(inputFile, opts.Suffix))
 
+		if opts.Debug {
+			fmt.Fprintf(&out, "\nSeek table: %s\n", seekTable)
+			gzstd.DumpSeekTable(&out, seekTable)
+			break
+		}
+
 		// Frame details
-		fmt.Printf("\nFrames: %d\n", seekTable.NumFrames())
+		fmt.Fprintf(&out, "\nFrames: %d\n", seekTable.NumFrames())
 		for i := uint32(0); i < seekTable.NumFrames() && i < 10; i++ {
 			cSize, _ := seekTable.FrameSizeComp(i)
 			dSize, _ := seekTable.FrameSizeDecomp(i)
-			fmt.Printf("  Frame %d: %d -> %d bytes\n", i, cSize, dSize)
+			fmt.Fprintf(&out, "  Frame %d: %d -> %d bytes\n", i, cSize, dSize)
 		}
 		if seekTable.NumFrames() > 10 {
-			fmt.Printf("  ... and %d more frames\n", seekTable.NumFrames()-10)
+			fmt.Fprintf(&out, "  ... and %d more frames\n", seekTable.NumFrames()-10)
 		}
-	} else {
+	default:
 		// Standard format
 		uncompressedName := strings.TrimSuffix(inputFile, opts.Suffix)
-		fmt.Printf("%12d %12d %5.1f%% %s\n",
+		fmt.Fprintf(&out, "%12d %12d %5.1f%% %s\n",
 			totalCompressed,
 			totalDecompressed,
 			ratio,
 			uncompressedName)
 	}
 
-	return nil
+	_, err = os.Stdout.Write(out.Bytes())
+	return err
+}
+
+// readSeekTable reads the seek table at the end of the archive in f or, for
+// an archive written with FormatHead, at its start
+func readSeekTable(f io.ReadSeeker) (*gzstd.SeekTable, error) {
+	format, _, err := gzstd.ArchiveFormat(f)
+	if err != nil {
+		return nil, err
+	}
+	if format == gzstd.FormatHead {
+		return gzstd.ReadHeadSeekTable(f)
+	}
+	return gzstd.ReadSeekTable(f)
+}
+
+// listFrame is a frame in the JSON list output
+type listFrame struct {
+	Index        uint32 `json:"index"`
+	Compressed   uint64 `json:"compressed"`
+	Decompressed uint64 `json:"decompressed"`
+	StartDecomp  uint64 `json:"startDecomp"`
+	EndDecomp    uint64 `json:"endDecomp"`
+}
+
+// listJSON is the JSON list output for one archive
+type listJSON struct {
+	Compressed   uint64      `json:"compressed"`
+	Decompressed uint64      `json:"decompressed"`
+	Ratio        float64     `json:"ratio"`
+	NumFrames    uint32      `json:"numFrames"`
+	Frames       []listFrame `json:"frames"`
+}
+
+// writeListJSON writes the archive listing as a JSON object with every frame
+func writeListJSON(w io.Writer, seekTable *gzstd.SeekTable, compressed, decompressed uint64, ratio float64) error {
+	list := listJSON{
+		Compressed:   compressed,
+		Decompressed: decompressed,
+		Ratio:        ratio,
+		NumFrames:    seekTable.NumFrames(),
+		Frames:       make([]listFrame, 0, seekTable.NumFrames()),
+	}
+	for i := uint32(0); i < seekTable.NumFrames(); i++ {
+		frame := listFrame{Index: i}
+		frame.Compressed, _ = seekTable.FrameSizeComp(i)
+		frame.Decompressed, _ = seekTable.FrameSizeDecomp(i)
+		frame.StartDecomp, _ = seekTable.FrameStartDecomp(i)
+		frame.EndDecomp, _ = seekTable.FrameEndDecomp(i)
+		list.Frames = append(list.Frames, frame)
+	}
+
+	return json.NewEncoder(w).Encode(list)
 }
 
 func testFile(inputFile string, opts *Options) error {
@@ -583,11 +1104,12 @@ func testFile(inputFile string, opts *Options) error {
 	// Create seekable reader
 	var seekableInput gzstd.Seekable
 	if inputFile == "-" {
-		data, err := io.ReadAll(input)
+		spool, cleanup, err := spoolInput(input, opts)
 		if err != nil {
 			return err
 		}
-		seekableInput = bytes.NewReader(data)
+		defer cleanup()
+		seekableInput = spool
 	} else {
 		seekableInput = input.(*os.File)
 	}
@@ -598,12 +1120,15 @@ func testFile(inputFile string, opts *Options) error {
 		return err
 	}
 
-	// Test by reading all data
-	_, err = io.Copy(io.Discard, decoder)
-	if err != nil {
+	if err := checkFrameExtents(seekableInput, decoder.SeekTable()); err != nil {
 		return err
 	}
 
+	// Test frame by frame, stopping at the first bad one
+	if frame, err := decoder.TestIntegrity(); err != nil {
+		return fmt.Errorf("frame %d: %v", frame, err)
+	}
+
 	if opts.Verbose {
 		fmt.Printf("%s:\tOK\n", inputFile)
 	}
@@ -611,8 +1136,118 @@ func testFile(inputFile string, opts *Options) error {
 	return nil
 }
 
+// checkFrameExtents reports the first frame of the seek table that extends
+// past the compressed data actually present in input, which is more useful
+// than the read error decoding that frame would give. The frame data is what
+// remains of input once the seek table, before or after the frames as its
+// format says, and any StreamChecksum frame after the last frame are left out.
+func checkFrameExtents(input gzstd.Seekable, seekTable *gzstd.SeekTable) error {
+	size, err := input.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if _, err := input.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	format, _, err := gzstd.ArchiveFormat(input)
+	if err != nil {
+		return err
+	}
+	serializer, err := seekTable.NewSerializer(format)
+	if err != nil {
+		return err
+	}
+	tableSize := int64(serializer.EncodedLen())
+	if tableSize > size {
+		return fmt.Errorf("seek table of %d bytes is larger than the %d byte file", tableSize, size)
+	}
+
+	dataStart, dataEnd := int64(0), size-tableSize
+	if format == gzstd.FormatHead {
+		dataStart, dataEnd = tableSize, size
+	}
+	hasChecksum, err := endsWithStreamChecksum(input, dataStart, dataEnd)
+	if err != nil {
+		return err
+	}
+	if hasChecksum {
+		dataEnd -= streamChecksumFrameSize
+	}
+	dataSize := uint64(dataEnd - dataStart)
+
+	for i := uint32(0); i < seekTable.NumFrames(); i++ {
+		end, _ := seekTable.FrameEndComp(i)
+		if end > dataSize {
+			start, _ := seekTable.FrameStartComp(i)
+			return fmt.Errorf("frame %d extends past end of file: bytes %d-%d, but only %d bytes of frame data", i, start, end, dataSize)
+		}
+	}
+	return nil
+}
+
+// endsWithStreamChecksum reports whether the data between dataStart and
+// dataEnd in input ends with a StreamChecksum frame
+func endsWithStreamChecksum(input gzstd.Seekable, dataStart, dataEnd int64) (bool, error) {
+	if dataEnd-dataStart < streamChecksumFrameSize {
+		return false, nil
+	}
+	if _, err := input.Seek(dataEnd-streamChecksumFrameSize, io.SeekStart); err != nil {
+		return false, err
+	}
+	header := make([]byte, gzstd.SKIPPABLE_HEADER_SIZE)
+	if _, err := io.ReadFull(input, header); err != nil {
+		return false, err
+	}
+	if _, err := input.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+	return binary.LittleEndian.Uint32(header[0:4]) == gzstd.StreamChecksumMagic &&
+		binary.LittleEndian.Uint32(header[4:8]) == 8, nil
+}
+
 // Helper functions
 
+// progressUpdate is a single machine-readable progress line
+type progressUpdate struct {
+	Bytes  uint64 `json:"bytes"`
+	Total  uint64 `json:"total"`
+	Frames uint32 `json:"frames"`
+}
+
+// setupProgress opens the progress file descriptor if one was requested
+func setupProgress(opts *Options) error {
+	if opts.ProgressFD < 0 {
+		return nil
+	}
+
+	f := os.NewFile(uintptr(opts.ProgressFD), "progress-fd")
+	if f == nil {
+		return fmt.Errorf("invalid progress fd %d", opts.ProgressFD)
+	}
+	if _, err := f.Stat(); err != nil {
+		return fmt.Errorf("invalid progress fd %d: %v", opts.ProgressFD, err)
+	}
+
+	opts.progress = f
+	return nil
+}
+
+// reportProgress writes a JSON progress line if progress output is enabled
+func reportProgress(opts *Options, bytes, total uint64, frames uint32) {
+	if opts.progress == nil {
+		return
+	}
+
+	line, err := json.Marshal(progressUpdate{Bytes: bytes, Total: total, Frames: frames})
+	if err != nil {
+		return
+	}
+	opts.mu.Lock()
+	defer opts.mu.Unlock()
+	opts.progress.Write(append(line, '\n'))
+}
+
 func openInput(filename string) (io.ReadCloser, os.FileInfo, error) {
 	if filename == "-" {
 		return os.Stdin, nil, nil
@@ -634,7 +1269,8 @@ func openInput(filename string) (io.ReadCloser, os.FileInfo, error) {
 
 func openOutput(filename string, force bool) (io.WriteCloser, error) {
 	if filename == "-" {
-		return os.Stdout, nil
+		// Left open for the files after this one
+		return stdoutWriter{os.Stdout}, nil
 	}
 
 	// Check if file exists
@@ -647,6 +1283,13 @@ func openOutput(filename string, force bool) (io.WriteCloser, error) {
 	return os.Create(filename)
 }
 
+// stdoutWriter is stdout as an output that closing does not close
+type stdoutWriter struct {
+	io.Writer
+}
+
+func (stdoutWriter) Close() error { return nil }
+
 func getOutputFileName(inputFile, extension string, toStdout bool) string {
 	if toStdout || inputFile == "-" {
 		return "-"
@@ -667,6 +1310,137 @@ func getOutputFileName(inputFile, extension string, toStdout bool) string {
 	return inputFile + ".out"
 }
 
+// expandNameTemplate substitutes the {dir}, {base}, {n} and {suffix}
+// placeholders of template for the given input file, the n-th one named in
+// this run. The cleaned path must stay under the template's output root:
+// the directory of its text before the first placeholder, or the input's
+// directory for a template starting with {dir}.
+func expandNameTemplate(template, inputFile, suffix string, n int) (string, error) {
+	replacer := strings.NewReplacer(
+		"{dir}", filepath.Dir(inputFile),
+		"{base}", filepath.Base(inputFile),
+		"{n}", strconv.Itoa(n),
+		"{suffix}", suffix,
+	)
+	outputFile := filepath.Clean(replacer.Replace(template))
+
+	root := filepath.Dir(inputFile)
+	if !strings.HasPrefix(template, "{dir}") {
+		prefix, _, _ := strings.Cut(template, "{")
+		root = filepath.Dir(prefix)
+	}
+	rel, err := filepath.Rel(root, outputFile)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("name template maps %s to %s, outside %s", inputFile, outputFile, root)
+	}
+	return outputFile, nil
+}
+
+// validateNameTemplate checks that a name template can produce distinct
+// output names for distinct input files
+func validateNameTemplate(template string) error {
+	if template != "" && !strings.Contains(template, "{base}") && !strings.Contains(template, "{n}") {
+		return fmt.Errorf("name template %q must contain {base} or {n}", template)
+	}
+	return nil
+}
+
+// inputNumber returns the 1-based number of inputFile among the inputs
+// named in this run, assigning the next one on first use
+func inputNumber(opts *Options, inputFile string) int {
+	opts.mu.Lock()
+	defer opts.mu.Unlock()
+	if opts.inputNumbers == nil {
+		opts.inputNumbers = make(map[string]int)
+	}
+	n, ok := opts.inputNumbers[inputFile]
+	if !ok {
+		n = len(opts.inputNumbers) + 1
+		opts.inputNumbers[inputFile] = n
+	}
+	return n
+}
+
+// claimOutputName records that outputFile is produced from inputFile, failing
+// if an earlier input in this run was already mapped to the same path
+func claimOutputName(opts *Options, inputFile, outputFile string) error {
+	opts.mu.Lock()
+	defer opts.mu.Unlock()
+	if opts.outputNames == nil {
+		opts.outputNames = make(map[string]string)
+	}
+	if previous, ok := opts.outputNames[outputFile]; ok && previous != inputFile {
+		return fmt.Errorf("name template maps both %s and %s to %s", previous, inputFile, outputFile)
+	}
+	opts.outputNames[outputFile] = inputFile
+	return nil
+}
+
+// spoolInput copies a non-seekable input such as stdin to a temporary file in
+// opts.TempDir so it can be read with random access. The returned cleanup
+// function closes and removes the temporary file.
+func spoolInput(input io.Reader, opts *Options) (*os.File, func(), error) {
+	f, err := os.CreateTemp(opts.TempDir, programName+"-spool-*")
+	if err != nil {
+		return nil, nil, err
+	}
+	cleanup := func() {
+		f.Close()
+		os.Remove(f.Name())
+	}
+
+	if _, err := io.Copy(f, input); err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+
+	return f, cleanup, nil
+}
+
+// validateTempDir checks that temporary files can be created in dir, so a
+// bad --temp-dir fails up front rather than after reading stdin
+func validateTempDir(dir string) error {
+	if dir == "" {
+		return nil
+	}
+
+	f, err := os.CreateTemp(dir, programName+"-check-*")
+	if err != nil {
+		return fmt.Errorf("temp dir %s is not writable: %v", dir, err)
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// encoderLevel returns the encoder level selected by --fast, else by
+// --zstd-level, or else by the gzip-style level
+func encoderLevel(opts *Options) zstd.EncoderLevel {
+	if opts.Fast > 0 {
+		return gzstd.FastLevel(opts.Fast)
+	}
+	if opts.ZstdLevel > 0 {
+		return zstd.EncoderLevelFromZstd(opts.ZstdLevel)
+	}
+	return getZstdLevel(opts.Level)
+}
+
+// sameZstdLevel returns the lowest numeric zstd level that selects the same
+// encoder as level. --zstd-level maps the 22 levels onto four encoders, so
+// levels other than 1, 3, 6 and 10 compress the same as one below them.
+func sameZstdLevel(level int) int {
+	for level > 1 && zstd.EncoderLevelFromZstd(level-1) == zstd.EncoderLevelFromZstd(level) {
+		level--
+	}
+	return level
+}
+
+// getZstdLevel maps the gzip-style levels 1-9 onto the four zstd encoder
+// levels: 1 is the fastest, 2-3 the default, 4-6 better compression and 7-9
+// the best. --zstd-level maps numeric zstd levels onto the same four.
 func getZstdLevel(level int) zstd.EncoderLevel {
 	// Map 1-9 to zstd levels
 	switch level {
@@ -693,27 +1467,19 @@ func getZstdLevel(level int) zstd.EncoderLevel {
 	}
 }
 
-func readSeekTable(f *os.File) (*gzstd.SeekTable, error) {
-	footer, err := gzstd.ReadSeekTableFooter(f)
-	if err != nil {
-		return nil, err
+// frameSizeFor parses a --frame-size value for an input with the given
+// info. "auto" divides the uncompressed input into about autoFrameCount
+// frames, within minAutoFrameSize and maxAutoFrameSize, or uses the
+// default frame size when the size is unknown, as for stdin.
+func frameSizeFor(value string, inputInfo os.FileInfo) (int64, error) {
+	if value != "auto" {
+		return parseByteSize(value)
 	}
-
-	seekTableSize, err := gzstd.ParseSeekTableSize(footer)
-	if err != nil {
-		return nil, err
-	}
-
-	if _, err := f.Seek(-int64(seekTableSize), io.SeekEnd); err != nil {
-		return nil, err
+	if inputInfo == nil || !inputInfo.Mode().IsRegular() {
+		return parseByteSize(defaultFrameSize)
 	}
-
-	seekTableData := make([]byte, seekTableSize)
-	if _, err := io.ReadFull(f, seekTableData); err != nil {
-		return nil, err
-	}
-
-	return gzstd.ParseSeekTable(seekTableData)
+	size := inputInfo.Size() / autoFrameCount
+	return min(max(size, minAutoFrameSize), maxAutoFrameSize), nil
 }
 
 func parseByteSize(s string) (int64, error) {
@@ -0,0 +1,933 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/epsniff/gozeekstd/src/gzstd"
+	"github.com/klauspost/compress/zstd"
+)
+
+// testOptions returns the options parseOptions produces with no flags set
+func testOptions() *Options {
+	return &Options{
+		Suffix:     fileExtension,
+		Level:      defaultCompressionLevel,
+		FrameSize:  defaultFrameSize,
+		Keep:       true,
+		Name:       true,
+		ProgressFD: -1,
+	}
+}
+
+func writeTestFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readArchive(t *testing.T, path string) []byte {
+	t.Helper()
+	decoder, closer, err := gzstd.OpenArchive(path)
+	if err != nil {
+		t.Fatalf("OpenArchive(%s) failed: %v", path, err)
+	}
+	defer closer()
+
+	data, err := io.ReadAll(decoder)
+	if err != nil {
+		t.Fatalf("reading %s failed: %v", path, err)
+	}
+	return data
+}
+
+// captureStdout runs fn with os.Stdout redirected and returns what it wrote
+func captureStdout(t *testing.T, fn func()) []byte {
+	t.Helper()
+	f, err := os.CreateTemp(t.TempDir(), "stdout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	stdout := os.Stdout
+	os.Stdout = f
+	defer func() { os.Stdout = stdout }()
+	fn()
+
+	out, err := os.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestNameTemplate_Recursive(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	files := map[string][]byte{
+		filepath.Join("data", "a.txt"):        []byte("first file"),
+		filepath.Join("data", "sub", "b.txt"): []byte("second file"),
+	}
+	for path, data := range files {
+		writeTestFile(t, path, data)
+	}
+
+	opts := testOptions()
+	opts.Recursive = true
+	opts.NameTemplate = "compressed/{dir}/{base}{suffix}"
+
+	if err := processFile("data", opts); err != nil {
+		t.Fatalf("processFile failed: %v", err)
+	}
+
+	for path, data := range files {
+		output := filepath.Join("compressed", path+fileExtension)
+		if got := readArchive(t, output); !bytes.Equal(got, data) {
+			t.Errorf("%s: expected %q, got %q", output, data, got)
+		}
+		if _, err := os.Stat(path + fileExtension); err == nil {
+			t.Errorf("Unexpected output next to input: %s", path+fileExtension)
+		}
+	}
+}
+
+func TestNameTemplate_Validation(t *testing.T) {
+	if err := validateNameTemplate("out/{dir}/{base}{suffix}"); err != nil {
+		t.Errorf("Expected valid template, got %v", err)
+	}
+	if err := validateNameTemplate("out/archive{suffix}"); err == nil {
+		t.Error("Expected error for template without {base}")
+	}
+
+	// Two inputs with the same base name collide when {dir} is omitted
+	t.Chdir(t.TempDir())
+	writeTestFile(t, filepath.Join("data", "one", "same.txt"), []byte("one"))
+	writeTestFile(t, filepath.Join("data", "two", "same.txt"), []byte("two"))
+
+	opts := testOptions()
+	opts.Recursive = true
+	opts.NameTemplate = "flat/{base}{suffix}"
+	if err := processFile("data", opts); err == nil {
+		t.Error("Expected error for duplicate templated output paths")
+	}
+
+	// {n} tells them apart, numbering inputs in walk order
+	opts = testOptions()
+	opts.Recursive = true
+	opts.NameTemplate = "numbered/{base}.{n}{suffix}"
+	if err := validateNameTemplate(opts.NameTemplate); err != nil {
+		t.Errorf("Expected valid template, got %v", err)
+	}
+	if err := processFile("data", opts); err != nil {
+		t.Fatalf("processFile failed: %v", err)
+	}
+	for n, data := range []string{"one", "two"} {
+		output := filepath.Join("numbered", fmt.Sprintf("same.txt.%d%s", n+1, fileExtension))
+		if got := readArchive(t, output); string(got) != data {
+			t.Errorf("%s: expected %q, got %q", output, data, got)
+		}
+	}
+
+	// Outputs may not escape the template's root
+	for _, tt := range []struct{ template, input string }{
+		{"out/{dir}/{base}{suffix}", filepath.Join("..", "a.txt")},
+		{"out/{base}/../../{base}{suffix}", "a.txt"},
+		{"{dir}/../{base}{suffix}", filepath.Join("data", "a.txt")},
+	} {
+		if got, err := expandNameTemplate(tt.template, tt.input, fileExtension, 1); err == nil {
+			t.Errorf("%s for %s: expected error, got %s", tt.template, tt.input, got)
+		}
+	}
+	got, err := expandNameTemplate("out/{dir}/{base}{suffix}", filepath.Join("data", "..", "a.txt"), fileExtension, 1)
+	if want := filepath.Join("out", "a.txt"+fileExtension); err != nil || got != want {
+		t.Errorf("Expected %s, got %s (%v)", want, got, err)
+	}
+}
+
+func TestSpoolInput_TempDir(t *testing.T) {
+	dir := t.TempDir()
+	opts := testOptions()
+	opts.TempDir = dir
+
+	data := []byte("spooled from stdin")
+	f, cleanup, err := spoolInput(bytes.NewReader(data), opts)
+	if err != nil {
+		t.Fatalf("spoolInput failed: %v", err)
+	}
+
+	if filepath.Dir(f.Name()) != dir {
+		t.Errorf("Expected temp file in %s, got %s", dir, f.Name())
+	}
+	got, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatalf("reading spool failed: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("Expected %q, got %q", data, got)
+	}
+
+	cleanup()
+	if _, err := os.Stat(f.Name()); !os.IsNotExist(err) {
+		t.Errorf("Expected temp file to be removed, got %v", err)
+	}
+
+	if err := validateTempDir(dir); err != nil {
+		t.Errorf("Expected %s to be a valid temp dir, got %v", dir, err)
+	}
+	if err := validateTempDir(filepath.Join(dir, "missing")); err == nil {
+		t.Error("Expected error for missing temp dir")
+	}
+}
+
+func TestListFile_JSON(t *testing.T) {
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "data.zst")
+	data := bytes.Repeat([]byte("0123456789"), 250)
+
+	var buf bytes.Buffer
+	if _, err := gzstd.CompressSeekable(&buf, data, &gzstd.EncoderOptions{
+		Level:       zstd.SpeedDefault,
+		FramePolicy: gzstd.UncompressedFrameSize{Size: 1000},
+	}); err != nil {
+		t.Fatalf("CompressSeekable failed: %v", err)
+	}
+	writeTestFile(t, archive, buf.Bytes())
+
+	opts := testOptions()
+	opts.JSON = true
+	var listErr error
+	out := captureStdout(t, func() { listErr = listFile(archive, opts) })
+	if listErr != nil {
+		t.Fatalf("listFile failed: %v", listErr)
+	}
+
+	var list listJSON
+	if err := json.Unmarshal(out, &list); err != nil {
+		t.Fatalf("invalid JSON %q: %v", out, err)
+	}
+	if list.Compressed != uint64(buf.Len()) || list.Decompressed != uint64(len(data)) || list.NumFrames != 3 {
+		t.Errorf("Unexpected totals: %+v", list)
+	}
+	want := []listFrame{
+		{Index: 0, Decompressed: 1000, StartDecomp: 0, EndDecomp: 1000},
+		{Index: 1, Decompressed: 1000, StartDecomp: 1000, EndDecomp: 2000},
+		{Index: 2, Decompressed: 500, StartDecomp: 2000, EndDecomp: 2500},
+	}
+	if len(list.Frames) != len(want) {
+		t.Fatalf("Expected %d frames, got %d", len(want), len(list.Frames))
+	}
+	for i, frame := range list.Frames {
+		if frame.Compressed == 0 {
+			t.Errorf("Frame %d: expected a compressed size", i)
+		}
+		frame.Compressed = 0
+		if frame != want[i] {
+			t.Errorf("Frame %d: expected %+v, got %+v", i, want[i], frame)
+		}
+	}
+}
+
+func TestListAndTest_HeadFormat(t *testing.T) {
+	dir := t.TempDir()
+	data := bytes.Repeat([]byte("0123456789"), 250)
+
+	for _, format := range []gzstd.Format{gzstd.FormatFoot, gzstd.FormatHead} {
+		var buf bytes.Buffer
+		encoder, err := gzstd.NewEncoder(&buf, &gzstd.EncoderOptions{
+			Level:         zstd.SpeedDefault,
+			FramePolicy:   gzstd.UncompressedFrameSize{Size: 1000},
+			ChecksumFlag:  true,
+			HeadSeekTable: format == gzstd.FormatHead,
+		})
+		if err != nil {
+			t.Fatalf("NewEncoder failed: %v", err)
+		}
+		encoder.Write(data)
+		if err := encoder.FinishWithFormat(format); err != nil {
+			t.Fatalf("FinishWithFormat failed: %v", err)
+		}
+		archive := buf.Bytes()
+		path := filepath.Join(dir, fmt.Sprintf("data-%d.zst", format))
+		writeTestFile(t, path, archive)
+
+		opts := testOptions()
+		opts.JSON = true
+		var listErr error
+		out := captureStdout(t, func() { listErr = listFile(path, opts) })
+		if listErr != nil {
+			t.Fatalf("format %d: listFile failed: %v", format, listErr)
+		}
+		var list listJSON
+		if err := json.Unmarshal(out, &list); err != nil {
+			t.Fatalf("invalid JSON %q: %v", out, err)
+		}
+		if list.Decompressed != uint64(len(data)) || list.NumFrames != 3 {
+			t.Errorf("format %d: unexpected listing %+v", format, list)
+		}
+
+		if err := testFile(path, testOptions()); err != nil {
+			t.Errorf("format %d: testFile failed: %v", format, err)
+		}
+	}
+}
+
+func TestListFile_Debug(t *testing.T) {
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "data.zst")
+	data := bytes.Repeat([]byte("0123456789"), 250)
+
+	var buf bytes.Buffer
+	st, err := gzstd.CompressSeekable(&buf, data, &gzstd.EncoderOptions{
+		Level:       zstd.SpeedDefault,
+		FramePolicy: gzstd.UncompressedFrameSize{Size: 1000},
+	})
+	if err != nil {
+		t.Fatalf("CompressSeekable failed: %v", err)
+	}
+	writeTestFile(t, archive, buf.Bytes())
+
+	opts := testOptions()
+	opts.Verbose = true
+	opts.Debug = true
+	var listErr error
+	out := captureStdout(t, func() { listErr = listFile(archive, opts) })
+	if listErr != nil {
+		t.Fatalf("listFile failed: %v", listErr)
+	}
+
+	var dump bytes.Buffer
+	gzstd.DumpSeekTable(&dump, st)
+	if !bytes.Contains(out, []byte("Seek table: "+st.String()+"\n")) || !bytes.HasSuffix(out, dump.Bytes()) {
+		t.Errorf("Expected the seek table summary and dump, got:\n%s", out)
+	}
+}
+
+func TestListFile_NoFrames(t *testing.T) {
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "empty.zst")
+	table := gzstd.NewSeekTable().Bytes(gzstd.FormatFoot)
+	writeTestFile(t, archive, table)
+
+	var listErr error
+	out := captureStdout(t, func() { listErr = listFile(archive, testOptions()) })
+	if listErr != nil {
+		t.Fatalf("listFile failed: %v", listErr)
+	}
+	want := fmt.Sprintf("%12d %12d %5.1f%% ", len(table), 0, 0.0)
+	if !bytes.HasPrefix(out, []byte(want)) {
+		t.Errorf("Expected %q, got %q", want, out)
+	}
+}
+
+func TestEmptyFile_RoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "empty.txt")
+	writeTestFile(t, input, nil)
+
+	opts := testOptions()
+	if err := compressFile(input, opts); err != nil {
+		t.Fatalf("compressFile failed: %v", err)
+	}
+	archive := input + fileExtension
+
+	var listErr error
+	out := captureStdout(t, func() { listErr = listFile(archive, opts) })
+	if listErr != nil {
+		t.Fatalf("listFile failed: %v", listErr)
+	}
+	if fields := strings.Fields(string(out)); len(fields) < 2 || fields[1] != "0" {
+		t.Errorf("Expected an empty uncompressed size, got %q", out)
+	}
+	if err := testFile(archive, opts); err != nil {
+		t.Errorf("testFile failed: %v", err)
+	}
+
+	output := filepath.Join(dir, "out.txt")
+	opts = testOptions()
+	opts.DecompressTo = output
+	if err := decompressFile(archive, opts); err != nil {
+		t.Fatalf("decompressFile failed: %v", err)
+	}
+	if got, err := os.ReadFile(output); err != nil || len(got) != 0 {
+		t.Errorf("Expected an empty file, got %d bytes, %v", len(got), err)
+	}
+}
+
+func TestCompressFile_VerboseEmpty(t *testing.T) {
+	input := filepath.Join(t.TempDir(), "empty.txt")
+	writeTestFile(t, input, nil)
+
+	opts := testOptions()
+	opts.Verbose = true
+	var compressErr error
+	out := captureStdout(t, func() { compressErr = compressFile(input, opts) })
+	if compressErr != nil {
+		t.Fatalf("compressFile failed: %v", compressErr)
+	}
+	if !strings.Contains(string(out), "\t0.0% -- ") {
+		t.Errorf("Expected a 0.0%% ratio for empty input, got %q", out)
+	}
+}
+
+func TestDecompressFile_ByteRange(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "data.txt")
+	var data []byte
+	for i := 0; len(data) < 50000; i++ {
+		data = append(data, fmt.Sprintf("line %d\n", i)...)
+	}
+	writeTestFile(t, input, data)
+
+	opts := testOptions()
+	opts.FrameSize = "4K"
+	if err := compressFile(input, opts); err != nil {
+		t.Fatalf("compressFile failed: %v", err)
+	}
+
+	for _, tt := range []struct {
+		name       string
+		start, end uint64
+		want       []byte
+	}{
+		{"middle", 12345, 23456, data[12345:23456]},
+		{"end past EOF", 40000, 1 << 40, data[40000:]},
+		{"start past EOF", 1 << 40, 1 << 41, nil},
+	} {
+		output := filepath.Join(dir, "range.txt")
+		opts := testOptions()
+		opts.Force = true
+		opts.DecompressTo = output
+		opts.StartByte = tt.start
+		opts.EndByte = tt.end
+		opts.EndByteSet = true
+		if err := decompressFile(input+fileExtension, opts); err != nil {
+			t.Fatalf("%s: decompressFile failed: %v", tt.name, err)
+		}
+
+		got, err := os.ReadFile(output)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, tt.want) {
+			t.Errorf("%s: expected %d bytes, got %d", tt.name, len(tt.want), len(got))
+		}
+	}
+}
+
+func TestProcessFiles_Jobs(t *testing.T) {
+	dir := t.TempDir()
+	want := make(map[string][]byte)
+	for i := 0; i < 20; i++ {
+		path := filepath.Join(dir, fmt.Sprintf("sub%d", i%3), fmt.Sprintf("file%d.txt", i))
+		data := bytes.Repeat([]byte(fmt.Sprintf("file %d\n", i)), 1000+i)
+		writeTestFile(t, path, data)
+		want[path] = data
+	}
+
+	opts := testOptions()
+	opts.Recursive = true
+	opts.Jobs = 4
+	if code := processFiles([]string{dir}, opts); code != 0 {
+		t.Fatalf("Expected exit code 0, got %d", code)
+	}
+	for path, data := range want {
+		if got := readArchive(t, path+fileExtension); !bytes.Equal(got, data) {
+			t.Errorf("%s: decoded content differs", path)
+		}
+	}
+
+	// A failing file sets the exit code without stopping the others
+	opts = testOptions()
+	opts.Quiet = true
+	opts.Jobs = 4
+	opts.Decompress = true
+	opts.Force = true
+	if code := processFiles([]string{filepath.Join(dir, "missing.zst"), filepath.Join(dir, "sub0", "file0.txt.zst")}, opts); code != 1 {
+		t.Errorf("Expected exit code 1, got %d", code)
+	}
+	if got, err := os.ReadFile(filepath.Join(dir, "sub0", "file0.txt")); err != nil || !bytes.Equal(got, want[filepath.Join(dir, "sub0", "file0.txt")]) {
+		t.Errorf("Expected file0.txt to be decompressed, got %v", err)
+	}
+
+	// Output to stdout is written one file at a time, in order
+	var archives []string
+	var concatenated []byte
+	for i := 1; i < 20; i++ {
+		path := filepath.Join(dir, fmt.Sprintf("sub%d", i%3), fmt.Sprintf("file%d.txt", i))
+		archives = append(archives, path+fileExtension)
+		concatenated = append(concatenated, want[path]...)
+	}
+	opts = testOptions()
+	opts.Jobs = 4
+	opts.Decompress = true
+	opts.Stdout = true
+	var code int
+	out := captureStdout(t, func() { code = processFiles(archives, opts) })
+	if code != 0 || !bytes.Equal(out, concatenated) {
+		t.Errorf("Expected the files decompressed in order to stdout, got exit code %d and %d bytes", code, len(out))
+	}
+
+	// Parallel list reports keep one whole line per file
+	opts = testOptions()
+	opts.Jobs = 4
+	opts.List = true
+	out = captureStdout(t, func() { code = processFiles(archives, opts) })
+	lines := strings.Split(strings.TrimSuffix(string(out), "\n"), "\n")
+	if code != 0 || len(lines) != len(archives) {
+		t.Fatalf("Expected %d report lines, got exit code %d and:\n%s", len(archives), code, out)
+	}
+	for _, line := range lines {
+		if fields := strings.Fields(line); len(fields) != 4 || !strings.HasSuffix(fields[3], ".txt") {
+			t.Errorf("Malformed list line %q", line)
+		}
+	}
+}
+
+func TestTrainDictionary_CLI(t *testing.T) {
+	dir := t.TempDir()
+	var samples []string
+	for i := 0; i < 200; i++ {
+		path := filepath.Join(dir, fmt.Sprintf("sample%d.json", i))
+		writeTestFile(t, path, []byte(fmt.Sprintf(`{"level":"info","service":"api","request_id":%d,"status":%d}`+"\n", i*31, 200+i%3)))
+		samples = append(samples, path)
+	}
+
+	output := filepath.Join(dir, "out.dict")
+	if err := trainDictionary(output, samples, testOptions()); err != nil {
+		t.Fatalf("trainDictionary failed: %v", err)
+	}
+	dict, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The dictionary round-trips through the library options
+	data := []byte(`{"level":"info","service":"api","request_id":12345,"status":200}` + "\n")
+	encoderOpts := gzstd.DefaultEncoderOptions()
+	encoderOpts.CompressionDict = dict
+	var buf bytes.Buffer
+	if _, err := gzstd.CompressSeekable(&buf, data, encoderOpts); err != nil {
+		t.Fatalf("CompressSeekable with dictionary failed: %v", err)
+	}
+	decoderOpts := gzstd.DefaultDecoderOptions()
+	decoderOpts.Dict = dict
+	decoder, err := gzstd.NewDecoderBytes(buf.Bytes(), decoderOpts)
+	if err != nil {
+		t.Fatalf("NewDecoderBytes failed: %v", err)
+	}
+	if got, err := io.ReadAll(decoder); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("Round trip with trained dictionary failed: %v", err)
+	}
+
+	if err := trainDictionary(output, nil, testOptions()); err == nil {
+		t.Error("Expected error without sample files")
+	}
+}
+
+func TestTestFile_FramePastEnd(t *testing.T) {
+	dir := t.TempDir()
+	data := bytes.Repeat([]byte("0123456789"), 250)
+
+	// archive compresses data and rewrites its seek table so the last frame
+	// claims extra more bytes than the file holds
+	archive := func(format gzstd.Format, streamChecksum bool, extra uint64) string {
+		t.Helper()
+		var buf bytes.Buffer
+		seekTable, err := gzstd.CompressSeekable(&buf, data, &gzstd.EncoderOptions{
+			Level:          zstd.SpeedDefault,
+			FramePolicy:    gzstd.UncompressedFrameSize{Size: 1000},
+			StreamChecksum: streamChecksum,
+			HeadSeekTable:  format == gzstd.FormatHead,
+		})
+		if err != nil {
+			t.Fatalf("CompressSeekable failed: %v", err)
+		}
+		corrupt := gzstd.NewSeekTable()
+		last := seekTable.NumFrames() - 1
+		for i := uint32(0); i <= last; i++ {
+			comp, _ := seekTable.FrameSizeComp(i)
+			decomp, _ := seekTable.FrameSizeDecomp(i)
+			if i == last {
+				comp += extra
+			}
+			corrupt.LogFrame(comp, decomp)
+		}
+		table := corrupt.Bytes(format)
+		frames := buf.Bytes()[:buf.Len()-len(table)]
+		if format == gzstd.FormatHead {
+			frames = buf.Bytes()[len(table):]
+		}
+		path := filepath.Join(dir, fmt.Sprintf("data-%d-%v-%d.zst", format, streamChecksum, extra))
+		if format == gzstd.FormatHead {
+			writeTestFile(t, path, append(table, frames...))
+		} else {
+			writeTestFile(t, path, append(append([]byte(nil), frames...), table...))
+		}
+		return path
+	}
+
+	for _, tt := range []struct {
+		name           string
+		format         gzstd.Format
+		streamChecksum bool
+		extra          uint64
+	}{
+		{"foot", gzstd.FormatFoot, false, 100},
+		{"head", gzstd.FormatHead, false, 100},
+		{"foot, overshoot within the stream checksum", gzstd.FormatFoot, true, 10},
+		{"head, overshoot within the stream checksum", gzstd.FormatHead, true, 10},
+	} {
+		path := archive(tt.format, tt.streamChecksum, tt.extra)
+		err := testFile(path, testOptions())
+		if err == nil || !strings.Contains(err.Error(), "extends past end of file") {
+			t.Errorf("%s: expected a frame past the end, got %v", tt.name, err)
+		}
+
+		// The same archive without the overshoot passes
+		if err := testFile(archive(tt.format, tt.streamChecksum, 0), testOptions()); err != nil {
+			t.Errorf("%s: intact archive failed: %v", tt.name, err)
+		}
+	}
+
+	// A seek table larger than the file is reported rather than wrapping
+	// around the frame data size
+	path := archive(gzstd.FormatFoot, false, 0)
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	huge := gzstd.NewSeekTable()
+	for i := 0; i < 1000; i++ {
+		huge.LogFrame(10, 10)
+	}
+	err = checkFrameExtents(f, huge)
+	if err == nil || !strings.Contains(err.Error(), "larger than the") {
+		t.Errorf("Expected a seek table larger than the file, got %v", err)
+	}
+}
+
+func TestTestFile_StreamChecksum(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "data.txt")
+	data := bytes.Repeat([]byte("whole stream checksum\n"), 5000)
+	writeTestFile(t, input, data)
+
+	opts := testOptions()
+	if err := compressFile(input, opts); err != nil {
+		t.Fatalf("compressFile failed: %v", err)
+	}
+	archive := input + fileExtension
+	if err := testFile(archive, opts); err != nil {
+		t.Fatalf("testFile failed: %v", err)
+	}
+
+	compressed, err := os.ReadFile(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoder, err := gzstd.NewDecoderBytes(compressed, &gzstd.DecoderOptions{ComputeChecksum: true})
+	if err != nil {
+		t.Fatalf("NewDecoderBytes failed: %v", err)
+	}
+	if _, err := io.Copy(io.Discard, decoder); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if stored, ok, err := decoder.StreamChecksum(); err != nil || !ok || stored != decoder.Checksum() {
+		t.Fatalf("Expected stored checksum %x, got %x, %v, %v", decoder.Checksum(), stored, ok, err)
+	}
+
+	// Flip a bit of the stored checksum, right after the last frame
+	st := decoder.SeekTable()
+	framesEnd, _ := st.FrameEndComp(st.NumFrames() - 1)
+	compressed[framesEnd+8] ^= 1
+	writeTestFile(t, archive, compressed)
+	if err := testFile(archive, opts); err == nil || !strings.Contains(err.Error(), gzstd.ErrStreamChecksum) {
+		t.Errorf("Expected %s, got %v", gzstd.ErrStreamChecksum, err)
+	}
+}
+
+func TestCompressFile_ZstdLevel(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "data.txt")
+	var data []byte
+	for i := 0; len(data) < 200000; i++ {
+		data = append(data, fmt.Sprintf("%d,%d,%x\n", i, i*i%977, i*31)...)
+	}
+	writeTestFile(t, input, data)
+
+	sizes := make(map[int64]int)
+	for _, level := range []int{1, 3, 7, 19} {
+		opts := testOptions()
+		opts.Force = true
+		opts.ZstdLevel = level
+		if err := compressFile(input, opts); err != nil {
+			t.Fatalf("level %d: compressFile failed: %v", level, err)
+		}
+		info, err := os.Stat(input + fileExtension)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if other, ok := sizes[info.Size()]; ok {
+			t.Errorf("levels %d and %d produced the same size %d", other, level, info.Size())
+		}
+		sizes[info.Size()] = level
+
+		if got := readArchive(t, input+fileExtension); !bytes.Equal(got, data) {
+			t.Errorf("level %d: round trip failed", level)
+		}
+	}
+}
+
+func TestSameZstdLevel(t *testing.T) {
+	for level, want := range map[int]int{1: 1, 2: 1, 3: 3, 5: 3, 6: 6, 9: 6, 10: 10, 19: 10, 22: 10} {
+		if got := sameZstdLevel(level); got != want {
+			t.Errorf("level %d: expected %d, got %d", level, want, got)
+		}
+	}
+
+	// Neighbouring levels that are not reported the same compress differently
+	dir := t.TempDir()
+	input := filepath.Join(dir, "data.txt")
+	var data []byte
+	for i := 0; len(data) < 200000; i++ {
+		data = append(data, fmt.Sprintf("%d,%d,%x\n", i, i*i%977, i*31)...)
+	}
+	writeTestFile(t, input, data)
+	compressedSize := func(level int) int64 {
+		t.Helper()
+		opts := testOptions()
+		opts.Force = true
+		opts.ZstdLevel = level
+		if err := compressFile(input, opts); err != nil {
+			t.Fatalf("level %d: compressFile failed: %v", level, err)
+		}
+		info, err := os.Stat(input + fileExtension)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info.Size()
+	}
+	for level := 2; level <= maxZstdLevel; level++ {
+		if sameZstdLevel(level) != level {
+			continue
+		}
+		if below, at := compressedSize(level-1), compressedSize(level); below == at {
+			t.Errorf("levels %d and %d produced the same size %d", level-1, level, at)
+		}
+	}
+}
+
+func TestCompressFile_Fast(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "data.txt")
+	var data []byte
+	for i := 0; len(data) < 200000; i++ {
+		data = append(data, fmt.Sprintf("GET /items/%d status=%d from host-%d\n", i%1000, 200+i%3*100, i%7)...)
+	}
+	writeTestFile(t, input, data)
+
+	sizes := make([]int64, 2)
+	for i, fast := range []int{0, 1} {
+		opts := testOptions()
+		opts.Force = true
+		opts.Level = 1
+		opts.Fast = fast
+		if err := compressFile(input, opts); err != nil {
+			t.Fatalf("fast %d: compressFile failed: %v", fast, err)
+		}
+		info, err := os.Stat(input + fileExtension)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes[i] = info.Size()
+		if got := readArchive(t, input+fileExtension); !bytes.Equal(got, data) {
+			t.Errorf("fast %d: round trip failed", fast)
+		}
+	}
+	if sizes[1] <= sizes[0] {
+		t.Errorf("--fast=1 archive %d bytes, want larger than level 1's %d", sizes[1], sizes[0])
+	}
+}
+
+func TestDecompressFile_OtherFormats(t *testing.T) {
+	dir := t.TempDir()
+	data := bytes.Repeat([]byte("not a seekable archive\n"), 1000)
+
+	// Two concatenated gzip members decode as one stream
+	var gz bytes.Buffer
+	for _, part := range [][]byte{data[:5000], data[5000:]} {
+		w := gzip.NewWriter(&gz)
+		w.Write(part)
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	plain, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+
+	for _, tt := range []struct {
+		name    string
+		archive []byte
+	}{
+		{"data.txt.gz", gz.Bytes()},
+		{"data.txt.zst", plain.EncodeAll(data, nil)},
+	} {
+		input := filepath.Join(dir, tt.name)
+		writeTestFile(t, input, tt.archive)
+
+		opts := testOptions()
+		opts.Decompress = true
+		opts.Force = true
+		if err := decompressFile(input, opts); err != nil {
+			t.Fatalf("%s: decompressFile failed: %v", tt.name, err)
+		}
+		got, err := os.ReadFile(filepath.Join(dir, "data.txt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("%s: decompressed %d bytes, expected %d", tt.name, len(got), len(data))
+		}
+	}
+}
+
+func TestCompressFile_RestoresName(t *testing.T) {
+	dir := t.TempDir()
+	name := "odd name -- [1] ü.tar"
+	data := bytes.Repeat([]byte("restored by name\n"), 1000)
+	input := filepath.Join(dir, name)
+	writeTestFile(t, input, data)
+	mtime := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	if err := os.Chtimes(input, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := testOptions()
+	if err := compressFile(input, opts); err != nil {
+		t.Fatalf("compressFile failed: %v", err)
+	}
+
+	// Decompress a renamed copy of the archive
+	archive := filepath.Join(dir, "renamed.zst")
+	if err := os.Rename(input+fileExtension, archive); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(input); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without -N the output is named after the archive and has its mtime
+	archiveTime := time.Date(2010, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(archive, archiveTime, archiveTime); err != nil {
+		t.Fatal(err)
+	}
+	opts.Decompress = true
+	if err := decompressFile(archive, opts); err != nil {
+		t.Fatalf("decompressFile failed: %v", err)
+	}
+	renamed := filepath.Join(dir, "renamed")
+	if got, err := os.ReadFile(renamed); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("expected output named from the archive without -N: %v", err)
+	}
+	if info, err := os.Stat(renamed); err != nil || !info.ModTime().Equal(archiveTime) {
+		t.Errorf("expected the archive's mtime without -N (%v)", err)
+	}
+	if _, err := os.Stat(input); !os.IsNotExist(err) {
+		t.Errorf("expected no output under the saved name without -N: %v", err)
+	}
+	os.Remove(renamed)
+
+	opts.NameSet = true
+	if err := decompressFile(archive, opts); err != nil {
+		t.Fatalf("decompressFile -N failed: %v", err)
+	}
+	got, err := os.ReadFile(input)
+	if err != nil {
+		t.Fatalf("original name not restored: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("decompressed %d bytes, expected %d", len(got), len(data))
+	}
+	if info, err := os.Stat(input); err != nil || !info.ModTime().Equal(mtime) {
+		t.Errorf("expected mtime %v, got %v (%v)", mtime, info.ModTime(), err)
+	}
+
+	// -n ignores the saved name
+	os.Remove(input)
+	opts.Name = false
+	if err := decompressFile(archive, opts); err != nil {
+		t.Fatalf("decompressFile -n failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "renamed")); err != nil {
+		t.Errorf("expected output named from the archive with -n: %v", err)
+	}
+}
+
+func TestFrameSizeFor_Auto(t *testing.T) {
+	dir := t.TempDir()
+	sized := func(name string, size int64) os.FileInfo {
+		t.Helper()
+		path := filepath.Join(dir, name)
+		writeTestFile(t, path, nil)
+		if err := os.Truncate(path, size); err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info
+	}
+	defaultSize, _ := parseByteSize(defaultFrameSize)
+
+	for _, tt := range []struct {
+		name string
+		info os.FileInfo
+		want int64
+	}{
+		{"tiny file", sized("tiny", 100), minAutoFrameSize},
+		{"large file", sized("large", 4<<30), (4 << 30) / autoFrameCount},
+		{"huge file", sized("huge", 100<<30), maxAutoFrameSize},
+		{"stdin", nil, defaultSize},
+	} {
+		if got, err := frameSizeFor("auto", tt.info); err != nil || got != tt.want {
+			t.Errorf("%s: got frame size %d, expected %d (%v)", tt.name, got, tt.want, err)
+		}
+	}
+
+	// Compressing with auto splits the input into frames of the picked
+	// uncompressed size, however well it compresses
+	input := filepath.Join(dir, "data.bin")
+	data := bytes.Repeat([]byte("compressible line of text\n"), 3*minAutoFrameSize/26)
+	writeTestFile(t, input, data)
+	opts := testOptions()
+	opts.FrameSize = "auto"
+	if err := compressFile(input, opts); err != nil {
+		t.Fatalf("compressFile failed: %v", err)
+	}
+	decoder, closer, err := gzstd.OpenArchive(input + fileExtension)
+	if err != nil {
+		t.Fatalf("OpenArchive failed: %v", err)
+	}
+	defer closer()
+	if n := decoder.SeekTable().NumFrames(); n != 3 {
+		t.Errorf("expected 3 frames, got %d", n)
+	}
+}
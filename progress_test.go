@@ -0,0 +1,85 @@
+//go:build unix
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestProgressFD(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "data.txt")
+	data := make([]byte, 64*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+	if err := os.WriteFile(input, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	// Hand the CLI its own descriptor so each *os.File owns exactly one fd
+	fd, err := syscall.Dup(int(w.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	opts := testOptions()
+	opts.FrameSize = "4K"
+	opts.ProgressFD = fd
+	if err := setupProgress(opts); err != nil {
+		t.Fatalf("setupProgress failed: %v", err)
+	}
+
+	lines := make(chan progressUpdate, 1024)
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			var update progressUpdate
+			if err := json.Unmarshal(scanner.Bytes(), &update); err != nil {
+				t.Errorf("invalid progress line %q: %v", scanner.Text(), err)
+				continue
+			}
+			lines <- update
+		}
+	}()
+
+	if err := compressFile(input, opts); err != nil {
+		t.Fatalf("compressFile failed: %v", err)
+	}
+	opts.progress.Close()
+
+	var updates []progressUpdate
+	for update := range lines {
+		updates = append(updates, update)
+	}
+
+	if len(updates) < 2 {
+		t.Fatalf("Expected multiple progress lines, got %d", len(updates))
+	}
+	for i, update := range updates {
+		if update.Total != uint64(len(data)) {
+			t.Errorf("Line %d: expected total %d, got %d", i, len(data), update.Total)
+		}
+		if update.Frames != uint32(i+1) {
+			t.Errorf("Line %d: expected %d frames, got %d", i, i+1, update.Frames)
+		}
+		if i > 0 && update.Bytes <= updates[i-1].Bytes {
+			t.Errorf("Line %d: bytes did not increase (%d -> %d)", i, updates[i-1].Bytes, update.Bytes)
+		}
+	}
+	if last := updates[len(updates)-1]; last.Bytes != uint64(len(data)) {
+		t.Errorf("Expected final bytes %d, got %d", len(data), last.Bytes)
+	}
+}
@@ -0,0 +1,76 @@
+package gzstd
+
+import "math/bits"
+
+// Content-defined frame boundaries for ContentDefinedFrameSize, found with a
+// buzhash rolling over the last Window bytes of a frame's input. Because a
+// boundary depends only on the bytes just before it, inserting or removing
+// bytes early in the input moves the frames around the edit but leaves
+// later boundaries, and so later frames, unchanged.
+
+// defaultChunkWindow is the rolling hash window when Window is not set
+const defaultChunkWindow = 64
+
+// buzTable maps each byte to a fixed pseudo-random value. It is generated
+// with splitmix64 from a constant seed, so boundaries are stable across runs
+// and builds.
+var buzTable = func() (table [256]uint32) {
+	state := uint64(0x9E3779B97F4A7C15)
+	for i := range table {
+		state += 0x9E3779B97F4A7C15
+		z := state
+		z = (z ^ (z >> 30)) * 0xBF58476D1CE4E5B9
+		z = (z ^ (z >> 27)) * 0x94D049BB133111EB
+		table[i] = uint32(z ^ (z >> 31))
+	}
+	return table
+}()
+
+// chunker tracks the rolling hash over the current frame's input
+type chunker struct {
+	window []byte // the last len(window) bytes, as a ring
+	pos    int    // next slot of window to overwrite
+	n      int    // bytes hashed since reset, up to len(window)
+	hash   uint32
+}
+
+// reset starts hashing a new frame with a window of size bytes
+func (c *chunker) reset(size int) {
+	if size <= 0 {
+		size = defaultChunkWindow
+	}
+	if len(c.window) != size {
+		c.window = make([]byte, size)
+	}
+	c.pos, c.n, c.hash = 0, 0, 0
+}
+
+// roll adds b to the hash, dropping the byte that leaves the window
+func (c *chunker) roll(b byte) {
+	c.hash = bits.RotateLeft32(c.hash, 1) ^ buzTable[b]
+	if c.n == len(c.window) {
+		out := c.window[c.pos]
+		c.hash ^= bits.RotateLeft32(buzTable[out], len(c.window))
+	} else {
+		c.n++
+	}
+	c.window[c.pos] = b
+	c.pos++
+	if c.pos == len(c.window) {
+		c.pos = 0
+	}
+}
+
+// next hashes p, whose first byte is at offset frameSize of the frame, and
+// returns the index of the first byte that ends a frame under policy, or -1
+// if p has none. Only the bytes up to that boundary are hashed.
+func (c *chunker) next(p []byte, frameSize uint64, policy ContentDefinedFrameSize) int {
+	mask := policy.mask()
+	for i, b := range p {
+		c.roll(b)
+		if c.n == len(c.window) && frameSize+uint64(i)+1 >= uint64(policy.Min) && c.hash&mask == mask {
+			return i
+		}
+	}
+	return -1
+}
@@ -2,25 +2,155 @@ package gzstd
 
 import (
 	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
+	"log/slog"
+	"maps"
+	"os"
+	"strings"
+	"sync"
 
 	"github.com/klauspost/compress/zstd"
 )
 
+const (
+	// Frames up to smallFrameSize compressed bytes are batched into a single
+	// DecodeAll call, up to smallFrameBatchSize compressed and
+	// maxBatchDecompressed decompressed bytes per batch
+	smallFrameSize       = 4 * 1024
+	smallFrameBatchSize  = 64 * 1024
+	maxBatchDecompressed = 1024 * 1024
+
+	// Frames that decompress to more than streamFrameSize bytes are streamed
+	// to the caller instead of being decompressed into memory at once.
+	// Smaller frames use DecodeAll: streaming them instead through a reset
+	// zstd.Decoder reading a LimitedReader over each run measured about 40%
+	// slower per frame, and 20% slower for batched runs, on an archive of
+	// 100,000 tiny frames (see BenchmarkDecoder_TinyFrames)
+	streamFrameSize = 1024 * 1024
+
+	// Error messages
+	ErrContentMismatch   = "decompressed content differs"
+	ErrInvalidFrameRange = "invalid frame range"
+	ErrFrameSizeMismatch = "decompressed frame size mismatch"
+	ErrNoSeekTable       = "no seek table found"
+	ErrNotSeekable       = "archive has no seek table, seeking is disabled"
+	ErrArchiveTruncated  = "archive truncated"
+	ErrWindowExceeded    = "frame window exceeds MaxWindowLog"
+	ErrSeekOutOfRange    = "seek offset out of range"
+	ErrStreamChecksum    = "stream checksum mismatch"
+	ErrBufferLimit       = "frame exceeds MaxBufferBytes"
+)
+
 // Seekable represents a seekable source
 type Seekable interface {
 	io.Reader
 	io.Seeker
 }
 
+// NewReaderAtSeekable returns a Seekable cursor over the size bytes of ra,
+// for sources that only offer io.ReaderAt, such as object store clients
+// issuing ranged GETs. Every Read is a ReadAt at the cursor, so a decoder
+// over it fetches only the ranges it needs: the seek table, then the frames
+// covering what is read.
+func NewReaderAtSeekable(ra io.ReaderAt, size int64) Seekable {
+	return io.NewSectionReader(ra, 0, size)
+}
+
 // DecoderOptions configures the decoder
 type DecoderOptions struct {
 	SeekTable    *SeekTable
 	LowerFrame   uint32
 	UpperFrame   uint32
-	Dict         []byte
-	MaxWindowLog int
+	Dict         []byte // CompressionDict the archive was compressed with
+	MaxWindowLog int    // largest window accepted, as log2 bytes; at least the encoder's WindowLog
+
+	// Dicts holds formatted zstd dictionaries by ID, for archives whose
+	// frames were compressed with different dictionaries by
+	// Encoder.SetFrameDict. Each frame is decoded with the dictionary whose
+	// ID its header records.
+	Dicts map[uint32][]byte
+
+	// UpperFrameSet marks UpperFrame as given even when it is 0, so that
+	// LowerFrame 0 and UpperFrame 0 decode only the first frame. Without it
+	// an UpperFrame of 0 means the last frame of the archive.
+	UpperFrameSet bool
+
+	// PrefixWindow is raw content used to seed the window when decoding every
+	// frame. It must match the EncoderOptions.PrefixWindow the archive was
+	// compressed with. Unlike Dict it is not a formatted zstd dictionary and
+	// is not identified in the frame headers. It is held in memory for the
+	// lifetime of the decoder.
+	PrefixWindow []byte
+
+	// OnFrame, if set, is called once for each frame decompressed by Read,
+	// WriteTo or Seek with the frame index and the decompressed offset of
+	// the frame's end, however the reads split the frame. It is not called
+	// for an archive without a seek table, whose frames are not known.
+	OnFrame func(frameIndex uint32, decompressed uint64)
+
+	// MaxCompressedReadSize, if non-zero, bounds how much of a frame's
+	// compressed data Read takes from the source at once. Larger frames are
+	// fed to a streaming zstd decoder in reads of at most this size instead
+	// of being read into a single frame-sized buffer. 0 reads whole frames.
+	MaxCompressedReadSize int
+
+	// VerifyOnSeek limits checksum verification to the frames reached by
+	// random access: the frame a Seek lands on and the first frame of each
+	// ReadAt. Frames read sequentially after them are not verified. It has
+	// no effect on archives without per-frame checksums.
+	VerifyOnSeek bool
+
+	// AllowNonSeekable decodes a source with no seek table, such as a file
+	// from the standard zstd tool, as a plain zstd stream instead of failing
+	// with ErrNoSeekTable. Such a decoder can only be read sequentially:
+	// Seek, ReadAt and TestIntegrity return ErrNotSeekable.
+	AllowNonSeekable bool
+
+	// FrameCacheSize, if greater than 0, keeps that many recently
+	// decompressed frames in memory, evicting the least recently used, so
+	// repeated ReadAt and Seek calls landing in the same frames skip
+	// decompression. The cache is bounded by frame count, not bytes, so its
+	// memory grows with the frame size. Frames that Read streams because
+	// they decompress to more than 1MB are only cached by ReadAt.
+	FrameCacheSize int
+
+	// Prefetch reads and decompresses the next frames in the background
+	// while the caller consumes the current ones, overlapping I/O and
+	// decompression with sequential Read and WriteTo. It stops at the
+	// decoder's upper frame and does not apply to streamed frames.
+	Prefetch bool
+
+	// VerifyLength checks when the decoder is created that the source is
+	// long enough to hold every frame in the seek table, plus the seek table
+	// itself when it was read from the end of the source, and fails with
+	// ErrArchiveTruncated otherwise. Without it a truncated archive is only
+	// noticed when Read reaches the missing data.
+	VerifyLength bool
+
+	// MaxBufferBytes, if greater than 0, bounds the decompressed data Read,
+	// WriteTo and Seek hold at once: frames that decompress to more are
+	// streamed in pieces, and runs of small frames are batched up to it.
+	// Prefetch may hold one more run of that size, and FrameCacheSize
+	// frames are kept on top of it. Where a frame cannot be streamed, in
+	// ReadWithPrefix, ReadAt, DecodeFrame, Frames and TestIntegrity, a
+	// larger frame fails with ErrBufferLimit. The zstd window, bounded by
+	// MaxWindowLog, is not counted.
+	MaxBufferBytes int
+
+	// ComputeChecksum hashes the content returned by Read and WriteTo with
+	// XXH64, for Checksum to compare against a checksum kept elsewhere
+	ComputeChecksum bool
+
+	// Logger, if set, receives debug-level diagnostics such as the seek
+	// table found, frame boundaries, and which decoding path each frame
+	// takes. nil logs nothing.
+	Logger *slog.Logger
 }
 
 // DefaultDecoderOptions returns default decoder options
@@ -46,104 +176,467 @@ type Decoder struct {
 	upperFrame   uint32
 	totalRead    uint64
 	eofReached   bool
+	batchLimit   int
+	streamRuns   bool   // stream every run, to compare against DecodeAll
+	data         []byte // whole archive when created by NewDecoderBytes
+	readAtMu     sync.Mutex
+
+	// Large frames are read through streamDecoder, kept separate from
+	// decoder so DecodeAll stays usable while a frame is being streamed
+	decoderOpts   []zstd.DOption
+	streamDecoder *zstd.Decoder
+	stream        io.Reader // frame being streamed, nil when none
+	streamLast    uint32    // last frame covered by stream
+
+	// Decoder for ReadWithPrefix, kept for reuse while the same prefix is
+	// given
+	prefixDecoder *zstd.Decoder
+	prefix        []byte
+
+	// With VerifyOnSeek, the frame the last Seek landed on, until verified
+	seekFrame  uint32
+	verifySeek bool
+
+	linear bool // no seek table: the source is read as one zstd stream
+
+	cache      *frameCache      // nil unless FrameCacheSize is set
+	streamHash *xxh64           // nil unless ComputeChecksum is set
+	skippable  []SkippableFrame // metadata frames ahead of the first frame
+	prefetched *prefetchJob     // frames being prefetched, nil when none
+
+	ctx context.Context // nil when not created with a context
 }
 
 // NewDecoder creates a new seekable decoder
 func NewDecoder(source Seekable, opts *DecoderOptions) (*Decoder, error) {
+	d := &Decoder{}
+	if err := d.Reset(source, opts); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Reset prepares the decoder to read a different archive from source, as if
+// it had been created by NewDecoder(source, opts), reading its seek table
+// unless opts supplies one. The underlying zstd decoder is reused when opts
+// configures it the same way as before, so services that open many small
+// archives can pool decoders instead of allocating one per archive.
+func (d *Decoder) Reset(source Seekable, opts *DecoderOptions) error {
+	d.stopPrefetch()
 	if opts == nil {
 		opts = DefaultDecoderOptions()
 	}
 
 	// Try to read seek table from source
 	var seekTable *SeekTable
+	var trailerSize uint64 // bytes of seek table after the frames
 	if opts.SeekTable != nil {
 		seekTable = opts.SeekTable
 	} else {
 		// Try to read seek table from the end of file
-		footer, err := ReadSeekTableFooter(source)
-		if err == nil {
-			seekTableSize, err := ParseSeekTableSize(footer)
-			if err == nil {
-				// Seek to start of seek table
-				currentPos, _ := source.Seek(0, io.SeekCurrent)
-				if _, err := source.Seek(-int64(seekTableSize), io.SeekEnd); err == nil {
-					seekTableData := make([]byte, seekTableSize)
-					if _, err := io.ReadFull(source, seekTableData); err == nil {
-						seekTable, _ = ParseSeekTable(seekTableData)
-					}
-				}
-				// Restore position
-				source.Seek(currentPos, io.SeekStart)
+		st, err := ReadSeekTable(source)
+		switch {
+		case err == nil:
+			seekTable = st
+			if s, err := st.NewSerializer(FormatFoot); err == nil {
+				trailerSize = uint64(s.EncodedLen())
+			}
+		case strings.HasPrefix(err.Error(), ErrArchiveTooSmall) && !opts.AllowNonSeekable:
+			return err
+		default:
+			// Fall back to a Head format table at the start, and present
+			// the frames after it as starting at offset 0
+			head, size, headErr := readHeadSeekTable(source)
+			if headErr == nil {
+				seekTable = head
+				source = &offsetSource{Seekable: source, base: int64(size)}
+			} else if opts.Logger != nil {
+				opts.Logger.Debug("seek table rejected", "error", err, "head_error", headErr)
 			}
 		}
 	}
 
-	if seekTable == nil {
-		return nil, errors.New("no seek table found")
+	if seekTable == nil && !opts.AllowNonSeekable {
+		return errors.New(ErrNoSeekTable)
 	}
 
-	decoderOpts := []zstd.DOption{
-		zstd.WithDecoderConcurrency(1),
+	if d.decoder == nil || !d.sameZstdOptions(opts) {
+		decoderOpts := []zstd.DOption{
+			zstd.WithDecoderConcurrency(1),
+		}
+
+		// Only set max window if it's large enough
+		if opts.MaxWindowLog >= 10 { // 2^10 = 1024 bytes minimum
+			decoderOpts = append(decoderOpts, zstd.WithDecoderMaxWindow(1<<uint(opts.MaxWindowLog)))
+		}
+
+		if len(opts.Dict) > 0 {
+			decoderOpts = append(decoderOpts, zstd.WithDecoderDicts(opts.Dict))
+		}
+		for id, dict := range opts.Dicts {
+			if dictID, err := DictID(dict); err != nil || dictID != id {
+				return fmt.Errorf("%s: dictionary given for ID %d has ID %d", ErrInvalidDict, id, dictID)
+			}
+			decoderOpts = append(decoderOpts, zstd.WithDecoderDicts(dict))
+		}
+
+		if len(opts.PrefixWindow) > 0 {
+			decoderOpts = append(decoderOpts, zstd.WithDecoderDictRaw(0, opts.PrefixWindow))
+		}
+
+		decoder, err := zstd.NewReader(nil, decoderOpts...)
+		if err != nil {
+			return err
+		}
+		if d.decoder != nil {
+			d.decoder.Close()
+		}
+		if d.streamDecoder != nil {
+			d.streamDecoder.Close()
+		}
+		if d.prefixDecoder != nil {
+			d.prefixDecoder.Close()
+		}
+		d.decoder = decoder
+		d.decoderOpts = decoderOpts
+		d.streamDecoder = nil
+		d.prefixDecoder = nil
+	}
+
+	d.source = source
+	d.options = opts
+	d.seekTable = seekTable
+	d.currentFrame = opts.LowerFrame
+	d.lowerFrame = opts.LowerFrame
+	d.upperFrame = opts.UpperFrame
+	d.batchLimit = smallFrameBatchSize
+	d.decompressed.Reset()
+	d.totalRead = 0
+	d.eofReached = false
+	d.data = nil
+	d.stream = nil
+	d.verifySeek = false
+	d.linear = seekTable == nil
+	d.cache = nil
+	d.skippable = nil
+	d.streamHash = nil
+	if opts.ComputeChecksum {
+		d.streamHash = newXXH64()
+	}
+	if opts.FrameCacheSize > 0 {
+		d.cache = newFrameCache(opts.FrameCacheSize)
 	}
-	
-	// Only set max window if it's large enough
-	if opts.MaxWindowLog >= 10 { // 2^10 = 1024 bytes minimum
-		decoderOpts = append(decoderOpts, zstd.WithDecoderMaxWindow(1 << uint(opts.MaxWindowLog)))
+
+	if d.linear {
+		d.seekTable = NewSeekTable()
+		d.debug("no seek table, decoding as a plain zstd stream")
+		return d.startLinear()
 	}
 
-	// Dictionary support disabled - requires properly formatted zstd dictionaries
-	// if len(opts.Dict) > 0 {
-	//     decoderOpts = append(decoderOpts, zstd.WithDecoderDicts(opts.Dict))
-	// }
+	d.debug("seek table loaded", "frames", seekTable.NumFrames(),
+		"checksums", seekTable.HasChecksums(), "from_options", opts.SeekTable != nil)
+	d.debug("decoder configured", "max_window_log", opts.MaxWindowLog,
+		"prefix_window", len(opts.PrefixWindow))
 
-	decoder, err := zstd.NewReader(nil, decoderOpts...)
-	if err != nil {
-		return nil, err
+	if (d.upperFrame == 0 && !opts.UpperFrameSet) || d.upperFrame >= seekTable.NumFrames() {
+		d.upperFrame = lastFrameIndex(seekTable)
+	}
+
+	if d.lowerFrame > d.upperFrame {
+		return fmt.Errorf("%s: lower frame %d is after upper frame %d",
+			ErrInvalidFrameRange, d.lowerFrame, d.upperFrame)
 	}
 
-	d := &Decoder{
-		source:       source,
-		decoder:      decoder,
-		options:      opts,
-		seekTable:    seekTable,
-		currentFrame: opts.LowerFrame,
-		lowerFrame:   opts.LowerFrame,
-		upperFrame:   opts.UpperFrame,
+	if opts.VerifyLength {
+		if err := d.verifyLength(trailerSize); err != nil {
+			return err
+		}
 	}
 
-	if d.upperFrame == 0 || d.upperFrame >= seekTable.NumFrames() {
-		d.upperFrame = seekTable.NumFrames() - 1
+	skippable, err := d.readSkippableFrames()
+	if err != nil {
+		return err
 	}
+	d.skippable = skippable
 
 	// Seek to start of first frame
 	if d.currentFrame > 0 {
 		startOffset, err := seekTable.FrameStartComp(d.currentFrame)
 		if err != nil {
-			return nil, err
+			return err
 		}
 		if _, err := source.Seek(int64(startOffset), io.SeekStart); err != nil {
-			return nil, err
+			return err
 		}
 	} else {
 		// Ensure we're at the start
 		if _, err := source.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Close waits for any prefetch to finish and releases the zstd decoders. The
+// source is not closed. A closed decoder can be reused through Reset.
+func (d *Decoder) Close() error {
+	d.stopPrefetch()
+	if d.decoder != nil {
+		d.decoder.Close()
+	}
+	if d.streamDecoder != nil {
+		d.streamDecoder.Close()
+	}
+	if d.prefixDecoder != nil {
+		d.prefixDecoder.Close()
+	}
+	d.decoder = nil
+	d.streamDecoder = nil
+	d.prefixDecoder = nil
+	d.prefix = nil
+	d.stream = nil
+	return nil
+}
+
+// SkippableFrame is a zstd skippable frame, such as the metadata written by
+// Encoder.WriteSkippableMetadata
+type SkippableFrame struct {
+	Magic uint32
+	Data  []byte
+}
+
+// SkippableFrames returns the skippable frames at the start of the archive,
+// ahead of its first frame, in order
+func (d *Decoder) SkippableFrames() []SkippableFrame {
+	return d.skippable
+}
+
+// readSkippableFrames reads the skippable frames at the start of the source
+// that lie within the first frame's compressed range, where the encoder
+// logs them
+func (d *Decoder) readSkippableFrames() ([]SkippableFrame, error) {
+	if d.seekTable.NumFrames() == 0 {
+		return nil, nil
+	}
+	end, _ := d.seekTable.FrameEndComp(0)
+	if _, err := d.source.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	var frames []SkippableFrame
+	header := make([]byte, SKIPPABLE_HEADER_SIZE)
+	for pos := uint64(0); pos+SKIPPABLE_HEADER_SIZE <= end; {
+		if _, err := io.ReadFull(d.source, header); err != nil {
+			return nil, err
+		}
+		magic := binary.LittleEndian.Uint32(header[0:4])
+		if magic&skippableMagicMask != skippableMagicBase {
+			break
+		}
+		size := uint64(binary.LittleEndian.Uint32(header[4:8]))
+		pos += SKIPPABLE_HEADER_SIZE + size
+		if pos > end {
+			return nil, fmt.Errorf("%s: skippable frame overruns frame 0", ErrCorrupted)
+		}
+		data := make([]byte, size)
+		if _, err := io.ReadFull(d.source, data); err != nil {
 			return nil, err
 		}
+		frames = append(frames, SkippableFrame{Magic: magic, Data: data})
+	}
+	return frames, nil
+}
+
+// verifyLength checks that the source holds every frame of the seek table
+// followed by trailerSize bytes
+func (d *Decoder) verifyLength(trailerSize uint64) error {
+	size, err := d.source.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	framesEnd := d.seekTable.entries[len(d.seekTable.entries)-1].CompressedOffset
+	if expected := framesEnd + trailerSize; uint64(size) < expected {
+		return fmt.Errorf("%s: expected at least %d bytes, got %d", ErrArchiveTruncated, expected, size)
+	}
+	return nil
+}
+
+// offsetSource presents the data after a Head format seek table as a source
+// starting at offset 0, so compressed frame offsets apply unchanged
+type offsetSource struct {
+	Seekable
+	base int64
+}
+
+func (s *offsetSource) Seek(offset int64, whence int) (int64, error) {
+	if whence == io.SeekStart {
+		offset += s.base
+	}
+	pos, err := s.Seekable.Seek(offset, whence)
+	return pos - s.base, err
+}
+
+// startLinear starts decoding the whole source as a single zstd stream
+func (d *Decoder) startLinear() error {
+	if d.streamDecoder == nil {
+		decoder, err := zstd.NewReader(nil, d.decoderOpts...)
+		if err != nil {
+			return err
+		}
+		d.streamDecoder = decoder
+	}
+	if _, err := d.source.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := d.streamDecoder.Reset(d.source); err != nil {
+		return err
+	}
+	d.stream = d.streamDecoder
+	return nil
+}
+
+// sameZstdOptions reports whether opts configures the zstd decoder the same
+// way as the options it was created with
+func (d *Decoder) sameZstdOptions(opts *DecoderOptions) bool {
+	return opts.MaxWindowLog == d.options.MaxWindowLog &&
+		bytes.Equal(opts.Dict, d.options.Dict) &&
+		maps.EqualFunc(opts.Dicts, d.options.Dicts, bytes.Equal) &&
+		bytes.Equal(opts.PrefixWindow, d.options.PrefixWindow)
+}
+
+// NewDecoderContext creates a seekable decoder that stops once ctx is done.
+// The context is checked before each frame is decompressed by Read or
+// WriteTo, which then return ErrCanceled wrapping ctx.Err().
+func NewDecoderContext(ctx context.Context, source Seekable, opts *DecoderOptions) (*Decoder, error) {
+	d, err := NewDecoder(source, opts)
+	if err != nil {
+		return nil, err
 	}
+	d.ctx = ctx
+	return d, nil
+}
 
+// NewDecoderBytes creates a decoder for an archive held entirely in memory.
+// Compressed frames are sliced directly out of data instead of being copied
+// into per-frame buffers, so data must not be modified while in use.
+func NewDecoderBytes(data []byte, opts *DecoderOptions) (*Decoder, error) {
+	d, err := NewDecoder(bytes.NewReader(data), opts)
+	if err != nil {
+		return nil, err
+	}
+	if src, ok := d.source.(*offsetSource); ok {
+		// Frame offsets of a Head format archive start after its seek table
+		data = data[src.base:]
+	}
+	d.data = data
 	return d, nil
 }
 
+// DecodeAll decompresses the whole of an archive held in memory, the
+// counterpart of EncodeAll. opts may restrict the frames decoded.
+func DecodeAll(archive []byte, opts *DecoderOptions) ([]byte, error) {
+	d, err := NewDecoderBytes(archive, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer d.Close()
+
+	var out bytes.Buffer
+	if d.seekTable.NumFrames() > 0 {
+		start, _ := d.seekTable.FrameStartDecomp(d.lowerFrame)
+		end, _ := d.seekTable.FrameEndDecomp(d.upperFrame)
+		out.Grow(int(end - start))
+	}
+	if _, err := d.WriteTo(&out); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// OpenArchive opens the seekable archive at path and returns a decoder for it
+// along with a function that closes the underlying file.
+func OpenArchive(path string) (*Decoder, func() error, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	d, err := NewDecoder(f, nil)
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+
+	return d, f.Close, nil
+}
+
 // Read implements io.Reader
 func (d *Decoder) Read(p []byte) (int, error) {
 	return d.ReadWithPrefix(p, nil)
 }
 
-// ReadWithPrefix reads decompressed data with optional prefix
+// Checksum returns the XXH64 of the content returned so far by Read and
+// WriteTo when ComputeChecksum is set, and 0 otherwise. Once the archive has
+// been read from start to end without seeking, it is the checksum of the
+// whole content, as stored by EncoderOptions.StreamChecksum.
+func (d *Decoder) Checksum() uint64 {
+	if d.streamHash == nil {
+		return 0
+	}
+	return d.streamHash.Sum64()
+}
+
+// StreamChecksum returns the checksum of the whole content that the encoder
+// stored after the last frame with EncoderOptions.StreamChecksum, and false
+// if the archive has none. Like ReadAt it does not move the Read cursor.
+func (d *Decoder) StreamChecksum() (uint64, bool, error) {
+	if d.linear || d.seekTable.NumFrames() == 0 {
+		return 0, false, nil
+	}
+	d.readAtMu.Lock()
+	defer d.readAtMu.Unlock()
+	if err := d.stopPrefetch(); err != nil {
+		return 0, false, err
+	}
+
+	pos, err := d.source.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, false, err
+	}
+	defer d.source.Seek(pos, io.SeekStart)
+
+	framesEnd, _ := d.seekTable.FrameEndComp(d.seekTable.NumFrames() - 1)
+	if _, err := d.source.Seek(int64(framesEnd), io.SeekStart); err != nil {
+		return 0, false, err
+	}
+	frame := make([]byte, streamChecksumFrameSize)
+	if _, err := io.ReadFull(d.source, frame); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, err
+	}
+	if binary.LittleEndian.Uint32(frame[0:4]) != StreamChecksumMagic ||
+		binary.LittleEndian.Uint32(frame[4:8]) != 8 {
+		return 0, false, nil
+	}
+	return binary.LittleEndian.Uint64(frame[SKIPPABLE_HEADER_SIZE:]), true, nil
+}
+
+// ReadWithPrefix reads decompressed data, decoding each frame it reaches
+// with prefix as a raw content dictionary. This reads the frames written by
+// Encoder.WriteWithPrefix with the same prefix; frames compressed without a
+// prefix decode unchanged. The prefix is not part of the output. Frames are
+// not streamed while reading with a prefix.
 func (d *Decoder) ReadWithPrefix(p []byte, prefix []byte) (int, error) {
 	if d.eofReached {
 		return 0, io.EOF
 	}
+	if d.linear {
+		n, err := d.stream.Read(p)
+		d.consumed(p[:n])
+		return n, err
+	}
 
 	totalRead := 0
 
@@ -151,13 +644,33 @@ func (d *Decoder) ReadWithPrefix(p []byte, prefix []byte) (int, error) {
 		// If we have decompressed data, return it
 		if d.decompressed.Len() > 0 {
 			n, _ := d.decompressed.Read(p[totalRead:])
+			d.consumed(p[totalRead : totalRead+n])
 			totalRead += n
-			d.totalRead += uint64(n)
+			continue
+		}
+
+		// Large frames are passed through as they decompress
+		if d.stream != nil {
+			n, err := d.stream.Read(p[totalRead:])
+			d.consumed(p[totalRead : totalRead+n])
+			totalRead += n
+			if err == io.EOF {
+				d.stream = nil
+				d.advanceFrames(d.streamLast)
+			} else if err != nil {
+				return totalRead, d.windowError(err)
+			}
 			continue
 		}
 
 		// Need to decompress more data
-		if err := d.decompressNextFrame(prefix); err != nil {
+		if err := d.checkContext(); err != nil {
+			return totalRead, err
+		}
+		n, err := d.decodeInto(p[totalRead:], prefix)
+		d.consumed(p[totalRead : totalRead+n])
+		totalRead += n
+		if err != nil {
 			if err == io.EOF {
 				d.eofReached = true
 				if totalRead > 0 {
@@ -171,24 +684,115 @@ func (d *Decoder) ReadWithPrefix(p []byte, prefix []byte) (int, error) {
 	return totalRead, nil
 }
 
-// Seek implements io.Seeker
+// consumed advances the read position past p, content just returned by
+// Read, and hashes it for ComputeChecksum
+func (d *Decoder) consumed(p []byte) {
+	d.totalRead += uint64(len(p))
+	if d.streamHash != nil {
+		d.streamHash.Write(p)
+	}
+}
+
+// WriteTo implements io.WriterTo, so io.Copy from a Decoder writes each
+// decompressed frame straight to w instead of copying it through Read's
+// buffer. It continues from the current position, including partway into a
+// frame after a Seek, up to the end of the decoder's frame range.
+func (d *Decoder) WriteTo(w io.Writer) (int64, error) {
+	if d.streamHash != nil {
+		w = io.MultiWriter(w, d.streamHash)
+	}
+	if d.linear {
+		n, err := io.Copy(w, d.stream)
+		d.totalRead += uint64(n)
+		return n, err
+	}
+
+	var written int64
+
+	for !d.eofReached {
+		switch {
+		case d.decompressed.Len() > 0:
+			// Rest of a frame left by Read or Seek
+			n, err := d.decompressed.WriteTo(w)
+			written += n
+			d.totalRead += uint64(n)
+			if err != nil {
+				return written, err
+			}
+
+		case d.stream != nil:
+			n, err := io.Copy(w, d.stream)
+			written += n
+			d.totalRead += uint64(n)
+			if err != nil {
+				return written, d.windowError(err)
+			}
+			d.stream = nil
+			d.advanceFrames(d.streamLast)
+
+		default:
+			if err := d.checkContext(); err != nil {
+				return written, err
+			}
+			decompressed, err := d.decodeNextFrames(nil, d.frameData[:0])
+			if err == io.EOF {
+				d.eofReached = true
+				break
+			}
+			if err != nil {
+				return written, err
+			}
+			if d.stream != nil {
+				continue
+			}
+			d.frameData = decompressed
+
+			n, err := w.Write(decompressed)
+			written += int64(n)
+			d.totalRead += uint64(n)
+			if err != nil {
+				return written, err
+			}
+		}
+	}
+
+	return written, nil
+}
+
+// Seek implements io.Seeker over absolute decompressed offsets. Seeking
+// before the start or past the end of the decoder's frame range fails with
+// ErrSeekOutOfRange, and io.SeekEnd is relative to the end of that range.
 func (d *Decoder) Seek(offset int64, whence int) (int64, error) {
-	var targetOffset uint64
+	if d.linear {
+		return 0, errors.New(ErrNotSeekable)
+	}
+	if err := d.stopPrefetch(); err != nil {
+		return 0, err
+	}
+	start, end := d.rangeDecomp()
 
+	var target int64
 	switch whence {
 	case io.SeekStart:
-		targetOffset = uint64(offset)
+		target = offset
 	case io.SeekCurrent:
-		targetOffset = d.totalRead + uint64(offset)
+		target = int64(d.totalRead) + offset
 	case io.SeekEnd:
-		totalSize, err := d.seekTable.FrameEndDecomp(d.seekTable.NumFrames() - 1)
-		if err != nil {
-			return 0, err
-		}
-		targetOffset = totalSize + uint64(offset)
+		target = int64(end) + offset
 	default:
 		return 0, errors.New("invalid whence")
 	}
+	if target < int64(start) || uint64(target) > end {
+		return 0, fmt.Errorf("%s: %d is outside [%d, %d]", ErrSeekOutOfRange, target, start, end)
+	}
+	targetOffset := uint64(target)
+	if targetOffset == end {
+		// At the end of the range there is nothing to decode
+		if err := d.seekToEnd(end); err != nil {
+			return 0, err
+		}
+		return int64(end), nil
+	}
 
 	// Find the frame containing the target offset
 	targetFrame := d.findFrameAtOffset(targetOffset)
@@ -217,121 +821,1333 @@ func (d *Decoder) Seek(offset int64, whence int) (int64, error) {
 	// Reset decoder state
 	d.currentFrame = targetFrame
 	d.decompressed.Reset()
+	d.stream = nil
 	d.totalRead = frameStartDecomp
 	d.eofReached = false
+	d.seekFrame = targetFrame
+	d.verifySeek = d.options.VerifyOnSeek
 
-	// If target is within the frame, decompress and skip to target
+	// If target is within the frame, decompress just that frame and skip
+	// to target
 	if targetOffset > frameStartDecomp {
-		skipBytes := targetOffset - frameStartDecomp
-		skipBuf := make([]byte, 4096)
-		for skipBytes > 0 {
-			toSkip := skipBytes
-			if toSkip > uint64(len(skipBuf)) {
-				toSkip = uint64(len(skipBuf))
-			}
-			n, err := d.Read(skipBuf[:toSkip])
-			if err != nil {
-				return 0, err
-			}
-			skipBytes -= uint64(n)
+		if err := d.skipIntoFrame(targetFrame, targetOffset-frameStartDecomp); err != nil {
+			return 0, err
 		}
 	}
 
 	return int64(d.totalRead), nil
 }
 
-// SeekTable returns the decoder's seek table
-func (d *Decoder) SeekTable() *SeekTable {
-	return d.seekTable
-}
-
-// SetLowerFrame sets the lower frame boundary
-func (d *Decoder) SetLowerFrame(frame uint32) {
-	d.lowerFrame = frame
-	if d.currentFrame < frame {
-		d.currentFrame = frame
+// rangeDecomp returns the decompressed offsets where the decoder's frame
+// range starts and ends, both 0 for an archive without frames
+func (d *Decoder) rangeDecomp() (start, end uint64) {
+	if d.seekTable.NumFrames() == 0 {
+		return 0, 0
 	}
+	start, _ = d.seekTable.FrameStartDecomp(d.lowerFrame)
+	end, _ = d.seekTable.FrameEndDecomp(d.upperFrame)
+	return start, end
 }
 
-// SetUpperFrame sets the upper frame boundary
-func (d *Decoder) SetUpperFrame(frame uint32) {
-	d.upperFrame = frame
-	if d.upperFrame >= d.seekTable.NumFrames() {
-		d.upperFrame = d.seekTable.NumFrames() - 1
+// seekToEnd moves past the last frame of the range, which ends at the
+// decompressed offset end, so Read returns io.EOF
+func (d *Decoder) seekToEnd(end uint64) error {
+	if d.seekTable.NumFrames() > 0 {
+		endComp, _ := d.seekTable.FrameEndComp(d.upperFrame)
+		if _, err := d.source.Seek(int64(endComp), io.SeekStart); err != nil {
+			return err
+		}
+		d.currentFrame = d.upperFrame + 1
 	}
+	d.decompressed.Reset()
+	d.stream = nil
+	d.totalRead = end
+	d.eofReached = false
+	d.verifySeek = false
+	return nil
 }
 
-func (d *Decoder) decompressNextFrame(prefix []byte) error {
-	if d.currentFrame > d.upperFrame {
-		return io.EOF
+// skipIntoFrame decompresses the frame at index, which Seek has made the
+// current frame, and buffers its content from skip onwards for Read. Unlike
+// Read it never decodes past the frame, so seeking does not batch or
+// prefetch the frames after it.
+func (d *Decoder) skipIntoFrame(index uint32, skip uint64) error {
+	if size, _ := d.seekTable.FrameSizeDecomp(index); d.exceedsBuffer(size) {
+		// Stream the frame, discarding up to the target, rather than
+		// holding all of it
+		compSize, _ := d.seekTable.FrameSizeComp(index)
+		if err := d.startStream(compSize, index); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(io.Discard, d.stream, int64(skip)); err != nil {
+			d.stream = nil
+			return d.windowError(err)
+		}
+		d.totalRead += skip
+		return nil
 	}
 
-	// Get frame size
-	frameSize, err := d.seekTable.FrameSizeComp(d.currentFrame)
+	decompressed, err := d.decodeFrame(index)
 	if err != nil {
 		return err
 	}
-
-	// Read compressed frame
-	compressedData := make([]byte, frameSize)
-	if _, err := io.ReadFull(d.source, compressedData); err != nil {
-		return err
-	}
-
-	// Decompress frame
-	var decompressed []byte
-	if prefix != nil && d.currentFrame == d.lowerFrame {
-		// For first frame, prepend prefix before decompression
-		combined := append(prefix, compressedData...)
-		decompressed, err = d.decoder.DecodeAll(combined, nil)
-		if err != nil {
-			// Try without prefix
-			decompressed, err = d.decoder.DecodeAll(compressedData, nil)
+	if d.verifySeek {
+		d.verifySeek = false
+		if err := d.verifyFrames(index, index, decompressed); err != nil {
+			return err
 		}
-	} else {
-		decompressed, err = d.decoder.DecodeAll(compressedData, nil)
 	}
-
-	if err != nil {
-		return err
+	if skip > uint64(len(decompressed)) {
+		return fmt.Errorf("%s: frame %d", ErrFrameSizeMismatch, index)
 	}
 
-	d.decompressed.Write(decompressed)
-	d.currentFrame++
-
+	d.decompressed.Write(decompressed[skip:])
+	d.totalRead += skip
+	d.advanceFrames(index)
 	return nil
 }
 
-func (d *Decoder) findFrameAtOffset(offset uint64) uint32 {
-	if offset == 0 {
-		return 0
+// ReadAt implements io.ReaderAt over the decompressed content, using the same
+// absolute decompressed offsets as Seek. Only the frames overlapping the
+// requested range are read and decompressed, and reads are limited to the
+// decoder's frame range, returning io.EOF past its end.
+//
+// ReadAt does not move the Read cursor. Concurrent ReadAt calls are safe:
+// they share the underlying source, so they are serialized internally. They
+// must not run concurrently with Read or Seek.
+func (d *Decoder) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
 	}
-
-	numFrames := d.seekTable.NumFrames()
-	if offset >= d.mustFrameEndDecomp(numFrames-1) {
-		return numFrames - 1
+	if d.linear {
+		return 0, errors.New(ErrNotSeekable)
 	}
-
-	low := uint32(0)
-	high := numFrames
-
-	for low+1 < high {
-		mid := (low + high) / 2
-		midOffset := d.mustFrameEndDecomp(mid)
-		if offset < midOffset {
-			high = mid
-		} else {
-			low = mid
-		}
+	if d.seekTable.NumFrames() == 0 {
+		return 0, io.EOF
 	}
 
-	if offset < d.mustFrameEndDecomp(low) {
-		return low
+	start, err := d.seekTable.FrameStartDecomp(d.lowerFrame)
+	if err != nil {
+		return 0, err
+	}
+	end, err := d.seekTable.FrameEndDecomp(d.upperFrame)
+	if err != nil {
+		return 0, err
+	}
+	offset := uint64(off)
+	if offset < start {
+		return 0, fmt.Errorf("%s: offset %d is before frame %d", ErrInvalidFrameRange, offset, d.lowerFrame)
+	}
+	if offset >= end {
+		return 0, io.EOF
+	}
+
+	d.readAtMu.Lock()
+	defer d.readAtMu.Unlock()
+	if err := d.stopPrefetch(); err != nil {
+		return 0, err
+	}
+
+	pos, err := d.source.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	defer d.source.Seek(pos, io.SeekStart)
+
+	n := 0
+	first := d.findFrameAtOffset(offset)
+	for frame := first; n < len(p) && frame <= d.upperFrame; frame++ {
+		decompressed, err := d.decodeFrame(frame)
+		if err != nil {
+			return n, err
+		}
+		if d.options.VerifyOnSeek && frame == first {
+			if err := d.verifyFrames(frame, frame, decompressed); err != nil {
+				return n, err
+			}
+		}
+
+		frameStart, _ := d.seekTable.FrameStartDecomp(frame)
+		skip := offset + uint64(n) - frameStart
+		if skip > uint64(len(decompressed)) {
+			return n, fmt.Errorf("%s: frame %d", ErrFrameSizeMismatch, frame)
+		}
+		n += copy(p[n:], decompressed[skip:])
+	}
+
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// DecodeFrame returns the decompressed content of the frame at index,
+// whatever the decoder's frame range. Like ReadAt it does not move the Read
+// cursor, so it can be interleaved with Read, but must not run concurrently
+// with Read or Seek. It returns ErrFrameIndexTooLarge past the last frame.
+func (d *Decoder) DecodeFrame(index uint32) ([]byte, error) {
+	if d.linear {
+		return nil, errors.New(ErrNotSeekable)
+	}
+	if index >= d.seekTable.NumFrames() {
+		return nil, fmt.Errorf("%s: %d", ErrFrameIndexTooLarge, index)
+	}
+
+	d.readAtMu.Lock()
+	defer d.readAtMu.Unlock()
+	if err := d.stopPrefetch(); err != nil {
+		return nil, err
+	}
+
+	pos, err := d.source.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	defer d.source.Seek(pos, io.SeekStart)
+
+	decompressed, err := d.decodeFrame(index)
+	if err != nil {
+		return nil, err
+	}
+	if d.options.VerifyOnSeek {
+		if err := d.verifyFrames(index, index, decompressed); err != nil {
+			return nil, err
+		}
+	}
+	if d.cache != nil {
+		// The frame cache keeps its own copy
+		return bytes.Clone(decompressed), nil
+	}
+	return decompressed, nil
+}
+
+// DecodeFrames decodes the frames at indices, each independently as by
+// DecodeFrame, and returns their content in the order requested, for
+// example to sample a large archive. Indices may be in any order and may
+// repeat. They are all checked first, so an index past the last frame fails
+// with ErrFrameIndexTooLarge before any frame is decoded.
+func (d *Decoder) DecodeFrames(indices []uint32) ([][]byte, error) {
+	if d.linear {
+		return nil, errors.New(ErrNotSeekable)
+	}
+	for _, index := range indices {
+		if index >= d.seekTable.NumFrames() {
+			return nil, fmt.Errorf("%s: %d", ErrFrameIndexTooLarge, index)
+		}
+	}
+
+	frames := make([][]byte, len(indices))
+	for i, index := range indices {
+		frame, err := d.DecodeFrame(index)
+		if err != nil {
+			return nil, err
+		}
+		frames[i] = frame
+	}
+	return frames, nil
+}
+
+// CompressedOffsetFor maps a decompressed offset to the frame containing it
+// and that frame's compressed byte range [compStart, compEnd) in the source,
+// so a caller can fetch just those bytes, for example with an HTTP Range
+// request, before decoding. Offsets in an archive with a Head format seek
+// table include the table. It returns ErrFrameIndexTooLarge for an offset
+// at or past the end of the content.
+func (d *Decoder) CompressedOffsetFor(decompOffset uint64) (compStart, compEnd uint64, frame uint32, err error) {
+	if d.linear {
+		return 0, 0, 0, errors.New(ErrNotSeekable)
+	}
+	frame, err = d.seekTable.FrameAtDecompOffset(decompOffset)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	var base uint64
+	if src, ok := d.source.(*offsetSource); ok {
+		base = uint64(src.base)
+	}
+	compStart, _ = d.seekTable.FrameStartComp(frame)
+	compEnd, _ = d.seekTable.FrameEndComp(frame)
+	return base + compStart, base + compEnd, frame, nil
+}
+
+// SeekTable returns the decoder's seek table
+func (d *Decoder) SeekTable() *SeekTable {
+	return d.seekTable
+}
+
+// SetLowerFrame sets the lower frame boundary
+func (d *Decoder) SetLowerFrame(frame uint32) {
+	d.stopPrefetch()
+	d.lowerFrame = frame
+	if d.currentFrame < frame {
+		d.currentFrame = frame
+	}
+}
+
+// SetUpperFrame sets the upper frame boundary
+func (d *Decoder) SetUpperFrame(frame uint32) {
+	d.stopPrefetch()
+	d.upperFrame = frame
+	if d.upperFrame >= d.seekTable.NumFrames() {
+		d.upperFrame = lastFrameIndex(d.seekTable)
+	}
+}
+
+// ReadFiltered decodes the frames within the decoder's frame range for which
+// keep returns true and writes their concatenated output to w. Frames that are
+// not kept are skipped without being read or decoded. The decoder's Read
+// position is left unchanged.
+func (d *Decoder) ReadFiltered(w io.Writer, keep func(index uint32) bool) error {
+	if err := d.stopPrefetch(); err != nil {
+		return err
+	}
+	pos, err := d.source.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	defer d.source.Seek(pos, io.SeekStart)
+
+	for i := d.lowerFrame; i <= d.upperFrame && i < d.seekTable.NumFrames(); i++ {
+		if !keep(i) {
+			continue
+		}
+
+		decompressed, err := d.decodeFrame(i)
+		if err != nil {
+			return err
+		}
+
+		if _, err := w.Write(decompressed); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// FrameIterator walks the frames of a decoder's frame range one at a time.
+// It is created by Decoder.Frames.
+type FrameIterator struct {
+	d     *Decoder
+	next  uint32
+	index uint32
+	bytes []byte
+	err   error
+}
+
+// Frames returns an iterator over the frames within the decoder's frame
+// range. Iterating does not move the decoder's Read position.
+func (d *Decoder) Frames() *FrameIterator {
+	return &FrameIterator{d: d, next: d.lowerFrame}
+}
+
+// Next decompresses the next frame, returning false when the range is
+// exhausted or an error occurs
+func (it *FrameIterator) Next() bool {
+	d := it.d
+	if it.err != nil || it.next > d.upperFrame || it.next >= d.seekTable.NumFrames() {
+		return false
+	}
+	if err := d.stopPrefetch(); err != nil {
+		it.err = err
+		return false
+	}
+
+	pos, err := d.source.Seek(0, io.SeekCurrent)
+	if err != nil {
+		it.err = err
+		return false
+	}
+	defer d.source.Seek(pos, io.SeekStart)
+
+	decompressed, err := d.decodeFrame(it.next)
+	if err != nil {
+		it.err = err
+		return false
+	}
+
+	it.index = it.next
+	it.bytes = decompressed
+	it.next++
+	return true
+}
+
+// Err returns the error that stopped the iteration, if any
+func (it *FrameIterator) Err() error {
+	return it.err
+}
+
+// Index returns the index of the current frame
+func (it *FrameIterator) Index() uint32 {
+	return it.index
+}
+
+// Bytes returns the decompressed content of the current frame
+func (it *FrameIterator) Bytes() []byte {
+	return it.bytes
+}
+
+// StartDecomp returns the decompressed offset of the current frame's start
+func (it *FrameIterator) StartDecomp() uint64 {
+	offset, _ := it.d.seekTable.FrameStartDecomp(it.index)
+	return offset
+}
+
+// EndDecomp returns the decompressed offset of the current frame's end
+func (it *FrameIterator) EndDecomp() uint64 {
+	offset, _ := it.d.seekTable.FrameEndDecomp(it.index)
+	return offset
+}
+
+// skipSkippableFrames returns data past any skippable frames at its start
+func skipSkippableFrames(data []byte) []byte {
+	for len(data) >= SKIPPABLE_HEADER_SIZE &&
+		binary.LittleEndian.Uint32(data)&skippableMagicMask == skippableMagicBase {
+		size := uint64(binary.LittleEndian.Uint32(data[4:8]))
+		if SKIPPABLE_HEADER_SIZE+size > uint64(len(data)) {
+			break
+		}
+		data = data[SKIPPABLE_HEADER_SIZE+size:]
+	}
+	return data
+}
+
+// DecodeByScanning recovers the content of an archive whose seek table is
+// damaged, for example when only the footer's frame count survives. It
+// ignores the seek table and decodes the zstd frames in r in order, skipping
+// skippable frames, until expectedFrames frames have been decoded or the
+// input ends. On failure it returns the content decoded so far along with
+// the error, as a best-effort result.
+func DecodeByScanning(r io.Reader, expectedFrames uint32) ([]byte, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	decoder, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	defer decoder.Close()
+
+	var out []byte
+	var frames uint32
+	for pos := 0; frames < expectedFrames && pos+4 <= len(data); {
+		magic := binary.LittleEndian.Uint32(data[pos:])
+		if magic&skippableMagicMask == skippableMagicBase {
+			if pos+SKIPPABLE_HEADER_SIZE > len(data) {
+				break
+			}
+			pos += SKIPPABLE_HEADER_SIZE + int(binary.LittleEndian.Uint32(data[pos+4:]))
+			continue
+		}
+
+		n, err := zstdFrameLength(data[pos:])
+		if err != nil {
+			return out, fmt.Errorf("frame %d at offset %d: %w", frames, pos, err)
+		}
+		if out, err = decoder.DecodeAll(data[pos:pos+n], out); err != nil {
+			return out, fmt.Errorf("frame %d at offset %d: %w", frames, pos, err)
+		}
+		frames++
+		pos += n
+	}
+
+	if frames < expectedFrames {
+		return out, fmt.Errorf("found %d of %d frames", frames, expectedFrames)
+	}
+	return out, nil
+}
+
+const (
+	zstdFrameMagic     = 0xFD2FB528
+	skippableMagicBase = 0x184D2A50
+	skippableMagicMask = 0xFFFFFFF0
+)
+
+// zstdFrameLength returns the length of the zstd frame at the start of data
+// by walking its header and block headers, without decompressing it
+func zstdFrameLength(data []byte) (int, error) {
+	if len(data) < 5 || binary.LittleEndian.Uint32(data) != zstdFrameMagic {
+		return 0, errors.New(ErrInvalidMagic)
+	}
+
+	descriptor := data[4]
+	singleSegment := descriptor&(1<<5) != 0
+	pos := 5
+	if !singleSegment {
+		pos++ // window descriptor
+	}
+	pos += []int{0, 1, 2, 4}[descriptor&3] // dictionary ID
+	switch fcsFlag := descriptor >> 6; {
+	case fcsFlag == 0 && singleSegment:
+		pos++
+	case fcsFlag > 0:
+		pos += 1 << fcsFlag
+	}
+
+	for {
+		if pos+3 > len(data) {
+			return 0, io.ErrUnexpectedEOF
+		}
+		header := uint32(data[pos]) | uint32(data[pos+1])<<8 | uint32(data[pos+2])<<16
+		pos += 3
+
+		last := header&1 != 0
+		size := int(header >> 3)
+		switch (header >> 1) & 3 {
+		case 1: // RLE block stores a single byte
+			pos++
+		case 3:
+			return 0, errors.New("reserved block type")
+		default:
+			pos += size
+		}
+		if last {
+			break
+		}
+	}
+
+	if descriptor&(1<<2) != 0 {
+		pos += 4 // content checksum
+	}
+	if pos > len(data) {
+		return 0, io.ErrUnexpectedEOF
+	}
+	return pos, nil
+}
+
+// TestIntegrity decodes every frame of the archive one at a time, discarding
+// the output, and returns the index of the first frame that fails to decode
+// or whose size disagrees with the seek table. If the archive stores a
+// StreamChecksum, the whole content is then checked against it, returning
+// NumFrames() and ErrStreamChecksum on a mismatch. On success it returns
+// NumFrames() and a nil error. Buffers are reused between frames, so memory
+// use is bounded by the largest frame rather than the archive.
+func (d *Decoder) TestIntegrity() (uint32, error) {
+	if d.linear {
+		return 0, errors.New(ErrNotSeekable)
+	}
+	stored, hasStored, err := d.StreamChecksum()
+	if err != nil {
+		return 0, err
+	}
+	var streamHash *xxh64
+	if hasStored {
+		streamHash = newXXH64()
+	}
+	if err := d.stopPrefetch(); err != nil {
+		return 0, err
+	}
+	pos, err := d.source.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	defer d.source.Seek(pos, io.SeekStart)
+
+	var compressed, decompressed []byte
+	for i := uint32(0); i < d.seekTable.NumFrames(); i++ {
+		if err := d.checkBuffer(i); err != nil {
+			return i, err
+		}
+		compressed, err = d.readFrameInto(i, compressed)
+		if err != nil {
+			return i, err
+		}
+
+		decompressed, err = d.decoder.DecodeAll(compressed, decompressed[:0])
+		if err != nil {
+			return i, d.windowError(err)
+		}
+
+		expected, _ := d.seekTable.FrameSizeDecomp(i)
+		if uint64(len(decompressed)) != expected {
+			return i, fmt.Errorf("%s: got %d bytes, expected %d", ErrFrameSizeMismatch, len(decompressed), expected)
+		}
+		if err := d.verifyFrames(i, i, decompressed); err != nil {
+			return i, err
+		}
+		if streamHash != nil {
+			streamHash.Write(decompressed)
+		}
+	}
+
+	if streamHash != nil && streamHash.Sum64() != stored {
+		return d.seekTable.NumFrames(), fmt.Errorf("%s: got %016x, expected %016x",
+			ErrStreamChecksum, streamHash.Sum64(), stored)
+	}
+	return d.seekTable.NumFrames(), nil
+}
+
+// ExtractFrames decodes each frame in [lo, hi] of the archive in src and
+// writes it to the writer returned by open for that frame index. This is the
+// library counterpart of splitting a frame range into separate outputs.
+func ExtractFrames(src io.ReadSeeker, lo, hi uint32, open func(index uint32) (io.Writer, error)) error {
+	d, err := NewDecoder(src, nil)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	if lo > hi {
+		return fmt.Errorf("%s: lower frame %d is after upper frame %d", ErrInvalidFrameRange, lo, hi)
+	}
+	if hi >= d.seekTable.NumFrames() {
+		return fmt.Errorf("%s: %d", ErrFrameIndexTooLarge, hi)
+	}
+
+	for i := lo; i <= hi; i++ {
+		decompressed, err := d.decodeFrame(i)
+		if err != nil {
+			return err
+		}
+
+		w, err := open(i)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(decompressed); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// MismatchError is returned by EqualDecompressed when two archives
+// decompress to different content.
+type MismatchError struct {
+	// Offset is the decompressed offset of the first differing byte, or the
+	// length of the shorter content when one is a prefix of the other
+	Offset uint64
+}
+
+func (e *MismatchError) Error() string {
+	return fmt.Sprintf("%s at offset %d", ErrContentMismatch, e.Offset)
+}
+
+// EqualDecompressed reports whether two archives decompress to the same bytes.
+// Both archives are streamed in lockstep without materializing either one.
+// When the content differs it returns false along with a *MismatchError
+// reporting the offset of the first differing byte.
+func EqualDecompressed(a, b io.ReadSeeker) (bool, error) {
+	da, err := NewDecoder(a, nil)
+	if err != nil {
+		return false, err
+	}
+	defer da.Close()
+	db, err := NewDecoder(b, nil)
+	if err != nil {
+		return false, err
+	}
+	defer db.Close()
+
+	bufA := make([]byte, 32*1024)
+	bufB := make([]byte, 32*1024)
+	var offset uint64
+
+	for {
+		na, errA := io.ReadFull(da, bufA)
+		nb, errB := io.ReadFull(db, bufB)
+		if errA != nil && errA != io.EOF && errA != io.ErrUnexpectedEOF {
+			return false, errA
+		}
+		if errB != nil && errB != io.EOF && errB != io.ErrUnexpectedEOF {
+			return false, errB
+		}
+
+		n := na
+		if nb < n {
+			n = nb
+		}
+		for i := 0; i < n; i++ {
+			if bufA[i] != bufB[i] {
+				return false, &MismatchError{Offset: offset + uint64(i)}
+			}
+		}
+		if na != nb {
+			return false, &MismatchError{Offset: offset + uint64(n)}
+		}
+		offset += uint64(n)
+
+		if errA != nil || errB != nil {
+			return true, nil
+		}
+	}
+}
+
+// FindDuplicateFrames hashes the compressed bytes of every frame in the
+// archive in r and returns the groups of frames with identical content. Each
+// group is keyed by its lowest frame index and lists all of its members in
+// ascending order; frames without duplicates are omitted. Empty frames are
+// never reported, and skippable metadata logged as part of frame 0 is not
+// hashed. Frames are not decompressed.
+func FindDuplicateFrames(r io.ReadSeeker) (map[uint32][]uint32, error) {
+	seekTable, err := ReadSeekTable(r)
+	if err != nil {
+		// Fall back to a Head format table, as Reset does, reading the
+		// frames after it
+		head, size, headErr := readHeadSeekTable(r)
+		if headErr != nil {
+			return nil, err
+		}
+		seekTable = head
+		r = &offsetSource{Seekable: r, base: int64(size)}
+	}
+
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	firstByHash := make(map[[sha256.Size]byte]uint32)
+	groups := make(map[uint32][]uint32)
+
+	for i := uint32(0); i < seekTable.NumFrames(); i++ {
+		size, _ := seekTable.FrameSizeComp(i)
+		compressedData := make([]byte, size)
+		if _, err := io.ReadFull(r, compressedData); err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			compressedData = skipSkippableFrames(compressedData)
+		}
+		if dSize, _ := seekTable.FrameSizeDecomp(i); dSize == 0 || len(compressedData) == 0 {
+			continue
+		}
+
+		sum := sha256.Sum256(compressedData)
+		first, seen := firstByHash[sum]
+		if !seen {
+			firstByHash[sum] = i
+			continue
+		}
+		if len(groups[first]) == 0 {
+			groups[first] = []uint32{first}
+		}
+		groups[first] = append(groups[first], i)
+	}
+
+	return groups, nil
+}
+
+// decodeFrame reads and decompresses the frame at index
+func (d *Decoder) decodeFrame(index uint32) ([]byte, error) {
+	if cached, ok := d.cache.get(index); ok {
+		return cached, nil
+	}
+	if err := d.checkBuffer(index); err != nil {
+		return nil, err
+	}
+
+	compressedData, err := d.readFrame(index)
+	if err != nil {
+		return nil, err
+	}
+	decompressed, err := d.decoder.DecodeAll(compressedData, nil)
+	if err != nil {
+		return nil, d.windowError(err)
+	}
+	if !d.options.VerifyOnSeek {
+		if err := d.verifyFrames(index, index, decompressed); err != nil {
+			return nil, err
+		}
+	}
+	d.cache.add(index, decompressed)
+	return decompressed, nil
+}
+
+// verifyRead checks the frames first to last decompressed by Read against
+// their checksums: all of them, or with VerifyOnSeek only the frame the last
+// Seek landed on
+func (d *Decoder) verifyRead(first, last uint32, decompressed []byte) error {
+	if !d.options.VerifyOnSeek {
+		return d.verifyFrames(first, last, decompressed)
+	}
+	if !d.verifySeek || d.seekFrame < first || d.seekFrame > last {
+		return nil
+	}
+	d.verifySeek = false
+
+	start, _ := d.seekTable.FrameStartDecomp(first)
+	frameStart, _ := d.seekTable.FrameStartDecomp(d.seekFrame)
+	if frameStart-start > uint64(len(decompressed)) {
+		return fmt.Errorf("%s: frame %d", ErrFrameSizeMismatch, d.seekFrame)
+	}
+	return d.verifyFrames(d.seekFrame, d.seekFrame, decompressed[frameStart-start:])
+}
+
+// verifyFrames checks the decompressed content of frames first to last
+// against their seek table checksums, if the seek table has any
+func (d *Decoder) verifyFrames(first, last uint32, decompressed []byte) error {
+	if !d.seekTable.HasChecksums() {
+		return nil
+	}
+	for i := first; i <= last; i++ {
+		size, err := d.seekTable.FrameSizeDecomp(i)
+		if err != nil {
+			return err
+		}
+		if uint64(len(decompressed)) < size {
+			return fmt.Errorf("%s: frame %d", ErrFrameSizeMismatch, i)
+		}
+		expected, _ := d.seekTable.FrameChecksum(i)
+		if frameChecksum(decompressed[:size]) != expected {
+			return fmt.Errorf("%s: frame %d", ErrChecksumMismatch, i)
+		}
+		decompressed = decompressed[size:]
+	}
+	return nil
+}
+
+// exceedsBuffer reports whether size decompressed bytes are more than
+// MaxBufferBytes allows holding at once
+func (d *Decoder) exceedsBuffer(size uint64) bool {
+	return d.options.MaxBufferBytes > 0 && size > uint64(d.options.MaxBufferBytes)
+}
+
+// checkBuffer returns ErrBufferLimit if the frame at index is too large to
+// decompress in one piece under MaxBufferBytes
+func (d *Decoder) checkBuffer(index uint32) error {
+	if size, _ := d.seekTable.FrameSizeDecomp(index); d.exceedsBuffer(size) {
+		return fmt.Errorf("%s: frame %d decompresses to %d bytes, limit %d",
+			ErrBufferLimit, index, size, d.options.MaxBufferBytes)
+	}
+	return nil
+}
+
+// readFrame reads the compressed bytes of the frame at index from the source
+func (d *Decoder) readFrame(index uint32) ([]byte, error) {
+	return d.readFrameInto(index, nil)
+}
+
+// readFrameInto is readFrame reusing buf for the compressed bytes when it is
+// large enough
+func (d *Decoder) readFrameInto(index uint32, buf []byte) ([]byte, error) {
+	start, err := d.seekTable.FrameStartComp(index)
+	if err != nil {
+		return nil, err
+	}
+	size, err := d.seekTable.FrameSizeComp(index)
+	if err != nil {
+		return nil, err
+	}
+
+	if d.data != nil {
+		return d.sliceData(start, size)
+	}
+
+	if _, err := d.source.Seek(int64(start), io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	compressedData := buf[:0]
+	if uint64(cap(compressedData)) < size {
+		compressedData = make([]byte, size)
+	}
+	compressedData = compressedData[:size]
+	if _, err := io.ReadFull(d.source, compressedData); err != nil {
+		return nil, err
+	}
+
+	return compressedData, nil
+}
+
+// sliceData returns size bytes of the in-memory archive starting at start
+func (d *Decoder) sliceData(start, size uint64) ([]byte, error) {
+	if start+size > uint64(len(d.data)) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return d.data[start : start+size : start+size], nil
+}
+
+// decodeInto decompresses the next frame, or run of small frames, for Read.
+// When the first frame fits in p it is decoded straight into p, skipping the
+// copy through d.decompressed; otherwise it is decoded into the reused
+// d.frameData. Whatever does not fit in p is kept in d.decompressed. It
+// returns the number of bytes of p filled, which is 0 when the frames are
+// streamed.
+func (d *Decoder) decodeInto(p []byte, prefix []byte) (int, error) {
+	dst := d.frameData[:0]
+	if size, err := d.seekTable.FrameSizeDecomp(d.currentFrame); err == nil && size <= uint64(len(p)) {
+		dst = p[:0:len(p)]
+	}
+	decompressed, err := d.decodeNextFrames(prefix, dst)
+	if err != nil || len(decompressed) == 0 {
+		return 0, err
+	}
+	if &decompressed[0] == &p[0] {
+		return len(decompressed), nil
+	}
+
+	n := copy(p, decompressed)
+	d.decompressed.Write(decompressed[n:])
+	d.frameData = decompressed
+	return n, nil
+}
+
+// decodeNextFrames decompresses the next frame, or run of small frames, and
+// returns its content appended to dst. Frames that are streamed instead set
+// up d.stream and return no content.
+func (d *Decoder) decodeNextFrames(prefix []byte, dst []byte) ([]byte, error) {
+	if job := d.prefetched; job != nil && prefix == nil {
+		d.prefetched = nil
+		<-job.done
+		if job.err != nil {
+			return nil, d.windowError(job.err)
+		}
+		return d.framesDecoded(job.last, job.decompressed)
+	}
+	if err := d.stopPrefetch(); err != nil {
+		return nil, err
+	}
+
+	if d.currentFrame > d.upperFrame || d.currentFrame >= d.seekTable.NumFrames() {
+		return nil, io.EOF
+	}
+
+	lastFrame, frameSize, stream := d.nextRun(prefix != nil)
+	if stream {
+		decompSize, _ := d.seekTable.FrameSizeDecomp(d.currentFrame)
+		d.debug("streaming frames", "first", d.currentFrame, "last", lastFrame,
+			"compressed", frameSize, "decompressed", decompSize)
+		return nil, d.startStream(frameSize, lastFrame)
+	}
+	if lastFrame > d.currentFrame {
+		d.debug("batching small frames", "first", d.currentFrame, "last", lastFrame, "compressed", frameSize)
+	}
+	if err := d.checkBuffer(d.currentFrame); err != nil {
+		return nil, err
+	}
+	if prefix == nil {
+		if cached, ok := d.cache.get(d.currentFrame); ok {
+			return d.cachedFrame(cached, dst)
+		}
+	}
+
+	// Read compressed frame
+	compressedData, err := d.readRun(d.currentFrame, frameSize)
+	if err != nil {
+		return nil, err
+	}
+
+	// Decompress frame
+	decoder := d.decoder
+	if prefix != nil {
+		d.debug("decoding with prefix", "frame", d.currentFrame, "prefix", len(prefix))
+		if decoder, err = d.decoderForPrefix(prefix); err != nil {
+			return nil, err
+		}
+	}
+	decompressed, err := decoder.DecodeAll(compressedData, dst)
+	if err != nil {
+		return nil, d.windowError(err)
+	}
+	return d.framesDecoded(lastFrame, decompressed)
+}
+
+// decoderForPrefix returns a zstd decoder that uses prefix as the raw
+// content dictionary of frames without a dictionary ID
+func (d *Decoder) decoderForPrefix(prefix []byte) (*zstd.Decoder, error) {
+	if d.prefixDecoder != nil && bytes.Equal(d.prefix, prefix) {
+		return d.prefixDecoder, nil
+	}
+
+	prefix = append([]byte(nil), prefix...)
+	opts := append(d.decoderOpts[:len(d.decoderOpts):len(d.decoderOpts)], zstd.WithDecoderDictRaw(0, prefix))
+	decoder, err := zstd.NewReader(nil, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if d.prefixDecoder != nil {
+		d.prefixDecoder.Close()
+	}
+	d.prefixDecoder = decoder
+	d.prefix = prefix
+	return decoder, nil
+}
+
+// nextRun returns the last frame and compressed size of the run of frames
+// to decode next, and whether it is streamed rather than decoded at once
+func (d *Decoder) nextRun(withPrefix bool) (lastFrame uint32, size uint64, stream bool) {
+	lastFrame = d.currentFrame
+	size, _ = d.seekTable.FrameSizeComp(d.currentFrame)
+
+	// Runs of tiny frames are read and decoded together, since concatenated
+	// zstd frames decode sequentially, to amortize the per-call overhead
+	if !withPrefix && d.cache == nil {
+		lastFrame = d.smallFrameRunEnd()
+		start, _ := d.seekTable.FrameStartComp(d.currentFrame)
+		end, _ := d.seekTable.FrameEndComp(lastFrame)
+		size = end - start
+	}
+
+	// Large frames, and frames bigger than MaxCompressedReadSize, are
+	// streamed rather than read and decompressed in one piece
+	decompSize, _ := d.seekTable.FrameSizeDecomp(d.currentFrame)
+	max := d.options.MaxCompressedReadSize
+	stream = !withPrefix && (d.streamRuns || decompSize > streamFrameSize || max > 0 && size > uint64(max) ||
+		d.exceedsBuffer(decompSize))
+	return lastFrame, size, stream
+}
+
+// readRun reads size compressed bytes starting at frame first, which the
+// source must be positioned at
+func (d *Decoder) readRun(first uint32, size uint64) ([]byte, error) {
+	if d.data != nil {
+		start, _ := d.seekTable.FrameStartComp(first)
+		return d.sliceData(start, size)
+	}
+	compressed := make([]byte, size)
+	if _, err := io.ReadFull(d.source, compressed); err != nil {
+		return nil, err
+	}
+	return compressed, nil
+}
+
+// framesDecoded verifies and caches the decompressed frames from the
+// current frame to lastFrame, moves past them and starts prefetching the
+// next run
+func (d *Decoder) framesDecoded(lastFrame uint32, decompressed []byte) ([]byte, error) {
+	if err := d.verifyRead(d.currentFrame, lastFrame, decompressed); err != nil {
+		return nil, err
+	}
+	if d.cache != nil {
+		// Cached frames are shared, so keep a copy the caller cannot reuse
+		d.cache.add(d.currentFrame, append([]byte(nil), decompressed...))
+	}
+
+	d.advanceFrames(lastFrame)
+	d.startPrefetch()
+	return decompressed, nil
+}
+
+// prefetchJob is a run of frames being read and decompressed ahead of Read
+type prefetchJob struct {
+	first, last  uint32
+	decompressed []byte
+	err          error
+	done         chan struct{}
+}
+
+// startPrefetch starts reading and decompressing the next run of frames in
+// the background when Prefetch is set. Streamed and cached frames are not
+// prefetched.
+func (d *Decoder) startPrefetch() {
+	if !d.options.Prefetch || d.currentFrame > d.upperFrame || d.currentFrame >= d.seekTable.NumFrames() {
+		return
+	}
+	lastFrame, size, stream := d.nextRun(false)
+	if stream {
+		return
+	}
+	if _, ok := d.cache.get(d.currentFrame); ok {
+		return
+	}
+
+	job := &prefetchJob{first: d.currentFrame, last: lastFrame, done: make(chan struct{})}
+	d.prefetched = job
+	go func() {
+		defer close(job.done)
+		compressed, err := d.readRun(job.first, size)
+		if err != nil {
+			job.err = err
+			return
+		}
+		job.decompressed, job.err = d.decoder.DecodeAll(compressed, nil)
+	}()
+}
+
+// stopPrefetch waits for any prefetch in progress, discards it and moves the
+// source back to where the prefetched frames start, so the source can be
+// used again
+func (d *Decoder) stopPrefetch() error {
+	job := d.prefetched
+	if job == nil {
+		return nil
+	}
+	d.prefetched = nil
+	<-job.done
+
+	if d.data != nil {
+		return nil
+	}
+	start, _ := d.seekTable.FrameStartComp(job.first)
+	_, err := d.source.Seek(int64(start), io.SeekStart)
+	return err
+}
+
+// cachedFrame returns the current frame from the cache, appended to dst, and
+// moves past it in the source as if it had been read. Frames are verified
+// before they are cached, except with VerifyOnSeek, where a Seek landing on a
+// cached frame still has it verified.
+func (d *Decoder) cachedFrame(cached []byte, dst []byte) ([]byte, error) {
+	if d.options.VerifyOnSeek {
+		if err := d.verifyRead(d.currentFrame, d.currentFrame, cached); err != nil {
+			return nil, err
+		}
+	}
+	if d.data == nil {
+		end, _ := d.seekTable.FrameEndComp(d.currentFrame)
+		if _, err := d.source.Seek(int64(end), io.SeekStart); err != nil {
+			return nil, err
+		}
+	}
+	d.advanceFrames(d.currentFrame)
+	d.startPrefetch()
+	return append(dst, cached...), nil
+}
+
+// advanceFrames moves past the frames up to lastFrame once they have been
+// decompressed
+func (d *Decoder) advanceFrames(lastFrame uint32) {
+	for ; d.currentFrame <= lastFrame; d.currentFrame++ {
+		end, _ := d.seekTable.FrameEndDecomp(d.currentFrame)
+		d.debug("frame decoded", "frame", d.currentFrame, "end", end)
+		if d.options.OnFrame != nil {
+			d.options.OnFrame(d.currentFrame, end)
+		}
+	}
+}
+
+// windowError explains a frame rejected for needing a larger window than
+// MaxWindowLog allows, which happens when the archive was compressed with a
+// larger EncoderOptions.WindowLog
+func (d *Decoder) windowError(err error) error {
+	if !errors.Is(err, zstd.ErrWindowSizeExceeded) {
+		return err
+	}
+	return fmt.Errorf("%s %d, it must be at least the encoder's WindowLog: %w", ErrWindowExceeded, d.options.MaxWindowLog, err)
+}
+
+// checkContext returns ErrCanceled once the decoder's context is done
+func (d *Decoder) checkContext() error {
+	if d.ctx == nil || d.ctx.Err() == nil {
+		return nil
+	}
+	return fmt.Errorf("%s: %w", ErrCanceled, d.ctx.Err())
+}
+
+// debug logs a diagnostic message to the configured Logger, if any
+func (d *Decoder) debug(msg string, args ...any) {
+	if d.options.Logger != nil {
+		d.options.Logger.Debug(msg, args...)
+	}
+}
+
+// startStream sets up Read to stream the next size compressed bytes, which
+// hold the frames up to lastFrame, through the streaming decoder. Reads of
+// the source are limited to MaxCompressedReadSize bytes when it is set.
+func (d *Decoder) startStream(size uint64, lastFrame uint32) error {
+	if d.streamDecoder == nil {
+		decoder, err := zstd.NewReader(nil, d.decoderOpts...)
+		if err != nil {
+			return err
+		}
+		d.streamDecoder = decoder
+	}
+
+	var compressed io.Reader
+	switch {
+	case d.data != nil:
+		start, _ := d.seekTable.FrameStartComp(d.currentFrame)
+		data, err := d.sliceData(start, size)
+		if err != nil {
+			return err
+		}
+		compressed = bytes.NewReader(data)
+	case d.options.MaxCompressedReadSize > 0:
+		compressed = &chunkReader{r: d.source, n: int64(size), size: d.options.MaxCompressedReadSize}
+	default:
+		compressed = &io.LimitedReader{R: d.source, N: int64(size)}
+	}
+
+	if err := d.streamDecoder.Reset(compressed); err != nil {
+		return err
+	}
+	d.stream = d.streamDecoder
+	if d.seekTable.HasChecksums() {
+		size, _ := d.seekTable.FrameSizeDecomp(d.currentFrame)
+		verify := &checksumReader{
+			r:         d.streamDecoder,
+			seekTable: d.seekTable,
+			frame:     d.currentFrame,
+			last:      lastFrame,
+			remaining: size,
+			hash:      newXXH64(),
+		}
+		if d.options.VerifyOnSeek {
+			verify.only, verify.onlyOne = d.seekFrame, true
+			if !d.verifySeek || d.seekFrame < d.currentFrame || d.seekFrame > lastFrame {
+				verify = nil
+			}
+			d.verifySeek = false
+		}
+		if verify != nil {
+			d.stream = verify
+		}
+	}
+	d.streamLast = lastFrame
+	return nil
+}
+
+// checksumReader passes through the decompressed content of frames up to
+// last, checking each frame against its seek table checksum as it ends
+type checksumReader struct {
+	r         io.Reader
+	seekTable *SeekTable
+	frame     uint32
+	last      uint32
+	remaining uint64 // bytes left in the current frame
+	hash      *xxh64
+	only      uint32 // the single frame to verify, when onlyOne is set
+	onlyOne   bool
+}
+
+func (c *checksumReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	for b := p[:n]; ; {
+		for c.remaining == 0 && c.frame <= c.last {
+			if err := c.endFrame(); err != nil {
+				return n, err
+			}
+		}
+		if len(b) == 0 || c.frame > c.last {
+			break
+		}
+		k := min(uint64(len(b)), c.remaining)
+		c.hash.Write(b[:k])
+		c.remaining -= k
+		b = b[k:]
+	}
+	if err == io.EOF && c.frame <= c.last {
+		return n, fmt.Errorf("%s: frame %d", ErrFrameSizeMismatch, c.frame)
+	}
+	return n, err
+}
+
+// endFrame verifies the frame that was just read and moves to the next one
+func (c *checksumReader) endFrame() error {
+	expected, _ := c.seekTable.FrameChecksum(c.frame)
+	if (!c.onlyOne || c.frame == c.only) && uint32(c.hash.Sum64()) != expected {
+		return fmt.Errorf("%s: frame %d", ErrChecksumMismatch, c.frame)
+	}
+	c.frame++
+	c.hash.Reset()
+	if c.frame <= c.last {
+		c.remaining, _ = c.seekTable.FrameSizeDecomp(c.frame)
+	}
+	return nil
+}
+
+// chunkReader reads at most n bytes from r, at most size bytes per Read
+type chunkReader struct {
+	r    io.Reader
+	n    int64
+	size int
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	if c.n <= 0 {
+		return 0, io.EOF
+	}
+	if len(p) > c.size {
+		p = p[:c.size]
+	}
+	if int64(len(p)) > c.n {
+		p = p[:c.n]
+	}
+	n, err := c.r.Read(p)
+	c.n -= int64(n)
+	return n, err
+}
+
+// smallFrameRunEnd returns the last frame of the run of tiny frames starting
+// at the current frame that can be decoded in one batch. It returns the
+// current frame itself when that frame is not small enough to batch.
+func (d *Decoder) smallFrameRunEnd() uint32 {
+	last := d.currentFrame
+	var compTotal, decompTotal uint64
+
+	for i := d.currentFrame; i <= d.upperFrame && i < d.seekTable.NumFrames(); i++ {
+		compSize, _ := d.seekTable.FrameSizeComp(i)
+		decompSize, _ := d.seekTable.FrameSizeDecomp(i)
+		if compSize > smallFrameSize || compTotal+compSize > uint64(d.batchLimit) ||
+			decompTotal+decompSize > maxBatchDecompressed || i > d.currentFrame && d.exceedsBuffer(decompTotal+decompSize) {
+			break
+		}
+		compTotal += compSize
+		decompTotal += decompSize
+		last = i
+	}
+
+	return last
+}
+
+// findFrameAtOffset returns the frame containing the decompressed offset,
+// or the last frame when offset is past the end
+func (d *Decoder) findFrameAtOffset(offset uint64) uint32 {
+	frame, err := d.seekTable.FrameAtDecompOffset(offset)
+	if err != nil {
+		return lastFrameIndex(d.seekTable)
+	}
+	return frame
+}
+
+// lastFrameIndex returns the index of the last frame in st, or 0 when it has
+// no frames, so frame ranges over an empty archive do not wrap around
+func lastFrameIndex(st *SeekTable) uint32 {
+	return max(st.NumFrames(), 1) - 1
+}
+
+// frameCache is an LRU cache of decompressed frames keyed by frame index. A
+// nil cache holds nothing.
+type frameCache struct {
+	size   int
+	order  *list.List // most recently used first, values are *cacheEntry
+	frames map[uint32]*list.Element
+}
+
+type cacheEntry struct {
+	index uint32
+	data  []byte
+}
+
+func newFrameCache(size int) *frameCache {
+	return &frameCache{
+		size:   size,
+		order:  list.New(),
+		frames: make(map[uint32]*list.Element),
+	}
+}
+
+// get returns a cached frame and marks it as recently used
+func (c *frameCache) get(index uint32) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	e, ok := c.frames[index]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*cacheEntry).data, true
+}
+
+// add caches a frame, evicting the least recently used one when full
+func (c *frameCache) add(index uint32, data []byte) {
+	if c == nil {
+		return
+	}
+	if e, ok := c.frames[index]; ok {
+		e.Value.(*cacheEntry).data = data
+		c.order.MoveToFront(e)
+		return
+	}
+	c.frames[index] = c.order.PushFront(&cacheEntry{index: index, data: data})
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.frames, oldest.Value.(*cacheEntry).index)
 	}
-	return high
-}
-
-func (d *Decoder) mustFrameEndDecomp(frame uint32) uint64 {
-	offset, _ := d.seekTable.FrameEndDecomp(frame)
-	return offset
 }
@@ -2,7 +2,18 @@ package gzstd
 
 import (
 	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
+	"log/slog"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/klauspost/compress/zstd"
@@ -257,3 +268,2483 @@ func TestDecoder_WithDictionary(t *testing.T) {
 	// Raw bytes cannot be used as dictionaries without proper training
 	t.Skip("Dictionary support requires properly formatted zstd dictionaries")
 }
+
+func TestDecoder_ReadFiltered(t *testing.T) {
+	frames := [][]byte{
+		[]byte("Frame 0"),
+		[]byte("Frame 1"),
+		[]byte("Frame 2"),
+		[]byte("Frame 3"),
+	}
+	archive := createTestArchive(t, frames)
+
+	decoder, err := NewDecoder(bytes.NewReader(archive.Bytes()), nil)
+	if err != nil {
+		t.Fatalf("NewDecoder failed: %v", err)
+	}
+
+	var visited []uint32
+	var result bytes.Buffer
+	err = decoder.ReadFiltered(&result, func(index uint32) bool {
+		visited = append(visited, index)
+		return index%2 == 0
+	})
+	if err != nil {
+		t.Fatalf("ReadFiltered failed: %v", err)
+	}
+
+	expected := "Frame 0Frame 2"
+	if result.String() != expected {
+		t.Errorf("Expected %q, got %q", expected, result.String())
+	}
+	if len(visited) != len(frames) {
+		t.Errorf("Expected keep to be called %d times, got %d", len(frames), len(visited))
+	}
+
+	// The sequential read position is unaffected
+	all, err := io.ReadAll(decoder)
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	if string(all) != "Frame 0Frame 1Frame 2Frame 3" {
+		t.Errorf("Unexpected sequential read %q", all)
+	}
+}
+
+func TestDecoder_SharedPrefix(t *testing.T) {
+	prefix := []byte(`{"service":"api","level":"info","region":"us-east-1","msg":"`)
+	var data []byte
+	for i := 0; i < 20; i++ {
+		data = append(data, prefix...)
+		data = append(data, fmt.Sprintf("request %d handled\"}\n", i)...)
+	}
+
+	var buf bytes.Buffer
+	encoder, err := NewEncoder(&buf, &EncoderOptions{
+		Level:        zstd.SpeedDefault,
+		FramePolicy:  UncompressedFrameSize{Size: 256},
+		PrefixWindow: prefix,
+	})
+	if err != nil {
+		t.Fatalf("NewEncoder failed: %v", err)
+	}
+	if _, err := encoder.Write(data); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if err := encoder.Finish(); err != nil {
+		t.Fatalf("Finish failed: %v", err)
+	}
+	if encoder.SeekTable().NumFrames() < 2 {
+		t.Fatalf("Expected multiple frames, got %d", encoder.SeekTable().NumFrames())
+	}
+
+	opts := DefaultDecoderOptions()
+	opts.PrefixWindow = prefix
+	decoder, err := NewDecoder(bytes.NewReader(buf.Bytes()), opts)
+	if err != nil {
+		t.Fatalf("NewDecoder failed: %v", err)
+	}
+
+	// Seek into a later frame so it is decoded without the earlier ones
+	if _, err := decoder.Seek(300, io.SeekStart); err != nil {
+		t.Fatalf("Seek failed: %v", err)
+	}
+	got, err := io.ReadAll(decoder)
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	if !bytes.Equal(got, data[300:]) {
+		t.Errorf("Decoded data mismatch")
+	}
+
+	// Without the prefix the frames cannot be decoded
+	decoder, err = NewDecoder(bytes.NewReader(buf.Bytes()), nil)
+	if err != nil {
+		t.Fatalf("NewDecoder failed: %v", err)
+	}
+	if got, err := io.ReadAll(decoder); err == nil && bytes.Equal(got, data) {
+		t.Error("Expected decoding without the prefix to fail")
+	}
+}
+
+func TestEqualDecompressed(t *testing.T) {
+	data := bytes.Repeat([]byte("seekable zstd "), 200)
+
+	encode := func(data []byte, frameSize uint32) []byte {
+		var buf bytes.Buffer
+		encoder, err := NewEncoder(&buf, &EncoderOptions{
+			Level:       zstd.SpeedDefault,
+			FramePolicy: UncompressedFrameSize{Size: frameSize},
+		})
+		if err != nil {
+			t.Fatalf("NewEncoder failed: %v", err)
+		}
+		if _, err := encoder.Write(data); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		if err := encoder.Finish(); err != nil {
+			t.Fatalf("Finish failed: %v", err)
+		}
+		return buf.Bytes()
+	}
+
+	original := encode(data, 500)
+
+	// Recompressed with different framing
+	recompressed := encode(data, 700)
+	equal, err := EqualDecompressed(bytes.NewReader(original), bytes.NewReader(recompressed))
+	if err != nil {
+		t.Fatalf("EqualDecompressed failed: %v", err)
+	}
+	if !equal {
+		t.Error("Expected recompressed archive to be equal")
+	}
+
+	// Corrupted content
+	corrupted := append([]byte(nil), data...)
+	corrupted[1234] ^= 0xFF
+	equal, err = EqualDecompressed(bytes.NewReader(original), bytes.NewReader(encode(corrupted, 500)))
+	if equal {
+		t.Error("Expected corrupted archive to differ")
+	}
+	var mismatch *MismatchError
+	if !errors.As(err, &mismatch) || mismatch.Offset != 1234 {
+		t.Errorf("Expected mismatch at offset 1234, got %v", err)
+	}
+	if err == nil || !strings.Contains(err.Error(), "offset 1234") {
+		t.Errorf("Expected the offset in the error, got %v", err)
+	}
+
+	// Truncated content differs where the shorter one ends
+	equal, err = EqualDecompressed(bytes.NewReader(original), bytes.NewReader(encode(data[:1000], 500)))
+	if equal {
+		t.Error("Expected truncated archive to differ")
+	}
+	if !errors.As(err, &mismatch) || mismatch.Offset != 1000 {
+		t.Errorf("Expected mismatch at offset 1000, got %v", err)
+	}
+}
+
+func TestDecoder_InvertedFrameRange(t *testing.T) {
+	archive := createTestArchive(t, [][]byte{
+		[]byte("Frame 0"),
+		[]byte("Frame 1"),
+		[]byte("Frame 2"),
+		[]byte("Frame 3"),
+	})
+
+	opts := DefaultDecoderOptions()
+	opts.LowerFrame = 3
+	opts.UpperFrame = 1
+
+	_, err := NewDecoder(bytes.NewReader(archive.Bytes()), opts)
+	if err == nil {
+		t.Fatal("Expected error for inverted frame range")
+	}
+	if !strings.HasPrefix(err.Error(), ErrInvalidFrameRange) {
+		t.Errorf("Expected %q error, got %q", ErrInvalidFrameRange, err)
+	}
+
+	// An unset upper frame means the last frame, so LowerFrame alone is valid
+	opts.UpperFrame = 0
+	decoder, err := NewDecoder(bytes.NewReader(archive.Bytes()), opts)
+	if err != nil {
+		t.Fatalf("NewDecoder failed: %v", err)
+	}
+	got, err := io.ReadAll(decoder)
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	if string(got) != "Frame 3" {
+		t.Errorf("Expected %q, got %q", "Frame 3", got)
+	}
+}
+
+func createTinyFrameArchive(tb testing.TB, numFrames int) ([]byte, []byte) {
+	var buf bytes.Buffer
+	encoder, err := NewEncoder(&buf, &EncoderOptions{
+		Level:       zstd.SpeedFastest,
+		FramePolicy: UncompressedFrameSize{Size: 1 << 20},
+	})
+	if err != nil {
+		tb.Fatalf("NewEncoder failed: %v", err)
+	}
+
+	var data []byte
+	for i := 0; i < numFrames; i++ {
+		record := []byte(fmt.Sprintf("record %d\n", i))
+		data = append(data, record...)
+		encoder.Write(record)
+		if err := encoder.EndFrame(); err != nil {
+			tb.Fatalf("EndFrame failed: %v", err)
+		}
+	}
+	if err := encoder.Finish(); err != nil {
+		tb.Fatalf("Finish failed: %v", err)
+	}
+
+	return buf.Bytes(), data
+}
+
+func TestDecoder_TinyFrameBatching(t *testing.T) {
+	archive, data := createTinyFrameArchive(t, 5000)
+
+	for _, streamRuns := range []bool{false, true} {
+		for _, batchLimit := range []int{0, smallFrameBatchSize} {
+			var frames int
+			opts := DefaultDecoderOptions()
+			opts.OnFrame = func(frameIndex uint32, decompressed uint64) { frames++ }
+
+			decoder, err := NewDecoder(bytes.NewReader(archive), opts)
+			if err != nil {
+				t.Fatalf("NewDecoder failed: %v", err)
+			}
+			decoder.batchLimit = batchLimit
+			decoder.streamRuns = streamRuns
+
+			got, err := io.ReadAll(decoder)
+			if err != nil {
+				t.Fatalf("ReadAll failed (batch limit %d, streamed %v): %v", batchLimit, streamRuns, err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("Decoded data mismatch with batch limit %d, streamed %v", batchLimit, streamRuns)
+			}
+			if frames != 5000 {
+				t.Errorf("Expected 5000 OnFrame calls with batch limit %d, streamed %v, got %d", batchLimit, streamRuns, frames)
+			}
+		}
+	}
+}
+
+func BenchmarkDecoder_TinyFrames(b *testing.B) {
+	archive, data := createTinyFrameArchive(b, 100000)
+
+	for _, bm := range []struct {
+		name       string
+		batchLimit int
+		streamRuns bool
+	}{
+		{"per-frame", 0, false},
+		{"batched", smallFrameBatchSize, false},
+		{"per-frame-streamed", 0, true},
+		{"batched-streamed", smallFrameBatchSize, true},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				decoder, err := NewDecoder(bytes.NewReader(archive), nil)
+				if err != nil {
+					b.Fatalf("NewDecoder failed: %v", err)
+				}
+				decoder.batchLimit = bm.batchLimit
+				decoder.streamRuns = bm.streamRuns
+				if _, err := io.Copy(io.Discard, decoder); err != nil {
+					b.Fatalf("Copy failed: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestOpenArchive(t *testing.T) {
+	archive := createTestArchive(t, [][]byte{
+		[]byte("Hello, "),
+		[]byte("World!"),
+	})
+
+	path := filepath.Join(t.TempDir(), "archive.zst")
+	if err := os.WriteFile(path, archive.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	decoder, closer, err := OpenArchive(path)
+	if err != nil {
+		t.Fatalf("OpenArchive failed: %v", err)
+	}
+	got, err := io.ReadAll(decoder)
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	if string(got) != "Hello, World!" {
+		t.Errorf("Expected %q, got %q", "Hello, World!", got)
+	}
+	if err := closer(); err != nil {
+		t.Errorf("closer failed: %v", err)
+	}
+
+	if _, _, err := OpenArchive(filepath.Join(t.TempDir(), "missing.zst")); err == nil {
+		t.Error("Expected error opening a missing archive")
+	}
+}
+
+func TestPrefixWindow_Baseline(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	baseline := make([]byte, 64*1024)
+	rng.Read(baseline)
+
+	// The new data is the baseline with a few small edits
+	data := append([]byte(nil), baseline...)
+	for i := 0; i < 10; i++ {
+		data[rng.Intn(len(data))] ^= 0xFF
+	}
+
+	encode := func(prefix []byte) []byte {
+		var buf bytes.Buffer
+		encoder, err := NewEncoder(&buf, &EncoderOptions{
+			Level:        zstd.SpeedDefault,
+			FramePolicy:  UncompressedFrameSize{Size: 16 * 1024},
+			PrefixWindow: prefix,
+		})
+		if err != nil {
+			t.Fatalf("NewEncoder failed: %v", err)
+		}
+		if _, err := encoder.Write(data); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		if err := encoder.Finish(); err != nil {
+			t.Fatalf("Finish failed: %v", err)
+		}
+		return buf.Bytes()
+	}
+
+	plain := encode(nil)
+	delta := encode(baseline)
+	if len(delta)*4 >= len(plain) {
+		t.Errorf("Expected baseline prefix to shrink archive substantially: %d bytes vs %d without", len(delta), len(plain))
+	}
+
+	opts := DefaultDecoderOptions()
+	opts.PrefixWindow = baseline
+	decoder, err := NewDecoder(bytes.NewReader(delta), opts)
+	if err != nil {
+		t.Fatalf("NewDecoder failed: %v", err)
+	}
+	got, err := io.ReadAll(decoder)
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("Decoded data mismatch")
+	}
+}
+
+func TestExtractFrames(t *testing.T) {
+	frames := [][]byte{
+		[]byte("Frame 0"),
+		[]byte("Frame 1"),
+		[]byte("Frame 2"),
+		[]byte("Frame 3"),
+	}
+	archive := createTestArchive(t, frames)
+
+	outputs := map[uint32]*bytes.Buffer{}
+	err := ExtractFrames(bytes.NewReader(archive.Bytes()), 1, 2, func(index uint32) (io.Writer, error) {
+		outputs[index] = &bytes.Buffer{}
+		return outputs[index], nil
+	})
+	if err != nil {
+		t.Fatalf("ExtractFrames failed: %v", err)
+	}
+
+	if len(outputs) != 2 {
+		t.Fatalf("Expected 2 outputs, got %d", len(outputs))
+	}
+	for _, index := range []uint32{1, 2} {
+		out, ok := outputs[index]
+		if !ok {
+			t.Errorf("Missing output for frame %d", index)
+			continue
+		}
+		if !bytes.Equal(out.Bytes(), frames[index]) {
+			t.Errorf("Frame %d: expected %q, got %q", index, frames[index], out.Bytes())
+		}
+	}
+
+	open := func(index uint32) (io.Writer, error) { return io.Discard, nil }
+	if err := ExtractFrames(bytes.NewReader(archive.Bytes()), 2, 1, open); err == nil {
+		t.Error("Expected error for inverted range")
+	}
+	if err := ExtractFrames(bytes.NewReader(archive.Bytes()), 3, 4, open); err == nil {
+		t.Error("Expected error for range past the last frame")
+	}
+}
+
+func TestFindDuplicateFrames(t *testing.T) {
+	archive := createTestArchive(t, [][]byte{
+		[]byte("repeated frame"),
+		[]byte("unique frame"),
+		[]byte("repeated frame"),
+		[]byte("another frame"),
+	})
+
+	groups, err := FindDuplicateFrames(bytes.NewReader(archive.Bytes()))
+	if err != nil {
+		t.Fatalf("FindDuplicateFrames failed: %v", err)
+	}
+
+	if len(groups) != 1 {
+		t.Fatalf("Expected 1 duplicate group, got %v", groups)
+	}
+	group := groups[0]
+	if len(group) != 2 || group[0] != 0 || group[1] != 2 {
+		t.Errorf("Expected group [0 2], got %v", group)
+	}
+
+	// The frames after a Head format table are hashed the same way
+	table, err := ReadSeekTable(bytes.NewReader(archive.Bytes()))
+	if err != nil {
+		t.Fatalf("ReadSeekTable failed: %v", err)
+	}
+	framesEnd := archive.Len() - len(table.Bytes(FormatFoot))
+	head := append(table.Bytes(FormatHead), archive.Bytes()[:framesEnd]...)
+	headGroups, err := FindDuplicateFrames(bytes.NewReader(head))
+	if err != nil {
+		t.Fatalf("FindDuplicateFrames on Head format failed: %v", err)
+	}
+	if len(headGroups) != 1 || fmt.Sprint(headGroups[0]) != fmt.Sprint(group) {
+		t.Errorf("Expected Head format groups %v, got %v", groups, headGroups)
+	}
+
+	// Metadata ahead of frame 0 is not hashed, and empty frames never match
+	var buf bytes.Buffer
+	encoder, err := NewEncoder(&buf, DefaultEncoderOptions())
+	if err != nil {
+		t.Fatalf("NewEncoder failed: %v", err)
+	}
+	if err := encoder.WriteSkippableMetadata(0x184D2A50, []byte("name=frames.txt")); err != nil {
+		t.Fatalf("WriteSkippableMetadata failed: %v", err)
+	}
+	for _, frame := range []string{"repeated frame", "", "unique frame", "", "repeated frame"} {
+		if _, err := encoder.Write([]byte(frame)); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		if err := encoder.EndFrameForce(); err != nil {
+			t.Fatalf("EndFrameForce failed: %v", err)
+		}
+	}
+	if err := encoder.Finish(); err != nil {
+		t.Fatalf("Finish failed: %v", err)
+	}
+	groups, err = FindDuplicateFrames(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("FindDuplicateFrames with metadata failed: %v", err)
+	}
+	if len(groups) != 1 || fmt.Sprint(groups[0]) != "[0 4]" {
+		t.Errorf("Expected only group [0 4], got %v", groups)
+	}
+}
+
+func TestNewDecoderBytes(t *testing.T) {
+	frames := [][]byte{
+		[]byte("Frame 0"),
+		[]byte("Frame 1"),
+		[]byte("Frame 2"),
+	}
+	archive := createTestArchive(t, frames)
+
+	decoder, err := NewDecoderBytes(archive.Bytes(), nil)
+	if err != nil {
+		t.Fatalf("NewDecoderBytes failed: %v", err)
+	}
+	if _, err := decoder.Seek(10, io.SeekStart); err != nil {
+		t.Fatalf("Seek failed: %v", err)
+	}
+	got, err := io.ReadAll(decoder)
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	if string(got) != "me 1Frame 2" {
+		t.Errorf("Expected %q, got %q", "me 1Frame 2", got)
+	}
+
+	var filtered bytes.Buffer
+	if err := decoder.ReadFiltered(&filtered, func(index uint32) bool { return index == 0 }); err != nil {
+		t.Fatalf("ReadFiltered failed: %v", err)
+	}
+	if filtered.String() != "Frame 0" {
+		t.Errorf("Expected %q, got %q", "Frame 0", filtered.String())
+	}
+}
+
+func BenchmarkDecoder_InMemory(b *testing.B) {
+	data := make([]byte, 4<<20)
+	rand.New(rand.NewSource(1)).Read(data[:len(data)/2])
+
+	var buf bytes.Buffer
+	encoder, err := NewEncoder(&buf, &EncoderOptions{
+		Level:       zstd.SpeedFastest,
+		FramePolicy: UncompressedFrameSize{Size: 64 * 1024},
+	})
+	if err != nil {
+		b.Fatalf("NewEncoder failed: %v", err)
+	}
+	encoder.Write(data)
+	if err := encoder.Finish(); err != nil {
+		b.Fatalf("Finish failed: %v", err)
+	}
+	archive := buf.Bytes()
+
+	b.Run("bytes.Reader", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(data)))
+		for i := 0; i < b.N; i++ {
+			decoder, err := NewDecoder(bytes.NewReader(archive), nil)
+			if err != nil {
+				b.Fatalf("NewDecoder failed: %v", err)
+			}
+			if _, err := io.Copy(io.Discard, decoder); err != nil {
+				b.Fatalf("Copy failed: %v", err)
+			}
+		}
+	})
+
+	b.Run("NewDecoderBytes", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(data)))
+		for i := 0; i < b.N; i++ {
+			decoder, err := NewDecoderBytes(archive, nil)
+			if err != nil {
+				b.Fatalf("NewDecoderBytes failed: %v", err)
+			}
+			if _, err := io.Copy(io.Discard, decoder); err != nil {
+				b.Fatalf("Copy failed: %v", err)
+			}
+		}
+	})
+}
+
+func TestDecoder_TestIntegrity(t *testing.T) {
+	frames := make([][]byte, 50)
+	for i := range frames {
+		frames[i] = bytes.Repeat([]byte(fmt.Sprintf("frame %d ", i)), 50)
+	}
+	archive := createTestArchive(t, frames).Bytes()
+
+	decoder, err := NewDecoder(bytes.NewReader(archive), nil)
+	if err != nil {
+		t.Fatalf("NewDecoder failed: %v", err)
+	}
+	n, err := decoder.TestIntegrity()
+	if err != nil {
+		t.Fatalf("TestIntegrity failed on a valid archive: %v", err)
+	}
+	if n != 50 {
+		t.Errorf("Expected 50, got %d", n)
+	}
+
+	// Corrupt the middle of frame 2
+	start, _ := decoder.SeekTable().FrameStartComp(2)
+	end, _ := decoder.SeekTable().FrameEndComp(2)
+	corrupted := bytes.Clone(archive)
+	for i := start + (end-start)/2; i < end-4; i++ {
+		corrupted[i] ^= 0xFF
+	}
+
+	decoder, err = NewDecoder(bytes.NewReader(corrupted), nil)
+	if err != nil {
+		t.Fatalf("NewDecoder failed: %v", err)
+	}
+	n, err = decoder.TestIntegrity()
+	if err == nil {
+		t.Fatal("Expected error for corrupted frame")
+	}
+	if n != 2 {
+		t.Errorf("Expected failing frame 2, got %d", n)
+	}
+}
+
+// maxReadRecorder records the largest single Read from the wrapped source
+type maxReadRecorder struct {
+	io.ReadSeeker
+	maxRead int
+}
+
+func (m *maxReadRecorder) Read(p []byte) (int, error) {
+	n, err := m.ReadSeeker.Read(p)
+	if n > m.maxRead {
+		m.maxRead = n
+	}
+	return n, err
+}
+
+func TestDecoder_MaxCompressedReadSize(t *testing.T) {
+	data := make([]byte, 2<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	var buf bytes.Buffer
+	encoder, err := NewEncoder(&buf, &EncoderOptions{
+		Level:       zstd.SpeedFastest,
+		FramePolicy: UncompressedFrameSize{Size: uint32(len(data))},
+	})
+	if err != nil {
+		t.Fatalf("NewEncoder failed: %v", err)
+	}
+	encoder.Write(data)
+	if err := encoder.Finish(); err != nil {
+		t.Fatalf("Finish failed: %v", err)
+	}
+
+	const readSize = 16 * 1024
+	source := &maxReadRecorder{ReadSeeker: bytes.NewReader(buf.Bytes())}
+	decoder, err := NewDecoder(source, &DecoderOptions{MaxCompressedReadSize: readSize})
+	if err != nil {
+		t.Fatalf("NewDecoder failed: %v", err)
+	}
+	if frameSize, _ := decoder.SeekTable().FrameSizeComp(0); frameSize <= readSize {
+		t.Fatalf("Frame of %d bytes is too small for the test", frameSize)
+	}
+	source.maxRead = 0
+
+	got, err := io.ReadAll(decoder)
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("Decompressed data differs from input")
+	}
+	if source.maxRead > readSize {
+		t.Errorf("Read %d compressed bytes at once, expected at most %d", source.maxRead, readSize)
+	}
+}
+
+func TestDecoder_ReadAt(t *testing.T) {
+	frames := make([][]byte, 20)
+	var data []byte
+	for i := range frames {
+		frames[i] = []byte(fmt.Sprintf("frame %02d content;", i))
+		data = append(data, frames[i]...)
+	}
+	archive := createTestArchive(t, frames)
+
+	decoder, err := NewDecoder(bytes.NewReader(archive.Bytes()), nil)
+	if err != nil {
+		t.Fatalf("NewDecoder failed: %v", err)
+	}
+	var _ io.ReaderAt = decoder
+
+	// Overlapping ranges, read in parallel
+	var wg sync.WaitGroup
+	errs := make(chan error, len(data))
+	for off := 0; off < len(data); off += 7 {
+		wg.Add(1)
+		go func(off int) {
+			defer wg.Done()
+			buf := make([]byte, 50)
+			n, err := decoder.ReadAt(buf, int64(off))
+			want := data[off:min(off+len(buf), len(data))]
+			if len(want) < len(buf) && err != io.EOF {
+				errs <- fmt.Errorf("offset %d: expected io.EOF, got %v", off, err)
+			} else if len(want) == len(buf) && err != nil {
+				errs <- fmt.Errorf("offset %d: %v", off, err)
+			} else if !bytes.Equal(buf[:n], want) {
+				errs <- fmt.Errorf("offset %d: expected %q, got %q", off, want, buf[:n])
+			}
+		}(off)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	// ReadAt leaves the Read cursor alone
+	buf := make([]byte, len(frames[0]))
+	if _, err := io.ReadFull(decoder, buf); err != nil || !bytes.Equal(buf, frames[0]) {
+		t.Errorf("Expected %q after ReadAt, got %q (%v)", frames[0], buf, err)
+	}
+
+	if _, err := decoder.ReadAt(buf, int64(len(data))); err != io.EOF {
+		t.Errorf("Expected io.EOF past the end, got %v", err)
+	}
+
+	// Reads are bounded by the frame range
+	bounded, err := NewDecoder(bytes.NewReader(archive.Bytes()), &DecoderOptions{LowerFrame: 1, UpperFrame: 2})
+	if err != nil {
+		t.Fatalf("NewDecoder failed: %v", err)
+	}
+	frameLen := len(frames[0])
+	buf = make([]byte, 2*frameLen)
+	n, err := bounded.ReadAt(buf, int64(frameLen+5))
+	if err != io.EOF || !bytes.Equal(buf[:n], data[frameLen+5:3*frameLen]) {
+		t.Errorf("Expected %q and io.EOF, got %q and %v", data[frameLen+5:3*frameLen], buf[:n], err)
+	}
+	if _, err := bounded.ReadAt(buf, 0); err == nil {
+		t.Error("Expected error reading before the lower frame")
+	}
+}
+
+func TestDecoder_DecodeFrame(t *testing.T) {
+	frames := make([][]byte, 20)
+	var data []byte
+	for i := range frames {
+		frames[i] = []byte(fmt.Sprintf("frame %02d content;", i))
+		data = append(data, frames[i]...)
+	}
+	archive := createTestArchive(t, frames)
+
+	for _, opts := range []*DecoderOptions{
+		DefaultDecoderOptions(),
+		{FrameCacheSize: 4},
+		{Prefetch: true},
+		{VerifyOnSeek: true},
+	} {
+		decoder, err := NewDecoder(bytes.NewReader(archive.Bytes()), opts)
+		if err != nil {
+			t.Fatalf("NewDecoder failed: %v", err)
+		}
+
+		// Interleave single frames with sequential reads
+		var read []byte
+		buf := make([]byte, 7)
+		for _, index := range []uint32{13, 0, 19, 13, 5, 2, 17} {
+			frame, err := decoder.DecodeFrame(index)
+			if err != nil {
+				t.Fatalf("DecodeFrame(%d) failed: %v", index, err)
+			}
+			if !bytes.Equal(frame, frames[index]) {
+				t.Errorf("DecodeFrame(%d) = %q, expected %q", index, frame, frames[index])
+			}
+			// Callers own the returned bytes
+			clear(frame)
+
+			n, err := io.ReadFull(decoder, buf)
+			if err != nil {
+				t.Fatalf("Read failed: %v", err)
+			}
+			read = append(read, buf[:n]...)
+		}
+		rest, err := io.ReadAll(decoder)
+		if err != nil {
+			t.Fatalf("ReadAll failed: %v", err)
+		}
+		if read = append(read, rest...); !bytes.Equal(read, data) {
+			t.Errorf("%+v: sequential reads interleaved with DecodeFrame returned %q", *opts, read)
+		}
+
+		if _, err := decoder.DecodeFrame(20); err == nil || !strings.HasPrefix(err.Error(), ErrFrameIndexTooLarge) {
+			t.Errorf("Expected %s, got %v", ErrFrameIndexTooLarge, err)
+		}
+	}
+
+	// Frames outside the decoder's range can still be decoded
+	bounded, err := NewDecoder(bytes.NewReader(archive.Bytes()), &DecoderOptions{LowerFrame: 1, UpperFrame: 2, UpperFrameSet: true})
+	if err != nil {
+		t.Fatalf("NewDecoder failed: %v", err)
+	}
+	if frame, err := bounded.DecodeFrame(10); err != nil || !bytes.Equal(frame, frames[10]) {
+		t.Errorf("Expected %q, got %q (%v)", frames[10], frame, err)
+	}
+}
+
+func TestDecoder_DecodeFrames(t *testing.T) {
+	frames := make([][]byte, 300)
+	for i := range frames {
+		frames[i] = []byte(fmt.Sprintf("frame %03d content;", i))
+	}
+	archive := createTestArchive(t, frames)
+
+	decoder, err := NewDecoderBytes(archive.Bytes(), nil)
+	if err != nil {
+		t.Fatalf("NewDecoderBytes failed: %v", err)
+	}
+	indices := []uint32{200, 0, 100, 299, 100, 7}
+	decoded, err := decoder.DecodeFrames(indices)
+	if err != nil {
+		t.Fatalf("DecodeFrames failed: %v", err)
+	}
+	if len(decoded) != len(indices) {
+		t.Fatalf("Expected %d frames, got %d", len(indices), len(decoded))
+	}
+	for i, index := range indices {
+		if !bytes.Equal(decoded[i], frames[index]) {
+			t.Errorf("Frame %d: expected %q, got %q", index, frames[index], decoded[i])
+		}
+	}
+
+	if decoded, err := decoder.DecodeFrames(nil); err != nil || len(decoded) != 0 {
+		t.Errorf("Expected no frames, got %d (%v)", len(decoded), err)
+	}
+	_, err = decoder.DecodeFrames([]uint32{1, 300})
+	if err == nil || !strings.HasPrefix(err.Error(), ErrFrameIndexTooLarge) {
+		t.Errorf("Expected %s, got %v", ErrFrameIndexTooLarge, err)
+	}
+}
+
+func TestDecoder_StreamsLargeFrame(t *testing.T) {
+	data := make([]byte, 32<<20)
+	for i := range data {
+		data[i] = byte(i/3) ^ byte(i%17)
+	}
+
+	var buf bytes.Buffer
+	encoder, err := NewEncoder(&buf, &EncoderOptions{
+		Level:       zstd.SpeedFastest,
+		FramePolicy: UncompressedFrameSize{Size: uint32(len(data))},
+	})
+	if err != nil {
+		t.Fatalf("NewEncoder failed: %v", err)
+	}
+	encoder.Write(data)
+	if err := encoder.Finish(); err != nil {
+		t.Fatalf("Finish failed: %v", err)
+	}
+	archive := buf.Bytes()
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	decoder, err := NewDecoder(bytes.NewReader(archive), nil)
+	if err != nil {
+		t.Fatalf("NewDecoder failed: %v", err)
+	}
+	if decoder.SeekTable().NumFrames() != 1 {
+		t.Fatalf("Expected a single frame, got %d", decoder.SeekTable().NumFrames())
+	}
+
+	readBuf := make([]byte, 32*1024)
+	offset := 0
+	for {
+		n, err := decoder.Read(readBuf)
+		if !bytes.Equal(readBuf[:n], data[offset:offset+n]) {
+			t.Fatalf("Data mismatch at offset %d", offset)
+		}
+		offset += n
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+	}
+	if offset != len(data) {
+		t.Fatalf("Expected %d bytes, got %d", len(data), offset)
+	}
+
+	runtime.ReadMemStats(&after)
+	allocated := after.TotalAlloc - before.TotalAlloc
+	if allocated > uint64(len(data))/2 {
+		t.Errorf("Allocated %d bytes decoding a %d byte frame", allocated, len(data))
+	}
+
+	// Random access keeps working while a frame is being streamed
+	decoder, err = NewDecoder(bytes.NewReader(archive), nil)
+	if err != nil {
+		t.Fatalf("NewDecoder failed: %v", err)
+	}
+	if _, err := io.ReadFull(decoder, readBuf); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	at := make([]byte, 100)
+	if _, err := decoder.ReadAt(at, 1<<20); err != nil || !bytes.Equal(at, data[1<<20:1<<20+100]) {
+		t.Errorf("ReadAt during streaming returned wrong data (%v)", err)
+	}
+	rest, err := io.ReadAll(decoder)
+	if err != nil || !bytes.Equal(rest, data[len(readBuf):]) {
+		t.Errorf("Read after ReadAt returned wrong data (%v)", err)
+	}
+}
+
+func TestDecoder_Frames(t *testing.T) {
+	collect := func(t *testing.T, d *Decoder) []string {
+		t.Helper()
+		var got []string
+		it := d.Frames()
+		for it.Next() {
+			start, end := it.StartDecomp(), it.EndDecomp()
+			if end-start != uint64(len(it.Bytes())) {
+				t.Errorf("Frame %d: offsets %d-%d do not match %d bytes", it.Index(), start, end, len(it.Bytes()))
+			}
+			got = append(got, fmt.Sprintf("%d@%d:%s", it.Index(), start, it.Bytes()))
+		}
+		if err := it.Err(); err != nil {
+			t.Fatalf("Iteration failed: %v", err)
+		}
+		return got
+	}
+
+	t.Run("empty", func(t *testing.T) {
+		var buf bytes.Buffer
+		encoder, err := NewEncoder(&buf, nil)
+		if err != nil {
+			t.Fatalf("NewEncoder failed: %v", err)
+		}
+		if err := encoder.Finish(); err != nil {
+			t.Fatalf("Finish failed: %v", err)
+		}
+		decoder, err := NewDecoder(bytes.NewReader(buf.Bytes()), nil)
+		if err != nil {
+			t.Fatalf("NewDecoder failed: %v", err)
+		}
+		if got := collect(t, decoder); len(got) != 0 {
+			t.Errorf("Expected no frames, got %v", got)
+		}
+	})
+
+	t.Run("single frame", func(t *testing.T) {
+		archive := createTestArchive(t, [][]byte{[]byte("only")})
+		decoder, err := NewDecoder(bytes.NewReader(archive.Bytes()), nil)
+		if err != nil {
+			t.Fatalf("NewDecoder failed: %v", err)
+		}
+		got := collect(t, decoder)
+		if want := []string{"0@0:only"}; fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("Expected %v, got %v", want, got)
+		}
+	})
+
+	t.Run("sub-range", func(t *testing.T) {
+		archive := createTestArchive(t, [][]byte{
+			[]byte("aa"), []byte("bbb"), []byte("cccc"), []byte("d"),
+		})
+		decoder, err := NewDecoder(bytes.NewReader(archive.Bytes()), &DecoderOptions{LowerFrame: 1, UpperFrame: 2})
+		if err != nil {
+			t.Fatalf("NewDecoder failed: %v", err)
+		}
+		got := collect(t, decoder)
+		if want := []string{"1@2:bbb", "2@5:cccc"}; fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("Expected %v, got %v", want, got)
+		}
+
+		// The Read position is unaffected by iterating
+		data, err := io.ReadAll(decoder)
+		if err != nil || string(data) != "bbbcccc" {
+			t.Errorf("Expected %q after iterating, got %q (%v)", "bbbcccc", data, err)
+		}
+	})
+}
+
+func TestDecodeByScanning(t *testing.T) {
+	random := make([]byte, 3000)
+	rand.New(rand.NewSource(1)).Read(random)
+	frames := [][]byte{
+		[]byte("plain text frame"),
+		random,
+		make([]byte, 2000),
+		bytes.Repeat([]byte("abc"), 500),
+	}
+	archive := createTestArchive(t, frames).Bytes()
+	expected := bytes.Join(frames, nil)
+
+	// Garble the seek table entries but keep the footer
+	footer, err := ReadSeekTableFooter(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatalf("ReadSeekTableFooter failed: %v", err)
+	}
+	tableSize, _ := ParseSeekTableSize(footer)
+	corrupted := bytes.Clone(archive)
+	entries := corrupted[len(corrupted)-tableSize+SKIPPABLE_HEADER_SIZE : len(corrupted)-SEEK_TABLE_FOOTER_SIZE]
+	rand.New(rand.NewSource(2)).Read(entries)
+
+	numFrames := binary.LittleEndian.Uint32(footer[0:4])
+	got, err := DecodeByScanning(bytes.NewReader(corrupted), numFrames)
+	if err != nil {
+		t.Fatalf("DecodeByScanning failed: %v", err)
+	}
+	if !bytes.Equal(got, expected) {
+		t.Error("Recovered data differs from input")
+	}
+
+	// Asking for more frames than exist returns what was found
+	got, err = DecodeByScanning(bytes.NewReader(corrupted), numFrames+1)
+	if err == nil {
+		t.Error("Expected error when frames are missing")
+	}
+	if !bytes.Equal(got, expected) {
+		t.Error("Expected the frames found to be returned")
+	}
+
+	// Stop early when fewer frames are requested
+	got, err = DecodeByScanning(bytes.NewReader(corrupted), 1)
+	if err != nil || !bytes.Equal(got, frames[0]) {
+		t.Errorf("Expected first frame only, got %d bytes (%v)", len(got), err)
+	}
+}
+
+// checksummedRawArchive compresses incompressible frames without zstd
+// content checksums, so a flipped byte still decodes, and gives the archive
+// a seek table with per-frame checksums
+func checksummedRawArchive(t *testing.T, frames [][]byte) []byte {
+	t.Helper()
+	encoder, err := zstd.NewWriter(nil, zstd.WithEncoderCRC(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer encoder.Close()
+
+	var archive []byte
+	st := NewSeekTable()
+	for _, frame := range frames {
+		compressed := encoder.EncodeAll(frame, nil)
+		archive = append(archive, compressed...)
+		st.LogFrameChecksum(uint64(len(compressed)), uint64(len(frame)), frameChecksum(frame))
+	}
+
+	serializer, err := st.NewSerializer(FormatFoot)
+	if err != nil {
+		t.Fatalf("NewSerializer failed: %v", err)
+	}
+	table := make([]byte, serializer.EncodedLen())
+	serializer.WriteTo(table)
+	return append(archive, table...)
+}
+
+func TestDecoder_ChecksumMismatch(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	frames := [][]byte{make([]byte, 3000), make([]byte, 3000), make([]byte, 2*streamFrameSize)}
+	for _, frame := range frames {
+		rng.Read(frame)
+	}
+	archive := checksummedRawArchive(t, frames)
+	content := bytes.Join(frames, nil)
+
+	decoder, err := NewDecoderBytes(archive, nil)
+	if err != nil {
+		t.Fatalf("NewDecoderBytes failed: %v", err)
+	}
+	if !decoder.SeekTable().HasChecksums() {
+		t.Fatal("Expected seek table with checksums")
+	}
+	got, err := io.ReadAll(decoder)
+	if err != nil || !bytes.Equal(got, content) {
+		t.Fatalf("ReadAll of intact archive failed: %v", err)
+	}
+
+	// Flip a byte inside each frame's raw block
+	for frame := uint32(0); frame < 3; frame++ {
+		t.Run(fmt.Sprintf("frame %d", frame), func(t *testing.T) {
+			start, _ := decoder.SeekTable().FrameStartComp(frame)
+			end, _ := decoder.SeekTable().FrameEndComp(frame)
+			corrupted := bytes.Clone(archive)
+			corrupted[start+(end-start)/2] ^= 0x01
+
+			d, err := NewDecoder(bytes.NewReader(corrupted), nil)
+			if err != nil {
+				t.Fatalf("NewDecoder failed: %v", err)
+			}
+			if _, err := io.ReadAll(d); err == nil || !strings.HasPrefix(err.Error(), ErrChecksumMismatch) {
+				t.Errorf("Expected %q from Read, got %v", ErrChecksumMismatch, err)
+			}
+
+			offset, _ := d.SeekTable().FrameStartDecomp(frame)
+			if _, err := d.ReadAt(make([]byte, 10), int64(offset)); err == nil || !strings.HasPrefix(err.Error(), ErrChecksumMismatch) {
+				t.Errorf("Expected %q from ReadAt, got %v", ErrChecksumMismatch, err)
+			}
+
+			n, err := d.TestIntegrity()
+			if err == nil || !strings.HasPrefix(err.Error(), ErrChecksumMismatch) || n != frame {
+				t.Errorf("Expected %q at frame %d from TestIntegrity, got %v at %d", ErrChecksumMismatch, frame, err, n)
+			}
+		})
+	}
+}
+
+func TestDecoder_VerifyOnSeek(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	frames := [][]byte{make([]byte, 3000), make([]byte, 3000), make([]byte, 3000), make([]byte, 2*streamFrameSize)}
+	for _, frame := range frames {
+		rng.Read(frame)
+	}
+	archive := checksummedRawArchive(t, frames)
+
+	// Corrupt frames 1 and 3
+	st, err := ParseSeekTable(archive[len(archive)-(SKIPPABLE_HEADER_SIZE+SEEK_TABLE_FOOTER_SIZE+4*SIZE_PER_FRAME_CRC):])
+	if err != nil {
+		t.Fatalf("ParseSeekTable failed: %v", err)
+	}
+	for _, frame := range []uint32{1, 3} {
+		start, _ := st.FrameStartComp(frame)
+		end, _ := st.FrameEndComp(frame)
+		archive[start+(end-start)/2] ^= 0x01
+	}
+
+	newDecoder := func() *Decoder {
+		d, err := NewDecoder(bytes.NewReader(archive), &DecoderOptions{VerifyOnSeek: true})
+		if err != nil {
+			t.Fatalf("NewDecoder failed: %v", err)
+		}
+		return d
+	}
+	isMismatch := func(err error) bool {
+		return err != nil && strings.HasPrefix(err.Error(), ErrChecksumMismatch)
+	}
+
+	// Sequential reads are not verified
+	if _, err := io.ReadAll(newDecoder()); err != nil {
+		t.Errorf("Expected sequential read to skip verification, got %v", err)
+	}
+
+	// Seeking into a corrupted frame fails, whether it is buffered or streamed
+	for _, frame := range []uint32{1, 3} {
+		d := newDecoder()
+		offset, _ := st.FrameStartDecomp(frame)
+		_, err := d.Seek(int64(offset)+100, io.SeekStart)
+		if err == nil {
+			_, err = io.ReadAll(d)
+		}
+		if !isMismatch(err) {
+			t.Errorf("Expected %q after seeking into frame %d, got %v", ErrChecksumMismatch, frame, err)
+		}
+	}
+
+	// Seeking into a clean frame succeeds, even though frame 3 is read after it
+	d := newDecoder()
+	offset, _ := st.FrameStartDecomp(2)
+	if _, err := d.Seek(int64(offset)+100, io.SeekStart); err != nil {
+		t.Fatalf("Seek into clean frame failed: %v", err)
+	}
+	got, err := io.ReadAll(d)
+	if err != nil {
+		t.Fatalf("ReadAll after Seek failed: %v", err)
+	}
+	if len(got) != 3000-100+2*streamFrameSize {
+		t.Errorf("Read %d bytes after Seek", len(got))
+	}
+
+	// ReadAt verifies only the frame it starts in
+	if _, err := d.ReadAt(make([]byte, 10), int64(3100)); !isMismatch(err) {
+		t.Errorf("Expected %q from ReadAt into frame 1, got %v", ErrChecksumMismatch, err)
+	}
+	if _, err := d.ReadAt(make([]byte, 4000), 0); err != nil {
+		t.Errorf("ReadAt from clean frame 0 failed: %v", err)
+	}
+}
+
+func TestDecoder_WriteTo(t *testing.T) {
+	data := make([]byte, 3*streamFrameSize+10)
+	for i := range data {
+		data[i] = byte(i/7) ^ byte(i%251)
+	}
+	var buf bytes.Buffer
+	encoder, err := NewEncoder(&buf, &EncoderOptions{
+		Level:       zstd.SpeedFastest,
+		FramePolicy: UncompressedFrameSize{Size: 1000 * 1000},
+	})
+	if err != nil {
+		t.Fatalf("NewEncoder failed: %v", err)
+	}
+	encoder.Write(data[:2*streamFrameSize])
+	encoder.EndFrame()
+	encoder.ContinueFrame()
+	encoder.Write(data[2*streamFrameSize:]) // one frame large enough to stream
+	if err := encoder.Finish(); err != nil {
+		t.Fatalf("Finish failed: %v", err)
+	}
+
+	decoder, err := NewDecoder(bytes.NewReader(buf.Bytes()), nil)
+	if err != nil {
+		t.Fatalf("NewDecoder failed: %v", err)
+	}
+	last := decoder.SeekTable().NumFrames() - 1
+
+	for _, offset := range []int64{0, 12345, 1000 * 1000, 2*streamFrameSize + 5} {
+		if _, err := decoder.Seek(offset, io.SeekStart); err != nil {
+			t.Fatalf("Seek to %d failed: %v", offset, err)
+		}
+		var out bytes.Buffer
+		n, err := decoder.WriteTo(&out)
+		if err != nil {
+			t.Fatalf("WriteTo after Seek to %d failed: %v", offset, err)
+		}
+		if n != int64(len(data))-offset || !bytes.Equal(out.Bytes(), data[offset:]) {
+			t.Fatalf("WriteTo after Seek to %d wrote %d bytes, content mismatch", offset, n)
+		}
+
+		// WriteTo leaves the decoder at the end, like reading to EOF
+		if pos, _ := decoder.Seek(0, io.SeekCurrent); pos != int64(len(data)) {
+			t.Errorf("Expected position %d after WriteTo, got %d", len(data), pos)
+		}
+		if n, err := decoder.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+			t.Errorf("Expected EOF after WriteTo, got %d, %v", n, err)
+		}
+	}
+
+	// Part of a frame already read is not written again
+	decoder.Seek(0, io.SeekStart)
+	head := make([]byte, 100)
+	io.ReadFull(decoder, head)
+	var out bytes.Buffer
+	if _, err := decoder.WriteTo(&out); err != nil || !bytes.Equal(out.Bytes(), data[100:]) {
+		t.Errorf("WriteTo after Read returned wrong content: %v", err)
+	}
+
+	// The frame range is honored
+	decoder.SetUpperFrame(last - 1)
+	decoder.Seek(0, io.SeekStart)
+	out.Reset()
+	end, _ := decoder.SeekTable().FrameEndDecomp(last - 1)
+	if _, err := decoder.WriteTo(&out); err != nil || !bytes.Equal(out.Bytes(), data[:end]) {
+		t.Errorf("WriteTo with an upper frame returned wrong content: %v", err)
+	}
+}
+
+func BenchmarkDecoder_WriteTo(b *testing.B) {
+	data := make([]byte, 4<<20)
+	for i := range data {
+		data[i] = byte(i/5) ^ byte(i%11)
+	}
+	var buf bytes.Buffer
+	if _, err := CompressSeekable(&buf, data, &EncoderOptions{
+		Level:       zstd.SpeedFastest,
+		FramePolicy: UncompressedFrameSize{Size: 256 * 1024},
+	}); err != nil {
+		b.Fatalf("CompressSeekable failed: %v", err)
+	}
+	archive := buf.Bytes()
+
+	b.Run("Read", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(data)))
+		for i := 0; i < b.N; i++ {
+			decoder, err := NewDecoderBytes(archive, nil)
+			if err != nil {
+				b.Fatalf("NewDecoderBytes failed: %v", err)
+			}
+			// Hide WriteTo so io.Copy goes through Read
+			if _, err := io.Copy(io.Discard, struct{ io.Reader }{decoder}); err != nil {
+				b.Fatalf("Copy failed: %v", err)
+			}
+		}
+	})
+
+	b.Run("WriteTo", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(data)))
+		for i := 0; i < b.N; i++ {
+			decoder, err := NewDecoderBytes(archive, nil)
+			if err != nil {
+				b.Fatalf("NewDecoderBytes failed: %v", err)
+			}
+			if _, err := io.Copy(io.Discard, decoder); err != nil {
+				b.Fatalf("Copy failed: %v", err)
+			}
+		}
+	})
+}
+
+// TestDecoder_ReadLarge reads with buffers larger and smaller than frames,
+// so frames are decoded straight into the buffer and split across reads
+func TestDecoder_ReadLarge(t *testing.T) {
+	data := make([]byte, 300*1024+77)
+	for i := range data {
+		data[i] = byte(i/5) ^ byte(i%13)
+	}
+	want := newXXH64()
+	want.Write(data)
+	var buf bytes.Buffer
+	if _, err := CompressSeekable(&buf, data, &EncoderOptions{
+		Level:       zstd.SpeedFastest,
+		FramePolicy: UncompressedFrameSize{Size: 64 * 1024},
+	}); err != nil {
+		t.Fatalf("CompressSeekable failed: %v", err)
+	}
+
+	for _, size := range []int{1000, 64 * 1024, 64*1024 + 1, 100 * 1024, 1 << 20} {
+		decoder, err := NewDecoderBytes(buf.Bytes(), &DecoderOptions{ComputeChecksum: true})
+		if err != nil {
+			t.Fatalf("NewDecoderBytes failed: %v", err)
+		}
+		var out []byte
+		p := make([]byte, size)
+		for {
+			// Bytes past what Read returns must not leak into the output
+			for i := range p {
+				p[i] = 0xAA
+			}
+			n, err := decoder.Read(p)
+			out = append(out, p[:n]...)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("Read with %d byte buffer failed: %v", size, err)
+			}
+		}
+		if !bytes.Equal(out, data) {
+			t.Fatalf("Read with %d byte buffer returned wrong content", size)
+		}
+		if decoder.Checksum() != want.Sum64() {
+			t.Errorf("Checksum with %d byte buffer does not cover the content read", size)
+		}
+
+		// Partway into a frame, the rest of it is decoded and then read whole
+		decoder.Seek(100, io.SeekStart)
+		n, err := io.ReadFull(decoder, p[:min(size, len(data)-100)])
+		if err != nil || !bytes.Equal(p[:n], data[100:100+n]) {
+			t.Errorf("Read after Seek with %d byte buffer returned wrong content: %v", size, err)
+		}
+	}
+}
+
+func BenchmarkDecoder_ReadLarge(b *testing.B) {
+	data := make([]byte, 4<<20)
+	for i := range data {
+		data[i] = byte(i/5) ^ byte(i%11)
+	}
+	var buf bytes.Buffer
+	if _, err := CompressSeekable(&buf, data, &EncoderOptions{
+		Level:       zstd.SpeedFastest,
+		FramePolicy: UncompressedFrameSize{Size: 256 * 1024},
+	}); err != nil {
+		b.Fatalf("CompressSeekable failed: %v", err)
+	}
+	archive := buf.Bytes()
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	p := make([]byte, 1<<20)
+	for i := 0; i < b.N; i++ {
+		decoder, err := NewDecoderBytes(archive, nil)
+		if err != nil {
+			b.Fatalf("NewDecoderBytes failed: %v", err)
+		}
+		for err == nil {
+			_, err = decoder.Read(p)
+		}
+		if err != io.EOF {
+			b.Fatalf("Read failed: %v", err)
+		}
+	}
+}
+
+func TestLogger(t *testing.T) {
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	var buf bytes.Buffer
+	encoder, err := NewEncoder(&buf, &EncoderOptions{
+		Level:       zstd.SpeedDefault,
+		FramePolicy: UncompressedFrameSize{Size: 100},
+		Logger:      logger,
+	})
+	if err != nil {
+		t.Fatalf("NewEncoder failed: %v", err)
+	}
+	encoder.Write(bytes.Repeat([]byte("log me "), 50))
+	if err := encoder.Finish(); err != nil {
+		t.Fatalf("Finish failed: %v", err)
+	}
+
+	decoder, err := NewDecoder(bytes.NewReader(buf.Bytes()), &DecoderOptions{Logger: logger})
+	if err != nil {
+		t.Fatalf("NewDecoder failed: %v", err)
+	}
+	if _, err := decoder.ReadWithPrefix(make([]byte, 50), []byte("not a zstd frame")); err != nil {
+		t.Fatalf("ReadWithPrefix failed: %v", err)
+	}
+	if _, err := io.ReadAll(decoder); err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+
+	for _, msg := range []string{
+		`msg="encoder configured" level=default frame_policy=gzstd.UncompressedFrameSize{Size:100}`,
+		`msg="frame written" frame=3 compressed=`,
+		`msg="seek table loaded" frames=4 checksums=false`,
+		`msg="decoding with prefix" frame=0 prefix=16`,
+		`msg="batching small frames" first=1 last=3`,
+		`msg="frame decoded" frame=3 end=350`,
+	} {
+		if !strings.Contains(logs.String(), msg) {
+			t.Errorf("Expected log containing %q, got:\n%s", msg, logs.String())
+		}
+	}
+
+	// Other encoders and decoders without a Logger stay silent
+	logs.Reset()
+	if _, err := CompressSeekable(io.Discard, []byte("quiet"), nil); err != nil {
+		t.Fatalf("CompressSeekable failed: %v", err)
+	}
+	if logs.Len() != 0 {
+		t.Errorf("Expected no logs without a Logger, got %q", logs.String())
+	}
+}
+
+func TestNewDecoderContext_Cancel(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	frames := make([][]byte, 5)
+	for i := range frames {
+		frames[i] = make([]byte, 5000) // too large to be batched
+		rng.Read(frames[i])
+	}
+	var buf bytes.Buffer
+	if _, err := CompressSeekable(&buf, bytes.Join(frames, nil), &EncoderOptions{
+		Level:       zstd.SpeedFastest,
+		FramePolicy: UncompressedFrameSize{Size: 5000},
+	}); err != nil {
+		t.Fatalf("CompressSeekable failed: %v", err)
+	}
+	archive := buf.Bytes()
+
+	for _, name := range []string{"Read", "WriteTo"} {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			var decoded []uint32
+			decoder, err := NewDecoderContext(ctx, bytes.NewReader(archive), &DecoderOptions{
+				OnFrame: func(frameIndex uint32, decompressed uint64) {
+					decoded = append(decoded, frameIndex)
+					if frameIndex == 1 {
+						cancel()
+					}
+				},
+			})
+			if err != nil {
+				t.Fatalf("NewDecoderContext failed: %v", err)
+			}
+
+			var out bytes.Buffer
+			if name == "Read" {
+				_, err = io.Copy(&out, struct{ io.Reader }{decoder})
+			} else {
+				_, err = decoder.WriteTo(&out)
+			}
+			if !errors.Is(err, context.Canceled) || !strings.HasPrefix(err.Error(), ErrCanceled) {
+				t.Fatalf("Expected %q wrapping context.Canceled, got %v", ErrCanceled, err)
+			}
+			if len(decoded) != 2 || !bytes.Equal(out.Bytes(), bytes.Join(frames[:2], nil)) {
+				t.Errorf("Expected only frames 0 and 1, decoded %v and %d bytes", decoded, out.Len())
+			}
+		})
+	}
+}
+
+func TestDecoder_UpperFrameZero(t *testing.T) {
+	frames := [][]byte{[]byte("first "), []byte("second "), []byte("third")}
+	archive := createTestArchive(t, frames).Bytes()
+
+	tests := []struct {
+		name     string
+		opts     *DecoderOptions
+		expected string
+	}{
+		{"unset", &DecoderOptions{}, "first second third"},
+		{"zero without UpperFrameSet", &DecoderOptions{UpperFrame: 0}, "first second third"},
+		{"first frame only", &DecoderOptions{UpperFrame: 0, UpperFrameSet: true}, "first "},
+		{"first two frames", &DecoderOptions{UpperFrame: 1, UpperFrameSet: true}, "first second "},
+		{"past the end", &DecoderOptions{UpperFrame: 10, UpperFrameSet: true}, "first second third"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decoder, err := NewDecoder(bytes.NewReader(archive), tt.opts)
+			if err != nil {
+				t.Fatalf("NewDecoder failed: %v", err)
+			}
+			got, err := io.ReadAll(decoder)
+			if err != nil {
+				t.Fatalf("ReadAll failed: %v", err)
+			}
+			if string(got) != tt.expected {
+				t.Errorf("Expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestDecoder_Reset(t *testing.T) {
+	first := createTestArchive(t, [][]byte{[]byte("one "), []byte("two "), []byte("three")}).Bytes()
+	secondContent := bytes.Repeat([]byte("a different layout "), 3000)
+	var buf bytes.Buffer
+	if _, err := CompressSeekable(&buf, secondContent, &EncoderOptions{
+		Level:        zstd.SpeedDefault,
+		FramePolicy:  UncompressedFrameSize{Size: 7000},
+		ChecksumFlag: true,
+	}); err != nil {
+		t.Fatalf("CompressSeekable failed: %v", err)
+	}
+	second := buf.Bytes()
+
+	decoder, err := NewDecoderBytes(second, nil)
+	if err != nil {
+		t.Fatalf("NewDecoderBytes failed: %v", err)
+	}
+	// Leave the decoder partway through a frame
+	io.ReadFull(decoder, make([]byte, 100))
+	zstdDecoder := decoder.decoder
+
+	for i, tt := range []struct {
+		archive  []byte
+		opts     *DecoderOptions
+		expected []byte
+	}{
+		{first, nil, []byte("one two three")},
+		{second, nil, secondContent},
+		{first, &DecoderOptions{LowerFrame: 1, MaxWindowLog: 27}, []byte("two three")},
+	} {
+		if err := decoder.Reset(bytes.NewReader(tt.archive), tt.opts); err != nil {
+			t.Fatalf("Reset %d failed: %v", i, err)
+		}
+		got, err := io.ReadAll(decoder)
+		if err != nil {
+			t.Fatalf("ReadAll %d failed: %v", i, err)
+		}
+		if !bytes.Equal(got, tt.expected) {
+			t.Errorf("Reset %d: expected %d bytes, got %d", i, len(tt.expected), len(got))
+		}
+	}
+
+	// The zstd decoder is only replaced when its settings change
+	if decoder.decoder != zstdDecoder {
+		t.Error("Expected Reset with the same options to reuse the zstd decoder")
+	}
+	if err := decoder.Reset(bytes.NewReader(first), &DecoderOptions{MaxWindowLog: 20}); err != nil {
+		t.Fatalf("Reset failed: %v", err)
+	}
+	if decoder.decoder == zstdDecoder {
+		t.Error("Expected Reset with a different window to replace the zstd decoder")
+	}
+
+	if err := decoder.Reset(bytes.NewReader([]byte("not an archive, but long enough to check")), nil); err == nil {
+		t.Error("Expected Reset to fail without a seek table")
+	}
+}
+
+func TestDecoder_Close(t *testing.T) {
+	archive := createTestArchive(t, [][]byte{[]byte("one "), []byte("two "), []byte("three")}).Bytes()
+	decoder, err := NewDecoder(bytes.NewReader(archive), &DecoderOptions{Prefetch: true})
+	if err != nil {
+		t.Fatalf("NewDecoder failed: %v", err)
+	}
+	io.ReadFull(decoder, make([]byte, 6))
+
+	if err := decoder.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if decoder.decoder != nil || decoder.prefetched != nil {
+		t.Error("Expected Close to release the zstd decoder and stop prefetching")
+	}
+	if err := decoder.Close(); err != nil {
+		t.Errorf("Second Close failed: %v", err)
+	}
+
+	// A closed decoder can be reused through Reset
+	if err := decoder.Reset(bytes.NewReader(archive), nil); err != nil {
+		t.Fatalf("Reset after Close failed: %v", err)
+	}
+	got, err := io.ReadAll(decoder)
+	if err != nil {
+		t.Fatalf("ReadAll after Reset failed: %v", err)
+	}
+	if string(got) != "one two three" {
+		t.Errorf("Expected %q, got %q", "one two three", got)
+	}
+}
+
+func TestDecoder_NoFrames(t *testing.T) {
+	var buf bytes.Buffer
+	encoder, err := NewEncoder(&buf, nil)
+	if err != nil {
+		t.Fatalf("NewEncoder failed: %v", err)
+	}
+	if err := encoder.Finish(); err != nil {
+		t.Fatalf("Finish failed: %v", err)
+	}
+	if n := encoder.SeekTable().NumFrames(); n != 0 {
+		t.Fatalf("Expected no frames for empty input, got %d", n)
+	}
+
+	decoder, err := NewDecoder(bytes.NewReader(buf.Bytes()), nil)
+	if err != nil {
+		t.Fatalf("NewDecoder failed: %v", err)
+	}
+	if n, err := decoder.Read(make([]byte, 10)); n != 0 || err != io.EOF {
+		t.Errorf("Expected EOF, got %d, %v", n, err)
+	}
+	if pos, err := decoder.Seek(0, io.SeekStart); pos != 0 || err != nil {
+		t.Errorf("Seek to 0 failed: %d, %v", pos, err)
+	}
+	if _, err := decoder.Seek(1, io.SeekStart); err == nil {
+		t.Error("Expected an error seeking past the end")
+	}
+	var out bytes.Buffer
+	if n, err := decoder.WriteTo(&out); n != 0 || err != nil {
+		t.Errorf("WriteTo failed: %d, %v", n, err)
+	}
+	if n, err := decoder.ReadAt(make([]byte, 10), 0); n != 0 || err != io.EOF {
+		t.Errorf("Expected EOF from ReadAt, got %d, %v", n, err)
+	}
+	decoder.SetUpperFrame(5)
+	if n, err := decoder.Read(make([]byte, 10)); n != 0 || err != io.EOF {
+		t.Errorf("Expected EOF after SetUpperFrame, got %d, %v", n, err)
+	}
+	if frame, err := decoder.TestIntegrity(); frame != 0 || err != nil {
+		t.Errorf("TestIntegrity failed at frame %d: %v", frame, err)
+	}
+
+	decoded, err := DecodeAll(buf.Bytes(), &DecoderOptions{Prefetch: true})
+	if err != nil || len(decoded) != 0 {
+		t.Errorf("Expected empty output, got %d bytes, %v", len(decoded), err)
+	}
+}
+
+func TestDecoder_HeadFormat(t *testing.T) {
+	data := bytes.Repeat([]byte("head format round trip "), 2000)
+	opts := DefaultEncoderOptions()
+	opts.FramePolicy = UncompressedFrameSize{Size: 8192}
+	opts.HeadSeekTable = true
+
+	var buf bytes.Buffer
+	encoder, err := NewEncoder(&buf, opts)
+	if err != nil {
+		t.Fatalf("NewEncoder failed: %v", err)
+	}
+	if _, err := encoder.Write(data); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("Expected frames to be held until Finish, %d bytes written", buf.Len())
+	}
+	if err := encoder.Finish(); err != nil {
+		t.Fatalf("Finish failed: %v", err)
+	}
+
+	// The encoder's output is decoded as written, with no seek table given
+	archive := buf.Bytes()
+	r := bytes.NewReader(archive)
+	if format, _, err := ArchiveFormat(r); err != nil || format != FormatHead {
+		t.Fatalf("Expected FormatHead, got %v, %v", format, err)
+	}
+
+	decoder, err := NewDecoder(r, nil)
+	if err != nil {
+		t.Fatalf("NewDecoder failed: %v", err)
+	}
+	if !decoder.SeekTable().Equal(encoder.SeekTable()) {
+		t.Error("Seek table differs from the one written")
+	}
+	decoded, err := io.ReadAll(decoder)
+	if err != nil || !bytes.Equal(decoded, data) {
+		t.Fatalf("Round trip failed: %v", err)
+	}
+
+	// Seeking uses frame offsets relative to the end of the table
+	if _, err := decoder.Seek(20000, io.SeekStart); err != nil {
+		t.Fatalf("Seek failed: %v", err)
+	}
+	part := make([]byte, 100)
+	if _, err := io.ReadFull(decoder, part); err != nil || !bytes.Equal(part, data[20000:20100]) {
+		t.Errorf("Read after Seek returned wrong data: %v", err)
+	}
+
+	// In memory, frames are sliced from after the table too
+	decoded, err = DecodeAll(archive, nil)
+	if err != nil || !bytes.Equal(decoded, data) {
+		t.Fatalf("DecodeAll failed: %v", err)
+	}
+	inMemory, err := NewDecoderBytes(archive, nil)
+	if err != nil {
+		t.Fatalf("NewDecoderBytes failed: %v", err)
+	}
+	if _, err := inMemory.Seek(20000, io.SeekStart); err != nil {
+		t.Fatalf("Seek failed: %v", err)
+	}
+	if _, err := io.ReadFull(inMemory, part); err != nil || !bytes.Equal(part, data[20000:20100]) {
+		t.Errorf("Read from memory after Seek returned wrong data: %v", err)
+	}
+}
+
+func TestDecoder_AllowNonSeekable(t *testing.T) {
+	data := bytes.Repeat([]byte("plain zstd stream "), 5000)
+	encoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatalf("zstd.NewWriter failed: %v", err)
+	}
+	plain := encoder.EncodeAll(data, nil)
+	empty := encoder.EncodeAll(nil, nil)
+	encoder.Close()
+
+	if _, err := NewDecoder(bytes.NewReader(plain), nil); err == nil || err.Error() != ErrNoSeekTable {
+		t.Errorf("Expected %q without AllowNonSeekable, got %v", ErrNoSeekTable, err)
+	}
+
+	opts := DefaultDecoderOptions()
+	opts.AllowNonSeekable = true
+	decoder, err := NewDecoder(bytes.NewReader(plain), opts)
+	if err != nil {
+		t.Fatalf("NewDecoder failed: %v", err)
+	}
+	decoded, err := io.ReadAll(decoder)
+	if err != nil || !bytes.Equal(decoded, data) {
+		t.Errorf("Reading plain stream failed: %v", err)
+	}
+	if _, err := decoder.Seek(0, io.SeekStart); err == nil || err.Error() != ErrNotSeekable {
+		t.Errorf("Expected %q from Seek, got %v", ErrNotSeekable, err)
+	}
+	if _, err := decoder.ReadAt(make([]byte, 1), 0); err == nil || err.Error() != ErrNotSeekable {
+		t.Errorf("Expected %q from ReadAt, got %v", ErrNotSeekable, err)
+	}
+
+	// WriteTo, and streams too short to hold a seek table
+	for _, tt := range []struct {
+		stream, want []byte
+	}{{plain, data}, {empty, nil}} {
+		if err := decoder.Reset(bytes.NewReader(tt.stream), opts); err != nil {
+			t.Fatalf("Reset failed: %v", err)
+		}
+		var out bytes.Buffer
+		if _, err := io.Copy(&out, decoder); err != nil || !bytes.Equal(out.Bytes(), tt.want) {
+			t.Errorf("WriteTo of a %d byte stream failed: %v", len(tt.stream), err)
+		}
+	}
+
+	// Seekable archives are still decoded through their seek table
+	var buf bytes.Buffer
+	if _, err := CompressSeekable(&buf, data, nil); err != nil {
+		t.Fatalf("CompressSeekable failed: %v", err)
+	}
+	if err := decoder.Reset(bytes.NewReader(buf.Bytes()), opts); err != nil {
+		t.Fatalf("Reset failed: %v", err)
+	}
+	if _, err := decoder.Seek(100, io.SeekStart); err != nil {
+		t.Errorf("Seek on a seekable archive failed: %v", err)
+	}
+}
+
+// offsetRecorder records the source offset of every Read
+type offsetRecorder struct {
+	*bytes.Reader
+	offsets []int64
+}
+
+func (r *offsetRecorder) Read(p []byte) (int, error) {
+	pos, _ := r.Reader.Seek(0, io.SeekCurrent)
+	r.offsets = append(r.offsets, pos)
+	return r.Reader.Read(p)
+}
+
+func TestDecoder_DictionaryLastFrame(t *testing.T) {
+	samples := dictSamples(300)
+	dict, err := TrainDictionary(samples, 4*1024)
+	if err != nil {
+		t.Fatalf("TrainDictionary failed: %v", err)
+	}
+
+	data := bytes.Join(samples, nil)
+	encoderOpts := DefaultEncoderOptions()
+	encoderOpts.FramePolicy = UncompressedFrameSize{Size: 2048}
+	encoderOpts.CompressionDict = dict
+	var buf bytes.Buffer
+	st, err := CompressSeekable(&buf, data, encoderOpts)
+	if err != nil {
+		t.Fatalf("CompressSeekable failed: %v", err)
+	}
+
+	source := &offsetRecorder{Reader: bytes.NewReader(buf.Bytes())}
+	decoderOpts := DefaultDecoderOptions()
+	decoderOpts.Dict = dict
+	decoder, err := NewDecoder(source, decoderOpts)
+	if err != nil {
+		t.Fatalf("NewDecoder failed: %v", err)
+	}
+
+	last := st.NumFrames() - 1
+	start, _ := st.FrameStartDecomp(last)
+	startComp, _ := st.FrameStartComp(last)
+	source.offsets = nil
+	if _, err := decoder.Seek(int64(start), io.SeekStart); err != nil {
+		t.Fatalf("Seek failed: %v", err)
+	}
+	got, err := io.ReadAll(decoder)
+	if err != nil || !bytes.Equal(got, data[start:]) {
+		t.Fatalf("Decoding the last frame failed: %v", err)
+	}
+
+	for _, offset := range source.offsets {
+		if offset < int64(startComp) {
+			t.Errorf("Read at offset %d, before the last frame at %d", offset, startComp)
+		}
+	}
+
+	// The frames depend on the dictionary
+	decoder, err = NewDecoderBytes(buf.Bytes(), nil)
+	if err != nil {
+		t.Fatalf("NewDecoderBytes failed: %v", err)
+	}
+	if _, err := io.ReadAll(decoder); err == nil {
+		t.Error("Expected decoding without the dictionary to fail")
+	}
+}
+
+func TestDecoder_FrameCache(t *testing.T) {
+	data := make([]byte, 40000)
+	rand.New(rand.NewSource(3)).Read(data)
+	encoderOpts := DefaultEncoderOptions()
+	encoderOpts.FramePolicy = UncompressedFrameSize{Size: 10000}
+	var buf bytes.Buffer
+	if _, err := CompressSeekable(&buf, data, encoderOpts); err != nil {
+		t.Fatalf("CompressSeekable failed: %v", err)
+	}
+
+	source := &offsetRecorder{Reader: bytes.NewReader(buf.Bytes())}
+	opts := DefaultDecoderOptions()
+	opts.FrameCacheSize = 2
+	decoder, err := NewDecoder(source, opts)
+	if err != nil {
+		t.Fatalf("NewDecoder failed: %v", err)
+	}
+
+	// readAt reads from the decoder and reports how many source reads it took
+	readAt := func(off int) int {
+		t.Helper()
+		source.offsets = nil
+		p := make([]byte, 100)
+		if _, err := decoder.ReadAt(p, int64(off)); err != nil || !bytes.Equal(p, data[off:off+100]) {
+			t.Fatalf("ReadAt(%d) failed: %v", off, err)
+		}
+		return len(source.offsets)
+	}
+	if readAt(15000) == 0 {
+		t.Error("Expected the first read to decompress frame 1")
+	}
+	if n := readAt(12000); n != 0 {
+		t.Errorf("Expected a repeated read of frame 1 to hit the cache, got %d source reads", n)
+	}
+
+	// Seek and Read share the cache
+	source.offsets = nil
+	if _, err := decoder.Seek(18000, io.SeekStart); err != nil {
+		t.Fatalf("Seek failed: %v", err)
+	}
+	p := make([]byte, 100)
+	if _, err := io.ReadFull(decoder, p); err != nil || !bytes.Equal(p, data[18000:18100]) {
+		t.Fatalf("Read after Seek failed: %v", err)
+	}
+	if len(source.offsets) != 0 {
+		t.Errorf("Expected Seek into frame 1 to hit the cache, got %d source reads", len(source.offsets))
+	}
+
+	// Frames 2 and 3 evict frame 1
+	readAt(25000)
+	readAt(35000)
+	if readAt(15000) == 0 {
+		t.Error("Expected frame 1 to be evicted")
+	}
+
+	if _, err := decoder.Seek(0, io.SeekStart); err != nil {
+		t.Fatalf("Seek failed: %v", err)
+	}
+	if decoded, err := io.ReadAll(decoder); err != nil || !bytes.Equal(decoded, data) {
+		t.Errorf("Full read with a frame cache failed: %v", err)
+	}
+}
+
+func TestDecoder_Prefetch(t *testing.T) {
+	data := make([]byte, 200000)
+	rand.New(rand.NewSource(4)).Read(data[:100000])
+	encoderOpts := DefaultEncoderOptions()
+	encoderOpts.FramePolicy = UncompressedFrameSize{Size: 7000}
+	var buf bytes.Buffer
+	if _, err := CompressSeekable(&buf, data, encoderOpts); err != nil {
+		t.Fatalf("CompressSeekable failed: %v", err)
+	}
+
+	opts := DefaultDecoderOptions()
+	opts.Prefetch = true
+	decoder, err := NewDecoder(bytes.NewReader(buf.Bytes()), opts)
+	if err != nil {
+		t.Fatalf("NewDecoder failed: %v", err)
+	}
+
+	// Prefetched output matches the serial decode through Read and WriteTo
+	if decoded, err := io.ReadAll(decoder); err != nil || !bytes.Equal(decoded, data) {
+		t.Fatalf("Read with Prefetch returned wrong content: %v", err)
+	}
+	decoder.Seek(0, io.SeekStart)
+	var out bytes.Buffer
+	if _, err := io.Copy(&out, decoder); err != nil || !bytes.Equal(out.Bytes(), data) {
+		t.Fatalf("WriteTo with Prefetch returned wrong content: %v", err)
+	}
+
+	// Seeking and ReadAt while frames are being prefetched
+	decoder.Seek(0, io.SeekStart)
+	p := make([]byte, 10000)
+	io.ReadFull(decoder, p)
+	if _, err := decoder.ReadAt(p, 50000); err != nil || !bytes.Equal(p, data[50000:60000]) {
+		t.Fatalf("ReadAt during Prefetch returned wrong content: %v", err)
+	}
+	if _, err := io.ReadFull(decoder, p); err != nil || !bytes.Equal(p, data[10000:20000]) {
+		t.Fatalf("Read after ReadAt returned wrong content: %v", err)
+	}
+	if _, err := decoder.Seek(123456, io.SeekStart); err != nil {
+		t.Fatalf("Seek failed: %v", err)
+	}
+	if decoded, err := io.ReadAll(decoder); err != nil || !bytes.Equal(decoded, data[123456:]) {
+		t.Fatalf("Read after Seek returned wrong content: %v", err)
+	}
+
+	// Prefetching stops at the upper frame
+	decoder.SetLowerFrame(3)
+	decoder.SetUpperFrame(9)
+	start, _ := decoder.SeekTable().FrameStartDecomp(3)
+	end, _ := decoder.SeekTable().FrameEndDecomp(9)
+	decoder.Seek(int64(start), io.SeekStart)
+	if decoded, err := io.ReadAll(decoder); err != nil || !bytes.Equal(decoded, data[start:end]) {
+		t.Errorf("Read of a frame range with Prefetch returned wrong content: %v", err)
+	}
+}
+
+func BenchmarkDecoder_Prefetch(b *testing.B) {
+	data := make([]byte, 8<<20)
+	rand.New(rand.NewSource(5)).Read(data)
+	for i := range data {
+		data[i] %= 16
+	}
+	var buf bytes.Buffer
+	if _, err := CompressSeekable(&buf, data, &EncoderOptions{
+		Level:       zstd.SpeedDefault,
+		FramePolicy: UncompressedFrameSize{Size: 256 * 1024},
+	}); err != nil {
+		b.Fatalf("CompressSeekable failed: %v", err)
+	}
+	archive := buf.Bytes()
+
+	for _, prefetch := range []bool{false, true} {
+		b.Run(fmt.Sprintf("Prefetch=%v", prefetch), func(b *testing.B) {
+			opts := DefaultDecoderOptions()
+			opts.Prefetch = prefetch
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				decoder, err := NewDecoder(bytes.NewReader(archive), opts)
+				if err != nil {
+					b.Fatalf("NewDecoder failed: %v", err)
+				}
+				if _, err := io.Copy(io.Discard, decoder); err != nil {
+					b.Fatalf("Copy failed: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestDecoder_VerifyLength(t *testing.T) {
+	data := make([]byte, 30000)
+	rand.New(rand.NewSource(6)).Read(data)
+	encoderOpts := DefaultEncoderOptions()
+	encoderOpts.FramePolicy = UncompressedFrameSize{Size: 10000}
+	var buf bytes.Buffer
+	encoder, err := NewEncoder(&buf, encoderOpts)
+	if err != nil {
+		t.Fatalf("NewEncoder failed: %v", err)
+	}
+	encoder.Write(data)
+	if err := encoder.Finish(); err != nil {
+		t.Fatalf("Finish failed: %v", err)
+	}
+	archive := buf.Bytes()
+	framesEnd := int(encoder.WrittenCompressed())
+
+	opts := DefaultDecoderOptions()
+	opts.VerifyLength = true
+	if _, err := NewDecoder(bytes.NewReader(archive), opts); err != nil {
+		t.Fatalf("VerifyLength rejected a complete archive: %v", err)
+	}
+
+	// The last frame lost its final 10 bytes but the seek table survived
+	truncated := append(append([]byte(nil), archive[:framesEnd-10]...), archive[framesEnd:]...)
+	_, err = NewDecoder(bytes.NewReader(truncated), opts)
+	want := fmt.Sprintf("%s: expected at least %d bytes, got %d", ErrArchiveTruncated, len(archive), len(truncated))
+	if err == nil || err.Error() != want {
+		t.Errorf("Expected %q, got %v", want, err)
+	}
+
+	// With the seek table supplied, only the frames need to be present
+	opts.SeekTable = encoder.SeekTable()
+	_, err = NewDecoder(bytes.NewReader(archive[:framesEnd-10]), opts)
+	if err == nil || !strings.HasPrefix(err.Error(), ErrArchiveTruncated) {
+		t.Errorf("Expected %s for truncated frames, got %v", ErrArchiveTruncated, err)
+	}
+
+	// Without VerifyLength the truncation is found when reading
+	opts.VerifyLength = false
+	decoder, err := NewDecoder(bytes.NewReader(archive[:framesEnd-10]), opts)
+	if err != nil {
+		t.Fatalf("NewDecoder failed: %v", err)
+	}
+	if _, err := io.ReadAll(decoder); err == nil {
+		t.Error("Expected reading a truncated archive to fail")
+	}
+}
+
+func TestDecoder_CompressedOffsetFor(t *testing.T) {
+	data := make([]byte, 25000)
+	rand.New(rand.NewSource(8)).Read(data)
+	encoderOpts := DefaultEncoderOptions()
+	encoderOpts.FramePolicy = UncompressedFrameSize{Size: 10000}
+	var buf bytes.Buffer
+	st, err := CompressSeekable(&buf, data, encoderOpts)
+	if err != nil {
+		t.Fatalf("CompressSeekable failed: %v", err)
+	}
+	archive := buf.Bytes()
+
+	decoder, err := NewDecoder(bytes.NewReader(archive), nil)
+	if err != nil {
+		t.Fatalf("NewDecoder failed: %v", err)
+	}
+	for _, tc := range []struct {
+		offset uint64
+		frame  uint32
+	}{
+		{0, 0}, {9999, 0}, {10000, 1}, {15000, 1}, {24999, 2},
+	} {
+		start, end, frame, err := decoder.CompressedOffsetFor(tc.offset)
+		if err != nil {
+			t.Fatalf("CompressedOffsetFor(%d) failed: %v", tc.offset, err)
+		}
+		wantStart, _ := st.FrameStartComp(tc.frame)
+		wantEnd, _ := st.FrameEndComp(tc.frame)
+		if frame != tc.frame || start != wantStart || end != wantEnd {
+			t.Errorf("CompressedOffsetFor(%d) = [%d, %d) frame %d, expected [%d, %d) frame %d",
+				tc.offset, start, end, frame, wantStart, wantEnd, tc.frame)
+		}
+
+		// The range alone is enough to decode the frame
+		frameStart, _ := st.FrameStartDecomp(frame)
+		frameEnd, _ := st.FrameEndDecomp(frame)
+		decoded, err := DecodeByScanning(bytes.NewReader(archive[start:end]), 1)
+		if err != nil || !bytes.Equal(decoded, data[frameStart:frameEnd]) {
+			t.Errorf("Decoding [%d, %d) failed: %v", start, end, err)
+		}
+	}
+
+	if _, _, _, err := decoder.CompressedOffsetFor(uint64(len(data))); err == nil ||
+		!strings.HasPrefix(err.Error(), ErrFrameIndexTooLarge) {
+		t.Errorf("Expected %s past the end, got %v", ErrFrameIndexTooLarge, err)
+	}
+}
+
+func TestDecoder_SeekDecodesOneFrame(t *testing.T) {
+	archive, data := createTinyFrameArchive(t, 1000)
+
+	for _, prefetch := range []bool{false, true} {
+		var decoded []uint32
+		opts := DefaultDecoderOptions()
+		opts.Prefetch = prefetch
+		opts.OnFrame = func(frameIndex uint32, decompressed uint64) {
+			decoded = append(decoded, frameIndex)
+		}
+		decoder, err := NewDecoder(bytes.NewReader(archive), opts)
+		if err != nil {
+			t.Fatalf("NewDecoder failed: %v", err)
+		}
+
+		pos, err := decoder.Seek(-5, io.SeekEnd)
+		if err != nil {
+			t.Fatalf("Seek failed: %v", err)
+		}
+		if pos != int64(len(data)-5) {
+			t.Errorf("Seek returned %d, expected %d", pos, len(data)-5)
+		}
+		if len(decoded) != 1 || decoded[0] != 999 {
+			t.Errorf("prefetch %v: expected only frame 999 decoded, got %v", prefetch, decoded)
+		}
+		got, err := io.ReadAll(decoder)
+		if err != nil || string(got) != string(data[len(data)-5:]) {
+			t.Errorf("read %q after Seek: %v", got, err)
+		}
+
+		// Seeking into a frame followed by more tiny frames decodes no
+		// more than that frame
+		decoded = nil
+		start, _ := decoder.SeekTable().FrameStartDecomp(500)
+		if _, err := decoder.Seek(int64(start)+3, io.SeekStart); err != nil {
+			t.Fatalf("Seek failed: %v", err)
+		}
+		if len(decoded) != 1 || decoded[0] != 500 {
+			t.Errorf("prefetch %v: expected only frame 500 decoded, got %v", prefetch, decoded)
+		}
+		got, err = io.ReadAll(decoder)
+		if err != nil || !bytes.Equal(got, data[start+3:]) {
+			t.Errorf("read %d bytes after Seek, expected %d: %v", len(got), len(data)-int(start)-3, err)
+		}
+	}
+}
+
+func TestDecoder_SeekOutOfRange(t *testing.T) {
+	archive := createTestArchive(t, [][]byte{[]byte("AAAAAAAAAA"), []byte("BBBBBBBBBB")})
+	decoder, err := NewDecoder(bytes.NewReader(archive.Bytes()), nil)
+	if err != nil {
+		t.Fatalf("NewDecoder failed: %v", err)
+	}
+	if _, err := decoder.Seek(15, io.SeekStart); err != nil {
+		t.Fatalf("Seek failed: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		offset int64
+		whence int
+	}{
+		{"negative start", -5, io.SeekStart},
+		{"current underflow", -16, io.SeekCurrent},
+		{"end underflow", -21, io.SeekEnd},
+		{"past end", 21, io.SeekStart},
+		{"current past end", 6, io.SeekCurrent},
+		{"end past end", 1, io.SeekEnd},
+	}
+	for _, tt := range tests {
+		if _, err := decoder.Seek(tt.offset, tt.whence); err == nil ||
+			!strings.HasPrefix(err.Error(), ErrSeekOutOfRange) {
+			t.Errorf("%s: expected %s, got %v", tt.name, ErrSeekOutOfRange, err)
+		}
+	}
+
+	// A failed seek leaves the position alone
+	if pos, err := decoder.Seek(0, io.SeekCurrent); err != nil || pos != 15 {
+		t.Errorf("expected position 15, got %d: %v", pos, err)
+	}
+	if pos, err := decoder.Seek(-15, io.SeekCurrent); err != nil || pos != 0 {
+		t.Errorf("expected position 0, got %d: %v", pos, err)
+	}
+	if pos, err := decoder.Seek(0, io.SeekEnd); err != nil || pos != 20 {
+		t.Errorf("expected position 20, got %d: %v", pos, err)
+	}
+
+	// A frame range bounds seeking, and SeekEnd is relative to its end
+	archive = createTestArchive(t, [][]byte{[]byte("AAAAAAAAAA"), []byte("BBBBBBBBBB"), []byte("CCCCCCCCCC")})
+	opts := DefaultDecoderOptions()
+	opts.LowerFrame = 1
+	opts.UpperFrame = 1
+	opts.UpperFrameSet = true
+	decoder, err = NewDecoder(bytes.NewReader(archive.Bytes()), opts)
+	if err != nil {
+		t.Fatalf("NewDecoder failed: %v", err)
+	}
+	for _, offset := range []int64{9, 21, 30} {
+		if _, err := decoder.Seek(offset, io.SeekStart); err == nil ||
+			!strings.HasPrefix(err.Error(), ErrSeekOutOfRange) {
+			t.Errorf("offset %d outside the frame range: expected %s, got %v", offset, ErrSeekOutOfRange, err)
+		}
+	}
+	if pos, err := decoder.Seek(-5, io.SeekEnd); err != nil || pos != 15 {
+		t.Fatalf("expected position 15, got %d: %v", pos, err)
+	}
+	if got, err := io.ReadAll(decoder); err != nil || string(got) != "BBBBB" {
+		t.Errorf("expected the end of frame 1, got %q: %v", got, err)
+	}
+	if pos, err := decoder.Seek(0, io.SeekEnd); err != nil || pos != 20 {
+		t.Errorf("expected position 20, got %d: %v", pos, err)
+	}
+	if n, err := decoder.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Errorf("expected EOF at the end of the range, got %d, %v", n, err)
+	}
+	if pos, err := decoder.Seek(10, io.SeekStart); err != nil || pos != 10 {
+		t.Errorf("expected position 10, got %d: %v", pos, err)
+	}
+	if got, err := io.ReadAll(decoder); err != nil || string(got) != "BBBBBBBBBB" {
+		t.Errorf("expected frame 1 after seeking back, got %q: %v", got, err)
+	}
+}
+
+func TestDecoder_OnFrame(t *testing.T) {
+	frames := [][]byte{
+		[]byte("first frame"),
+		bytes.Repeat([]byte("second "), 100),
+		[]byte("3"),
+		bytes.Repeat([]byte("fourth frame "), 50),
+	}
+	archive := createTestArchive(t, frames).Bytes()
+	data := bytes.Join(frames, nil)
+
+	type call struct {
+		index uint32
+		end   uint64
+	}
+	var want []call
+	var end uint64
+	for i, frame := range frames {
+		end += uint64(len(frame))
+		want = append(want, call{uint32(i), end})
+	}
+
+	for _, mode := range []string{"Read", "ReadStreamed", "ReadPrefetch", "WriteTo"} {
+		t.Run(mode, func(t *testing.T) {
+			var calls []call
+			opts := DefaultDecoderOptions()
+			opts.Prefetch = mode == "ReadPrefetch"
+			opts.OnFrame = func(frameIndex uint32, decompressed uint64) {
+				calls = append(calls, call{frameIndex, decompressed})
+			}
+			decoder, err := NewDecoder(bytes.NewReader(archive), opts)
+			if err != nil {
+				t.Fatalf("NewDecoder failed: %v", err)
+			}
+			decoder.streamRuns = mode == "ReadStreamed"
+
+			var out bytes.Buffer
+			if mode == "WriteTo" {
+				_, err = decoder.WriteTo(&out)
+			} else {
+				// Small reads split every frame across several calls
+				p := make([]byte, 7)
+				for err == nil {
+					var n int
+					n, err = decoder.Read(p)
+					out.Write(p[:n])
+				}
+				if err == io.EOF {
+					err = nil
+				}
+			}
+			if err != nil || !bytes.Equal(out.Bytes(), data) {
+				t.Fatalf("decoded %d bytes: %v", out.Len(), err)
+			}
+			if fmt.Sprint(calls) != fmt.Sprint(want) {
+				t.Errorf("OnFrame calls %v, expected %v", calls, want)
+			}
+		})
+	}
+}
+
+// rangeRecorder is an io.ReaderAt recording the ranges read from it, like
+// an object store client issuing ranged GETs
+type rangeRecorder struct {
+	data   []byte
+	ranges [][2]int64
+}
+
+func (r *rangeRecorder) ReadAt(p []byte, off int64) (int, error) {
+	r.ranges = append(r.ranges, [2]int64{off, off + int64(len(p))})
+	if off >= int64(len(r.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, r.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func TestNewReaderAtSeekable(t *testing.T) {
+	data := make([]byte, 200000)
+	rand.New(rand.NewSource(13)).Read(data)
+	opts := DefaultEncoderOptions()
+	opts.FramePolicy = UncompressedFrameSize{Size: 20000}
+	archive, err := EncodeAll(data, opts)
+	if err != nil {
+		t.Fatalf("EncodeAll failed: %v", err)
+	}
+
+	ra := &rangeRecorder{data: archive}
+	decoder, err := NewDecoder(NewReaderAtSeekable(ra, int64(len(archive))), nil)
+	if err != nil {
+		t.Fatalf("NewDecoder failed: %v", err)
+	}
+	decoded, err := io.ReadAll(decoder)
+	if err != nil || !bytes.Equal(decoded, data) {
+		t.Fatalf("decoding through ReaderAt failed: %v", err)
+	}
+
+	// Reading one frame fetches only that frame's compressed bytes
+	st := decoder.SeekTable()
+	start, _ := st.FrameStartComp(5)
+	end, _ := st.FrameEndComp(5)
+	ra.ranges = nil
+	p := make([]byte, 100)
+	if _, err := decoder.ReadAt(p, 5*20000+10); err != nil {
+		t.Fatalf("ReadAt failed: %v", err)
+	}
+	if !bytes.Equal(p, data[5*20000+10:5*20000+110]) {
+		t.Error("ReadAt returned wrong data")
+	}
+	var fetched int64
+	for _, r := range ra.ranges {
+		if r[0] < int64(start) || r[1] > int64(end) {
+			t.Errorf("fetched %v outside frame 5 at [%d, %d)", r, start, end)
+		}
+		fetched += r[1] - r[0]
+	}
+	if fetched != int64(end-start) {
+		t.Errorf("fetched %d bytes for a %d byte frame", fetched, end-start)
+	}
+}
+
+func TestDecoder_StreamChecksum(t *testing.T) {
+	data := make([]byte, 300000)
+	rand.New(rand.NewSource(1)).Read(data)
+	want := newXXH64()
+	want.Write(data)
+
+	for _, concurrency := range []int{1, 4} {
+		var buf bytes.Buffer
+		encoder, err := NewEncoder(&buf, &EncoderOptions{
+			Level:          zstd.SpeedFastest,
+			FramePolicy:    UncompressedFrameSize{Size: 100000},
+			StreamChecksum: true,
+			Concurrency:    concurrency,
+		})
+		if err != nil {
+			t.Fatalf("NewEncoder failed: %v", err)
+		}
+		encoder.Write(data)
+		if err := encoder.Finish(); err != nil {
+			t.Fatalf("Finish failed: %v", err)
+		}
+		archive := buf.Bytes()
+
+		decoder, err := NewDecoderBytes(archive, &DecoderOptions{ComputeChecksum: true})
+		if err != nil {
+			t.Fatalf("NewDecoderBytes failed: %v", err)
+		}
+		stored, ok, err := decoder.StreamChecksum()
+		if err != nil || !ok || stored != want.Sum64() {
+			t.Fatalf("concurrency %d: StreamChecksum() = %x, %v, %v, expected %x", concurrency, stored, ok, err, want.Sum64())
+		}
+		if _, err := io.Copy(io.Discard, struct{ io.Reader }{decoder}); err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+		if decoder.Checksum() != stored {
+			t.Errorf("concurrency %d: Read checksum %x, expected %x", concurrency, decoder.Checksum(), stored)
+		}
+		if frames, err := decoder.TestIntegrity(); err != nil || frames != 3 {
+			t.Errorf("TestIntegrity failed at frame %d: %v", frames, err)
+		}
+
+		// Plain zstd decoders skip the checksum frame
+		zstdDecoder, _ := zstd.NewReader(nil)
+		plain, err := zstdDecoder.DecodeAll(archive, nil)
+		zstdDecoder.Close()
+		if err != nil || !bytes.Equal(plain, data) {
+			t.Errorf("zstd round trip failed: %v", err)
+		}
+
+		// Overwrite frame 1 with frame 0: every frame still decodes, and
+		// without seek table checksums only the stream checksum notices
+		st := encoder.SeekTable()
+		start0, _ := st.FrameStartComp(0)
+		end0, _ := st.FrameEndComp(0)
+		start1, _ := st.FrameStartComp(1)
+		if size, _ := st.FrameSizeComp(1); size != end0-start0 {
+			t.Fatalf("Expected equal frame sizes, got %d and %d", end0-start0, size)
+		}
+		corrupted := bytes.Clone(archive)
+		copy(corrupted[start1:], archive[start0:end0])
+		decoder, err = NewDecoderBytes(corrupted, &DecoderOptions{ComputeChecksum: true})
+		if err != nil {
+			t.Fatalf("NewDecoderBytes failed: %v", err)
+		}
+		if _, err := decoder.WriteTo(io.Discard); err != nil {
+			t.Fatalf("WriteTo failed: %v", err)
+		}
+		if decoder.Checksum() == stored {
+			t.Error("Expected the corrupted content to change the checksum")
+		}
+		if _, err := decoder.TestIntegrity(); err == nil || !strings.HasPrefix(err.Error(), ErrStreamChecksum) {
+			t.Errorf("Expected %s, got %v", ErrStreamChecksum, err)
+		}
+	}
+
+	// Archives without a stream checksum
+	archive, err := EncodeAll(data, nil)
+	if err != nil {
+		t.Fatalf("EncodeAll failed: %v", err)
+	}
+	decoder, err := NewDecoderBytes(archive, nil)
+	if err != nil {
+		t.Fatalf("NewDecoderBytes failed: %v", err)
+	}
+	if _, ok, err := decoder.StreamChecksum(); ok || err != nil {
+		t.Errorf("Expected no stream checksum, got %v, %v", ok, err)
+	}
+	if decoder.Checksum() != 0 {
+		t.Error("Expected Checksum to be 0 without ComputeChecksum")
+	}
+}
+
+func TestDecoder_MaxBufferBytes(t *testing.T) {
+	const limit = 64 * 1024
+	// A frame much larger than the limit between runs of small frames
+	var buf bytes.Buffer
+	encoder, err := NewEncoder(&buf, &EncoderOptions{
+		Level:        zstd.SpeedFastest,
+		FramePolicy:  UncompressedFrameSize{Size: 4 << 20},
+		ChecksumFlag: true,
+	})
+	if err != nil {
+		t.Fatalf("NewEncoder failed: %v", err)
+	}
+	var data []byte
+	write := func(p []byte) {
+		encoder.Write(p)
+		data = append(data, p...)
+		if err := encoder.EndFrame(); err != nil {
+			t.Fatalf("EndFrame failed: %v", err)
+		}
+	}
+	for i := 0; i < 40; i++ {
+		write([]byte(fmt.Sprintf("small frame %d with a few bytes of content ", i)))
+	}
+	// Under streamFrameSize, so only the limit streams it
+	large := make([]byte, 900<<10)
+	for i := range large {
+		large[i] = byte(i/7) ^ byte(i%13)
+	}
+	write(large)
+	for i := 0; i < 40; i++ {
+		write(bytes.Repeat([]byte{byte('a' + i%26)}, 10000))
+	}
+	if err := encoder.Finish(); err != nil {
+		t.Fatalf("Finish failed: %v", err)
+	}
+
+	opts := &DecoderOptions{MaxBufferBytes: limit}
+	decoder, err := NewDecoder(bytes.NewReader(buf.Bytes()), opts)
+	if err != nil {
+		t.Fatalf("NewDecoder failed: %v", err)
+	}
+	checkBuffers := func(when string) {
+		t.Helper()
+		if n := decoder.decompressed.Len(); n > limit {
+			t.Fatalf("%s: %d bytes buffered, limit %d", when, n, limit)
+		}
+		if c := decoder.decompressed.Cap(); c > 2*limit {
+			t.Fatalf("%s: buffer grew to %d bytes", when, c)
+		}
+	}
+
+	var decoded []byte
+	p := make([]byte, 4096)
+	for {
+		n, err := decoder.Read(p)
+		decoded = append(decoded, p[:n]...)
+		checkBuffers("Read")
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+	}
+	if !bytes.Equal(decoded, data) {
+		t.Fatal("Read returned different content")
+	}
+
+	// Seeking into the large frame streams it rather than buffering it
+	largeStart := int64(bytes.Index(data, large[:100]))
+	target := largeStart + int64(len(large))/2
+	if _, err := decoder.Seek(target, io.SeekStart); err != nil {
+		t.Fatalf("Seek failed: %v", err)
+	}
+	checkBuffers("Seek")
+	var rest bytes.Buffer
+	if _, err := decoder.WriteTo(&rest); err != nil {
+		t.Fatalf("WriteTo failed: %v", err)
+	}
+	if !bytes.Equal(rest.Bytes(), data[target:]) {
+		t.Error("WriteTo after Seek returned different content")
+	}
+	if c := cap(decoder.frameData); c > 2*limit {
+		t.Errorf("WriteTo buffer grew to %d bytes", c)
+	}
+
+	// Whole-frame APIs refuse the large frame
+	if _, err := decoder.DecodeFrame(40); err == nil || !strings.HasPrefix(err.Error(), ErrBufferLimit) {
+		t.Errorf("Expected %s from DecodeFrame, got %v", ErrBufferLimit, err)
+	}
+	if _, err := decoder.ReadAt(p, largeStart); err == nil || !strings.HasPrefix(err.Error(), ErrBufferLimit) {
+		t.Errorf("Expected %s from ReadAt, got %v", ErrBufferLimit, err)
+	}
+	if frame, err := decoder.DecodeFrame(41); err != nil || len(frame) != 10000 {
+		t.Errorf("DecodeFrame(41) returned %d bytes, %v", len(frame), err)
+	}
+}
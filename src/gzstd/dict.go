@@ -0,0 +1,49 @@
+package gzstd
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/klauspost/compress/dict"
+)
+
+const (
+	// zstdDictMagic starts every formatted zstd dictionary
+	zstdDictMagic = 0xEC30A437
+
+	ErrInvalidDict = "not a zstd dictionary with an ID"
+)
+
+// DictID returns the ID of a formatted zstd dictionary. Frames compressed
+// with the dictionary record the ID in their header, which is how decoders
+// given several dictionaries in DecoderOptions.Dicts pick the right one.
+func DictID(dict []byte) (uint32, error) {
+	if len(dict) < 8 || binary.LittleEndian.Uint32(dict[0:4]) != zstdDictMagic {
+		return 0, errors.New(ErrInvalidDict)
+	}
+	id := binary.LittleEndian.Uint32(dict[4:8])
+	if id == 0 {
+		return 0, fmt.Errorf("%s: dictionary ID is 0", ErrInvalidDict)
+	}
+	return id, nil
+}
+
+// TrainDictionary builds a zstd dictionary of at most maxDictSize bytes from
+// sample inputs, such as individual records of the data to be compressed.
+// The result can be used as EncoderOptions.CompressionDict and
+// DecoderOptions.Dict. Dictionaries help most when frames are small and
+// share structure, as with frames of similar JSON log lines.
+func TrainDictionary(samples [][]byte, maxDictSize int) ([]byte, error) {
+	if len(samples) == 0 {
+		return nil, errors.New("no dictionary samples")
+	}
+	if maxDictSize <= 0 {
+		return nil, errors.New("invalid dictionary size")
+	}
+
+	return dict.BuildZstdDict(samples, dict.Options{
+		MaxDictSize: maxDictSize,
+		HashBytes:   6,
+	})
+}
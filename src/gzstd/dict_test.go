@@ -0,0 +1,156 @@
+package gzstd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// dictSamples returns small JSON records sharing most of their structure
+func dictSamples(n int) [][]byte {
+	samples := make([][]byte, n)
+	for i := range samples {
+		samples[i] = []byte(fmt.Sprintf(`{"timestamp":"2024-01-01T00:00:%02dZ","level":"info","service":"checkout","message":"order processed","order_id":%d,"duration_ms":%d}`+"\n",
+			i%60, 100000+i*7, i%250))
+	}
+	return samples
+}
+
+func TestTrainDictionary(t *testing.T) {
+	samples := dictSamples(300)
+	dictionary, err := TrainDictionary(samples, 4*1024)
+	if err != nil {
+		t.Fatalf("TrainDictionary failed: %v", err)
+	}
+	if len(dictionary) == 0 || len(dictionary) > 4*1024 {
+		t.Fatalf("Unexpected dictionary size %d", len(dictionary))
+	}
+
+	// One record per frame, where a dictionary matters most
+	data := bytes.Join(dictSamples(500), nil)
+	compress := func(dict []byte) []byte {
+		opts := DefaultEncoderOptions()
+		opts.FramePolicy = UncompressedFrameSize{Size: uint32(len(samples[0]))}
+		opts.CompressionDict = dict
+		var buf bytes.Buffer
+		if _, err := CompressSeekable(&buf, data, opts); err != nil {
+			t.Fatalf("CompressSeekable failed: %v", err)
+		}
+		return buf.Bytes()
+	}
+	plain := compress(nil)
+	withDict := compress(dictionary)
+	if len(withDict) >= len(plain) {
+		t.Errorf("Expected the dictionary to shrink the archive: %d bytes with, %d without", len(withDict), len(plain))
+	}
+
+	opts := DefaultDecoderOptions()
+	opts.Dict = dictionary
+	decoder, err := NewDecoderBytes(withDict, opts)
+	if err != nil {
+		t.Fatalf("NewDecoderBytes failed: %v", err)
+	}
+	decoded, err := io.ReadAll(decoder)
+	if err != nil || !bytes.Equal(decoded, data) {
+		t.Errorf("Round trip with dictionary failed: %v", err)
+	}
+
+	if _, err := TrainDictionary(nil, 1024); err == nil {
+		t.Error("Expected error without samples")
+	}
+}
+
+func TestEncoder_SetFrameDict(t *testing.T) {
+	jsonDict, err := TrainDictionary(dictSamples(300), 4*1024)
+	if err != nil {
+		t.Fatalf("TrainDictionary failed: %v", err)
+	}
+	csvSamples := make([][]byte, 300)
+	for i := range csvSamples {
+		csvSamples[i] = []byte(fmt.Sprintf("%d,checkout,order processed,%d,%d.%02d EUR\n", 100000+i*7, i%250, i%90, i%100))
+	}
+	csvDict, err := TrainDictionary(csvSamples, 4*1024)
+	if err != nil {
+		t.Fatalf("TrainDictionary failed: %v", err)
+	}
+	jsonID, _ := DictID(jsonDict)
+	csvID, _ := DictID(csvDict)
+	if jsonID == csvID {
+		t.Fatalf("Expected distinct dictionary IDs, both are %d", jsonID)
+	}
+
+	records := [][]byte{dictSamples(1)[0], csvSamples[0], dictSamples(2)[1], []byte("no dictionary")}
+	dicts := [][]byte{jsonDict, csvDict, jsonDict, nil}
+	for _, concurrency := range []int{1, 4} {
+		var buf bytes.Buffer
+		encoder, err := NewEncoder(&buf, &EncoderOptions{
+			Level:       zstd.SpeedDefault,
+			FramePolicy: UncompressedFrameSize{Size: 1 << 20},
+			Concurrency: concurrency,
+		})
+		if err != nil {
+			t.Fatalf("NewEncoder failed: %v", err)
+		}
+		for i, record := range records {
+			if dicts[i] != nil {
+				if err := encoder.SetFrameDict(dicts[i]); err != nil {
+					t.Fatalf("SetFrameDict failed: %v", err)
+				}
+			}
+			encoder.Write(record)
+			if err := encoder.EndFrame(); err != nil {
+				t.Fatalf("EndFrame failed: %v", err)
+			}
+		}
+		if err := encoder.Finish(); err != nil {
+			t.Fatalf("Finish failed: %v", err)
+		}
+		archive := buf.Bytes()
+
+		// Each frame header records its dictionary
+		st := encoder.SeekTable()
+		for i, dict := range dicts {
+			start, _ := st.FrameStartComp(uint32(i))
+			var header zstd.Header
+			if err := header.Decode(archive[start:]); err != nil {
+				t.Fatalf("frame %d: decoding header failed: %v", i, err)
+			}
+			var want uint32
+			if dict != nil {
+				want, _ = DictID(dict)
+			}
+			if header.DictionaryID != want {
+				t.Errorf("concurrency %d: frame %d has dictionary %d, expected %d", concurrency, i, header.DictionaryID, want)
+			}
+		}
+
+		opts := DefaultDecoderOptions()
+		opts.Dicts = map[uint32][]byte{jsonID: jsonDict, csvID: csvDict}
+		decoded, err := DecodeAll(archive, opts)
+		if err != nil || !bytes.Equal(decoded, bytes.Join(records, nil)) {
+			t.Errorf("concurrency %d: round trip failed: %v", concurrency, err)
+		}
+
+		if _, err := DecodeAll(archive, nil); err == nil {
+			t.Errorf("concurrency %d: expected decoding without the dictionaries to fail", concurrency)
+		}
+	}
+
+	archive, err := EncodeAll([]byte("data"), nil)
+	if err != nil {
+		t.Fatalf("EncodeAll failed: %v", err)
+	}
+	opts := DefaultDecoderOptions()
+	opts.Dicts = map[uint32][]byte{jsonID: csvDict}
+	if _, err := NewDecoderBytes(archive, opts); err == nil || !strings.HasPrefix(err.Error(), ErrInvalidDict) {
+		t.Errorf("expected %s for a dictionary under the wrong ID, got %v", ErrInvalidDict, err)
+	}
+	encoder, _ := NewEncoder(io.Discard, nil)
+	if err := encoder.SetFrameDict([]byte("raw content")); err == nil || err.Error() != ErrInvalidDict {
+		t.Errorf("expected %s for raw content, got %v", ErrInvalidDict, err)
+	}
+}
@@ -2,7 +2,16 @@ package gzstd
 
 import (
 	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
+	"log/slog"
+	"math"
+	"math/bits"
+	"sync"
+	"time"
 
 	"github.com/klauspost/compress/zstd"
 )
@@ -10,6 +19,40 @@ import (
 const (
 	MAX_FRAME_SIZE     = 1 << 32    // 4GB max frame size
 	DEFAULT_FRAME_SIZE = 512 * 1024 // 512KB default
+
+	// maxFrameSize is the largest frame the encoder produces, the largest
+	// size a seek table entry's 32-bit fields can hold
+	maxFrameSize = MAX_FRAME_SIZE - 1
+
+	// streamBlockSize is the amount of input the zstd stream buffers before
+	// it emits a compressed block (the zstd maximum block size)
+	streamBlockSize = 128 * 1024
+
+	// Window sizes zstd allows, as log2 bytes
+	minWindowLog = 10
+	maxWindowLog = 29
+
+	// FastLevel(1) uses a window of 1<<fastWindowLog bytes, halved by each
+	// further step down to a stream block, below which zstd would emit
+	// smaller blocks than the frame size policies assume
+	fastWindowLog    = 19
+	minFastWindowLog = 17
+
+	// Error messages
+	ErrDeadlineExceeded   = "encoder deadline exceeded"
+	ErrCanceled           = "operation canceled"
+	ErrInvalidWindowLog   = "invalid window log"
+	ErrInvalidPolicy      = "invalid frame size policy"
+	ErrMetadataMagic      = "invalid skippable metadata magic"
+	ErrMetadataAfterData  = "metadata must be written before the first frame"
+	ErrVerificationFailed = "frame does not decode to its input"
+	ErrEncoderClosed      = "encoder closed"
+	ErrHeadFormat         = "FormatHead requires EncoderOptions.HeadSeekTable"
+
+	// StreamChecksumMagic marks the skippable frame holding the
+	// StreamChecksum, an 8-byte little-endian XXH64
+	StreamChecksumMagic     = 0x184D2A5B
+	streamChecksumFrameSize = SKIPPABLE_HEADER_SIZE + 8
 )
 
 // FrameSizePolicy defines how frames are sized
@@ -34,12 +77,183 @@ type UncompressedFrameSize struct {
 func (u UncompressedFrameSize) isFrameSizePolicy() {}
 func (u UncompressedFrameSize) MaxSize() uint32    { return u.Size }
 
+// HybridFrameSize ends a frame when either its compressed size reaches
+// MaxCompressed or its uncompressed size reaches MaxUncompressed, bounding
+// both seek granularity and how much input a frame can hold back
+type HybridFrameSize struct {
+	MaxCompressed   uint32
+	MaxUncompressed uint32
+}
+
+func (h HybridFrameSize) isFrameSizePolicy() {}
+func (h HybridFrameSize) MaxSize() uint32    { return h.MaxCompressed }
+
+// ContentDefinedFrameSize ends frames at boundaries chosen by a rolling hash
+// over the last Window bytes of uncompressed input (64 when 0), with each
+// frame holding between Min and Max uncompressed bytes. Inserting bytes early
+// in the input then only changes the frames around the insertion, so most
+// later frames stay byte-identical, which helps rsync and deduplicating
+// backups.
+type ContentDefinedFrameSize struct {
+	Min    uint32
+	Max    uint32
+	Window int
+}
+
+func (c ContentDefinedFrameSize) isFrameSizePolicy() {}
+func (c ContentDefinedFrameSize) MaxSize() uint32    { return c.Max }
+
+// mask returns the bits of the rolling hash that must all be set at a
+// boundary, chosen so a boundary usually falls well before Max
+func (c ContentDefinedFrameSize) mask() uint32 {
+	span := (c.Max - c.Min) / 2
+	if c.Max <= c.Min || span == 0 {
+		return 0
+	}
+	return 1<<(bits.Len32(span)-1) - 1
+}
+
+// FastLevel returns an EncoderOptions.Level faster than zstd.SpeedFastest,
+// the counterpart of zstd's negative levels (--fast=n). It skips entropy
+// coding and, as n grows, shrinks the window, trading compression ratio for
+// speed, up to FastLevel(3). n must be at least 1; an explicit WindowLog
+// overrides the window.
+func FastLevel(n int) zstd.EncoderLevel {
+	return zstd.EncoderLevel(-max(n, 1))
+}
+
+// fastLevelOptions returns the zstd options of FastLevel(n)
+func fastLevelOptions(n int) []zstd.EOption {
+	return []zstd.EOption{
+		zstd.WithEncoderLevel(zstd.SpeedFastest),
+		zstd.WithNoEntropyCompression(true),
+		zstd.WithWindowSize(1 << max(fastWindowLog-(n-1), minFastWindowLog)),
+	}
+}
+
+// levelName returns level's name, "fast-n" for FastLevel(n)
+func levelName(level zstd.EncoderLevel) string {
+	if level < 0 {
+		return fmt.Sprintf("fast-%d", -level)
+	}
+	return level.String()
+}
+
 // EncoderOptions configures the encoder
 type EncoderOptions struct {
-	Level           zstd.EncoderLevel
-	FramePolicy     FrameSizePolicy
-	ChecksumFlag    bool
+	Level        zstd.EncoderLevel // zstd levels, or FastLevel for faster ones
+	FramePolicy  FrameSizePolicy
+	ChecksumFlag bool // zstd frame checksums, plus per-frame XXH64 checksums in the seek table
+
+	// CompressionDict is a formatted zstd dictionary, as produced by
+	// TrainDictionary. Every frame is compressed against it independently,
+	// so any single frame can be decoded without the frames before it given
+	// the same DecoderOptions.Dict.
 	CompressionDict []byte
+
+	// PrefixWindow is raw content used to seed the window of every frame, so
+	// each frame is compressed against the same baseline (for example a
+	// previous version of the data). Unlike a zstd dictionary it is arbitrary
+	// bytes with no ID or entropy tables, and the frames do not record it:
+	// decoders must supply the same DecoderOptions.PrefixWindow.
+	//
+	// The prefix is kept in memory by both encoder and decoder, and only its
+	// last window-size bytes can be referenced, so very large prefixes cost
+	// memory without improving the ratio.
+	PrefixWindow []byte
+
+	// WindowLog, if non-zero, sets the zstd window to 1<<WindowLog bytes,
+	// between 10 and 29. A larger window can improve the ratio of large
+	// frames, and a smaller one bounds the memory needed to encode and
+	// decode. Decoders need a DecoderOptions.MaxWindowLog at least this
+	// large. 0 uses the window of the compression level.
+	WindowLog int
+
+	// Deadline, if non-zero, is an absolute time by which compression must
+	// complete. It is checked as each frame ends and after every stream
+	// block (128 KiB) of input, so a large frame overruns it by at most one
+	// block. Once it has passed, the in-progress frame is dropped and the
+	// completed frames are written with their seek table (in FormatHead with
+	// HeadSeekTable, FormatFoot otherwise), leaving a valid truncated
+	// archive. Write then returns ErrDeadlineExceeded, counting only the
+	// input in the written frames, and so does any later call.
+	Deadline time.Time
+
+	// MaxFrameInterval, if non-zero, bounds how long a frame stays open: a
+	// Write arriving once this much time has passed since the frame's first
+	// byte flushes the frame before taking the new data. Streaming producers
+	// use it to bound how stale the readable end of the archive can get.
+	MaxFrameInterval time.Duration
+
+	// Now, if set, replaces time.Now for Deadline and MaxFrameInterval
+	Now func() time.Time
+
+	// IndexWriter, if set, receives each frame's serialized seek table entry
+	// as soon as the frame is ended, so a consumer tailing it can track frame
+	// boundaries before Finish writes the full seek table to the output. A
+	// frame that fills up is only ended by the next Write (see
+	// ContinueFrame), Flush, EndFrame or Finish, not as soon as it is full.
+	IndexWriter io.Writer
+
+	// NoSeekTable leaves the seek table out of the output, which is then a
+	// plain multi-frame zstd stream, for when the index is stored elsewhere
+	// (from SeekTable or IndexWriter). Decoders need the seek table given in
+	// DecoderOptions.SeekTable to seek in it.
+	NoSeekTable bool
+
+	// OnFrame, if set, is called after each frame is written with the frame
+	// index and the cumulative compressed and decompressed byte counts. It
+	// is called once the encoder is ready for the next frame, so it may
+	// write to the encoder itself; that data starts the next frame. Like
+	// IndexWriter, it fires when a full frame is ended by the next Write,
+	// Flush, EndFrame or Finish rather than as soon as the frame fills.
+	OnFrame func(frameIndex uint32, compressed, decompressed uint64)
+
+	// Concurrency, if greater than 1, compresses up to that many frames in
+	// parallel. Finished frames are still written and logged in order on the
+	// calling goroutine, so the output is identical to serial compression.
+	// It only applies to UncompressedFrameSize: with a compressed size limit
+	// a frame's end depends on its own compressed size, so frames are serial.
+	Concurrency int
+
+	// DelimiterFrame, if non-zero, aligns frames to records ending in this
+	// byte (for example '\n' for newline-delimited JSON). A write that would
+	// fill the frame ends it after the last delimiter within the write
+	// window; if the window has none, the frame stays open past the frame
+	// size policy until the next delimiter arrives. Because 0 disables it,
+	// NUL cannot be used as a delimiter.
+	DelimiterFrame byte
+
+	// VerifyFrames decodes each frame as soon as it is compressed and
+	// compares it with the input, failing with ErrVerificationFailed before
+	// a frame that does not round-trip is written. It guards archives
+	// against encoder bugs and memory corruption at the cost of decoding
+	// everything and keeping each frame's input until it ends.
+	VerifyFrames bool
+
+	// StreamChecksum hashes all input with XXH64 and has Finish store the
+	// digest in a skippable frame (StreamChecksumMagic) between the last
+	// frame and the seek table, outside every frame, so the whole content
+	// can be checked end to end with Decoder.StreamChecksum or
+	// Decoder.TestIntegrity.
+	StreamChecksum bool
+
+	// SeekTableMagic, if non-zero, is the skippable frame magic the seek
+	// table is written with, in place of SKIPPABLE_MAGIC_NUMBER, for tools
+	// that reserve that magic for their own frames. It must be between
+	// 0x184D2A50 and 0x184D2A5F. Decoders find the seek table by its
+	// integrity field, so they read archives written with any magic.
+	SeekTableMagic uint32
+
+	// HeadSeekTable buffers every frame in memory until Finish, which then
+	// writes the seek table in FormatHead ahead of them, so the archive can
+	// be indexed from its first bytes. Nothing reaches the writer before
+	// Finish. FinishWithFormat(FormatHead) requires it.
+	HeadSeekTable bool
+
+	// Logger, if set, receives debug-level diagnostics such as frame
+	// boundaries and why each frame ended. nil logs nothing.
+	Logger *slog.Logger
 }
 
 // DefaultEncoderOptions returns default encoder options
@@ -51,17 +265,137 @@ func DefaultEncoderOptions() *EncoderOptions {
 	}
 }
 
-// Encoder handles seekable compression
+// Encoder handles seekable compression. Each seekable frame is written as a
+// single zstd frame: input is streamed through one zstd writer into
+// frameBuffer, and the frame is closed when it ends.
 type Encoder struct {
 	writer          io.Writer
+	output          io.Writer    // the caller's writer when HeadSeekTable buffers frames in writer
+	headBuffer      bytes.Buffer // frames held for HeadSeekTable
 	encoder         *zstd.Encoder
+	encoderOpts     []zstd.EOption
 	options         *EncoderOptions
 	seekTable       *SeekTable
 	frameBuffer     bytes.Buffer
 	frameCSize      uint64
 	frameDSize      uint64
+	framePending    uint64 // input buffered in the zstd stream, not yet in frameBuffer
 	writtenTotal    uint64
 	currentFrameNum uint32
+	continueFrame   bool
+	frameAtRecord   bool      // frame ends on a DelimiterFrame or ContentDefinedFrameSize boundary
+	frameStart      time.Time // when the current frame's first byte was written
+	chunker         chunker   // rolling hash for ContentDefinedFrameSize
+	metadataSize    uint64    // skippable frames written ahead of the first frame
+	frameHash       *xxh64
+	frameRaw        bytes.Buffer    // the current frame's input, kept for VerifyFrames
+	verifier        *frameVerifier  // nil unless VerifyFrames is set
+	streamHash      *xxh64          // all input, nil unless StreamChecksum is set
+	readBuffer      []byte          // input buffer for ReadFrom
+	stringBuffer    []byte          // WriteString's copy of short strings
+	ctx             context.Context // nil when not created with a context
+	expired         bool            // Deadline passed and the partial archive was written
+	deadlineInput   uint64          // input taken since the deadline was last checked
+	err             error
+
+	// frameEncoder compresses the current frame: encoder, prefixEncoder
+	// when the frame was started by WriteWithPrefix, or one of dictEncoders
+	// for a dictionary set by SetFrameDict. prefixEncoder is kept for reuse
+	// while the same prefix is given, dictEncoders by dictionary ID.
+	frameEncoder  *zstd.Encoder
+	framePrefix   []byte
+	prefixEncoder *zstd.Encoder
+	prefix        []byte
+	frameDict     []byte // dictionary of the current frame, if set by SetFrameDict
+	nextDict      []byte // dictionary for the next frame started
+	dictEncoders  map[uint32]*zstd.Encoder
+
+	// Concurrent compression: the current frame's input is collected in
+	// rawBuffer and compressed by workers, and inFlight holds the ended
+	// frames not yet written, in order
+	jobs      chan *frameJob
+	workers   sync.WaitGroup
+	rawBuffer *bytes.Buffer
+	inFlight  []*frameJob
+}
+
+// frameJob is a frame handed to a compression worker
+type frameJob struct {
+	raw        *bytes.Buffer
+	prefix     []byte
+	dict       []byte
+	dSize      uint64
+	checksum   uint32
+	compressed *bytes.Buffer
+	mismatch   bool // VerifyFrames found compressed does not decode to raw
+	err        error
+	done       chan struct{}
+}
+
+// frameVerifier decodes frames back for VerifyFrames
+type frameVerifier struct {
+	decoderOpts []zstd.DOption
+	decoder     *zstd.Decoder // for frames without a prefix or per-frame dictionary
+	decoded     []byte
+}
+
+// newFrameVerifier returns a verifier for frames compressed with opts
+func newFrameVerifier(opts *EncoderOptions) (*frameVerifier, error) {
+	decoderOpts := []zstd.DOption{zstd.WithDecoderConcurrency(1)}
+	if opts.WindowLog != 0 {
+		decoderOpts = append(decoderOpts, zstd.WithDecoderMaxWindow(1<<opts.WindowLog))
+	}
+	if len(opts.CompressionDict) > 0 {
+		decoderOpts = append(decoderOpts, zstd.WithDecoderDicts(opts.CompressionDict))
+	}
+	if len(opts.PrefixWindow) > 0 {
+		decoderOpts = append(decoderOpts, zstd.WithDecoderDictRaw(0, opts.PrefixWindow))
+	}
+	decoder, err := zstd.NewReader(nil, decoderOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return &frameVerifier{decoderOpts: decoderOpts, decoder: decoder}, nil
+}
+
+// verify reports whether frame, compressed against prefix or dict when set,
+// decodes to raw
+func (v *frameVerifier) verify(frame, raw, prefix, dict []byte) bool {
+	decoder := v.decoder
+	if prefix != nil || dict != nil {
+		opts := v.decoderOpts[:len(v.decoderOpts):len(v.decoderOpts)]
+		if prefix != nil {
+			opts = append(opts, zstd.WithDecoderDictRaw(0, prefix))
+		} else {
+			opts = append(opts, zstd.WithDecoderDicts(dict))
+		}
+		frameDecoder, err := zstd.NewReader(nil, opts...)
+		if err != nil {
+			return false
+		}
+		defer frameDecoder.Close()
+		decoder = frameDecoder
+	}
+
+	var err error
+	v.decoded, err = decoder.DecodeAll(frame, v.decoded[:0])
+	return err == nil && bytes.Equal(v.decoded, raw)
+}
+
+// close releases the verifier's decoder
+func (v *frameVerifier) close() {
+	v.decoder.Close()
+}
+
+// frameBufferPool recycles the raw and compressed buffers of frame jobs
+var frameBufferPool = sync.Pool{
+	New: func() any { return new(bytes.Buffer) },
+}
+
+func getFrameBuffer() *bytes.Buffer {
+	buf := frameBufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
 }
 
 // NewEncoder creates a new seekable encoder
@@ -72,28 +406,215 @@ func NewEncoder(w io.Writer, opts *EncoderOptions) (*Encoder, error) {
 
 	encoderOpts := []zstd.EOption{
 		zstd.WithEncoderLevel(opts.Level),
+		// Compress blocks synchronously so frameBuffer always holds exactly
+		// the blocks emitted for the input written so far
+		zstd.WithEncoderConcurrency(1),
+	}
+	if opts.Level < 0 {
+		encoderOpts = append(fastLevelOptions(int(-opts.Level)), encoderOpts[1:]...)
 	}
 
 	if opts.ChecksumFlag {
 		encoderOpts = append(encoderOpts, zstd.WithEncoderCRC(true))
 	}
 
-	// Dictionary support disabled - requires properly formatted zstd dictionaries
-	// if len(opts.CompressionDict) > 0 {
-	//     encoderOpts = append(encoderOpts, zstd.WithEncoderDict(opts.CompressionDict))
-	// }
+	if opts.WindowLog != 0 {
+		if opts.WindowLog < minWindowLog || opts.WindowLog > maxWindowLog {
+			return nil, fmt.Errorf("%s: %d", ErrInvalidWindowLog, opts.WindowLog)
+		}
+		encoderOpts = append(encoderOpts, zstd.WithWindowSize(1<<opts.WindowLog))
+	}
+
+	// CompressionDict must be a formatted zstd dictionary, as produced by
+	// TrainDictionary
+	if len(opts.CompressionDict) > 0 {
+		encoderOpts = append(encoderOpts, zstd.WithEncoderDict(opts.CompressionDict))
+	}
+
+	if len(opts.PrefixWindow) > 0 {
+		encoderOpts = append(encoderOpts, zstd.WithEncoderDictRaw(0, opts.PrefixWindow))
+	}
+
+	e := &Encoder{
+		encoderOpts: encoderOpts,
+		options:     opts,
+		seekTable:   NewSeekTable(),
+		frameHash:   newXXH64(),
+	}
+	e.setWriter(w)
+	if opts.StreamChecksum {
+		e.streamHash = newXXH64()
+	}
+	if opts.SeekTableMagic != 0 && opts.SeekTableMagic&skippableMagicMask != skippableMagicBase {
+		return nil, fmt.Errorf("%s: %#x", ErrSeekTableMagic, opts.SeekTableMagic)
+	}
+
+	if policy, ok := opts.FramePolicy.(ContentDefinedFrameSize); ok {
+		if policy.Max == 0 || policy.Min > policy.Max {
+			return nil, fmt.Errorf("%s: Min %d, Max %d", ErrInvalidPolicy, policy.Min, policy.Max)
+		}
+		e.chunker.reset(policy.Window)
+	}
+
+	encoder, err := zstd.NewWriter(&e.frameBuffer, encoderOpts...)
+	if err != nil {
+		return nil, err
+	}
+	e.encoder = encoder
+	e.frameEncoder = encoder
+
+	if e.concurrent() {
+		if err := e.startWorkers(opts.Concurrency, encoderOpts); err != nil {
+			return nil, err
+		}
+	}
+	e.debug("encoder configured", "level", levelName(opts.Level),
+		"frame_policy", fmt.Sprintf("%T%+v", opts.FramePolicy, opts.FramePolicy),
+		"checksums", opts.ChecksumFlag, "concurrency", opts.Concurrency, "parallel", e.jobs != nil)
 
-	encoder, err := zstd.NewWriter(nil, encoderOpts...)
+	return e, nil
+}
+
+// NewEncoderContext creates a seekable encoder that stops once ctx is done.
+// The context is checked before each frame is written: the in-progress
+// frame is dropped rather than written or logged, nothing more is written to
+// w, and Write and Finish return ErrCanceled wrapping ctx.Err(). Unlike an
+// expired Deadline, no seek table is written.
+func NewEncoderContext(ctx context.Context, w io.Writer, opts *EncoderOptions) (*Encoder, error) {
+	e, err := NewEncoder(w, opts)
 	if err != nil {
 		return nil, err
 	}
+	e.ctx = ctx
+	return e, nil
+}
+
+// Reset discards any unfinished archive and prepares the encoder to write a
+// new one to w, reusing its zstd encoder and buffers. This lets servers that
+// compress many objects pool encoders instead of allocating one per output.
+// The options given to NewEncoder, including any context, apply to every
+// archive and cannot be changed by Reset.
+func (e *Encoder) Reset(w io.Writer) {
+	e.stopWorkers()
+	e.inFlight = nil
+	if e.rawBuffer != nil {
+		e.rawBuffer.Reset()
+	}
+	e.resetFrame()
+
+	e.setWriter(w)
+	e.seekTable = NewSeekTable()
+	e.writtenTotal = 0
+	e.metadataSize = 0
+	e.currentFrameNum = 0
+	e.continueFrame = false
+	e.nextDict = nil
+	e.expired = false
+	e.deadlineInput = 0
+	e.err = nil
+	if e.streamHash != nil {
+		e.streamHash.Reset()
+	}
+
+	if e.concurrent() {
+		e.err = e.startWorkers(e.options.Concurrency, e.encoderOpts)
+	}
+}
+
+// setWriter directs the output to w, through headBuffer with HeadSeekTable
+func (e *Encoder) setWriter(w io.Writer) {
+	e.writer = w
+	e.output = nil
+	if e.options.HeadSeekTable {
+		e.headBuffer.Reset()
+		e.writer = &e.headBuffer
+		e.output = w
+	}
+}
 
-	return &Encoder{
-		writer:    w,
-		encoder:   encoder,
-		options:   opts,
-		seekTable: NewSeekTable(),
-	}, nil
+// concurrent reports whether frames are compressed by parallel workers
+func (e *Encoder) concurrent() bool {
+	_, ok := e.options.FramePolicy.(UncompressedFrameSize)
+	return ok && e.options.Concurrency > 1
+}
+
+// startWorkers starts n goroutines that each compress ended frames with their
+// own zstd encoder
+func (e *Encoder) startWorkers(n int, encoderOpts []zstd.EOption) error {
+	e.jobs = make(chan *frameJob, n)
+	e.rawBuffer = getFrameBuffer()
+	for i := 0; i < n; i++ {
+		encoder, err := zstd.NewWriter(nil, encoderOpts...)
+		if err != nil {
+			e.stopWorkers()
+			return err
+		}
+		var verifier *frameVerifier
+		if e.options.VerifyFrames {
+			if verifier, err = newFrameVerifier(e.options); err != nil {
+				encoder.Close()
+				e.stopWorkers()
+				return err
+			}
+		}
+		e.workers.Add(1)
+		go func() {
+			defer e.workers.Done()
+			defer encoder.Close()
+			if verifier != nil {
+				defer verifier.close()
+			}
+			for job := range e.jobs {
+				// Mirror the serial path: one streamed zstd frame per job
+				job.compressed = getFrameBuffer()
+				frameEncoder := encoder
+				if job.prefix != nil {
+					frameEncoder, job.err = newPrefixEncoder(encoderOpts, job.prefix)
+				} else if job.dict != nil {
+					frameEncoder, job.err = newDictEncoder(encoderOpts, job.dict)
+				}
+				if job.err == nil {
+					frameEncoder.Reset(job.compressed)
+					if _, job.err = frameEncoder.Write(job.raw.Bytes()); job.err == nil {
+						job.err = frameEncoder.Close()
+					}
+				}
+				if job.err == nil && verifier != nil {
+					job.mismatch = !verifier.verify(job.compressed.Bytes(), job.raw.Bytes(), job.prefix, job.dict)
+				}
+				if e.options.ChecksumFlag {
+					job.checksum = frameChecksum(job.raw.Bytes())
+				}
+				close(job.done)
+			}
+		}()
+	}
+	return nil
+}
+
+// newPrefixEncoder returns a zstd encoder configured by encoderOpts that
+// compresses with prefix as its raw content dictionary
+func newPrefixEncoder(encoderOpts []zstd.EOption, prefix []byte) (*zstd.Encoder, error) {
+	opts := append(encoderOpts[:len(encoderOpts):len(encoderOpts)], zstd.WithEncoderDictRaw(0, prefix))
+	return zstd.NewWriter(nil, opts...)
+}
+
+// newDictEncoder returns a zstd encoder configured by encoderOpts that
+// compresses with dict, a formatted zstd dictionary, in place of any
+// CompressionDict
+func newDictEncoder(encoderOpts []zstd.EOption, dict []byte) (*zstd.Encoder, error) {
+	opts := append(encoderOpts[:len(encoderOpts):len(encoderOpts)], zstd.WithEncoderDict(dict))
+	return zstd.NewWriter(nil, opts...)
+}
+
+// stopWorkers shuts down the compression workers, if any
+func (e *Encoder) stopWorkers() {
+	if e.jobs == nil {
+		return
+	}
+	close(e.jobs)
+	e.workers.Wait()
+	e.jobs = nil
 }
 
 // Write implements io.Writer
@@ -101,16 +622,106 @@ func (e *Encoder) Write(p []byte) (int, error) {
 	return e.WriteWithPrefix(p, nil)
 }
 
-// WriteWithPrefix writes data with an optional prefix
+// WriteString implements io.StringWriter. Strings up to a stream block are
+// copied into a buffer the encoder reuses rather than converted to a new
+// slice, so writing many short strings such as log lines does not allocate.
+// Frames are cut exactly as if the bytes had been passed to Write.
+func (e *Encoder) WriteString(s string) (int, error) {
+	if len(s) > streamBlockSize {
+		return e.Write([]byte(s))
+	}
+	// Take the buffer for the call, in case OnFrame writes a string too
+	buf := append(e.stringBuffer[:0], s...)
+	e.stringBuffer = nil
+	n, err := e.Write(buf)
+	e.stringBuffer = buf
+	return n, err
+}
+
+// ReadFrom implements io.ReaderFrom, so io.Copy into an Encoder reads the
+// input in whole stream blocks rather than through io.Copy's smaller buffer.
+// It continues any frame left open by a previous Write, and frames are cut
+// exactly as if the data had been passed to Write.
+func (e *Encoder) ReadFrom(r io.Reader) (int64, error) {
+	if e.readBuffer == nil {
+		e.readBuffer = make([]byte, streamBlockSize)
+	}
+
+	var total int64
+	for {
+		n, err := io.ReadFull(r, e.readBuffer)
+		if n > 0 {
+			written, werr := e.Write(e.readBuffer[:n])
+			total += int64(written)
+			if werr != nil {
+				return total, werr
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return total, nil
+		}
+		if err != nil {
+			return total, err
+		}
+	}
+}
+
+// WriteWithPrefix writes data with an optional prefix. Each frame that p
+// starts is compressed with the prefix as a raw content dictionary: matches
+// against the prefix shrink the frame, but the prefix is not part of the
+// archive's content or its decompressed offsets. Those frames must be read
+// back with Decoder.ReadWithPrefix and the same prefix. For those frames
+// the prefix takes the place of CompressionDict and PrefixWindow.
 func (e *Encoder) WriteWithPrefix(p []byte, prefix []byte) (int, error) {
+	if e.err != nil {
+		return 0, e.err
+	}
+	if err := e.checkContext(); err != nil {
+		return 0, err
+	}
+
+	if e.frameExpired() {
+		e.debug("frame interval elapsed", "frame", e.currentFrameNum+uint32(len(e.inFlight)),
+			"decompressed", e.frameDSize)
+		if err := e.FlushFrame(); err != nil {
+			return 0, err
+		}
+	}
+
 	totalWritten := 0
 
 	for len(p) > 0 {
 		remaining := e.remainingFrameSize()
-		if remaining == 0 {
+		if e.continueFrame {
+			// Keep appending to the current frame regardless of the policy
+			remaining = int(maxFrameSize - e.frameDSize)
+		} else if remaining == 0 {
+			// Measure input still buffered in the zstd stream before
+			// deciding that the frame is full
+			if err := e.flushPending(); err != nil {
+				return totalWritten, err
+			}
+			remaining = e.remainingFrameSize()
+		}
+		if remaining == 0 && !e.continueFrame && !e.frameAtRecord && e.options.DelimiterFrame != 0 {
+			// The frame filled up without a record boundary in the write
+			// window; keep it open up to the next delimiter
+			e.debug("frame held open for delimiter", "frame", e.currentFrameNum+uint32(len(e.inFlight)),
+				"decompressed", e.frameDSize)
+			remaining = int(maxFrameSize - e.frameDSize)
+			if i := bytes.IndexByte(p, e.options.DelimiterFrame); i >= 0 && i+1 < remaining {
+				remaining = i + 1
+			}
+		}
+		if remaining == 0 || (e.frameAtRecord && !e.continueFrame) {
+			// The current frame is full; end it now that more data has
+			// arrived. Even ContinueFrame cannot grow it past maxFrameSize.
 			if err := e.EndFrame(); err != nil {
 				return totalWritten, err
 			}
+			if err := e.checkDeadline(); err != nil {
+				return totalWritten, err
+			}
 			remaining = e.remainingFrameSize()
 		}
 
@@ -118,94 +729,670 @@ func (e *Encoder) WriteWithPrefix(p []byte, prefix []byte) (int, error) {
 		if toWrite > remaining {
 			toWrite = remaining
 		}
+		// A write that fills the frame ends it on the last record boundary
+		atRecord := false
+		if delim := e.options.DelimiterFrame; delim != 0 && !e.continueFrame && toWrite == remaining {
+			if i := bytes.LastIndexByte(p[:toWrite], delim); i >= 0 {
+				toWrite = i + 1
+				atRecord = true
+			}
+		}
+		// Stop at the next block boundary so the frame size policy is
+		// checked against the same stream state however the input is split
+		// across writes
+		if toBoundary := streamBlockSize - int(e.framePending); toWrite > toBoundary {
+			toWrite = toBoundary
+			atRecord = false
+		}
+		// Content-defined frames end after the first boundary in the window
+		if policy, ok := e.options.FramePolicy.(ContentDefinedFrameSize); ok {
+			if i := e.chunker.next(p[:toWrite], e.frameDSize, policy); i >= 0 && !e.continueFrame {
+				toWrite = i + 1
+				atRecord = true
+			}
+		}
 
-		// For the first write of a frame with prefix
+		if e.frameDSize == 0 && e.options.MaxFrameInterval > 0 {
+			e.frameStart = e.now()
+		}
+
+		// A frame started after SetFrameDict is compressed with that
+		// dictionary, and one started with a prefix against the prefix
+		if e.frameDSize == 0 && e.nextDict != nil && prefix == nil {
+			if err := e.startDictFrame(); err != nil {
+				return totalWritten, err
+			}
+		}
 		if e.frameDSize == 0 && prefix != nil {
-			// Create a combined input
-			combined := append(prefix, p[:toWrite]...)
-			compressed := e.encoder.EncodeAll(combined, nil)
+			if err := e.startPrefixFrame(prefix); err != nil {
+				return totalWritten, err
+			}
+		}
 
-			e.frameBuffer.Write(compressed)
-			e.frameCSize += uint64(len(compressed))
-			e.frameDSize += uint64(toWrite) // Don't count prefix in decompressed size
-		} else {
-			// Normal compression
-			compressed := e.encoder.EncodeAll(p[:toWrite], nil)
-			e.frameBuffer.Write(compressed)
-			e.frameCSize += uint64(len(compressed))
-			e.frameDSize += uint64(toWrite)
+		if err := e.writeStream(p[:toWrite]); err != nil {
+			return totalWritten, err
 		}
+		e.frameDSize += uint64(toWrite)
+		e.frameAtRecord = atRecord
 
 		totalWritten += toWrite
 		p = p[toWrite:]
 
-		if e.isFrameComplete() {
-			if err := e.EndFrame(); err != nil {
+		// Check the deadline every block of input as well, so a large
+		// frame cannot run far past it
+		e.deadlineInput += uint64(toWrite)
+		if e.deadlineInput >= streamBlockSize {
+			inFrame := min(int(e.frameDSize), totalWritten)
+			if err := e.checkDeadline(); err != nil {
+				if e.expired {
+					// This write's input in the dropped frame is lost
+					return totalWritten - inFrame, err
+				}
 				return totalWritten, err
 			}
 		}
 	}
 
+	e.continueFrame = false
+
 	return totalWritten, nil
 }
 
+// startPrefixFrame compresses the frame being started with prefix as its
+// dictionary
+func (e *Encoder) startPrefixFrame(prefix []byte) error {
+	e.framePrefix = append([]byte(nil), prefix...)
+	if e.jobs != nil {
+		return nil // compressed by a worker when the frame ends
+	}
+
+	if e.prefixEncoder == nil || !bytes.Equal(e.prefix, prefix) {
+		encoder, err := newPrefixEncoder(e.encoderOpts, e.framePrefix)
+		if err != nil {
+			return err
+		}
+		if e.prefixEncoder != nil {
+			e.prefixEncoder.Close()
+		}
+		e.prefixEncoder = encoder
+		e.prefix = e.framePrefix
+	}
+	e.prefixEncoder.Reset(&e.frameBuffer)
+	e.frameEncoder = e.prefixEncoder
+	return nil
+}
+
+// SetFrameDict compresses the next frame the encoder starts with dict, a
+// formatted zstd dictionary such as one from TrainDictionary, in place of
+// CompressionDict. If the current frame has no data yet, that is the frame.
+// Later frames go back to CompressionDict unless SetFrameDict is called
+// again, so interleaved kinds of records can each use their own dictionary.
+// The frame records the dictionary's ID in its header; decoders need every
+// dictionary used in DecoderOptions.Dicts. A frame started by
+// WriteWithPrefix is compressed against the prefix instead.
+func (e *Encoder) SetFrameDict(dict []byte) error {
+	if _, err := DictID(dict); err != nil {
+		return err
+	}
+	e.nextDict = append([]byte(nil), dict...)
+	return nil
+}
+
+// startDictFrame compresses the frame being started with the dictionary
+// set by SetFrameDict
+func (e *Encoder) startDictFrame() error {
+	e.frameDict, e.nextDict = e.nextDict, nil
+	if e.jobs != nil {
+		return nil // compressed by a worker when the frame ends
+	}
+
+	id, _ := DictID(e.frameDict)
+	encoder, ok := e.dictEncoders[id]
+	if !ok {
+		var err error
+		if encoder, err = newDictEncoder(e.encoderOpts, e.frameDict); err != nil {
+			return err
+		}
+		if e.dictEncoders == nil {
+			e.dictEncoders = make(map[uint32]*zstd.Encoder)
+		}
+		e.dictEncoders[id] = encoder
+	}
+	encoder.Reset(&e.frameBuffer)
+	e.frameEncoder = encoder
+	return nil
+}
+
+// writeStream feeds p into the current zstd frame
+func (e *Encoder) writeStream(p []byte) error {
+	if e.streamHash != nil {
+		e.streamHash.Write(p)
+	}
+	if e.jobs != nil {
+		// Compressed by a worker when the frame ends
+		e.rawBuffer.Write(p)
+		return nil
+	}
+	if _, err := e.frameEncoder.Write(p); err != nil {
+		return err
+	}
+	if e.options.ChecksumFlag {
+		e.frameHash.Write(p)
+	}
+	if e.options.VerifyFrames {
+		e.frameRaw.Write(p)
+	}
+	// The stream emits a block each time it has buffered a full block
+	e.framePending = (e.framePending + uint64(len(p))) % streamBlockSize
+	e.frameCSize = uint64(e.frameBuffer.Len())
+	return nil
+}
+
+// flushPending compresses input buffered in the zstd stream into a block
+// when a compressed size limit would otherwise end the frame on the
+// assumption that the buffered input does not compress. Small remainders are
+// left buffered so the frame is not split into many tiny blocks.
+func (e *Encoder) flushPending() error {
+	limit, ok := e.compressedLimit()
+	if !ok || e.framePending == 0 || e.framePending < uint64(limit)/8 {
+		return nil
+	}
+
+	e.debug("flushing buffered input to measure frame", "pending", e.framePending,
+		"compressed", e.frameCSize)
+	if err := e.frameEncoder.Flush(); err != nil {
+		return err
+	}
+	e.framePending = 0
+	e.frameCSize = uint64(e.frameBuffer.Len())
+	return nil
+}
+
+// ContinueFrame keeps the current frame open for the next Write, even if the
+// frame size policy has been reached. A frame that fills up is only ended
+// when more data arrives, so calling ContinueFrame before a small trailing
+// write merges it into the last frame instead of producing a tiny final frame.
+func (e *Encoder) ContinueFrame() {
+	e.continueFrame = true
+}
+
 // EndFrame finishes the current frame
 func (e *Encoder) EndFrame() error {
+	if e.err != nil {
+		return e.err
+	}
 	if e.frameDSize == 0 {
 		return nil // No data in frame
 	}
+	return e.endFrame()
+}
 
-	// Write frame to output
-	frameData := e.frameBuffer.Bytes()
-	if _, err := e.writer.Write(frameData); err != nil {
+// EndFrameForce finishes the current frame like EndFrame, but also when it
+// has no data: the seek table then logs a frame of 0 compressed and 0
+// decompressed bytes, a boundary that consumers can rely on as a record or
+// section marker. Nothing is written to the output for it and decoders
+// return no data for it, though it counts as a frame for frame indices,
+// IndexWriter and OnFrame.
+func (e *Encoder) EndFrameForce() error {
+	if e.err != nil {
+		return e.err
+	}
+	return e.endFrame()
+}
+
+// endFrame finishes the current frame, even if it is empty
+func (e *Encoder) endFrame() error {
+	if e.jobs != nil {
+		return e.submitFrame()
+	}
+
+	// Close the zstd frame so frameBuffer holds all of it
+	if err := e.frameEncoder.Close(); err != nil {
 		return err
 	}
+	e.frameCSize = uint64(e.frameBuffer.Len())
 
-	// Log frame in seek table
-	if err := e.seekTable.LogFrame(uint32(e.frameCSize), uint32(e.frameDSize)); err != nil {
+	if e.options.VerifyFrames {
+		if err := e.verifyFrame(); err != nil {
+			return err
+		}
+	}
+
+	if err := e.writeFrame(e.frameBuffer.Bytes(), e.frameDSize, uint32(e.frameHash.Sum64())); err != nil {
 		return err
 	}
 
-	e.writtenTotal += e.frameCSize
+	// Reset for next frame
+	e.resetFrame()
+	e.frameWritten()
+
+	return nil
+}
+
+// verifyFrame checks that the closed current frame decodes to its input
+func (e *Encoder) verifyFrame() error {
+	if e.verifier == nil {
+		verifier, err := newFrameVerifier(e.options)
+		if err != nil {
+			return err
+		}
+		e.verifier = verifier
+	}
+	if !e.verifier.verify(e.frameBuffer.Bytes(), e.frameRaw.Bytes(), e.framePrefix, e.frameDict) {
+		return e.verificationFailed()
+	}
+	return nil
+}
+
+// verificationFailed fails the encoder for good once the next frame to be
+// written does not decode to its input, so a bad frame is never written
+func (e *Encoder) verificationFailed() error {
+	e.debug("frame verification failed", "frame", e.currentFrameNum)
+	return e.fail(fmt.Errorf("%s: frame %d", ErrVerificationFailed, e.currentFrameNum))
+}
+
+// FlushFrame ends the current frame and waits until it and every earlier
+// frame have been written to the output, so readers of the output can decode
+// everything written so far. Unlike EndFrame, it does not return while
+// concurrent workers still hold ended frames. It does nothing if no data has
+// been written since the last frame ended.
+func (e *Encoder) FlushFrame() error {
+	if err := e.EndFrame(); err != nil {
+		return err
+	}
+	return e.writeFinishedFrames(0)
+}
+
+// Flush writes the current frame, if it has data, along with any frames
+// still held by concurrent workers, then flushes the underlying writer if it
+// has a Flush or Sync method. When Flush returns, everything written so far
+// is decodable from the output and, for a file, durable on disk; the seek
+// table is only written by Finish. With HeadSeekTable the frames stay
+// buffered until Finish, so Flush only ends the frame.
+func (e *Encoder) Flush() error {
+	if err := e.FlushFrame(); err != nil {
+		return err
+	}
+
+	switch w := e.writer.(type) {
+	case interface{ Flush() error }:
+		return w.Flush()
+	case interface{ Sync() error }:
+		return w.Sync()
+	}
+	return nil
+}
+
+// frameExpired reports whether the current frame has been open longer than
+// MaxFrameInterval. A frame kept open by ContinueFrame never expires.
+func (e *Encoder) frameExpired() bool {
+	if e.options.MaxFrameInterval <= 0 || e.frameDSize == 0 || e.continueFrame {
+		return false
+	}
+	return e.now().Sub(e.frameStart) >= e.options.MaxFrameInterval
+}
+
+// now returns the current time from the configured clock
+func (e *Encoder) now() time.Time {
+	if e.options.Now != nil {
+		return e.options.Now()
+	}
+	return time.Now()
+}
+
+// submitFrame hands the current frame to the compression workers and writes
+// whichever earlier frames have finished, waiting for the oldest one when
+// too many frames are in flight
+func (e *Encoder) submitFrame() error {
+	job := &frameJob{
+		raw:    e.rawBuffer,
+		prefix: e.framePrefix,
+		dict:   e.frameDict,
+		dSize:  e.frameDSize,
+		done:   make(chan struct{}),
+	}
+	e.jobs <- job
+	e.inFlight = append(e.inFlight, job)
+
+	// The worker owns job.raw now, so the next frame needs a new buffer
+	e.rawBuffer = getFrameBuffer()
+	e.resetFrame()
+
+	return e.writeFinishedFrames(cap(e.jobs))
+}
+
+// writeFinishedFrames writes completed frames in order, waiting for frames
+// to finish until at most limit are still in flight
+func (e *Encoder) writeFinishedFrames(limit int) error {
+	for len(e.inFlight) > 0 {
+		job := e.inFlight[0]
+		if len(e.inFlight) > limit {
+			<-job.done
+		} else {
+			select {
+			case <-job.done:
+			default:
+				return nil
+			}
+		}
+		e.inFlight = e.inFlight[1:]
+
+		if job.err != nil {
+			return job.err
+		}
+		if job.mismatch {
+			return e.verificationFailed()
+		}
+		if err := e.writeFrame(job.compressed.Bytes(), job.dSize, job.checksum); err != nil {
+			return err
+		}
+		frameBufferPool.Put(job.raw)
+		frameBufferPool.Put(job.compressed)
+		e.frameWritten()
+	}
+	return nil
+}
+
+// writeFrame writes a compressed frame to the output and logs it. checksum
+// is only recorded when ChecksumFlag is set.
+func (e *Encoder) writeFrame(frameData []byte, dSize uint64, checksum uint32) error {
+	if err := e.checkContext(); err != nil {
+		return err
+	}
+
+	// Skippable metadata frames ahead of the first frame are logged as part
+	// of it, so frame offsets stay offsets into the archive
+	cSize := uint64(len(frameData))
+	if e.currentFrameNum == 0 {
+		cSize += e.metadataSize
+	}
+
+	// Check the frame fits in its seek table entry before writing it, and
+	// log it only once written, so the table never lists a frame missing
+	// from the output. Failed writes leave the output unusable, so they fail
+	// the encoder.
+	if err := e.seekTable.checkFrame(cSize, dSize); err != nil {
+		return err
+	}
+	if _, err := e.writer.Write(frameData); err != nil {
+		return e.fail(err)
+	}
+	entrySize := SIZE_PER_FRAME
+	if e.options.ChecksumFlag {
+		entrySize = SIZE_PER_FRAME_CRC
+		e.seekTable.LogFrameChecksum(cSize, dSize, checksum)
+	} else {
+		e.seekTable.LogFrame(cSize, dSize)
+	}
+	frame := Frame{CompressedSize: uint32(cSize), DecompressedSize: uint32(dSize), Checksum: checksum}
+
+	if e.options.IndexWriter != nil {
+		if _, err := e.options.IndexWriter.Write(frame.entryBytes(entrySize)); err != nil {
+			return e.fail(err)
+		}
+	}
+
+	e.writtenTotal += uint64(len(frameData))
 	e.currentFrameNum++
+	e.debug("frame written", "frame", e.currentFrameNum-1, "compressed", len(frameData),
+		"decompressed", dSize, "total_compressed", e.writtenTotal)
 
-	// Reset for next frame
-	e.frameBuffer.Reset()
-	e.frameCSize = 0
-	e.frameDSize = 0
+	return nil
+}
+
+// frameWritten reports the last frame written to OnFrame. Callers invoke it
+// only once the encoder's frame state is consistent, as OnFrame may write.
+func (e *Encoder) frameWritten() {
+	if e.options.OnFrame != nil {
+		decompressed, _ := e.seekTable.FrameEndDecomp(e.currentFrameNum - 1)
+		e.options.OnFrame(e.currentFrameNum-1, e.writtenTotal, decompressed)
+	}
+}
 
+// WriteSkippableMetadata writes data as a zstd skippable frame with the given
+// magic, for application metadata such as the original file name or a schema
+// version. magic must be a skippable frame magic (0x184D2A50 to 0x184D2A5F)
+// other than SKIPPABLE_MAGIC_NUMBER and EncoderOptions.SeekTableMagic, which
+// mark the seek table. Metadata can only be written before the first frame;
+// zstd decoders skip it, it is not counted as a frame, and
+// Decoder.SkippableFrames reads it back.
+func (e *Encoder) WriteSkippableMetadata(magic uint32, data []byte) error {
+	if e.err != nil {
+		return e.err
+	}
+	if magic&skippableMagicMask != skippableMagicBase || magic == SKIPPABLE_MAGIC_NUMBER ||
+		magic == e.options.SeekTableMagic {
+		return fmt.Errorf("%s: %#x", ErrMetadataMagic, magic)
+	}
+	if e.currentFrameNum > 0 || e.frameDSize > 0 || len(e.inFlight) > 0 {
+		return errors.New(ErrMetadataAfterData)
+	}
+	if uint64(len(data)) > math.MaxUint32 {
+		return fmt.Errorf("%s: %d bytes of metadata", ErrFrameTooLarge, len(data))
+	}
+
+	frame := make([]byte, SKIPPABLE_HEADER_SIZE, SKIPPABLE_HEADER_SIZE+len(data))
+	binary.LittleEndian.PutUint32(frame[0:4], magic)
+	binary.LittleEndian.PutUint32(frame[4:8], uint32(len(data)))
+	if _, err := e.writer.Write(append(frame, data...)); err != nil {
+		return err
+	}
+	e.metadataSize += uint64(len(frame) + len(data))
+	e.writtenTotal += uint64(len(frame) + len(data))
 	return nil
 }
 
-// Finish finalizes compression and writes the seek table
+// Finish finalizes compression and writes the seek table, in FormatHead
+// with HeadSeekTable and FormatFoot otherwise
 func (e *Encoder) Finish() error {
-	return e.FinishWithFormat(FormatFoot)
+	return e.FinishWithFormat(e.tableFormat())
 }
 
-// FinishWithFormat finalizes compression with specified seek table format
+// FinishWithFormat finalizes compression with specified seek table format.
+// FormatFoot writes the seek table after the frames. FormatHead writes it
+// ahead of them, which needs the frames buffered by HeadSeekTable; without
+// it FinishWithFormat returns ErrHeadFormat and the encoder can still be
+// finished with FormatFoot.
 func (e *Encoder) FinishWithFormat(format Format) error {
-	// End any remaining frame
-	if err := e.EndFrame(); err != nil {
-		return err
+	if format == FormatHead && e.output == nil {
+		return errors.New(ErrHeadFormat)
+	}
+	// The workers and zstd encoders are released whether or not it succeeds
+	defer e.close()
+	if e.err != nil {
+		return e.err
 	}
 
-	// Serialize and write seek table
-	serializer := e.seekTable.NewSerializer(format)
-	buf := make([]byte, 4096)
+	if err := e.checkDeadline(); err != nil {
+		return err
+	}
+	if err := e.checkContext(); err != nil {
+		return err
+	}
 
-	for {
-		n := serializer.WriteTo(buf)
-		if n == 0 {
-			break
+	// End any remaining frame, along with whatever OnFrame writes meanwhile
+	for e.frameDSize > 0 || len(e.inFlight) > 0 {
+		if err := e.EndFrame(); err != nil {
+			return err
 		}
-		if _, err := e.writer.Write(buf[:n]); err != nil {
+		if err := e.writeFinishedFrames(0); err != nil {
 			return err
 		}
 	}
 
-	// Close the encoder
+	if e.streamHash != nil {
+		if err := e.writeStreamChecksum(); err != nil {
+			return err
+		}
+	}
+	return e.writeSeekTable(format)
+}
+
+// checkDeadline aborts compression once the configured deadline has passed.
+// Any in-progress frame is dropped, and the completed frames are written
+// with their seek table so the output remains a valid archive. The stream
+// checksum is left out, as it covers the dropped input too.
+func (e *Encoder) checkDeadline() error {
+	e.deadlineInput = 0
+	if e.options.Deadline.IsZero() || e.now().Before(e.options.Deadline) {
+		return nil
+	}
+
+	e.debug("deadline exceeded, dropping in-progress frame", "decompressed", e.frameDSize)
+	if e.rawBuffer != nil {
+		e.rawBuffer.Reset()
+	}
+	e.resetFrame()
+
+	// Frames that were already ended still make it into the archive
+	if err := e.writeFinishedFrames(0); err != nil {
+		return err
+	}
+	if err := e.writeSeekTable(e.tableFormat()); err != nil {
+		return err
+	}
+	e.expired = true
+	return e.fail(errors.New(ErrDeadlineExceeded))
+}
+
+// checkContext aborts compression once the encoder's context is done,
+// dropping the in-progress frame and any frames not yet written
+func (e *Encoder) checkContext() error {
+	if e.ctx == nil || e.ctx.Err() == nil {
+		return nil
+	}
+
+	e.debug("context done, dropping unwritten frames", "in_flight", len(e.inFlight),
+		"decompressed", e.frameDSize)
+	e.inFlight = nil
+	if e.rawBuffer != nil {
+		e.rawBuffer.Reset()
+	}
+	e.resetFrame()
+	return e.fail(fmt.Errorf("%s: %w", ErrCanceled, e.ctx.Err()))
+}
+
+// debug logs a diagnostic message to the configured Logger, if any
+func (e *Encoder) debug(msg string, args ...any) {
+	if e.options.Logger != nil {
+		e.options.Logger.Debug(msg, args...)
+	}
+}
+
+// fail records err as the error every later call returns and releases the
+// compression workers, which will not be given another frame
+func (e *Encoder) fail(err error) error {
+	e.err = err
+	e.close()
+	return err
+}
+
+// Close releases the compression workers and zstd encoders without
+// finishing the archive, for an encoder that is abandoned, for example after
+// an error. Finish releases them itself. Later calls fail with
+// ErrEncoderClosed until Reset.
+func (e *Encoder) Close() error {
+	if e.err == nil {
+		e.err = errors.New(ErrEncoderClosed)
+	}
+	e.expired = false
+	e.close()
+	return nil
+}
+
+// close releases the zstd encoder and any compression workers
+func (e *Encoder) close() {
+	e.stopWorkers()
 	e.encoder.Close()
+	if e.prefixEncoder != nil {
+		e.prefixEncoder.Close()
+	}
+	for _, encoder := range e.dictEncoders {
+		encoder.Close()
+	}
+	if e.verifier != nil {
+		e.verifier.close()
+		e.verifier = nil
+	}
+}
+
+// resetFrame discards the current frame and starts a new zstd frame
+func (e *Encoder) resetFrame() {
+	e.frameBuffer.Reset()
+	e.encoder.Reset(&e.frameBuffer)
+	e.frameEncoder = e.encoder
+	e.framePrefix = nil
+	e.frameDict = nil
+	e.frameCSize = 0
+	e.frameDSize = 0
+	e.framePending = 0
+	e.frameAtRecord = false
+	e.frameHash.Reset()
+	e.frameRaw.Reset()
+	if policy, ok := e.options.FramePolicy.(ContentDefinedFrameSize); ok {
+		e.chunker.reset(policy.Window)
+	}
+}
+
+// writeStreamChecksum writes the StreamChecksum frame after the last frame
+func (e *Encoder) writeStreamChecksum() error {
+	frame := make([]byte, streamChecksumFrameSize)
+	binary.LittleEndian.PutUint32(frame[0:4], StreamChecksumMagic)
+	binary.LittleEndian.PutUint32(frame[4:8], 8)
+	binary.LittleEndian.PutUint64(frame[SKIPPABLE_HEADER_SIZE:], e.streamHash.Sum64())
+	if _, err := e.writer.Write(frame); err != nil {
+		return e.fail(err)
+	}
+	e.writtenTotal += uint64(len(frame))
+	return nil
+}
+
+// tableFormat returns the seek table format Finish writes
+func (e *Encoder) tableFormat() Format {
+	if e.options.HeadSeekTable {
+		return FormatHead
+	}
+	return FormatFoot
+}
 
+// writeSeekTable serializes the seek table to the output, unless
+// NoSeekTable is set. With HeadSeekTable the buffered frames are written
+// too, after a FormatHead table or before a FormatFoot one.
+func (e *Encoder) writeSeekTable(format Format) error {
+	if format == FormatFoot {
+		if err := e.flushHeadBuffer(); err != nil {
+			return err
+		}
+	}
+	if !e.options.NoSeekTable {
+		serializer, err := e.seekTable.NewSerializer(format)
+		if err != nil {
+			return err
+		}
+		if e.options.SeekTableMagic != 0 {
+			if err := serializer.SetMagic(e.options.SeekTableMagic); err != nil {
+				return err
+			}
+		}
+		w := e.writer
+		if e.output != nil {
+			w = e.output
+		}
+		if _, err := serializer.writeAll(w); err != nil {
+			return e.fail(err)
+		}
+	}
+	return e.flushHeadBuffer()
+}
+
+// flushHeadBuffer writes the frames buffered for HeadSeekTable to the output
+func (e *Encoder) flushHeadBuffer() error {
+	if e.output == nil {
+		return nil
+	}
+	if _, err := e.headBuffer.WriteTo(e.output); err != nil {
+		return e.fail(err)
+	}
 	return nil
 }
 
@@ -219,43 +1406,240 @@ func (e *Encoder) WrittenCompressed() uint64 {
 	return e.writtenTotal
 }
 
-func (e *Encoder) remainingFrameSize() int {
-	switch policy := e.options.FramePolicy.(type) {
-	case CompressedFrameSize:
-		remaining := int64(policy.Size) - int64(e.frameCSize)
-		if remaining < 0 {
-			return 0
+// DecompressedOffset returns the decompressed offset the next byte written
+// will have: every byte accepted so far, whether in written frames, frames
+// still being compressed, or the current frame. Recording it before writing
+// a record maps the record to its offset in the archive's content.
+func (e *Encoder) DecompressedOffset() uint64 {
+	var offset uint64
+	if n := e.seekTable.NumFrames(); n > 0 {
+		offset, _ = e.seekTable.FrameEndDecomp(n - 1)
+	}
+	for _, job := range e.inFlight {
+		offset += job.dSize
+	}
+	return offset + e.frameDSize
+}
+
+// CompressedOffset returns the offset in the output at which the next frame
+// will be written, the same as WrittenCompressed. Data in frames not yet
+// written is not counted.
+func (e *Encoder) CompressedOffset() uint64 {
+	return e.writtenTotal
+}
+
+// EncoderStats summarizes the frames of an archive
+type EncoderStats struct {
+	NumFrames         uint32
+	TotalCompressed   uint64 // frame bytes, excluding the seek table
+	TotalDecompressed uint64
+	MinFrameDecomp    uint64
+	MaxFrameDecomp    uint64
+
+	// MeanCompressionRatio is the average over frames of each frame's
+	// decompressed size divided by its compressed size
+	MeanCompressionRatio float64
+}
+
+// Stats returns statistics for the frames written so far, computed from the
+// seek table, so it remains valid after Finish
+func (e *Encoder) Stats() EncoderStats {
+	st := e.seekTable
+	stats := EncoderStats{NumFrames: st.NumFrames()}
+	if stats.NumFrames == 0 {
+		return stats
+	}
+
+	stats.TotalCompressed, _ = st.FrameEndComp(stats.NumFrames - 1)
+	stats.TotalDecompressed, _ = st.FrameEndDecomp(stats.NumFrames - 1)
+	stats.MinFrameDecomp = math.MaxUint64
+
+	var ratios float64
+	for i := uint32(0); i < stats.NumFrames; i++ {
+		comp, _ := st.FrameSizeComp(i)
+		decomp, _ := st.FrameSizeDecomp(i)
+		stats.MinFrameDecomp = min(stats.MinFrameDecomp, decomp)
+		stats.MaxFrameDecomp = max(stats.MaxFrameDecomp, decomp)
+		if comp > 0 {
+			ratios += float64(decomp) / float64(comp)
 		}
-		maxRemaining := int64(MAX_FRAME_SIZE) - int64(e.frameDSize)
-		if remaining > maxRemaining {
-			return int(maxRemaining)
+	}
+	stats.MeanCompressionRatio = ratios / float64(stats.NumFrames)
+
+	return stats
+}
+
+// CompressSeekable compresses data held in memory into a seekable archive
+// written to dst and returns its seek table. Frames are cut by opts the same
+// way as with an Encoder (compressed in parallel when opts.Concurrency
+// allows), so the output matches writing data through NewEncoder and Finish.
+func CompressSeekable(dst io.Writer, data []byte, opts *EncoderOptions) (*SeekTable, error) {
+	e, err := NewEncoder(dst, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := e.Write(data); err != nil {
+		e.close()
+		return nil, err
+	}
+	if err := e.Finish(); err != nil {
+		e.close()
+		return nil, err
+	}
+
+	return e.SeekTable(), nil
+}
+
+// EncodeAll compresses src into a complete seekable archive held in memory,
+// the counterpart of DecodeAll
+func EncodeAll(src []byte, opts *EncoderOptions) ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := CompressSeekable(&buf, src, opts); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// ConcatArchives writes to dst a single seekable archive holding the frames
+// of each source archive in order, followed by one combined seek table. The
+// compressed frames are copied through without being decompressed, so every
+// source must use the foot seek table format. Checksums are kept only if
+// every source has them. Frames are not re-encoded, so sources compressed
+// with a dictionary or PrefixWindow must all share it, and it is the
+// caller's responsibility to decode the result with the same one.
+func ConcatArchives(dst io.Writer, srcs ...Seekable) error {
+	combined := NewSeekTable()
+
+	for i, src := range srcs {
+		st, err := ReadSeekTable(src)
+		if err != nil {
+			return fmt.Errorf("source %d: %w", i, err)
 		}
-		return int(remaining)
-	case UncompressedFrameSize:
-		remaining := int64(policy.Size) - int64(e.frameDSize)
-		if remaining < 0 {
-			return 0
+
+		if err := combined.Append(st); err != nil {
+			return fmt.Errorf("source %d: %w", i, err)
+		}
+
+		if st.NumFrames() == 0 {
+			continue
+		}
+		// The frames are everything before the seek table
+		framesEnd := st.TotalCompressed()
+		if _, err := src.Seek(0, io.SeekStart); err != nil {
+			return err
 		}
-		if remaining > MAX_FRAME_SIZE {
-			return MAX_FRAME_SIZE
+		if _, err := io.CopyN(dst, src, int64(framesEnd)); err != nil {
+			return fmt.Errorf("source %d: %w", i, err)
 		}
-		return int(remaining)
+	}
+
+	_, err := combined.WriteTo(dst, FormatFoot)
+	return err
+}
+
+// EstimateCompressedSize compresses r with the given options, discarding the
+// output, and returns the size of the compressed frame payload (excluding the
+// seek table) along with the number of frames produced.
+func EstimateCompressedSize(r io.Reader, opts *EncoderOptions) (uint64, uint32, error) {
+	e, err := NewEncoder(io.Discard, opts)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer e.close()
+
+	if _, err := io.Copy(e, r); err != nil {
+		return 0, 0, err
+	}
+	if err := e.EndFrame(); err != nil {
+		return 0, 0, err
+	}
+	if err := e.writeFinishedFrames(0); err != nil {
+		return 0, 0, err
+	}
+
+	return e.WrittenCompressed(), e.seekTable.NumFrames(), nil
+}
+
+// EstimateArchiveSize returns the exact size of the archive that compressing r
+// with the given options would produce, including the seek table and
+// StreamChecksum overhead.
+// This is useful to pre-allocate disk space or set a Content-Length.
+func EstimateArchiveSize(r io.Reader, opts *EncoderOptions) (totalBytes uint64, frames uint32, err error) {
+	if opts == nil {
+		opts = DefaultEncoderOptions()
+	}
+	payload, frames, err := EstimateCompressedSize(r, opts)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	total := payload
+	if opts.StreamChecksum {
+		total += streamChecksumFrameSize
+	}
+	if !opts.NoSeekTable {
+		entrySize := SIZE_PER_FRAME
+		if opts.ChecksumFlag {
+			entrySize = SIZE_PER_FRAME_CRC
+		}
+		total += uint64(SKIPPABLE_HEADER_SIZE + SEEK_TABLE_FOOTER_SIZE + int(frames)*entrySize)
+	}
+	return total, frames, nil
+}
+
+func (e *Encoder) remainingFrameSize() int {
+	switch policy := e.options.FramePolicy.(type) {
+	case CompressedFrameSize:
+		return e.remainingCompressed(policy.Size)
+	case UncompressedFrameSize:
+		return e.remainingUncompressed(policy.Size)
+	case HybridFrameSize:
+		return min(e.remainingCompressed(policy.MaxCompressed), e.remainingUncompressed(policy.MaxUncompressed))
+	case ContentDefinedFrameSize:
+		return e.remainingUncompressed(policy.Max)
 	default:
 		return 0
 	}
 }
 
-func (e *Encoder) isFrameComplete() bool {
+// remainingCompressed returns how much more input fits in the frame under a
+// compressed size limit
+func (e *Encoder) remainingCompressed(limit uint32) int {
+	// Input still buffered in the zstd stream is assumed not to shrink
+	pending := int64(e.framePending)
+	remaining := int64(limit) - int64(e.frameCSize) - pending
+	if remaining < 0 {
+		return 0
+	}
+	maxRemaining := int64(maxFrameSize) - int64(e.frameDSize)
+	if remaining > maxRemaining {
+		return int(maxRemaining)
+	}
+	return int(remaining)
+}
+
+// remainingUncompressed returns how much more input fits in the frame under
+// an uncompressed size limit
+func (e *Encoder) remainingUncompressed(limit uint32) int {
+	remaining := int64(limit) - int64(e.frameDSize)
+	if remaining < 0 {
+		return 0
+	}
+	if remaining > maxFrameSize {
+		return maxFrameSize
+	}
+	return int(remaining)
+}
+
+// compressedLimit returns the frame policy's compressed size limit, if any
+func (e *Encoder) compressedLimit() (uint32, bool) {
 	switch policy := e.options.FramePolicy.(type) {
 	case CompressedFrameSize:
-		return e.frameCSize >= uint64(policy.Size) || e.frameDSize >= MAX_FRAME_SIZE
-	case UncompressedFrameSize:
-		maxSize := uint64(policy.Size)
-		if maxSize > MAX_FRAME_SIZE {
-			maxSize = MAX_FRAME_SIZE
-		}
-		return e.frameDSize >= maxSize
+		return policy.Size, true
+	case HybridFrameSize:
+		return policy.MaxCompressed, true
 	default:
-		return true
+		return 0, false
 	}
 }
@@ -2,7 +2,16 @@ package gzstd
 
 import (
 	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"slices"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/klauspost/compress/zstd"
 )
@@ -154,6 +163,72 @@ func TestEncoder_WriteWithPrefix(t *testing.T) {
 	}
 }
 
+func TestEncoder_WriteWithPrefixRoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewSource(7))
+	prefix := make([]byte, 4096)
+	rng.Read(prefix)
+	// Content that repeats the prefix compresses much better against it
+	var p []byte
+	for i := 0; i < 6; i++ {
+		p = append(p, prefix[i*500:i*500+1500]...)
+	}
+
+	for _, concurrency := range []int{1, 2} {
+		var buf bytes.Buffer
+		encoder, err := NewEncoder(&buf, &EncoderOptions{
+			Level:       zstd.SpeedDefault,
+			FramePolicy: UncompressedFrameSize{Size: 4000},
+			Concurrency: concurrency,
+		})
+		if err != nil {
+			t.Fatalf("NewEncoder failed: %v", err)
+		}
+		if _, err := encoder.WriteWithPrefix(p, prefix); err != nil {
+			t.Fatalf("WriteWithPrefix failed: %v", err)
+		}
+		if err := encoder.Finish(); err != nil {
+			t.Fatalf("Finish failed: %v", err)
+		}
+
+		// The prefix is not counted in the decompressed offsets
+		st := encoder.SeekTable()
+		end, _ := st.FrameEndDecomp(st.NumFrames() - 1)
+		if st.NumFrames() != 3 || end != uint64(len(p)) {
+			t.Errorf("Concurrency %d: expected 3 frames ending at %d, got %d ending at %d",
+				concurrency, len(p), st.NumFrames(), end)
+		}
+		if buf.Len() > len(p)/4 {
+			t.Errorf("Concurrency %d: expected the prefix to shrink the archive, got %d bytes", concurrency, buf.Len())
+		}
+
+		decoder, err := NewDecoder(bytes.NewReader(buf.Bytes()), nil)
+		if err != nil {
+			t.Fatalf("NewDecoder failed: %v", err)
+		}
+		var decoded []byte
+		chunk := make([]byte, 1000)
+		for {
+			n, err := decoder.ReadWithPrefix(chunk, prefix)
+			decoded = append(decoded, chunk[:n]...)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("ReadWithPrefix failed: %v", err)
+			}
+		}
+		if !bytes.Equal(decoded, p) {
+			t.Errorf("Concurrency %d: decoded %d bytes, expected exactly the %d written", concurrency, len(decoded), len(p))
+		}
+
+		// The frames cannot be decoded without the prefix
+		decoder.Seek(0, io.SeekStart)
+		if _, err := io.ReadAll(decoder); err == nil {
+			t.Errorf("Concurrency %d: expected reading without the prefix to fail", concurrency)
+		}
+	}
+}
+
 func TestEncoder_EndFrame(t *testing.T) {
 	var buf bytes.Buffer
 	encoder, err := NewEncoder(&buf, nil)
@@ -194,7 +269,9 @@ func TestEncoder_FinishWithFormat(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			var buf bytes.Buffer
-			encoder, err := NewEncoder(&buf, nil)
+			opts := DefaultEncoderOptions()
+			opts.HeadSeekTable = tt.format == FormatHead
+			encoder, err := NewEncoder(&buf, opts)
 			if err != nil {
 				t.Fatalf("NewEncoder failed: %v", err)
 			}
@@ -205,11 +282,25 @@ func TestEncoder_FinishWithFormat(t *testing.T) {
 				t.Fatalf("FinishWithFormat failed: %v", err)
 			}
 			
-			if buf.Len() == 0 {
-				t.Error("No data written")
+			if format, _, err := ArchiveFormat(bytes.NewReader(buf.Bytes())); err != nil || format != tt.format {
+				t.Errorf("Expected format %v, got %v, %v", tt.format, format, err)
 			}
 		})
 	}
+
+	// FormatHead cannot be written once the frames have gone to the writer
+	var buf bytes.Buffer
+	encoder, err := NewEncoder(&buf, nil)
+	if err != nil {
+		t.Fatalf("NewEncoder failed: %v", err)
+	}
+	encoder.Write([]byte("Test data"))
+	if err := encoder.FinishWithFormat(FormatHead); err == nil || err.Error() != ErrHeadFormat {
+		t.Errorf("Expected %q, got %v", ErrHeadFormat, err)
+	}
+	if err := encoder.FinishWithFormat(FormatFoot); err != nil {
+		t.Errorf("FinishWithFormat(FormatFoot) after ErrHeadFormat failed: %v", err)
+	}
 }
 
 func TestFrameSizePolicy(t *testing.T) {
@@ -225,3 +316,1930 @@ func TestFrameSizePolicy(t *testing.T) {
 		t.Errorf("Expected max size 2048, got %d", ufs.MaxSize())
 	}
 }
+
+func TestEncoder_Deadline(t *testing.T) {
+	var buf bytes.Buffer
+	opts := &EncoderOptions{
+		Level:       zstd.SpeedDefault,
+		FramePolicy: UncompressedFrameSize{Size: 100},
+		Deadline:    time.Now().Add(time.Millisecond),
+	}
+
+	encoder, err := NewEncoder(&buf, opts)
+	if err != nil {
+		t.Fatalf("NewEncoder failed: %v", err)
+	}
+	time.Sleep(2 * time.Millisecond)
+
+	data := bytes.Repeat([]byte("0123456789"), 30)
+	n, err := encoder.Write(data)
+	if err == nil || err.Error() != ErrDeadlineExceeded {
+		t.Fatalf("Expected %q, got %v", ErrDeadlineExceeded, err)
+	}
+	if n != 100 {
+		t.Errorf("Expected 100 bytes accepted before deadline, got %d", n)
+	}
+
+	// The seek table is written before Write returns
+	decoder, err := NewDecoder(bytes.NewReader(buf.Bytes()), nil)
+	if err != nil {
+		t.Fatalf("NewDecoder after Write failed: %v", err)
+	}
+	if decoder.SeekTable().NumFrames() != 1 {
+		t.Errorf("Expected 1 frame, got %d", decoder.SeekTable().NumFrames())
+	}
+	got, err := io.ReadAll(decoder)
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	if !bytes.Equal(got, data[:100]) {
+		t.Errorf("Decoded %q, want %q", got, data[:100])
+	}
+
+	// Write and Finish keep failing without writing anything
+	size := buf.Len()
+	if _, err := encoder.Write(data); err == nil || err.Error() != ErrDeadlineExceeded {
+		t.Errorf("Expected %q from Write, got %v", ErrDeadlineExceeded, err)
+	}
+	if err := encoder.Finish(); err == nil || err.Error() != ErrDeadlineExceeded {
+		t.Errorf("Expected %q from Finish, got %v", ErrDeadlineExceeded, err)
+	}
+	if buf.Len() != size {
+		t.Errorf("Output grew after deadline: %d -> %d", size, buf.Len())
+	}
+
+	// With HeadSeekTable the table is written ahead of the frames
+	buf.Reset()
+	opts.Deadline = time.Now().Add(time.Millisecond)
+	opts.HeadSeekTable = true
+	encoder, err = NewEncoder(&buf, opts)
+	if err != nil {
+		t.Fatalf("NewEncoder failed: %v", err)
+	}
+	time.Sleep(2 * time.Millisecond)
+	if _, err := encoder.Write(data); err == nil || err.Error() != ErrDeadlineExceeded {
+		t.Fatalf("Expected %q, got %v", ErrDeadlineExceeded, err)
+	}
+	if format, _, err := ArchiveFormat(bytes.NewReader(buf.Bytes())); err != nil || format != FormatHead {
+		t.Fatalf("Expected FormatHead, got %v, %v", format, err)
+	}
+	decoder, err = NewDecoder(bytes.NewReader(buf.Bytes()), nil)
+	if err != nil {
+		t.Fatalf("NewDecoder failed: %v", err)
+	}
+	if decoder.SeekTable().NumFrames() != 1 {
+		t.Errorf("Expected 1 frame in FormatHead table, got %d", decoder.SeekTable().NumFrames())
+	}
+}
+
+func TestEncoder_DeadlineLargeFrame(t *testing.T) {
+	// The clock passes the deadline once the first block of a single large
+	// frame has been written
+	start := time.Now()
+	calls := 0
+	var buf bytes.Buffer
+	encoder, err := NewEncoder(&buf, &EncoderOptions{
+		Level:       zstd.SpeedDefault,
+		FramePolicy: UncompressedFrameSize{Size: 4 << 20},
+		Deadline:    start.Add(time.Second),
+		Now: func() time.Time {
+			calls++
+			return start.Add(time.Duration(calls) * time.Second)
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewEncoder failed: %v", err)
+	}
+
+	data := make([]byte, 1<<20)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	n, err := encoder.Write(data)
+	if err == nil || err.Error() != ErrDeadlineExceeded {
+		t.Fatalf("Expected %q, got %v", ErrDeadlineExceeded, err)
+	}
+	if n != 0 {
+		t.Errorf("Expected no input in completed frames, got %d", n)
+	}
+	if calls != 1 {
+		t.Errorf("Expected the deadline checked once, after the first block, got %d checks", calls)
+	}
+
+	// The archive holds no frames, but is still valid
+	decoder, err := NewDecoder(bytes.NewReader(buf.Bytes()), nil)
+	if err != nil {
+		t.Fatalf("NewDecoder failed: %v", err)
+	}
+	if decoder.SeekTable().NumFrames() != 0 {
+		t.Errorf("Expected 0 frames, got %d", decoder.SeekTable().NumFrames())
+	}
+}
+
+func TestEstimateArchiveSize(t *testing.T) {
+	data := make([]byte, 5000)
+	for i := range data {
+		data[i] = byte(i % 37)
+	}
+
+	tests := []struct {
+		name string
+		opts EncoderOptions
+	}{
+		{"default", EncoderOptions{}},
+		{"checksums", EncoderOptions{ChecksumFlag: true}},
+		{"stream checksum", EncoderOptions{StreamChecksum: true}},
+		{"no seek table", EncoderOptions{NoSeekTable: true}},
+		{"no seek table, stream checksum", EncoderOptions{NoSeekTable: true, StreamChecksum: true, ChecksumFlag: true}},
+	}
+	for _, tt := range tests {
+		opts := tt.opts
+		opts.Level = zstd.SpeedDefault
+		opts.FramePolicy = UncompressedFrameSize{Size: 1024}
+
+		total, frames, err := EstimateArchiveSize(bytes.NewReader(data), &opts)
+		if err != nil {
+			t.Fatalf("%s: EstimateArchiveSize failed: %v", tt.name, err)
+		}
+
+		var buf bytes.Buffer
+		encoder, err := NewEncoder(&buf, &opts)
+		if err != nil {
+			t.Fatalf("%s: NewEncoder failed: %v", tt.name, err)
+		}
+		if _, err := encoder.Write(data); err != nil {
+			t.Fatalf("%s: Write failed: %v", tt.name, err)
+		}
+		if err := encoder.Finish(); err != nil {
+			t.Fatalf("%s: Finish failed: %v", tt.name, err)
+		}
+
+		if frames != encoder.SeekTable().NumFrames() {
+			t.Errorf("%s: Expected %d frames, got %d", tt.name, encoder.SeekTable().NumFrames(), frames)
+		}
+		if total != uint64(buf.Len()) {
+			t.Errorf("%s: Expected archive size %d, got %d", tt.name, buf.Len(), total)
+		}
+	}
+}
+
+func TestEncoder_ContinueFrame(t *testing.T) {
+	newEncoder := func(buf *bytes.Buffer) *Encoder {
+		encoder, err := NewEncoder(buf, &EncoderOptions{
+			Level:       zstd.SpeedDefault,
+			FramePolicy: UncompressedFrameSize{Size: 100},
+		})
+		if err != nil {
+			t.Fatalf("NewEncoder failed: %v", err)
+		}
+		return encoder
+	}
+
+	body := bytes.Repeat([]byte("a"), 100)
+	tail := []byte("tail")
+
+	// Without ContinueFrame the trailing write forms its own frame
+	var plain bytes.Buffer
+	encoder := newEncoder(&plain)
+	encoder.Write(body)
+	encoder.Write(tail)
+	if err := encoder.Finish(); err != nil {
+		t.Fatalf("Finish failed: %v", err)
+	}
+	if encoder.SeekTable().NumFrames() != 2 {
+		t.Errorf("Expected 2 frames without ContinueFrame, got %d", encoder.SeekTable().NumFrames())
+	}
+
+	// With ContinueFrame the trailing write merges into the full frame
+	var merged bytes.Buffer
+	encoder = newEncoder(&merged)
+	encoder.Write(body)
+	encoder.ContinueFrame()
+	encoder.Write(tail)
+	if err := encoder.Finish(); err != nil {
+		t.Fatalf("Finish failed: %v", err)
+	}
+	if encoder.SeekTable().NumFrames() != 1 {
+		t.Errorf("Expected 1 frame with ContinueFrame, got %d", encoder.SeekTable().NumFrames())
+	}
+
+	decoder, err := NewDecoder(bytes.NewReader(merged.Bytes()), nil)
+	if err != nil {
+		t.Fatalf("NewDecoder failed: %v", err)
+	}
+	got, err := io.ReadAll(decoder)
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	if !bytes.Equal(got, append(body, tail...)) {
+		t.Errorf("Decoded data mismatch")
+	}
+
+	// Even with ContinueFrame, a frame ends once it holds maxFrameSize
+	// bytes. The frame's size is set rather than writing 4GB into it.
+	var full bytes.Buffer
+	encoder = newEncoder(&full)
+	encoder.Write([]byte("a"))
+	encoder.frameDSize = maxFrameSize - 5
+	encoder.ContinueFrame()
+	done := make(chan error, 1)
+	go func() {
+		_, err := encoder.Write(bytes.Repeat([]byte("b"), 20))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Write past maxFrameSize failed: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Write past maxFrameSize did not return")
+	}
+	if size, err := encoder.SeekTable().FrameSizeDecomp(0); err != nil || size != maxFrameSize {
+		t.Errorf("Expected a first frame of %d bytes, got %d: %v", uint64(maxFrameSize), size, err)
+	}
+	if encoder.frameDSize != 15 {
+		t.Errorf("Expected 15 bytes in the next frame, got %d", encoder.frameDSize)
+	}
+	encoder.Close()
+}
+
+func TestEncoder_IndexWriter(t *testing.T) {
+	var buf, index bytes.Buffer
+	encoder, err := NewEncoder(&buf, &EncoderOptions{
+		Level:       zstd.SpeedDefault,
+		FramePolicy: UncompressedFrameSize{Size: 100},
+		IndexWriter: &index,
+	})
+	if err != nil {
+		t.Fatalf("NewEncoder failed: %v", err)
+	}
+
+	data := make([]byte, 350)
+	for i := range data {
+		data[i] = byte(i % 7)
+	}
+	if _, err := encoder.Write(data); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	// Entries for ended frames are available before Finish
+	if index.Len() != 3*SIZE_PER_FRAME {
+		t.Errorf("Expected %d index bytes before Finish, got %d", 3*SIZE_PER_FRAME, index.Len())
+	}
+
+	if err := encoder.Finish(); err != nil {
+		t.Fatalf("Finish failed: %v", err)
+	}
+
+	// Rebuild a seek table from the index stream
+	rebuilt := NewSeekTable()
+	entries := index.Bytes()
+	if len(entries)%SIZE_PER_FRAME != 0 {
+		t.Fatalf("Index length %d is not a multiple of %d", len(entries), SIZE_PER_FRAME)
+	}
+	for off := 0; off < len(entries); off += SIZE_PER_FRAME {
+		comp := binary.LittleEndian.Uint32(entries[off : off+4])
+		decomp := binary.LittleEndian.Uint32(entries[off+4 : off+8])
+		if err := rebuilt.LogFrame(uint64(comp), uint64(decomp)); err != nil {
+			t.Fatalf("LogFrame failed: %v", err)
+		}
+	}
+
+	if !rebuilt.Equal(encoder.SeekTable()) {
+		t.Error("Seek table rebuilt from index does not match encoder seek table")
+	}
+}
+
+func TestEncoder_OneZstdFramePerFrame(t *testing.T) {
+	data := make([]byte, 300*1024)
+	for i := range data {
+		data[i] = byte(i/7) ^ byte(i%13)
+	}
+
+	policies := []FrameSizePolicy{
+		UncompressedFrameSize{Size: 64 * 1024},
+		CompressedFrameSize{Size: 4 * 1024},
+	}
+	for _, policy := range policies {
+		t.Run(fmt.Sprintf("%T", policy), func(t *testing.T) {
+			encode := func(chunk int) ([]byte, *SeekTable) {
+				var buf bytes.Buffer
+				encoder, err := NewEncoder(&buf, &EncoderOptions{
+					Level:       zstd.SpeedDefault,
+					FramePolicy: policy,
+				})
+				if err != nil {
+					t.Fatalf("NewEncoder failed: %v", err)
+				}
+				for p := data; len(p) > 0; {
+					n := min(chunk, len(p))
+					if _, err := encoder.Write(p[:n]); err != nil {
+						t.Fatalf("Write failed: %v", err)
+					}
+					p = p[n:]
+				}
+				if err := encoder.Finish(); err != nil {
+					t.Fatalf("Finish failed: %v", err)
+				}
+				return buf.Bytes(), encoder.SeekTable()
+			}
+
+			single, singleTable := encode(len(data))
+			bytewise, bytewiseTable := encode(1)
+
+			if singleTable.NumFrames() < 2 {
+				t.Fatalf("Expected multiple frames, got %d", singleTable.NumFrames())
+			}
+			if bytewiseTable.NumFrames() != singleTable.NumFrames() {
+				t.Fatalf("Expected %d frames, got %d", singleTable.NumFrames(), bytewiseTable.NumFrames())
+			}
+			for i := uint32(0); i < singleTable.NumFrames(); i++ {
+				want, _ := singleTable.FrameSizeComp(i)
+				got, _ := bytewiseTable.FrameSizeComp(i)
+				if got != want {
+					t.Errorf("Frame %d: expected compressed size %d, got %d", i, want, got)
+				}
+			}
+			if !bytes.Equal(single, bytewise) {
+				t.Error("Byte-at-a-time output differs from single write")
+			}
+
+			// Each frame decodes on its own to exactly its slice of the input
+			decoder, err := zstd.NewReader(nil)
+			if err != nil {
+				t.Fatalf("NewReader failed: %v", err)
+			}
+			defer decoder.Close()
+			for i := uint32(0); i < singleTable.NumFrames(); i++ {
+				start, _ := singleTable.FrameStartComp(i)
+				end, _ := singleTable.FrameEndComp(i)
+				var header zstd.Header
+				if err := header.Decode(single[start:end]); err != nil {
+					t.Fatalf("Frame %d: bad zstd header: %v", i, err)
+				}
+				decompressed, err := decoder.DecodeAll(single[start:end], nil)
+				if err != nil {
+					t.Fatalf("Frame %d: DecodeAll failed: %v", i, err)
+				}
+				dStart, _ := singleTable.FrameStartDecomp(i)
+				dEnd, _ := singleTable.FrameEndDecomp(i)
+				if !bytes.Equal(decompressed, data[dStart:dEnd]) {
+					t.Errorf("Frame %d: decoded %d bytes, expected %d", i, len(decompressed), dEnd-dStart)
+				}
+			}
+		})
+	}
+}
+
+func encodeForTest(tb testing.TB, data []byte, opts *EncoderOptions, chunk int) []byte {
+	tb.Helper()
+	var buf bytes.Buffer
+	encoder, err := NewEncoder(&buf, opts)
+	if err != nil {
+		tb.Fatalf("NewEncoder failed: %v", err)
+	}
+	for p := data; len(p) > 0; {
+		n := min(chunk, len(p))
+		if _, err := encoder.Write(p[:n]); err != nil {
+			tb.Fatalf("Write failed: %v", err)
+		}
+		p = p[n:]
+	}
+	if err := encoder.Finish(); err != nil {
+		tb.Fatalf("Finish failed: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestEncoder_Concurrency(t *testing.T) {
+	data := make([]byte, 4<<20)
+	rand.New(rand.NewSource(1)).Read(data[:1<<20])
+	for i := 1 << 20; i < len(data); i++ {
+		data[i] = byte(i/5) ^ byte(i%11)
+	}
+
+	for _, policy := range []FrameSizePolicy{
+		UncompressedFrameSize{Size: 100 * 1000},
+		CompressedFrameSize{Size: 32 * 1024},
+	} {
+		t.Run(fmt.Sprintf("%T", policy), func(t *testing.T) {
+			serial := encodeForTest(t, data, &EncoderOptions{
+				Level:        zstd.SpeedDefault,
+				FramePolicy:  policy,
+				ChecksumFlag: true,
+			}, 7000)
+
+			var frames []uint32
+			concurrent := encodeForTest(t, data, &EncoderOptions{
+				Level:        zstd.SpeedDefault,
+				FramePolicy:  policy,
+				ChecksumFlag: true,
+				Concurrency:  4,
+				OnFrame: func(frameIndex uint32, compressed, decompressed uint64) {
+					frames = append(frames, frameIndex)
+				},
+			}, 7000)
+
+			if !bytes.Equal(concurrent, serial) {
+				t.Fatal("Concurrent output differs from serial output")
+			}
+			for i, index := range frames {
+				if index != uint32(i) {
+					t.Fatalf("OnFrame called out of order: %v", frames)
+				}
+			}
+
+			decoder, err := NewDecoder(bytes.NewReader(concurrent), nil)
+			if err != nil {
+				t.Fatalf("NewDecoder failed: %v", err)
+			}
+			decoded, err := io.ReadAll(decoder)
+			if err != nil {
+				t.Fatalf("ReadAll failed: %v", err)
+			}
+			if !bytes.Equal(decoded, data) {
+				t.Error("Decoded concurrent output differs from input")
+			}
+		})
+	}
+}
+
+// limitedWriter fails every write once n bytes have been written
+type limitedWriter struct {
+	w io.Writer
+	n int
+}
+
+func (l *limitedWriter) Write(p []byte) (int, error) {
+	if len(p) > l.n {
+		return 0, errors.New("write limit reached")
+	}
+	l.n -= len(p)
+	return l.w.Write(p)
+}
+
+func TestEncoder_ConcurrencyRelease(t *testing.T) {
+	data := bytes.Repeat([]byte("released workers "), 20000)
+	opts := &EncoderOptions{
+		Level:       zstd.SpeedFastest,
+		FramePolicy: UncompressedFrameSize{Size: 10000},
+		Concurrency: 4,
+	}
+
+	// Close releases the workers of an abandoned encoder
+	encoder, err := NewEncoder(io.Discard, opts)
+	if err != nil {
+		t.Fatalf("NewEncoder failed: %v", err)
+	}
+	if _, err := encoder.Write(data); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if err := encoder.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if encoder.jobs != nil {
+		t.Error("Expected Close to stop the workers")
+	}
+	if _, err := encoder.Write(data); err == nil || err.Error() != ErrEncoderClosed {
+		t.Errorf("Expected %q after Close, got %v", ErrEncoderClosed, err)
+	}
+
+	// Reset starts them again
+	var buf bytes.Buffer
+	encoder.Reset(&buf)
+	if _, err := encoder.Write(data); err != nil {
+		t.Fatalf("Write after Reset failed: %v", err)
+	}
+	if err := encoder.Finish(); err != nil {
+		t.Fatalf("Finish after Reset failed: %v", err)
+	}
+	if decoded, err := DecodeAll(buf.Bytes(), nil); err != nil || !bytes.Equal(decoded, data) {
+		t.Errorf("Round trip after Reset failed: %v", err)
+	}
+
+	// A failing Finish releases them too
+	encoder, err = NewEncoder(&limitedWriter{w: io.Discard, n: 1000}, opts)
+	if err != nil {
+		t.Fatalf("NewEncoder failed: %v", err)
+	}
+	encoder.Write(data)
+	if err := encoder.Finish(); err == nil {
+		t.Fatal("Expected Finish to fail")
+	}
+	if encoder.jobs != nil {
+		t.Error("Expected a failed Finish to stop the workers")
+	}
+}
+
+func TestEncoder_WriteErrorSticky(t *testing.T) {
+	data := bytes.Repeat([]byte("transient write error "), 1000)
+	var buf bytes.Buffer
+	w := &limitedWriter{w: &buf, n: 0}
+	encoder, err := NewEncoder(w, &EncoderOptions{
+		Level:       zstd.SpeedFastest,
+		FramePolicy: UncompressedFrameSize{Size: 1000},
+	})
+	if err != nil {
+		t.Fatalf("NewEncoder failed: %v", err)
+	}
+	_, writeErr := encoder.Write(data)
+	if writeErr == nil {
+		t.Fatal("Expected Write to fail")
+	}
+	if n := encoder.SeekTable().NumFrames(); n != 0 {
+		t.Errorf("Expected no frame logged for a failed write, got %d", n)
+	}
+
+	// The writer recovers, but the encoder keeps failing rather than
+	// writing a seek table that lists the lost frame
+	w.n = 1 << 20
+	if _, err := encoder.Write(data); err != writeErr {
+		t.Errorf("Expected Write to return %v again, got %v", writeErr, err)
+	}
+	if err := encoder.Finish(); err != writeErr {
+		t.Errorf("Expected Finish to return %v, got %v", writeErr, err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("Expected nothing written after the failure, got %d bytes", buf.Len())
+	}
+}
+
+func BenchmarkEncoder_Concurrency(b *testing.B) {
+	incompressible := make([]byte, 100<<20)
+	rand.New(rand.NewSource(1)).Read(incompressible)
+	compressible := make([]byte, 100<<20)
+	for i := range compressible {
+		compressible[i] = byte(i/5) ^ byte(i%11)
+	}
+
+	payloads := []struct {
+		name string
+		data []byte
+	}{
+		{"incompressible", incompressible},
+		{"compressible", compressible},
+	}
+	for _, payload := range payloads {
+		for _, concurrency := range []int{1, 4} {
+			b.Run(fmt.Sprintf("%s/concurrency=%d", payload.name, concurrency), func(b *testing.B) {
+				opts := &EncoderOptions{
+					Level:       zstd.SpeedDefault,
+					FramePolicy: UncompressedFrameSize{Size: DEFAULT_FRAME_SIZE},
+					Concurrency: concurrency,
+				}
+				b.SetBytes(int64(len(payload.data)))
+				for i := 0; i < b.N; i++ {
+					encoder, err := NewEncoder(io.Discard, opts)
+					if err != nil {
+						b.Fatalf("NewEncoder failed: %v", err)
+					}
+					if _, err := encoder.Write(payload.data); err != nil {
+						b.Fatalf("Write failed: %v", err)
+					}
+					if err := encoder.Finish(); err != nil {
+						b.Fatalf("Finish failed: %v", err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestEncoder_DelimiterFrame(t *testing.T) {
+	var input bytes.Buffer
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 200; i++ {
+		fmt.Fprintf(&input, `{"id":%d,"pad":"%s"}`+"\n", i, bytes.Repeat([]byte("x"), rng.Intn(60)))
+	}
+	// A record longer than a frame can only end its frame at its newline
+	fmt.Fprintf(&input, `{"id":"long","pad":"%s"}`+"\n", bytes.Repeat([]byte("y"), 1000))
+	data := input.Bytes()
+
+	var buf bytes.Buffer
+	encoder, err := NewEncoder(&buf, &EncoderOptions{
+		Level:          zstd.SpeedFastest,
+		FramePolicy:    UncompressedFrameSize{Size: 256},
+		DelimiterFrame: '\n',
+	})
+	if err != nil {
+		t.Fatalf("NewEncoder failed: %v", err)
+	}
+	for p := data; len(p) > 0; {
+		n := min(1+rng.Intn(100), len(p))
+		if _, err := encoder.Write(p[:n]); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		p = p[n:]
+	}
+	if err := encoder.Finish(); err != nil {
+		t.Fatalf("Finish failed: %v", err)
+	}
+
+	decoder, err := NewDecoder(bytes.NewReader(buf.Bytes()), nil)
+	if err != nil {
+		t.Fatalf("NewDecoder failed: %v", err)
+	}
+	if decoder.SeekTable().NumFrames() < 10 {
+		t.Fatalf("Expected many frames, got %d", decoder.SeekTable().NumFrames())
+	}
+
+	var decoded []byte
+	it := decoder.Frames()
+	for it.Next() {
+		frame := it.Bytes()
+		if frame[len(frame)-1] != '\n' {
+			t.Errorf("Frame %d does not end on a newline: %q", it.Index(), frame)
+		}
+		// A frame only outgrows the frame size to finish its last record
+		if i := bytes.LastIndexByte(frame[:len(frame)-1], '\n'); i+1 > 256 {
+			t.Errorf("Frame %d continues past a record boundary at %d", it.Index(), i+1)
+		}
+		decoded = append(decoded, frame...)
+	}
+	if err := it.Err(); err != nil {
+		t.Fatalf("Iteration failed: %v", err)
+	}
+	if !bytes.Equal(decoded, data) {
+		t.Error("Decoded data differs from input")
+	}
+}
+
+func TestCompressSeekable(t *testing.T) {
+	data := make([]byte, 1<<20)
+	for i := range data {
+		data[i] = byte(i/3) ^ byte(i%13)
+	}
+
+	for _, opts := range []*EncoderOptions{
+		{Level: zstd.SpeedDefault, FramePolicy: UncompressedFrameSize{Size: 100 * 1000}, ChecksumFlag: true},
+		{Level: zstd.SpeedDefault, FramePolicy: UncompressedFrameSize{Size: 100 * 1000}, Concurrency: 4},
+		{Level: zstd.SpeedFastest, FramePolicy: CompressedFrameSize{Size: 8 * 1024}},
+	} {
+		t.Run(fmt.Sprintf("%T/%d", opts.FramePolicy, opts.Concurrency), func(t *testing.T) {
+			incremental := encodeForTest(t, data, opts, 10000)
+
+			var buf bytes.Buffer
+			st, err := CompressSeekable(&buf, data, opts)
+			if err != nil {
+				t.Fatalf("CompressSeekable failed: %v", err)
+			}
+			if !bytes.Equal(buf.Bytes(), incremental) {
+				t.Fatal("CompressSeekable output differs from incremental encoder")
+			}
+
+			decoder, err := NewDecoderBytes(buf.Bytes(), nil)
+			if err != nil {
+				t.Fatalf("NewDecoderBytes failed: %v", err)
+			}
+			if !st.Equal(decoder.SeekTable()) {
+				t.Error("Returned seek table differs from the archive's")
+			}
+		})
+	}
+}
+
+func TestEncoder_MaxUncompressedFrameSize(t *testing.T) {
+	data := bytes.Repeat([]byte("largest frame policy "), 1000)
+	var buf bytes.Buffer
+	st, err := CompressSeekable(&buf, data, &EncoderOptions{
+		Level:       zstd.SpeedDefault,
+		FramePolicy: UncompressedFrameSize{Size: 0xFFFFFFFF},
+	})
+	if err != nil {
+		t.Fatalf("CompressSeekable failed: %v", err)
+	}
+	if st.NumFrames() != 1 {
+		t.Errorf("Expected 1 frame, got %d", st.NumFrames())
+	}
+
+	decoder, err := NewDecoderBytes(buf.Bytes(), nil)
+	if err != nil {
+		t.Fatalf("NewDecoderBytes failed: %v", err)
+	}
+	decoded, err := io.ReadAll(decoder)
+	if err != nil || !bytes.Equal(decoded, data) {
+		t.Errorf("Round trip failed: %v", err)
+	}
+}
+
+func TestNewEncoderContext_Cancel(t *testing.T) {
+	data := make([]byte, 10*1000)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	for _, concurrency := range []int{0, 4} {
+		t.Run(fmt.Sprintf("concurrency %d", concurrency), func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			var buf bytes.Buffer
+			var written []uint32
+			encoder, err := NewEncoderContext(ctx, &buf, &EncoderOptions{
+				Level:       zstd.SpeedFastest,
+				FramePolicy: UncompressedFrameSize{Size: 1000},
+				Concurrency: concurrency,
+				OnFrame: func(frameIndex uint32, compressed, decompressed uint64) {
+					written = append(written, frameIndex)
+					if frameIndex == 1 {
+						cancel()
+					}
+				},
+			})
+			if err != nil {
+				t.Fatalf("NewEncoderContext failed: %v", err)
+			}
+
+			_, err = encoder.Write(data)
+			if err == nil {
+				err = encoder.Finish()
+			}
+			if !errors.Is(err, context.Canceled) || !strings.HasPrefix(err.Error(), ErrCanceled) {
+				t.Fatalf("Expected %q wrapping context.Canceled, got %v", ErrCanceled, err)
+			}
+			if err := encoder.Finish(); !errors.Is(err, context.Canceled) {
+				t.Errorf("Expected Finish after cancel to fail, got %v", err)
+			}
+
+			// Only the first two frames reached the output and the seek table
+			if len(written) != 2 || encoder.SeekTable().NumFrames() != 2 {
+				t.Fatalf("Expected 2 frames, got %v and %d in the seek table", written, encoder.SeekTable().NumFrames())
+			}
+			end, _ := encoder.SeekTable().FrameEndComp(1)
+			if uint64(buf.Len()) != end {
+				t.Errorf("Expected %d bytes of output, got %d", end, buf.Len())
+			}
+		})
+	}
+}
+
+func TestEncoder_Reset(t *testing.T) {
+	payloads := [][]byte{
+		bytes.Repeat([]byte("first payload "), 500),
+		[]byte("tiny"),
+		bytes.Repeat([]byte("third payload, a little longer "), 2000),
+	}
+
+	for _, concurrency := range []int{0, 4} {
+		t.Run(fmt.Sprintf("concurrency %d", concurrency), func(t *testing.T) {
+			opts := &EncoderOptions{
+				Level:        zstd.SpeedDefault,
+				FramePolicy:  UncompressedFrameSize{Size: 4096},
+				ChecksumFlag: true,
+				Concurrency:  concurrency,
+			}
+
+			var buf bytes.Buffer
+			encoder, err := NewEncoder(&buf, opts)
+			if err != nil {
+				t.Fatalf("NewEncoder failed: %v", err)
+			}
+			// Abandon an unfinished archive before the first Reset
+			encoder.Write(bytes.Repeat([]byte("discarded "), 1000))
+
+			for i, payload := range payloads {
+				buf.Reset()
+				encoder.Reset(&buf)
+				if _, err := encoder.Write(payload); err != nil {
+					t.Fatalf("Write %d failed: %v", i, err)
+				}
+				if err := encoder.Finish(); err != nil {
+					t.Fatalf("Finish %d failed: %v", i, err)
+				}
+
+				if !bytes.Equal(buf.Bytes(), encodeForTest(t, payload, opts, len(payload))) {
+					t.Errorf("Payload %d: output after Reset differs from a new encoder", i)
+				}
+				decoder, err := NewDecoderBytes(buf.Bytes(), nil)
+				if err != nil {
+					t.Fatalf("NewDecoderBytes %d failed: %v", i, err)
+				}
+				decoded, err := io.ReadAll(decoder)
+				if err != nil || !bytes.Equal(decoded, payload) {
+					t.Errorf("Payload %d did not round trip: %v", i, err)
+				}
+			}
+		})
+	}
+}
+
+func TestEncoder_ReadFrom(t *testing.T) {
+	data := make([]byte, 3<<20)
+	rand.New(rand.NewSource(1)).Read(data[:1<<20])
+	for i := 1 << 20; i < len(data); i++ {
+		data[i] = byte(i/9) ^ byte(i%5)
+	}
+
+	for _, policy := range []FrameSizePolicy{
+		UncompressedFrameSize{Size: 300 * 1000},
+		CompressedFrameSize{Size: 64 * 1024},
+	} {
+		t.Run(fmt.Sprintf("%T", policy), func(t *testing.T) {
+			opts := &EncoderOptions{Level: zstd.SpeedFastest, FramePolicy: policy}
+
+			var buf bytes.Buffer
+			encoder, err := NewEncoder(&buf, opts)
+			if err != nil {
+				t.Fatalf("NewEncoder failed: %v", err)
+			}
+			// Leave a partial frame open, then read the rest in one go
+			if _, err := encoder.Write(data[:12345]); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+			n, err := io.Copy(encoder, struct{ io.Reader }{bytes.NewReader(data[12345:])})
+			if err != nil || n != int64(len(data)-12345) {
+				t.Fatalf("ReadFrom copied %d bytes: %v", n, err)
+			}
+			if err := encoder.Finish(); err != nil {
+				t.Fatalf("Finish failed: %v", err)
+			}
+
+			if encoder.SeekTable().NumFrames() < 4 {
+				t.Errorf("Expected the input to be split into frames, got %d", encoder.SeekTable().NumFrames())
+			}
+			if !bytes.Equal(buf.Bytes(), encodeForTest(t, data, opts, 7000)) {
+				t.Error("ReadFrom output differs from Write output")
+			}
+		})
+	}
+}
+
+func BenchmarkEncoder_ReadFrom(b *testing.B) {
+	data := make([]byte, 8<<20)
+	for i := range data {
+		data[i] = byte(i/7) ^ byte(i%13)
+	}
+	opts := &EncoderOptions{Level: zstd.SpeedFastest, FramePolicy: UncompressedFrameSize{Size: DEFAULT_FRAME_SIZE}}
+
+	b.Run("Write", func(b *testing.B) {
+		b.SetBytes(int64(len(data)))
+		for i := 0; i < b.N; i++ {
+			encoder, _ := NewEncoder(io.Discard, opts)
+			// Hide ReadFrom so io.Copy goes through Write
+			if _, err := io.Copy(struct{ io.Writer }{encoder}, struct{ io.Reader }{bytes.NewReader(data)}); err != nil {
+				b.Fatalf("Copy failed: %v", err)
+			}
+			encoder.Finish()
+		}
+	})
+
+	b.Run("ReadFrom", func(b *testing.B) {
+		b.SetBytes(int64(len(data)))
+		for i := 0; i < b.N; i++ {
+			encoder, _ := NewEncoder(io.Discard, opts)
+			if _, err := io.Copy(encoder, struct{ io.Reader }{bytes.NewReader(data)}); err != nil {
+				b.Fatalf("Copy failed: %v", err)
+			}
+			encoder.Finish()
+		}
+	})
+}
+
+func TestEncoder_HybridFrameSize(t *testing.T) {
+	policy := HybridFrameSize{MaxCompressed: 16 * 1024, MaxUncompressed: 100 * 1000}
+
+	compressible := bytes.Repeat([]byte("compressible hybrid policy data "), 20000)
+	incompressible := make([]byte, 300*1000)
+	rand.New(rand.NewSource(1)).Read(incompressible)
+
+	for _, tt := range []struct {
+		name         string
+		data         []byte
+		uncompressed bool // whether frames should end at the uncompressed cap
+	}{
+		{"uncompressed cap first", compressible, true},
+		{"compressed cap first", incompressible, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			st, err := CompressSeekable(&buf, tt.data, &EncoderOptions{Level: zstd.SpeedDefault, FramePolicy: policy})
+			if err != nil {
+				t.Fatalf("CompressSeekable failed: %v", err)
+			}
+			if st.NumFrames() < 3 {
+				t.Fatalf("Expected several frames, got %d", st.NumFrames())
+			}
+
+			for i := uint32(0); i < st.NumFrames()-1; i++ {
+				comp, _ := st.FrameSizeComp(i)
+				decomp, _ := st.FrameSizeDecomp(i)
+				if tt.uncompressed {
+					if decomp != uint64(policy.MaxUncompressed) || comp >= uint64(policy.MaxCompressed) {
+						t.Errorf("Frame %d: %d -> %d bytes, expected to end at the uncompressed cap", i, comp, decomp)
+					}
+				} else if comp > uint64(policy.MaxCompressed)+64 || decomp >= uint64(policy.MaxUncompressed) {
+					t.Errorf("Frame %d: %d -> %d bytes, expected to end at the compressed cap", i, comp, decomp)
+				}
+			}
+
+			decoder, err := NewDecoderBytes(buf.Bytes(), nil)
+			if err != nil {
+				t.Fatalf("NewDecoderBytes failed: %v", err)
+			}
+			decoded, err := io.ReadAll(decoder)
+			if err != nil || !bytes.Equal(decoded, tt.data) {
+				t.Errorf("Round trip failed: %v", err)
+			}
+		})
+	}
+
+	// Within one stream, each frame ends at whichever cap it reaches first
+	mixed := append(append([]byte(nil), compressible[:300*1000]...), incompressible...)
+	var buf bytes.Buffer
+	st, err := CompressSeekable(&buf, mixed, &EncoderOptions{Level: zstd.SpeedDefault, FramePolicy: policy})
+	if err != nil {
+		t.Fatalf("CompressSeekable failed: %v", err)
+	}
+	var atUncompressed, atCompressed int
+	for i := uint32(0); i < st.NumFrames()-1; i++ {
+		comp, _ := st.FrameSizeComp(i)
+		decomp, _ := st.FrameSizeDecomp(i)
+		switch {
+		case decomp == uint64(policy.MaxUncompressed) && comp < uint64(policy.MaxCompressed):
+			atUncompressed++
+		case decomp < uint64(policy.MaxUncompressed) && comp <= uint64(policy.MaxCompressed)+64 &&
+			comp > uint64(policy.MaxCompressed)/2:
+			atCompressed++
+		default:
+			t.Errorf("Frame %d: %d -> %d bytes, expected to end at one of the caps", i, comp, decomp)
+		}
+	}
+	if atUncompressed == 0 || atCompressed == 0 {
+		t.Errorf("Expected frames ending at both caps, got %d uncompressed and %d compressed",
+			atUncompressed, atCompressed)
+	}
+}
+
+func TestEncoder_MaxFrameInterval(t *testing.T) {
+	clock := time.Unix(1000, 0)
+	for _, concurrency := range []int{0, 4} {
+		var buf bytes.Buffer
+		encoder, err := NewEncoder(&buf, &EncoderOptions{
+			Level:            zstd.SpeedDefault,
+			FramePolicy:      UncompressedFrameSize{Size: 1 << 20},
+			MaxFrameInterval: time.Second,
+			Now:              func() time.Time { return clock },
+			Concurrency:      concurrency,
+		})
+		if err != nil {
+			t.Fatalf("NewEncoder failed: %v", err)
+		}
+
+		// Writes within the interval share a frame; the first write after
+		// it elapses flushes the frame before its own data
+		var want []byte
+		for _, step := range []time.Duration{0, 500 * time.Millisecond, 400 * time.Millisecond,
+			200 * time.Millisecond, 2 * time.Second, 0} {
+			clock = clock.Add(step)
+			line := []byte(fmt.Sprintf("log line at %v\n", clock))
+			want = append(want, line...)
+			if _, err := encoder.Write(line); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+		}
+		if got := encoder.SeekTable().NumFrames(); got != 2 {
+			t.Errorf("concurrency %d: expected 2 frames before Finish, got %d", concurrency, got)
+		}
+		if err := encoder.Finish(); err != nil {
+			t.Fatalf("Finish failed: %v", err)
+		}
+
+		st := encoder.SeekTable()
+		if st.NumFrames() != 3 {
+			t.Fatalf("concurrency %d: expected 3 frames, got %d", concurrency, st.NumFrames())
+		}
+		decoder, err := NewDecoderBytes(buf.Bytes(), nil)
+		if err != nil {
+			t.Fatalf("NewDecoderBytes failed: %v", err)
+		}
+		decoded, err := io.ReadAll(decoder)
+		if err != nil || !bytes.Equal(decoded, want) {
+			t.Errorf("Round trip failed: %v", err)
+		}
+	}
+}
+
+func TestEncoder_FlushFrame(t *testing.T) {
+	var buf bytes.Buffer
+	encoder, err := NewEncoder(&buf, &EncoderOptions{
+		Level:       zstd.SpeedDefault,
+		FramePolicy: UncompressedFrameSize{Size: 1 << 20},
+		Concurrency: 4,
+	})
+	if err != nil {
+		t.Fatalf("NewEncoder failed: %v", err)
+	}
+
+	if err := encoder.FlushFrame(); err != nil {
+		t.Fatalf("FlushFrame on an empty frame failed: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := encoder.Write([]byte("some data")); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		if err := encoder.FlushFrame(); err != nil {
+			t.Fatalf("FlushFrame failed: %v", err)
+		}
+		// The frame is in the output as soon as FlushFrame returns
+		if got := encoder.SeekTable().NumFrames(); got != uint32(i+1) {
+			t.Errorf("Expected %d frames written, got %d", i+1, got)
+		}
+		if encoder.WrittenCompressed() != uint64(buf.Len()) {
+			t.Errorf("Expected %d bytes written, got %d", encoder.WrittenCompressed(), buf.Len())
+		}
+	}
+	if err := encoder.Finish(); err != nil {
+		t.Fatalf("Finish failed: %v", err)
+	}
+}
+
+func TestConcatArchives(t *testing.T) {
+	var srcs []Seekable
+	var want []byte
+	for i := 0; i < 3; i++ {
+		data := bytes.Repeat([]byte(fmt.Sprintf("shard %d content ", i)), 1000)
+		want = append(want, data...)
+
+		var buf bytes.Buffer
+		st, err := CompressSeekable(&buf, data, &EncoderOptions{
+			Level:        zstd.SpeedDefault,
+			FramePolicy:  UncompressedFrameSize{Size: uint32(len(data)/2 + 1)},
+			ChecksumFlag: true,
+		})
+		if err != nil {
+			t.Fatalf("CompressSeekable failed: %v", err)
+		}
+		if st.NumFrames() != 2 {
+			t.Fatalf("Expected 2 frames in shard %d, got %d", i, st.NumFrames())
+		}
+		srcs = append(srcs, bytes.NewReader(buf.Bytes()))
+	}
+
+	var out bytes.Buffer
+	if err := ConcatArchives(&out, srcs...); err != nil {
+		t.Fatalf("ConcatArchives failed: %v", err)
+	}
+
+	decoder, err := NewDecoderBytes(out.Bytes(), nil)
+	if err != nil {
+		t.Fatalf("NewDecoderBytes failed: %v", err)
+	}
+	st := decoder.SeekTable()
+	if st.NumFrames() != 6 {
+		t.Errorf("Expected 6 frames, got %d", st.NumFrames())
+	}
+	if !st.HasChecksums() {
+		t.Error("Expected checksums to be kept")
+	}
+	decoded, err := io.ReadAll(decoder)
+	if err != nil || !bytes.Equal(decoded, want) {
+		t.Errorf("Decoding concatenated archive failed: %v", err)
+	}
+
+	// Sources without a seek table are rejected
+	if err := ConcatArchives(io.Discard, bytes.NewReader([]byte("not an archive at all"))); err == nil {
+		t.Error("Expected error for a non-seekable source")
+	}
+}
+
+// flushRecorder records how much data it held at each Flush call
+type flushRecorder struct {
+	bytes.Buffer
+	flushedAt []int
+}
+
+func (f *flushRecorder) Flush() error {
+	f.flushedAt = append(f.flushedAt, f.Len())
+	return nil
+}
+
+func TestEncoder_Flush(t *testing.T) {
+	var out flushRecorder
+	encoder, err := NewEncoder(&out, nil)
+	if err != nil {
+		t.Fatalf("NewEncoder failed: %v", err)
+	}
+
+	if _, err := encoder.Write([]byte("first record")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if err := encoder.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	if encoder.SeekTable().NumFrames() != 1 {
+		t.Errorf("Expected Flush to end the frame, got %d frames", encoder.SeekTable().NumFrames())
+	}
+	if len(out.flushedAt) != 1 || out.flushedAt[0] == 0 || out.flushedAt[0] != int(encoder.WrittenCompressed()) {
+		t.Errorf("Expected the frame written before Flush, flushes at %v", out.flushedAt)
+	}
+
+	// With no new data the writer is still flushed but no frame is added
+	if err := encoder.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	if encoder.SeekTable().NumFrames() != 1 || len(out.flushedAt) != 2 {
+		t.Errorf("Expected 1 frame and 2 flushes, got %d and %v", encoder.SeekTable().NumFrames(), out.flushedAt)
+	}
+
+	if _, err := encoder.Write([]byte("second record")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if err := encoder.Finish(); err != nil {
+		t.Fatalf("Finish failed: %v", err)
+	}
+	decoder, err := NewDecoderBytes(out.Bytes(), nil)
+	if err != nil {
+		t.Fatalf("NewDecoderBytes failed: %v", err)
+	}
+	decoded, err := io.ReadAll(decoder)
+	if err != nil || string(decoded) != "first recordsecond record" {
+		t.Errorf("Round trip failed: %q, %v", decoded, err)
+	}
+}
+
+func TestEncoder_Stats(t *testing.T) {
+	e := &Encoder{seekTable: NewSeekTable()}
+	if stats := e.Stats(); stats != (EncoderStats{}) {
+		t.Errorf("Expected zero stats with no frames, got %+v", stats)
+	}
+
+	e.seekTable.LogFrame(100, 400) // ratio 4
+	e.seekTable.LogFrame(50, 100)  // ratio 2
+	e.seekTable.LogFrame(10, 30)   // ratio 3
+	want := EncoderStats{
+		NumFrames:            3,
+		TotalCompressed:      160,
+		TotalDecompressed:    530,
+		MinFrameDecomp:       30,
+		MaxFrameDecomp:       400,
+		MeanCompressionRatio: 3,
+	}
+	if stats := e.Stats(); stats != want {
+		t.Errorf("Expected %+v, got %+v", want, stats)
+	}
+
+	// Stats remain available after Finish
+	var buf bytes.Buffer
+	encoder, err := NewEncoder(&buf, &EncoderOptions{
+		Level:       zstd.SpeedDefault,
+		FramePolicy: UncompressedFrameSize{Size: 1000},
+	})
+	if err != nil {
+		t.Fatalf("NewEncoder failed: %v", err)
+	}
+	if _, err := encoder.Write(bytes.Repeat([]byte("x"), 2500)); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if err := encoder.Finish(); err != nil {
+		t.Fatalf("Finish failed: %v", err)
+	}
+	stats := encoder.Stats()
+	if stats.NumFrames != 3 || stats.TotalDecompressed != 2500 || stats.MinFrameDecomp != 500 ||
+		stats.MaxFrameDecomp != 1000 || stats.TotalCompressed != encoder.WrittenCompressed() {
+		t.Errorf("Unexpected stats after Finish: %+v", stats)
+	}
+}
+
+func TestEncoder_WindowLog(t *testing.T) {
+	data := make([]byte, 300000)
+	rand.New(rand.NewSource(10)).Read(data[:100000])
+	copy(data[200000:], data[:100000]) // a match 200KB back
+
+	for _, windowLog := range []int{10, 20} {
+		opts := DefaultEncoderOptions()
+		opts.WindowLog = windowLog
+		opts.FramePolicy = UncompressedFrameSize{Size: 1 << 20}
+		var buf bytes.Buffer
+		if _, err := CompressSeekable(&buf, data, opts); err != nil {
+			t.Fatalf("WindowLog %d: CompressSeekable failed: %v", windowLog, err)
+		}
+
+		decoderOpts := DefaultDecoderOptions()
+		decoderOpts.MaxWindowLog = windowLog
+		decoder, err := NewDecoder(bytes.NewReader(buf.Bytes()), decoderOpts)
+		if err != nil {
+			t.Fatalf("WindowLog %d: NewDecoder failed: %v", windowLog, err)
+		}
+		if decoded, err := io.ReadAll(decoder); err != nil || !bytes.Equal(decoded, data) {
+			t.Errorf("WindowLog %d: round trip failed: %v", windowLog, err)
+		}
+
+		// A decoder allowing a smaller window rejects the frames
+		decoderOpts.MaxWindowLog = windowLog - 1
+		decoder, err = NewDecoder(bytes.NewReader(buf.Bytes()), decoderOpts)
+		if err != nil {
+			t.Fatalf("WindowLog %d: NewDecoder failed: %v", windowLog, err)
+		}
+		_, err = io.ReadAll(decoder)
+		if windowLog > 10 && (err == nil || !strings.HasPrefix(err.Error(), ErrWindowExceeded)) {
+			t.Errorf("WindowLog %d: expected %s, got %v", windowLog, ErrWindowExceeded, err)
+		}
+	}
+
+	for _, windowLog := range []int{9, 30, -1} {
+		if _, err := NewEncoder(io.Discard, &EncoderOptions{Level: zstd.SpeedDefault, WindowLog: windowLog}); err == nil ||
+			!strings.HasPrefix(err.Error(), ErrInvalidWindowLog) {
+			t.Errorf("WindowLog %d: expected %s, got %v", windowLog, ErrInvalidWindowLog, err)
+		}
+	}
+}
+
+func TestEncoder_ContentDefinedFrameSize(t *testing.T) {
+	data := make([]byte, 2<<20)
+	rand.New(rand.NewSource(11)).Read(data)
+	edited := append(append(append([]byte(nil), data[:1000]...), "inserted"...), data[1000:]...)
+	policy := ContentDefinedFrameSize{Min: 16 * 1024, Max: 128 * 1024, Window: 48}
+
+	// frames compresses input, split across uneven writes, and returns the
+	// compressed bytes of each frame
+	frames := func(input []byte) [][]byte {
+		t.Helper()
+		var buf bytes.Buffer
+		encoder, err := NewEncoder(&buf, &EncoderOptions{Level: zstd.SpeedFastest, FramePolicy: policy})
+		if err != nil {
+			t.Fatalf("NewEncoder failed: %v", err)
+		}
+		for rest := input; len(rest) > 0; {
+			n := min(len(rest), 7777)
+			encoder.Write(rest[:n])
+			rest = rest[n:]
+		}
+		if err := encoder.Finish(); err != nil {
+			t.Fatalf("Finish failed: %v", err)
+		}
+
+		st := encoder.SeekTable()
+		var out [][]byte
+		for i := uint32(0); i < st.NumFrames(); i++ {
+			start, _ := st.FrameStartComp(i)
+			end, _ := st.FrameEndComp(i)
+			out = append(out, buf.Bytes()[start:end])
+			size, _ := st.FrameSizeDecomp(i)
+			if size > uint64(policy.Max) || (size < uint64(policy.Min) && i < st.NumFrames()-1) {
+				t.Errorf("Frame %d holds %d bytes, outside [%d, %d]", i, size, policy.Min, policy.Max)
+			}
+		}
+
+		decoder, err := NewDecoderBytes(buf.Bytes(), nil)
+		if err != nil {
+			t.Fatalf("NewDecoderBytes failed: %v", err)
+		}
+		decoded, err := io.ReadAll(decoder)
+		if err != nil || !bytes.Equal(decoded, input) {
+			t.Fatalf("Round trip failed: %v", err)
+		}
+		return out
+	}
+
+	original := make(map[string]bool)
+	for _, frame := range frames(data) {
+		original[string(frame)] = true
+	}
+	editedFrames := frames(edited)
+	var shared int
+	for _, frame := range editedFrames {
+		if original[string(frame)] {
+			shared++
+		}
+	}
+	if len(editedFrames) < 10 || shared < len(editedFrames)-2 {
+		t.Errorf("Expected all but the edited frames to be unchanged, %d of %d are", shared, len(editedFrames))
+	}
+
+	if _, err := NewEncoder(io.Discard, &EncoderOptions{
+		Level:       zstd.SpeedFastest,
+		FramePolicy: ContentDefinedFrameSize{Min: 100, Max: 10},
+	}); err == nil || !strings.HasPrefix(err.Error(), ErrInvalidPolicy) {
+		t.Errorf("Expected %s for Min > Max, got %v", ErrInvalidPolicy, err)
+	}
+}
+
+func TestEncoder_WriteSkippableMetadata(t *testing.T) {
+	data := make([]byte, 50000)
+	rand.New(rand.NewSource(11)).Read(data)
+
+	opts := DefaultEncoderOptions()
+	opts.FramePolicy = UncompressedFrameSize{Size: 10000}
+	var buf bytes.Buffer
+	encoder, err := NewEncoder(&buf, opts)
+	if err != nil {
+		t.Fatalf("NewEncoder failed: %v", err)
+	}
+	if err := encoder.WriteSkippableMetadata(SKIPPABLE_MAGIC_NUMBER, nil); err == nil ||
+		!strings.HasPrefix(err.Error(), ErrMetadataMagic) {
+		t.Errorf("expected %s for the seek table magic, got %v", ErrMetadataMagic, err)
+	}
+	if err := encoder.WriteSkippableMetadata(0x12345678, nil); err == nil {
+		t.Error("expected an error for a non-skippable magic")
+	}
+	metadata := []SkippableFrame{
+		{Magic: 0x184D2A50, Data: []byte(`{"name":"data.bin"}`)},
+		{Magic: 0x184D2A51, Data: []byte{}},
+	}
+	for _, frame := range metadata {
+		if err := encoder.WriteSkippableMetadata(frame.Magic, frame.Data); err != nil {
+			t.Fatalf("WriteSkippableMetadata failed: %v", err)
+		}
+	}
+	if _, err := encoder.Write(data); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if err := encoder.WriteSkippableMetadata(0x184D2A52, nil); err == nil ||
+		err.Error() != ErrMetadataAfterData {
+		t.Errorf("expected %s, got %v", ErrMetadataAfterData, err)
+	}
+	if err := encoder.Finish(); err != nil {
+		t.Fatalf("Finish failed: %v", err)
+	}
+
+	decoder, err := NewDecoder(bytes.NewReader(buf.Bytes()), nil)
+	if err != nil {
+		t.Fatalf("NewDecoder failed: %v", err)
+	}
+	if n := decoder.SeekTable().NumFrames(); n != 5 {
+		t.Errorf("expected 5 frames, got %d", n)
+	}
+	frames := decoder.SkippableFrames()
+	if len(frames) != len(metadata) {
+		t.Fatalf("expected %d skippable frames, got %d", len(metadata), len(frames))
+	}
+	for i, frame := range frames {
+		if frame.Magic != metadata[i].Magic || !bytes.Equal(frame.Data, metadata[i].Data) {
+			t.Errorf("skippable frame %d: got %#x %q", i, frame.Magic, frame.Data)
+		}
+	}
+	if decoded, err := io.ReadAll(decoder); err != nil || !bytes.Equal(decoded, data) {
+		t.Fatalf("round trip failed: %v", err)
+	}
+
+	for _, offset := range []int64{0, 5000, 25000} {
+		p := make([]byte, 1000)
+		if _, err := decoder.ReadAt(p, offset); err != nil {
+			t.Fatalf("ReadAt %d failed: %v", offset, err)
+		}
+		if !bytes.Equal(p, data[offset:offset+1000]) {
+			t.Errorf("ReadAt %d returned wrong data", offset)
+		}
+	}
+
+	decoderOpts := DefaultDecoderOptions()
+	decoderOpts.LowerFrame = 2
+	decoder, err = NewDecoder(bytes.NewReader(buf.Bytes()), decoderOpts)
+	if err != nil {
+		t.Fatalf("NewDecoder failed: %v", err)
+	}
+	if decoded, err := io.ReadAll(decoder); err != nil || !bytes.Equal(decoded, data[20000:]) {
+		t.Errorf("reading from frame 2 failed: %v", err)
+	}
+	if len(decoder.SkippableFrames()) != len(metadata) {
+		t.Errorf("expected %d skippable frames from frame 2", len(metadata))
+	}
+}
+
+func TestEncodeAll_DecodeAll(t *testing.T) {
+	const frameSize = 4096
+	opts := DefaultEncoderOptions()
+	opts.FramePolicy = UncompressedFrameSize{Size: frameSize}
+
+	for _, size := range []int{0, 1, frameSize - 1, frameSize, frameSize + 1, 5*frameSize + 123} {
+		data := make([]byte, size)
+		rand.New(rand.NewSource(int64(size))).Read(data)
+
+		archive, err := EncodeAll(data, opts)
+		if err != nil {
+			t.Fatalf("size %d: EncodeAll failed: %v", size, err)
+		}
+		decoded, err := DecodeAll(archive, nil)
+		if err != nil {
+			t.Fatalf("size %d: DecodeAll failed: %v", size, err)
+		}
+		if !bytes.Equal(decoded, data) {
+			t.Errorf("size %d: round trip returned %d bytes", size, len(decoded))
+		}
+	}
+
+	// Decoder options restrict the frames decoded
+	data := bytes.Repeat([]byte("0123456789"), 2000)
+	archive, err := EncodeAll(data, opts)
+	if err != nil {
+		t.Fatalf("EncodeAll failed: %v", err)
+	}
+	decoderOpts := DefaultDecoderOptions()
+	decoderOpts.LowerFrame = 1
+	decoderOpts.UpperFrame = 2
+	decoded, err := DecodeAll(archive, decoderOpts)
+	if err != nil {
+		t.Fatalf("DecodeAll failed: %v", err)
+	}
+	if !bytes.Equal(decoded, data[frameSize:3*frameSize]) {
+		t.Errorf("frames 1-2 returned %d bytes", len(decoded))
+	}
+}
+
+func TestEncoder_OnFrame(t *testing.T) {
+	type call struct {
+		index                    uint32
+		compressed, decompressed uint64
+	}
+
+	for _, concurrency := range []int{1, 4} {
+		var calls []call
+		var buf bytes.Buffer
+		encoder, err := NewEncoder(&buf, &EncoderOptions{
+			Level:       zstd.SpeedDefault,
+			FramePolicy: UncompressedFrameSize{Size: 1 << 20},
+			Concurrency: concurrency,
+			OnFrame: func(frameIndex uint32, compressed, decompressed uint64) {
+				calls = append(calls, call{frameIndex, compressed, decompressed})
+			},
+		})
+		if err != nil {
+			t.Fatalf("NewEncoder failed: %v", err)
+		}
+		for _, frame := range []string{"first frame", "second, longer frame", "third"} {
+			encoder.Write([]byte(frame))
+			if err := encoder.EndFrame(); err != nil {
+				t.Fatalf("EndFrame failed: %v", err)
+			}
+		}
+		if err := encoder.Finish(); err != nil {
+			t.Fatalf("Finish failed: %v", err)
+		}
+
+		st := encoder.SeekTable()
+		if len(calls) != 3 {
+			t.Fatalf("concurrency %d: expected 3 calls, got %v", concurrency, calls)
+		}
+		for i, c := range calls {
+			compEnd, _ := st.FrameEndComp(uint32(i))
+			decompEnd, _ := st.FrameEndDecomp(uint32(i))
+			if c != (call{uint32(i), compEnd, decompEnd}) {
+				t.Errorf("concurrency %d: call %d was %+v, expected {%d %d %d}",
+					concurrency, i, c, i, compEnd, decompEnd)
+			}
+		}
+	}
+}
+
+func TestEncoder_OnFrameWrites(t *testing.T) {
+	for _, concurrency := range []int{1, 4} {
+		var encoder *Encoder
+		var buf bytes.Buffer
+		encoder, err := NewEncoder(&buf, &EncoderOptions{
+			Level:       zstd.SpeedDefault,
+			FramePolicy: UncompressedFrameSize{Size: 10},
+			Concurrency: concurrency,
+			OnFrame: func(frameIndex uint32, compressed, decompressed uint64) {
+				// Start each of the next frames with a marker
+				if frameIndex < 3 {
+					encoder.Write([]byte(fmt.Sprintf("<%d>", frameIndex)))
+				}
+			},
+		})
+		if err != nil {
+			t.Fatalf("NewEncoder failed: %v", err)
+		}
+		if _, err := encoder.Write(bytes.Repeat([]byte("x"), 25)); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		if err := encoder.Finish(); err != nil {
+			t.Fatalf("Finish failed: %v", err)
+		}
+
+		decoded, err := DecodeAll(buf.Bytes(), nil)
+		if err != nil {
+			t.Fatalf("concurrency %d: DecodeAll failed: %v", concurrency, err)
+		}
+		if got := bytes.Count(decoded, []byte("x")); got != 25 {
+			t.Errorf("concurrency %d: decoded %d of 25 bytes written", concurrency, got)
+		}
+		for i := 0; i < 3; i++ {
+			if !bytes.Contains(decoded, []byte(fmt.Sprintf("<%d>", i))) {
+				t.Errorf("concurrency %d: marker %d written by OnFrame is missing from %q", concurrency, i, decoded)
+			}
+		}
+	}
+}
+
+func TestEncoder_Offsets(t *testing.T) {
+	for _, concurrency := range []int{1, 4} {
+		var buf bytes.Buffer
+		encoder, err := NewEncoder(&buf, &EncoderOptions{
+			Level:       zstd.SpeedDefault,
+			FramePolicy: UncompressedFrameSize{Size: 1000},
+			Concurrency: concurrency,
+		})
+		if err != nil {
+			t.Fatalf("NewEncoder failed: %v", err)
+		}
+
+		var want uint64
+		for _, size := range []int{100, 250, 900, 1, 3000} {
+			if _, err := encoder.Write(bytes.Repeat([]byte("a"), size)); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+			want += uint64(size)
+			if got := encoder.DecompressedOffset(); got != want {
+				t.Errorf("concurrency %d: after writing %d bytes DecompressedOffset is %d", concurrency, want, got)
+			}
+			if got := encoder.CompressedOffset(); got != uint64(buf.Len()) {
+				t.Errorf("concurrency %d: CompressedOffset is %d, %d bytes written", concurrency, got, buf.Len())
+			}
+		}
+
+		// Frames ended but still compressing count as accepted
+		if err := encoder.EndFrame(); err != nil {
+			t.Fatalf("EndFrame failed: %v", err)
+		}
+		if got := encoder.DecompressedOffset(); got != want {
+			t.Errorf("concurrency %d: after EndFrame DecompressedOffset is %d, expected %d", concurrency, got, want)
+		}
+		if err := encoder.FlushFrame(); err != nil {
+			t.Fatalf("FlushFrame failed: %v", err)
+		}
+		if got := encoder.DecompressedOffset(); got != want {
+			t.Errorf("concurrency %d: after FlushFrame DecompressedOffset is %d, expected %d", concurrency, got, want)
+		}
+		end, _ := encoder.SeekTable().FrameEndComp(encoder.SeekTable().NumFrames() - 1)
+		if got := encoder.CompressedOffset(); got != end || got != uint64(buf.Len()) {
+			t.Errorf("concurrency %d: after FlushFrame CompressedOffset is %d, frames end at %d", concurrency, got, end)
+		}
+	}
+}
+
+func TestEncoder_NoSeekTable(t *testing.T) {
+	data := make([]byte, 100000)
+	rand.New(rand.NewSource(12)).Read(data[:50000])
+
+	opts := DefaultEncoderOptions()
+	opts.FramePolicy = UncompressedFrameSize{Size: 30000}
+	opts.NoSeekTable = true
+	var buf bytes.Buffer
+	st, err := CompressSeekable(&buf, data, opts)
+	if err != nil {
+		t.Fatalf("CompressSeekable failed: %v", err)
+	}
+	end, _ := st.FrameEndComp(st.NumFrames() - 1)
+	if st.NumFrames() != 4 || end != uint64(buf.Len()) {
+		t.Fatalf("expected 4 frames filling the output, got %d ending at %d of %d", st.NumFrames(), end, buf.Len())
+	}
+
+	// A standard zstd decoder reads the frames as one stream
+	plain, err := zstd.NewReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("zstd.NewReader failed: %v", err)
+	}
+	defer plain.Close()
+	decoded, err := io.ReadAll(plain)
+	if err != nil || !bytes.Equal(decoded, data) {
+		t.Errorf("plain zstd decoding failed: %v", err)
+	}
+
+	// The seek table kept elsewhere still makes the output seekable
+	decoderOpts := DefaultDecoderOptions()
+	decoderOpts.SeekTable = st
+	decoderOpts.LowerFrame = 2
+	decoded, err = DecodeAll(buf.Bytes(), decoderOpts)
+	if err != nil || !bytes.Equal(decoded, data[60000:]) {
+		t.Errorf("decoding with the seek table failed: %v", err)
+	}
+	if _, err := NewDecoderBytes(buf.Bytes(), nil); err == nil {
+		t.Error("expected an error decoding without a seek table")
+	}
+}
+
+func TestEncoder_WriteString(t *testing.T) {
+	lines := make([]string, 2000)
+	for i := range lines {
+		lines[i] = fmt.Sprintf("2024-01-01T00:00:%02dZ INFO request %d served in %dms\n", i%60, i, i%97)
+	}
+	long := strings.Repeat("a long line that spans stream blocks ", 5000)
+
+	for _, opts := range []*EncoderOptions{
+		{Level: zstd.SpeedDefault, FramePolicy: UncompressedFrameSize{Size: 10000}, ChecksumFlag: true},
+		{Level: zstd.SpeedDefault, FramePolicy: CompressedFrameSize{Size: 2000}, DelimiterFrame: '\n'},
+		{Level: zstd.SpeedDefault, FramePolicy: UncompressedFrameSize{Size: 10000}, Concurrency: 4},
+	} {
+		var viaString, viaBytes bytes.Buffer
+		stringEncoder, err := NewEncoder(&viaString, opts)
+		if err != nil {
+			t.Fatalf("NewEncoder failed: %v", err)
+		}
+		bytesEncoder, err := NewEncoder(&viaBytes, opts)
+		if err != nil {
+			t.Fatalf("NewEncoder failed: %v", err)
+		}
+		for _, line := range append(lines, long, "tail\n") {
+			if _, err := stringEncoder.WriteString(line); err != nil {
+				t.Fatalf("WriteString failed: %v", err)
+			}
+			if _, err := bytesEncoder.Write([]byte(line)); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+		}
+		if err := stringEncoder.Finish(); err != nil {
+			t.Fatalf("Finish failed: %v", err)
+		}
+		if err := bytesEncoder.Finish(); err != nil {
+			t.Fatalf("Finish failed: %v", err)
+		}
+		if !bytes.Equal(viaString.Bytes(), viaBytes.Bytes()) {
+			t.Errorf("%T: WriteString output differs from Write", opts.FramePolicy)
+		}
+	}
+
+	var _ io.StringWriter = (*Encoder)(nil)
+	encoder, err := NewEncoder(io.Discard, nil)
+	if err != nil {
+		t.Fatalf("NewEncoder failed: %v", err)
+	}
+	if allocs := testing.AllocsPerRun(100, func() { encoder.WriteString(lines[0]) }); allocs > 0 {
+		t.Errorf("WriteString allocated %.1f times per call", allocs)
+	}
+}
+
+// fastLevelData returns log lines with enough repetition at long distances
+// for the window to matter
+func fastLevelData(size int) []byte {
+	rng := rand.New(rand.NewSource(1))
+	paths := make([]string, 500)
+	for i := range paths {
+		paths[i] = fmt.Sprintf("/api/v1/resource/%x/items", rng.Int63())
+	}
+	var data []byte
+	for i := 0; len(data) < size; i++ {
+		data = fmt.Appendf(data, "2024-01-01T00:%02d:%02dZ INFO GET %s request=%x status=%d latency=%dms\n",
+			i/60%60, i%60, paths[rng.Intn(len(paths))], rng.Uint32(), 200+rng.Intn(3)*100, rng.Intn(500))
+	}
+	return data
+}
+
+func TestEncoder_FastLevel(t *testing.T) {
+	data := fastLevelData(4 << 20)
+
+	sizes := make(map[zstd.EncoderLevel]int)
+	for _, level := range []zstd.EncoderLevel{zstd.SpeedFastest, FastLevel(1), FastLevel(3)} {
+		archive, err := EncodeAll(data, &EncoderOptions{
+			Level:        level,
+			FramePolicy:  UncompressedFrameSize{Size: 4 << 20},
+			ChecksumFlag: true,
+		})
+		if err != nil {
+			t.Fatalf("%s: EncodeAll failed: %v", levelName(level), err)
+		}
+		decoded, err := DecodeAll(archive, nil)
+		if err != nil {
+			t.Fatalf("%s: DecodeAll failed: %v", levelName(level), err)
+		}
+		if !bytes.Equal(decoded, data) {
+			t.Errorf("%s: round trip failed", levelName(level))
+		}
+		sizes[level] = len(archive)
+	}
+
+	if sizes[FastLevel(1)] <= sizes[zstd.SpeedFastest] {
+		t.Errorf("FastLevel(1) archive %d bytes, want larger than SpeedFastest's %d",
+			sizes[FastLevel(1)], sizes[zstd.SpeedFastest])
+	}
+	if sizes[FastLevel(3)] < sizes[FastLevel(1)] {
+		t.Errorf("FastLevel(3) archive %d bytes, want at least FastLevel(1)'s %d",
+			sizes[FastLevel(3)], sizes[FastLevel(1)])
+	}
+	if got := levelName(FastLevel(0)); got != "fast-1" {
+		t.Errorf("FastLevel(0) is %q, want fast-1", got)
+	}
+}
+
+func BenchmarkEncoder_FastLevel(b *testing.B) {
+	data := fastLevelData(32 << 20)
+	for _, level := range []zstd.EncoderLevel{zstd.SpeedFastest, FastLevel(1), FastLevel(3)} {
+		b.Run(levelName(level), func(b *testing.B) {
+			opts := &EncoderOptions{Level: level, FramePolicy: UncompressedFrameSize{Size: DEFAULT_FRAME_SIZE}}
+			var compressed int
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				archive, err := EncodeAll(data, opts)
+				if err != nil {
+					b.Fatalf("EncodeAll failed: %v", err)
+				}
+				compressed = len(archive)
+			}
+			b.ReportMetric(float64(len(data))/float64(compressed), "ratio")
+		})
+	}
+}
+
+func TestEncoder_VerifyFrames(t *testing.T) {
+	data := fastLevelData(1 << 20)
+	dict, err := TrainDictionary(dictSamples(300), 4*1024)
+	if err != nil {
+		t.Fatalf("TrainDictionary failed: %v", err)
+	}
+	prefix := data[:64*1024]
+
+	for _, opts := range []*EncoderOptions{
+		{Level: zstd.SpeedDefault, FramePolicy: CompressedFrameSize{Size: 16 * 1024}, ChecksumFlag: true},
+		{Level: zstd.SpeedFastest, FramePolicy: UncompressedFrameSize{Size: 100000}, Concurrency: 4},
+		{Level: zstd.SpeedDefault, FramePolicy: UncompressedFrameSize{Size: 100000}, CompressionDict: dict},
+		{Level: FastLevel(2), FramePolicy: UncompressedFrameSize{Size: 100000}, WindowLog: 17},
+	} {
+		for _, concurrency := range []int{opts.Concurrency, 4} {
+			opts := *opts
+			opts.VerifyFrames = true
+			opts.Concurrency = concurrency
+			var buf bytes.Buffer
+			encoder, err := NewEncoder(&buf, &opts)
+			if err != nil {
+				t.Fatalf("NewEncoder failed: %v", err)
+			}
+			// Per-frame prefixes and dictionaries are verified against
+			// their own frame
+			if _, err := encoder.WriteWithPrefix(data[:200000], prefix); err != nil {
+				t.Fatalf("WriteWithPrefix failed: %v", err)
+			}
+			if err := encoder.EndFrame(); err != nil {
+				t.Fatalf("EndFrame failed: %v", err)
+			}
+			if err := encoder.SetFrameDict(dict); err != nil {
+				t.Fatalf("SetFrameDict failed: %v", err)
+			}
+			if _, err := encoder.Write(data[200000:]); err != nil {
+				t.Fatalf("%T, concurrency %d: Write failed: %v", opts.FramePolicy, concurrency, err)
+			}
+			if err := encoder.Finish(); err != nil {
+				t.Fatalf("%T, concurrency %d: Finish failed: %v", opts.FramePolicy, concurrency, err)
+			}
+			if encoder.SeekTable().NumFrames() < 2 {
+				t.Errorf("%T: expected several frames", opts.FramePolicy)
+			}
+		}
+	}
+
+	// A frame that does not decode to the input fails verification
+	verifier, err := newFrameVerifier(&EncoderOptions{})
+	if err != nil {
+		t.Fatalf("newFrameVerifier failed: %v", err)
+	}
+	defer verifier.close()
+	var archive bytes.Buffer
+	st, err := CompressSeekable(&archive, data[:1000], nil)
+	if err != nil {
+		t.Fatalf("CompressSeekable failed: %v", err)
+	}
+	frameEnd, _ := st.FrameEndComp(0)
+	if !verifier.verify(archive.Bytes()[:frameEnd], data[:1000], nil, nil) {
+		t.Error("Expected the frame to verify")
+	}
+	if verifier.verify(archive.Bytes()[:frameEnd], data[1:1001], nil, nil) {
+		t.Error("Expected a frame with different input to fail verification")
+	}
+	if verifier.verify(archive.Bytes()[:frameEnd-4], data[:1000], nil, nil) {
+		t.Error("Expected a truncated frame to fail verification")
+	}
+}
+
+func TestEncoder_EndFrameForce(t *testing.T) {
+	first := bytes.Repeat([]byte("first section "), 500)
+	second := bytes.Repeat([]byte("second section "), 500)
+	data := append(append([]byte(nil), first...), second...)
+
+	for _, concurrency := range []int{1, 4} {
+		var buf bytes.Buffer
+		encoder, err := NewEncoder(&buf, &EncoderOptions{
+			Level:        zstd.SpeedDefault,
+			FramePolicy:  UncompressedFrameSize{Size: 1 << 20},
+			ChecksumFlag: true,
+			Concurrency:  concurrency,
+			VerifyFrames: true,
+		})
+		if err != nil {
+			t.Fatalf("NewEncoder failed: %v", err)
+		}
+		encoder.Write(first)
+		if err := encoder.EndFrame(); err != nil {
+			t.Fatalf("EndFrame failed: %v", err)
+		}
+		// EndFrame ignores the empty frame, EndFrameForce writes it
+		if err := encoder.EndFrame(); err != nil {
+			t.Fatalf("EndFrame failed: %v", err)
+		}
+		if err := encoder.EndFrameForce(); err != nil {
+			t.Fatalf("EndFrameForce failed: %v", err)
+		}
+		encoder.Write(second)
+		if err := encoder.Finish(); err != nil {
+			t.Fatalf("Finish failed: %v", err)
+		}
+
+		st := encoder.SeekTable()
+		if st.NumFrames() != 3 {
+			t.Fatalf("concurrency %d: expected 3 frames, got %d", concurrency, st.NumFrames())
+		}
+		if size, _ := st.FrameSizeDecomp(1); size != 0 {
+			t.Errorf("concurrency %d: marker frame has %d bytes", concurrency, size)
+		}
+		if size, _ := st.FrameSizeComp(1); size != 0 {
+			t.Errorf("concurrency %d: marker frame has %d compressed bytes", concurrency, size)
+		}
+		archive := buf.Bytes()
+
+		// The marker is only in the seek table
+		zstdDecoder, _ := zstd.NewReader(nil)
+		if decoded, err := zstdDecoder.DecodeAll(archive, nil); err != nil || !bytes.Equal(decoded, data) {
+			t.Errorf("concurrency %d: zstd round trip failed: %v", concurrency, err)
+		}
+		zstdDecoder.Close()
+
+		for _, opts := range []*DecoderOptions{
+			DefaultDecoderOptions(),
+			{Prefetch: true},
+			{FrameCacheSize: 2, VerifyOnSeek: true},
+		} {
+			decoded, err := DecodeAll(archive, opts)
+			if err != nil || !bytes.Equal(decoded, data) {
+				t.Errorf("concurrency %d: DecodeAll failed: %v", concurrency, err)
+			}
+
+			decoder, err := NewDecoderBytes(archive, opts)
+			if err != nil {
+				t.Fatalf("NewDecoderBytes failed: %v", err)
+			}
+			if frame, err := decoder.DecodeFrame(1); err != nil || len(frame) != 0 {
+				t.Errorf("DecodeFrame(1) = %q, %v", frame, err)
+			}
+			var sizes []int
+			for it := decoder.Frames(); it.Next(); {
+				sizes = append(sizes, len(it.Bytes()))
+			}
+			if !slices.Equal(sizes, []int{len(first), 0, len(second)}) {
+				t.Errorf("Frames returned sizes %v", sizes)
+			}
+
+			// Seeking to the boundary lands at the start of the second section
+			if _, err := decoder.Seek(int64(len(first)), io.SeekStart); err != nil {
+				t.Fatalf("Seek failed: %v", err)
+			}
+			rest, err := io.ReadAll(decoder)
+			if err != nil || !bytes.Equal(rest, second) {
+				t.Errorf("Read after seeking to the marker failed: %v", err)
+			}
+			if _, err := decoder.ReadAt(rest[:10], int64(len(first)-5)); err != nil || !bytes.Equal(rest[:10], data[len(first)-5:len(first)+5]) {
+				t.Errorf("ReadAt across the marker failed: %v", err)
+			}
+		}
+	}
+}
+
+func TestEncoder_SeekTableMagic(t *testing.T) {
+	const magic = 0x184D2A50
+	data := bytes.Repeat([]byte("custom seek table magic "), 2000)
+	opts := DefaultEncoderOptions()
+	opts.FramePolicy = UncompressedFrameSize{Size: 8192}
+	opts.SeekTableMagic = magic
+
+	for _, format := range []Format{FormatFoot, FormatHead} {
+		var buf bytes.Buffer
+		opts.HeadSeekTable = format == FormatHead
+		encoder, err := NewEncoder(&buf, opts)
+		if err != nil {
+			t.Fatalf("NewEncoder failed: %v", err)
+		}
+		if err := encoder.WriteSkippableMetadata(magic, []byte("meta")); err == nil {
+			t.Error("expected metadata with the seek table magic to be rejected")
+		}
+		if _, err := encoder.Write(data); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		if err := encoder.FinishWithFormat(format); err != nil {
+			t.Fatalf("FinishWithFormat failed: %v", err)
+		}
+		tableStart := int(encoder.WrittenCompressed())
+		if format == FormatHead {
+			tableStart = 0
+		}
+		if got := binary.LittleEndian.Uint32(buf.Bytes()[tableStart:]); got != magic {
+			t.Fatalf("seek table written with magic %#x, want %#x", got, magic)
+		}
+
+		// Decoders find the table by its integrity field, whatever its magic
+		r := bytes.NewReader(buf.Bytes())
+		if got, _, err := ArchiveFormat(r); err != nil || got != format {
+			t.Fatalf("Expected format %v, got %v, %v", format, got, err)
+		}
+		decoder, err := NewDecoder(r, nil)
+		if err != nil {
+			t.Fatalf("NewDecoder failed: %v", err)
+		}
+		if !decoder.SeekTable().Equal(encoder.SeekTable()) {
+			t.Error("Seek table differs from the one written")
+		}
+		decoded, err := io.ReadAll(decoder)
+		if err != nil || !bytes.Equal(decoded, data) {
+			t.Fatalf("Round trip failed: %v", err)
+		}
+	}
+
+	opts.SeekTableMagic = 0x184D2A60
+	if _, err := NewEncoder(io.Discard, opts); err == nil || !strings.HasPrefix(err.Error(), ErrSeekTableMagic) {
+		t.Errorf("expected %q, got %v", ErrSeekTableMagic, err)
+	}
+}
@@ -0,0 +1,100 @@
+package gzstd
+
+import (
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// rangeHandler serves the decompressed content of a seekable archive
+type rangeHandler struct {
+	ra       io.ReaderAt
+	size     int64
+	decoders sync.Pool
+
+	// The seek table is parsed by the first request to succeed and shared
+	// by all
+	mu        sync.Mutex
+	loaded    bool
+	seekTable *SeekTable
+	headSize  int64 // bytes of Head format seek table ahead of the frames
+}
+
+// NewRangeHandler returns an http.Handler serving the decompressed content
+// of the seekable archive in ra, which is size bytes long. It answers Range
+// requests against the decompressed content, decompressing only the frames
+// covering each requested range, and sets Accept-Ranges and Content-Length.
+// Requests are served concurrently, each by its own pooled Decoder reading
+// ra through NewReaderAtSeekable. The seek table is read once, by the first
+// request; if that fails, the next request tries again.
+func NewRangeHandler(ra io.ReaderAt, size int64) http.Handler {
+	return &rangeHandler{ra: ra, size: size}
+}
+
+// loadSeekTable reads the archive's seek table unless an earlier request
+// already has, keeping the decoder that read it for the pool
+func (h *rangeHandler) loadSeekTable() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.loaded {
+		return nil
+	}
+
+	d, err := NewDecoder(NewReaderAtSeekable(h.ra, h.size), nil)
+	if err != nil {
+		return err
+	}
+	h.seekTable = d.SeekTable()
+	if src, ok := d.source.(*offsetSource); ok {
+		h.headSize = src.base
+	}
+	h.loaded = true
+	h.decoders.Put(d)
+	return nil
+}
+
+func (h *rangeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := h.loadSeekTable(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var source Seekable = NewReaderAtSeekable(h.ra, h.size)
+	if h.headSize > 0 {
+		source = &offsetSource{Seekable: source, base: h.headSize}
+	}
+	opts := DefaultDecoderOptions()
+	opts.SeekTable = h.seekTable
+
+	d, _ := h.decoders.Get().(*Decoder)
+	if d == nil {
+		d = &Decoder{}
+	}
+	defer h.decoders.Put(d)
+	if err := d.Reset(source, opts); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "application/octet-stream")
+	}
+	content := sizedContent{Decoder: d, size: int64(h.seekTable.TotalDecompressed())}
+	http.ServeContent(w, r, "", time.Time{}, content)
+}
+
+// sizedContent answers http.ServeContent's probe for the content size from
+// the seek table rather than by seeking the decoder to its end. ServeContent
+// seeks back to the start, or to the requested range, before reading.
+type sizedContent struct {
+	*Decoder
+	size int64
+}
+
+func (c sizedContent) Seek(offset int64, whence int) (int64, error) {
+	if offset == 0 && whence == io.SeekEnd {
+		return c.size, nil
+	}
+	return c.Decoder.Seek(offset, whence)
+}
@@ -0,0 +1,191 @@
+package gzstd
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+func TestNewRangeHandler(t *testing.T) {
+	data := make([]byte, 50000)
+	rand.New(rand.NewSource(9)).Read(data)
+	encoderOpts := DefaultEncoderOptions()
+	encoderOpts.FramePolicy = UncompressedFrameSize{Size: 8000}
+	var buf bytes.Buffer
+	if _, err := CompressSeekable(&buf, data, encoderOpts); err != nil {
+		t.Fatalf("CompressSeekable failed: %v", err)
+	}
+
+	server := httptest.NewServer(NewRangeHandler(bytes.NewReader(buf.Bytes()), int64(buf.Len())))
+	defer server.Close()
+
+	get := func(rangeHeader string) (*http.Response, []byte) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+		if rangeHeader != "" {
+			req.Header.Set("Range", rangeHeader)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("GET failed: %v", err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("reading body failed: %v", err)
+		}
+		return resp, body
+	}
+
+	// A range spanning a frame boundary
+	resp, body := get("bytes=7000-20999")
+	if resp.StatusCode != http.StatusPartialContent {
+		t.Fatalf("Expected status 206, got %d", resp.StatusCode)
+	}
+	if !bytes.Equal(body, data[7000:21000]) {
+		t.Errorf("Ranged response differs from the decompressed content")
+	}
+	if resp.Header.Get("Accept-Ranges") != "bytes" || resp.Header.Get("Content-Length") != "14000" {
+		t.Errorf("Unexpected headers: %v", resp.Header)
+	}
+
+	resp, body = get("bytes=-100")
+	if resp.StatusCode != http.StatusPartialContent || !bytes.Equal(body, data[len(data)-100:]) {
+		t.Errorf("Suffix range returned status %d and wrong content", resp.StatusCode)
+	}
+
+	resp, body = get("")
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(body, data) {
+		t.Errorf("Full request returned status %d and wrong content", resp.StatusCode)
+	}
+	if resp.Header.Get("Content-Length") != strconv.Itoa(len(data)) {
+		t.Errorf("Expected Content-Length %d, got %s", len(data), resp.Header.Get("Content-Length"))
+	}
+
+	resp, _ = get("bytes=60000-")
+	if resp.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("Expected status 416 past the end, got %d", resp.StatusCode)
+	}
+}
+
+// footerCounter counts the reads of an archive's seek table footer
+type footerCounter struct {
+	io.ReaderAt
+	size  int64
+	reads atomic.Int32
+}
+
+func (c *footerCounter) ReadAt(p []byte, off int64) (int, error) {
+	if off+int64(len(p)) > c.size-SEEK_TABLE_FOOTER_SIZE {
+		c.reads.Add(1)
+	}
+	return c.ReaderAt.ReadAt(p, off)
+}
+
+func TestNewRangeHandler_SeekTableOnce(t *testing.T) {
+	data := make([]byte, 300000)
+	rand.New(rand.NewSource(10)).Read(data)
+	encoderOpts := DefaultEncoderOptions()
+	encoderOpts.FramePolicy = UncompressedFrameSize{Size: 4000}
+	var buf bytes.Buffer
+	if _, err := CompressSeekable(&buf, data, encoderOpts); err != nil {
+		t.Fatalf("CompressSeekable failed: %v", err)
+	}
+	table, err := ReadSeekTable(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("ReadSeekTable failed: %v", err)
+	}
+	framesEnd := buf.Len() - len(table.Bytes(FormatFoot))
+	head := append(table.Bytes(FormatHead), buf.Bytes()[:framesEnd]...)
+
+	for _, tt := range []struct {
+		name    string
+		archive []byte
+	}{
+		{"foot", buf.Bytes()},
+		{"head", head},
+	} {
+		counter := &footerCounter{ReaderAt: bytes.NewReader(tt.archive), size: int64(len(tt.archive))}
+		server := httptest.NewServer(NewRangeHandler(counter, counter.size))
+		var firstReads int32
+		for i := 0; i < 5; i++ {
+			req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+			req.Header.Set("Range", "bytes=3000-12999")
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("%s: GET failed: %v", tt.name, err)
+			}
+			body, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				t.Fatalf("%s: reading body failed: %v", tt.name, err)
+			}
+			if resp.StatusCode != http.StatusPartialContent || !bytes.Equal(body, data[3000:13000]) {
+				t.Errorf("%s: request %d returned status %d and wrong content", tt.name, i, resp.StatusCode)
+			}
+			if i == 0 {
+				firstReads = counter.reads.Load()
+			}
+		}
+		server.Close()
+
+		// Only the first request looked for the seek table
+		if reads := counter.reads.Load(); firstReads == 0 || reads != firstReads {
+			t.Errorf("%s: footer read %d times by the first request, %d in all", tt.name, firstReads, reads)
+		}
+	}
+}
+
+// failingReaderAt fails as many reads as fails holds, then reads normally
+type failingReaderAt struct {
+	io.ReaderAt
+	fails atomic.Int32
+}
+
+func (f *failingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if f.fails.Add(-1) >= 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	return f.ReaderAt.ReadAt(p, off)
+}
+
+func TestNewRangeHandler_RetriesSeekTable(t *testing.T) {
+	data := make([]byte, 20000)
+	rand.New(rand.NewSource(12)).Read(data)
+	encoderOpts := DefaultEncoderOptions()
+	encoderOpts.FramePolicy = UncompressedFrameSize{Size: 4000}
+	var buf bytes.Buffer
+	if _, err := CompressSeekable(&buf, data, encoderOpts); err != nil {
+		t.Fatalf("CompressSeekable failed: %v", err)
+	}
+
+	ra := &failingReaderAt{ReaderAt: bytes.NewReader(buf.Bytes())}
+	ra.fails.Store(1)
+	server := httptest.NewServer(NewRangeHandler(ra, int64(buf.Len())))
+	defer server.Close()
+
+	for i, want := range []int{http.StatusInternalServerError, http.StatusPartialContent} {
+		req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+		req.Header.Set("Range", "bytes=100-199")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("GET failed: %v", err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("reading body failed: %v", err)
+		}
+		if resp.StatusCode != want {
+			t.Fatalf("request %d: expected status %d, got %d", i, want, resp.StatusCode)
+		}
+		if want == http.StatusPartialContent && !bytes.Equal(body, data[100:200]) {
+			t.Errorf("request %d: wrong content after the seek table loaded", i)
+		}
+	}
+}
@@ -1,24 +1,40 @@
 package gzstd
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
+	"math"
+	"sort"
 )
 
 const (
-	// Magic numbers and constants
-	SKIPPABLE_MAGIC_NUMBER = 0x184D2A5F
+	// Magic numbers and constants, following the zstd seekable format spec
+	// (contrib/seekable_format/zstd_seekable_compression_format.md)
+	SKIPPABLE_MAGIC_NUMBER = 0x184D2A5E
 	SEEKABLE_MAGIC_NUMBER  = 0x8F92EAB1
 	SKIPPABLE_HEADER_SIZE  = 8
 	SEEK_TABLE_FOOTER_SIZE = 9
-	SIZE_PER_FRAME         = 17
+	SIZE_PER_FRAME         = 8         // Compressed_Size(4) + Decompressed_Size(4)
+	SIZE_PER_FRAME_CRC     = 12        // SIZE_PER_FRAME plus a 4-byte checksum
 	SEEKABLE_MAX_FRAMES    = 0x8000000 // 134217728
 
+	// Seek table descriptor flags
+	DESCRIPTOR_CHECKSUM_FLAG  = 1 << 7
+	DESCRIPTOR_RESERVED_FLAGS = 0x7C // bits 6-2, must be zero
+
 	// Error messages
 	ErrFrameIndexTooLarge = "frame index too large"
 	ErrCorrupted          = "corrupted seek table"
 	ErrInvalidMagic       = "invalid magic number"
+	ErrFrameTooLarge      = "frame too large"
+	ErrArchiveTooSmall    = "archive too small"
+	ErrChecksumMismatch   = "frame checksum mismatch"
+	ErrNoChecksums        = "seek table has no checksums"
+	ErrSeekTableMagic     = "invalid seek table magic"
+	ErrNoExpectedTable    = "no expected seek table"
 )
 
 // Format represents the seek table format
@@ -39,11 +55,25 @@ type Entry struct {
 type Frame struct {
 	CompressedSize   uint32
 	DecompressedSize uint32
+	Checksum         uint32 // low 32 bits of XXH64 of the decompressed content
+}
+
+// entryBytes packs the frame into its serialized seek table entry of
+// entrySize bytes, SIZE_PER_FRAME_CRC to include the checksum
+func (f Frame) entryBytes(entrySize int) []byte {
+	frameData := make([]byte, entrySize)
+	binary.LittleEndian.PutUint32(frameData[0:4], f.CompressedSize)
+	binary.LittleEndian.PutUint32(frameData[4:8], f.DecompressedSize)
+	if entrySize == SIZE_PER_FRAME_CRC {
+		binary.LittleEndian.PutUint32(frameData[8:12], f.Checksum)
+	}
+	return frameData
 }
 
 // SeekTable manages frame offsets for seekable archives
 type SeekTable struct {
-	entries []Entry
+	entries   []Entry
+	checksums []uint32 // per-frame checksums, when every frame has one
 }
 
 // NewSeekTable creates a new empty seek table
@@ -53,10 +83,11 @@ func NewSeekTable() *SeekTable {
 	}
 }
 
-// LogFrame adds a new frame to the seek table
-func (st *SeekTable) LogFrame(compressedSize, decompressedSize uint32) error {
-	if st.NumFrames() >= SEEKABLE_MAX_FRAMES {
-		return errors.New(ErrFrameIndexTooLarge)
+// LogFrame adds a new frame to the seek table. It returns ErrFrameTooLarge
+// if either size does not fit in the 32-bit fields of a seek table entry.
+func (st *SeekTable) LogFrame(compressedSize, decompressedSize uint64) error {
+	if err := st.checkFrame(compressedSize, decompressedSize); err != nil {
+		return err
 	}
 
 	last := st.entries[len(st.entries)-1]
@@ -68,11 +99,67 @@ func (st *SeekTable) LogFrame(compressedSize, decompressedSize uint32) error {
 	return nil
 }
 
+// checkFrame returns the error LogFrame would return for a frame of the given
+// sizes, without logging it
+func (st *SeekTable) checkFrame(compressedSize, decompressedSize uint64) error {
+	if st.NumFrames() >= SEEKABLE_MAX_FRAMES {
+		return errors.New(ErrFrameIndexTooLarge)
+	}
+	if compressedSize > math.MaxUint32 || decompressedSize > math.MaxUint32 {
+		return fmt.Errorf("%s: frame %d is %d -> %d bytes", ErrFrameTooLarge, st.NumFrames(), compressedSize, decompressedSize)
+	}
+	return nil
+}
+
+// LogFrameChecksum adds a new frame to the seek table along with the
+// checksum of its decompressed content. The table only carries checksums
+// when every frame was logged with one.
+func (st *SeekTable) LogFrameChecksum(compressedSize, decompressedSize uint64, checksum uint32) error {
+	hadChecksums := st.HasChecksums() || st.NumFrames() == 0
+	if err := st.LogFrame(compressedSize, decompressedSize); err != nil {
+		return err
+	}
+	if hadChecksums {
+		st.checksums = append(st.checksums, checksum)
+	}
+	return nil
+}
+
+// HasChecksums reports whether the seek table carries per-frame checksums
+func (st *SeekTable) HasChecksums() bool {
+	return st.NumFrames() > 0 && len(st.checksums) == int(st.NumFrames())
+}
+
+// FrameChecksum returns the checksum of a frame's decompressed content, the
+// low 32 bits of its XXH64 digest. It returns an error if the seek table has
+// no checksums.
+func (st *SeekTable) FrameChecksum(index uint32) (uint32, error) {
+	if index >= st.NumFrames() {
+		return 0, errors.New(ErrFrameIndexTooLarge)
+	}
+	if !st.HasChecksums() {
+		return 0, errors.New(ErrNoChecksums)
+	}
+	return st.checksums[index], nil
+}
+
 // NumFrames returns the number of frames in the seek table
 func (st *SeekTable) NumFrames() uint32 {
 	return uint32(len(st.entries) - 1)
 }
 
+// TotalCompressed returns the compressed size of all frames, 0 for an empty
+// table
+func (st *SeekTable) TotalCompressed() uint64 {
+	return st.entries[len(st.entries)-1].CompressedOffset
+}
+
+// TotalDecompressed returns the decompressed size of all frames, 0 for an
+// empty table
+func (st *SeekTable) TotalDecompressed() uint64 {
+	return st.entries[len(st.entries)-1].DecompressedOffset
+}
+
 // FrameStartComp returns the compressed offset of the frame start
 func (st *SeekTable) FrameStartComp(index uint32) (uint64, error) {
 	if index >= st.NumFrames() {
@@ -121,6 +208,83 @@ func (st *SeekTable) FrameSizeDecomp(index uint32) (uint64, error) {
 	return st.entries[index+1].DecompressedOffset - st.entries[index].DecompressedOffset, nil
 }
 
+// FrameAtDecompOffset returns the index of the frame containing the given
+// decompressed offset, found by binary search. An offset equal to a frame's
+// start belongs to that frame. It returns ErrFrameIndexTooLarge if offset is
+// at or past the end of the decompressed content.
+func (st *SeekTable) FrameAtDecompOffset(offset uint64) (uint32, error) {
+	return st.frameAt(offset, func(e Entry) uint64 { return e.DecompressedOffset })
+}
+
+// FrameAtCompOffset returns the index of the frame containing the given
+// compressed offset, found by binary search. An offset equal to a frame's
+// start belongs to that frame. It returns ErrFrameIndexTooLarge if offset is
+// at or past the end of the last frame.
+func (st *SeekTable) FrameAtCompOffset(offset uint64) (uint32, error) {
+	return st.frameAt(offset, func(e Entry) uint64 { return e.CompressedOffset })
+}
+
+// frameAt finds the first frame whose end, as given by field, is past offset.
+// Empty frames never contain an offset.
+func (st *SeekTable) frameAt(offset uint64, field func(Entry) uint64) (uint32, error) {
+	n := int(st.NumFrames())
+	i := sort.Search(n, func(i int) bool { return field(st.entries[i+1]) > offset })
+	if i == n {
+		return 0, fmt.Errorf("%s: offset %d is past the end", ErrFrameIndexTooLarge, offset)
+	}
+	return uint32(i), nil
+}
+
+// OffsetsFor returns the start offsets of the requested frames, in request
+// order. Each lookup is O(1), so sparse access to a handful of frames does
+// not need to walk the whole table.
+func (st *SeekTable) OffsetsFor(indices []uint32) ([]Entry, error) {
+	offsets := make([]Entry, 0, len(indices))
+	for _, index := range indices {
+		if index >= st.NumFrames() {
+			return nil, fmt.Errorf("%s: %d", ErrFrameIndexTooLarge, index)
+		}
+		offsets = append(offsets, st.entries[index])
+	}
+	return offsets, nil
+}
+
+// Entries returns a copy of the table's offsets: the start of each frame
+// followed by the end of the last, so it has NumFrames()+1 entries
+func (st *SeekTable) Entries() []Entry {
+	return append([]Entry(nil), st.entries...)
+}
+
+// Append adds the frames of other to the end of st, rebasing their offsets
+// onto st's last entry. Checksums are kept only if both tables have them (or
+// st is empty). It returns ErrFrameIndexTooLarge if the combined table would
+// exceed SEEKABLE_MAX_FRAMES, leaving st unchanged.
+func (st *SeekTable) Append(other *SeekTable) error {
+	if uint64(st.NumFrames())+uint64(other.NumFrames()) > SEEKABLE_MAX_FRAMES {
+		return fmt.Errorf("%s: %d + %d frames", ErrFrameIndexTooLarge, st.NumFrames(), other.NumFrames())
+	}
+	if other.NumFrames() == 0 {
+		return nil
+	}
+
+	keepChecksums := (st.HasChecksums() || st.NumFrames() == 0) && other.HasChecksums()
+
+	last := st.entries[len(st.entries)-1]
+	for _, e := range other.entries[1:] {
+		st.entries = append(st.entries, Entry{
+			CompressedOffset:   last.CompressedOffset + e.CompressedOffset,
+			DecompressedOffset: last.DecompressedOffset + e.DecompressedOffset,
+		})
+	}
+	if keepChecksums {
+		st.checksums = append(st.checksums, other.checksums...)
+	} else {
+		st.checksums = nil
+	}
+
+	return nil
+}
+
 // MaxFrameSizeDecomp returns the maximum decompressed frame size
 func (st *SeekTable) MaxFrameSizeDecomp() uint64 {
 	var maxSize uint64
@@ -133,22 +297,187 @@ func (st *SeekTable) MaxFrameSizeDecomp() uint64 {
 	return maxSize
 }
 
+// Validate checks the seek table's internal consistency: the first entry is
+// at offset zero, offsets never decrease, and no frame is larger than
+// MAX_FRAME_SIZE allows. It returns an error naming the first offending
+// frame, which lets callers check a table from an untrusted source before
+// relying on its offsets.
+func (st *SeekTable) Validate() error {
+	if len(st.entries) == 0 || st.entries[0] != (Entry{}) {
+		return fmt.Errorf("%s: first entry is not at offset zero", ErrCorrupted)
+	}
+	if len(st.checksums) != 0 && len(st.checksums) != int(st.NumFrames()) {
+		return fmt.Errorf("%s: %d checksums for %d frames", ErrCorrupted, len(st.checksums), st.NumFrames())
+	}
+	for i := 1; i < len(st.entries); i++ {
+		prev, e := st.entries[i-1], st.entries[i]
+		if e.CompressedOffset < prev.CompressedOffset || e.DecompressedOffset < prev.DecompressedOffset {
+			return fmt.Errorf("%s: frame %d offsets decrease", ErrCorrupted, i-1)
+		}
+		if e.CompressedOffset-prev.CompressedOffset > maxFrameSize ||
+			e.DecompressedOffset-prev.DecompressedOffset > maxFrameSize {
+			return fmt.Errorf("%s: frame %d is %d -> %d bytes", ErrFrameTooLarge, i-1,
+				e.CompressedOffset-prev.CompressedOffset, e.DecompressedOffset-prev.DecompressedOffset)
+		}
+	}
+	return nil
+}
+
+// Equal reports whether two seek tables describe the same frames
+func (st *SeekTable) Equal(other *SeekTable) bool {
+	if other == nil || len(st.entries) != len(other.entries) {
+		return false
+	}
+	for i := range st.entries {
+		if st.entries[i] != other.entries[i] {
+			return false
+		}
+	}
+	if st.HasChecksums() && other.HasChecksums() {
+		for i := range st.checksums {
+			if st.checksums[i] != other.checksums[i] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// String summarizes the seek table for debugging: its frame count, total
+// sizes and smallest and largest frames, for example
+// "3 frames, 120 -> 300 bytes, frames 30-50 -> 100-100 bytes, checksums".
+func (st *SeekTable) String() string {
+	n := st.NumFrames()
+	if n == 0 {
+		return "0 frames"
+	}
+	minComp, maxComp := uint64(math.MaxUint64), uint64(0)
+	minDecomp, maxDecomp := uint64(math.MaxUint64), uint64(0)
+	for i := uint32(0); i < n; i++ {
+		cSize, _ := st.FrameSizeComp(i)
+		dSize, _ := st.FrameSizeDecomp(i)
+		minComp, maxComp = min(minComp, cSize), max(maxComp, cSize)
+		minDecomp, maxDecomp = min(minDecomp, dSize), max(maxDecomp, dSize)
+	}
+	s := fmt.Sprintf("%d frames, %d -> %d bytes, frames %d-%d -> %d-%d bytes",
+		n, st.TotalCompressed(), st.TotalDecompressed(), minComp, maxComp, minDecomp, maxDecomp)
+	if st.HasChecksums() {
+		s += ", checksums"
+	}
+	return s
+}
+
+// DumpSeekTable writes every frame's compressed and decompressed offsets and
+// sizes to w, one frame per line, along with its checksum when the table
+// has them. Write errors are ignored; it is meant for debugging output.
+func DumpSeekTable(w io.Writer, st *SeekTable) {
+	fmt.Fprintf(w, "%8s %14s %10s %14s %10s %8s\n",
+		"frame", "comp_offset", "comp_size", "decomp_offset", "decomp_size", "checksum")
+	for i := uint32(0); i < st.NumFrames(); i++ {
+		start, end := st.entries[i], st.entries[i+1]
+		checksum := "-"
+		if st.HasChecksums() {
+			checksum = fmt.Sprintf("%08x", st.checksums[i])
+		}
+		fmt.Fprintf(w, "%8d %14d %10d %14d %10d %8s\n", i,
+			start.CompressedOffset, end.CompressedOffset-start.CompressedOffset,
+			start.DecompressedOffset, end.DecompressedOffset-start.DecompressedOffset, checksum)
+	}
+}
+
+// VerifyFraming reads the seek table of the archive in r and compares it to
+// expected, returning an error describing the first differing frame. This
+// lets callers assert that an archive was produced with reproducible framing.
+// A nil expected table is an error rather than a match.
+func VerifyFraming(r io.ReadSeeker, expected *SeekTable) error {
+	if expected == nil {
+		return errors.New(ErrNoExpectedTable)
+	}
+	actual, err := ReadSeekTable(r)
+	if err != nil {
+		return err
+	}
+
+	if actual.Equal(expected) {
+		return nil
+	}
+
+	if actual.NumFrames() != expected.NumFrames() {
+		return fmt.Errorf("framing mismatch: archive has %d frames, expected %d",
+			actual.NumFrames(), expected.NumFrames())
+	}
+
+	for i := uint32(0); i < actual.NumFrames(); i++ {
+		aComp, _ := actual.FrameSizeComp(i)
+		eComp, _ := expected.FrameSizeComp(i)
+		aDecomp, _ := actual.FrameSizeDecomp(i)
+		eDecomp, _ := expected.FrameSizeDecomp(i)
+		if aComp != eComp || aDecomp != eDecomp {
+			return fmt.Errorf("framing mismatch at frame %d: archive has %d -> %d bytes, expected %d -> %d bytes",
+				i, aComp, aDecomp, eComp, eDecomp)
+		}
+	}
+
+	return errors.New("framing mismatch")
+}
+
+// WriteTo writes the complete seek table serialized in format to w and
+// returns the number of bytes written
+func (st *SeekTable) WriteTo(w io.Writer, format Format) (int64, error) {
+	serializer, err := st.NewSerializer(format)
+	if err != nil {
+		return 0, err
+	}
+	return serializer.writeAll(w)
+}
+
+// Bytes returns the complete seek table serialized in format. It returns nil
+// if a frame is too large for a seek table entry, which NewSerializer
+// reports as an error.
+func (st *SeekTable) Bytes(format Format) []byte {
+	serializer, err := st.NewSerializer(format)
+	if err != nil {
+		return nil
+	}
+	buf := make([]byte, serializer.EncodedLen())
+	serializer.WriteTo(buf)
+	return buf
+}
+
 // Serializer handles seek table serialization
 type Serializer struct {
 	frames     []Frame
 	frameIndex int
 	writePos   int
 	format     Format
+	entrySize  int
+	magic      uint32 // skippable frame magic, SKIPPABLE_MAGIC_NUMBER by default
 }
 
-// NewSerializer creates a serializer from a seek table
-func (st *SeekTable) NewSerializer(format Format) *Serializer {
+// NewSerializer creates a serializer from a seek table. It returns an error
+// if any frame's size does not fit in the 32-bit fields of a seek table entry.
+func (st *SeekTable) NewSerializer(format Format) (*Serializer, error) {
 	frames := make([]Frame, 0, len(st.entries)-1)
 	for i := 0; i < len(st.entries)-1; i++ {
-		frames = append(frames, Frame{
-			CompressedSize:   uint32(st.entries[i+1].CompressedOffset - st.entries[i].CompressedOffset),
-			DecompressedSize: uint32(st.entries[i+1].DecompressedOffset - st.entries[i].DecompressedOffset),
-		})
+		compSize := st.entries[i+1].CompressedOffset - st.entries[i].CompressedOffset
+		decompSize := st.entries[i+1].DecompressedOffset - st.entries[i].DecompressedOffset
+		if compSize > math.MaxUint32 || decompSize > math.MaxUint32 {
+			return nil, fmt.Errorf("%s: frame %d is %d -> %d bytes", ErrFrameTooLarge, i, compSize, decompSize)
+		}
+
+		frame := Frame{
+			CompressedSize:   uint32(compSize),
+			DecompressedSize: uint32(decompSize),
+		}
+		if st.HasChecksums() {
+			frame.Checksum = st.checksums[i]
+		}
+		frames = append(frames, frame)
+	}
+
+	entrySize := SIZE_PER_FRAME
+	if st.HasChecksums() {
+		entrySize = SIZE_PER_FRAME_CRC
 	}
 
 	return &Serializer{
@@ -156,12 +485,26 @@ func (st *SeekTable) NewSerializer(format Format) *Serializer {
 		frameIndex: 0,
 		writePos:   0,
 		format:     format,
+		entrySize:  entrySize,
+		magic:      SKIPPABLE_MAGIC_NUMBER,
+	}, nil
+}
+
+// SetMagic sets the skippable frame magic of the serialized seek table, for
+// tools that reserve SKIPPABLE_MAGIC_NUMBER. It must be a skippable frame
+// magic, 0x184D2A50 to 0x184D2A5F, and be set before writing; decoders
+// recognize the table by its integrity field whatever its magic.
+func (s *Serializer) SetMagic(magic uint32) error {
+	if magic&skippableMagicMask != skippableMagicBase {
+		return fmt.Errorf("%s: %#x", ErrSeekTableMagic, magic)
 	}
+	s.magic = magic
+	return nil
 }
 
 // EncodedLen returns the total encoded length
 func (s *Serializer) EncodedLen() int {
-	return SKIPPABLE_HEADER_SIZE + SEEK_TABLE_FOOTER_SIZE + len(s.frames)*SIZE_PER_FRAME
+	return SKIPPABLE_HEADER_SIZE + SEEK_TABLE_FOOTER_SIZE + len(s.frames)*s.entrySize
 }
 
 // WriteTo writes the serialized seek table
@@ -177,7 +520,7 @@ func (s *Serializer) WriteTo(buf []byte) int {
 		}
 
 		header := make([]byte, 8)
-		binary.LittleEndian.PutUint32(header[0:4], SKIPPABLE_MAGIC_NUMBER)
+		binary.LittleEndian.PutUint32(header[0:4], s.magic)
 		binary.LittleEndian.PutUint32(header[4:8], uint32(s.frameSize()))
 
 		copy(buf[bufPos:], header[s.writePos:s.writePos+needed])
@@ -209,22 +552,16 @@ func (s *Serializer) WriteTo(buf []byte) int {
 
 	for s.frameIndex < len(s.frames) && remaining > 0 {
 		frameOffset := s.writePos - startPos
-		framePos := frameOffset % SIZE_PER_FRAME
-		frameIdx := frameOffset / SIZE_PER_FRAME
+		framePos := frameOffset % s.entrySize
+		frameIdx := frameOffset / s.entrySize
 
 		if frameIdx >= len(s.frames) {
 			break
 		}
 
-		frame := s.frames[frameIdx]
-		frameData := make([]byte, SIZE_PER_FRAME)
-
-		// Pack frame data
-		binary.LittleEndian.PutUint32(frameData[0:4], frame.CompressedSize)
-		binary.LittleEndian.PutUint32(frameData[4:8], frame.DecompressedSize)
-		// Reserved byte at position 8 is already 0
+		frameData := s.frames[frameIdx].entryBytes(s.entrySize)
 
-		needed := SIZE_PER_FRAME - framePos
+		needed := s.entrySize - framePos
 		if needed > remaining {
 			needed = remaining
 		}
@@ -234,14 +571,14 @@ func (s *Serializer) WriteTo(buf []byte) int {
 		s.writePos += needed
 		remaining -= needed
 
-		if framePos+needed == SIZE_PER_FRAME {
+		if framePos+needed == s.entrySize {
 			s.frameIndex++
 		}
 	}
 
 	// Write integrity field for Foot format
 	if s.format == FormatFoot {
-		integrityStart := startPos + len(s.frames)*SIZE_PER_FRAME
+		integrityStart := startPos + len(s.frames)*s.entrySize
 		if s.writePos >= integrityStart && remaining > 0 {
 			integrityPos := s.writePos - integrityStart
 			needed := SEEK_TABLE_FOOTER_SIZE - integrityPos
@@ -259,74 +596,186 @@ func (s *Serializer) WriteTo(buf []byte) int {
 	return bufPos
 }
 
+// writeAll writes the rest of the serialized seek table to w
+func (s *Serializer) writeAll(w io.Writer) (int64, error) {
+	buf := make([]byte, 4096)
+
+	var written int64
+	for {
+		n := s.WriteTo(buf)
+		if n == 0 {
+			return written, nil
+		}
+		m, err := w.Write(buf[:n])
+		written += int64(m)
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
 func (s *Serializer) frameSize() int {
-	return SEEK_TABLE_FOOTER_SIZE + len(s.frames)*SIZE_PER_FRAME
+	return SEEK_TABLE_FOOTER_SIZE + len(s.frames)*s.entrySize
 }
 
 func (s *Serializer) makeIntegrity() []byte {
 	integrity := make([]byte, SEEK_TABLE_FOOTER_SIZE)
 	binary.LittleEndian.PutUint32(integrity[0:4], uint32(len(s.frames)))
 	integrity[4] = 0 // descriptor byte
+	if s.entrySize == SIZE_PER_FRAME_CRC {
+		integrity[4] |= DESCRIPTOR_CHECKSUM_FLAG
+	}
 	binary.LittleEndian.PutUint32(integrity[5:9], SEEKABLE_MAGIC_NUMBER)
 	return integrity
 }
 
-// ParseSeekTable parses a seek table from bytes
+// ParseSeekTable parses a seek table from bytes. The parsed table is checked
+// with Validate before it is returned.
 func ParseSeekTable(data []byte) (*SeekTable, error) {
 	if len(data) < SEEK_TABLE_FOOTER_SIZE {
 		return nil, errors.New(ErrCorrupted)
 	}
 
 	// Parse integrity footer
-	footerStart := len(data) - SEEK_TABLE_FOOTER_SIZE
-	footer := data[footerStart:]
+	footer := data[len(data)-SEEK_TABLE_FOOTER_SIZE:]
+	dataStart := SKIPPABLE_HEADER_SIZE
 
 	if binary.LittleEndian.Uint32(footer[5:9]) != SEEKABLE_MAGIC_NUMBER {
-		return nil, errors.New(ErrInvalidMagic)
+		// Head format: the integrity field follows the skippable header
+		if len(data) < SKIPPABLE_HEADER_SIZE+SEEK_TABLE_FOOTER_SIZE {
+			return nil, errors.New(ErrInvalidMagic)
+		}
+		footer = data[SKIPPABLE_HEADER_SIZE : SKIPPABLE_HEADER_SIZE+SEEK_TABLE_FOOTER_SIZE]
+		dataStart += SEEK_TABLE_FOOTER_SIZE
+		if binary.LittleEndian.Uint32(footer[5:9]) != SEEKABLE_MAGIC_NUMBER {
+			return nil, errors.New(ErrInvalidMagic)
+		}
 	}
 
 	numFrames := binary.LittleEndian.Uint32(footer[0:4])
 	if numFrames > SEEKABLE_MAX_FRAMES {
 		return nil, errors.New(ErrFrameIndexTooLarge)
 	}
+	if footer[4]&DESCRIPTOR_RESERVED_FLAGS != 0 {
+		return nil, errors.New(ErrCorrupted)
+	}
 
-	expectedSize := SKIPPABLE_HEADER_SIZE + SEEK_TABLE_FOOTER_SIZE + int(numFrames)*SIZE_PER_FRAME
+	entrySize := entrySizeForDescriptor(footer[4])
+	expectedSize := SKIPPABLE_HEADER_SIZE + SEEK_TABLE_FOOTER_SIZE + int(numFrames)*entrySize
 	if len(data) != expectedSize {
 		return nil, errors.New(ErrCorrupted)
 	}
 
 	// Verify skippable header
-	if binary.LittleEndian.Uint32(data[0:4]) != SKIPPABLE_MAGIC_NUMBER {
+	if binary.LittleEndian.Uint32(data[0:4])&skippableMagicMask != skippableMagicBase {
 		return nil, errors.New(ErrInvalidMagic)
 	}
 
-	// Parse entries
-	st := NewSeekTable()
-	dataStart := SKIPPABLE_HEADER_SIZE
+	entries := data[dataStart : dataStart+int(numFrames)*entrySize]
+	return readSeekTableEntries(bytes.NewReader(entries), footer)
+}
 
-	// Check if integrity is at the beginning (Head format)
-	if len(data) > SKIPPABLE_HEADER_SIZE+SEEK_TABLE_FOOTER_SIZE {
-		possibleIntegrity := data[SKIPPABLE_HEADER_SIZE : SKIPPABLE_HEADER_SIZE+SEEK_TABLE_FOOTER_SIZE]
-		if binary.LittleEndian.Uint32(possibleIntegrity[5:9]) == SEEKABLE_MAGIC_NUMBER {
-			dataStart += SEEK_TABLE_FOOTER_SIZE
+// ParseSeekTableStream parses a seek table of size bytes read from r, like
+// ParseSeekTable, without holding the serialized table in memory: entries
+// are read and parsed a chunk at a time. A Head format table streams from
+// any reader. A Foot format table's integrity field follows its entries, so
+// r must then also be an io.ReaderAt over the same size bytes, such as an
+// io.SectionReader, for the integrity field to be read first.
+func ParseSeekTableStream(r io.Reader, size int) (*SeekTable, error) {
+	if size < SKIPPABLE_HEADER_SIZE+SEEK_TABLE_FOOTER_SIZE {
+		return nil, errors.New(ErrCorrupted)
+	}
+	header := make([]byte, SKIPPABLE_HEADER_SIZE+SEEK_TABLE_FOOTER_SIZE)
+	if _, err := io.ReadFull(r, header[:SKIPPABLE_HEADER_SIZE]); err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint32(header[0:4])&skippableMagicMask != skippableMagicBase {
+		return nil, errors.New(ErrInvalidMagic)
+	}
+
+	integrity := header[SKIPPABLE_HEADER_SIZE:]
+	if ra, ok := r.(io.ReaderAt); ok {
+		if _, err := ra.ReadAt(integrity, int64(size-SEEK_TABLE_FOOTER_SIZE)); err != nil {
+			return nil, err
+		}
+	}
+	if binary.LittleEndian.Uint32(integrity[5:9]) != SEEKABLE_MAGIC_NUMBER {
+		// Head format: the integrity field follows the skippable header
+		if _, err := io.ReadFull(r, integrity); err != nil {
+			return nil, err
+		}
+		if binary.LittleEndian.Uint32(integrity[5:9]) != SEEKABLE_MAGIC_NUMBER {
+			return nil, errors.New(ErrInvalidMagic)
 		}
 	}
 
-	for i := 0; i < int(numFrames); i++ {
-		offset := dataStart + i*SIZE_PER_FRAME
-		compSize := binary.LittleEndian.Uint32(data[offset : offset+4])
-		decompSize := binary.LittleEndian.Uint32(data[offset+4 : offset+8])
+	expectedSize, err := ParseSeekTableSize(integrity)
+	if err != nil {
+		return nil, err
+	}
+	if size != expectedSize || integrity[4]&DESCRIPTOR_RESERVED_FLAGS != 0 {
+		return nil, errors.New(ErrCorrupted)
+	}
+	return readSeekTableEntries(r, integrity)
+}
+
+// seekTableChunkFrames is how many entries readSeekTableEntries reads at once
+const seekTableChunkFrames = 4096
+
+// readSeekTableEntries reads from r the entries of the seek table described
+// by integrity and returns the table, checked with Validate
+func readSeekTableEntries(r io.Reader, integrity []byte) (*SeekTable, error) {
+	numFrames := int(binary.LittleEndian.Uint32(integrity[0:4]))
+	entrySize := entrySizeForDescriptor(integrity[4])
 
-		if err := st.LogFrame(compSize, decompSize); err != nil {
+	st := NewSeekTable()
+	chunk := make([]byte, min(numFrames, seekTableChunkFrames)*entrySize)
+	for remaining := numFrames; remaining > 0; {
+		n := min(remaining, seekTableChunkFrames)
+		if _, err := io.ReadFull(r, chunk[:n*entrySize]); err != nil {
 			return nil, err
 		}
+		remaining -= n
+
+		for offset := 0; offset < n*entrySize; offset += entrySize {
+			compSize := binary.LittleEndian.Uint32(chunk[offset : offset+4])
+			decompSize := binary.LittleEndian.Uint32(chunk[offset+4 : offset+8])
+
+			if entrySize == SIZE_PER_FRAME_CRC {
+				checksum := binary.LittleEndian.Uint32(chunk[offset+8 : offset+12])
+				if err := st.LogFrameChecksum(uint64(compSize), uint64(decompSize), checksum); err != nil {
+					return nil, err
+				}
+			} else if err := st.LogFrame(uint64(compSize), uint64(decompSize)); err != nil {
+				return nil, err
+			}
+		}
 	}
 
+	if err := st.Validate(); err != nil {
+		return nil, err
+	}
 	return st, nil
 }
 
-// ReadSeekTableFooter reads the seek table footer from a reader
+// ReadSeekTableFooter reads the seek table footer from a reader. It returns
+// ErrArchiveTooSmall if the input is shorter than the smallest valid archive,
+// and restores the reader's original position afterward.
 func ReadSeekTableFooter(r io.ReadSeeker) ([]byte, error) {
+	pos, err := r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Seek(pos, io.SeekStart)
+
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	if size < SKIPPABLE_HEADER_SIZE+SEEK_TABLE_FOOTER_SIZE {
+		return nil, fmt.Errorf("%s: %d bytes", ErrArchiveTooSmall, size)
+	}
+
 	footer := make([]byte, SEEK_TABLE_FOOTER_SIZE)
 	if _, err := r.Seek(-SEEK_TABLE_FOOTER_SIZE, io.SeekEnd); err != nil {
 		return nil, err
@@ -337,6 +786,153 @@ func ReadSeekTableFooter(r io.ReadSeeker) ([]byte, error) {
 	return footer, nil
 }
 
+// ReadSeekTable locates and parses the seek table at the end of r, restoring
+// r's original position afterward. It returns ErrArchiveTooSmall if r is
+// shorter than the smallest valid archive and ErrInvalidMagic if r does not
+// end with a seek table.
+func ReadSeekTable(r io.ReadSeeker) (*SeekTable, error) {
+	footer, err := ReadSeekTableFooter(r)
+	if err != nil {
+		return nil, err
+	}
+
+	pos, err := r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Seek(pos, io.SeekStart)
+
+	seekTableSize, err := ParseSeekTableSize(footer)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := r.Seek(-int64(seekTableSize), io.SeekEnd); err != nil {
+		return nil, err
+	}
+
+	if seekTableSize > streamSeekTableSize {
+		return parseFootSeekTableStream(r, footer)
+	}
+	seekTableData := make([]byte, seekTableSize)
+	if _, err := io.ReadFull(r, seekTableData); err != nil {
+		return nil, err
+	}
+
+	return ParseSeekTable(seekTableData)
+}
+
+// streamSeekTableSize is the size above which seek tables are parsed as they
+// are read rather than read into memory whole first
+var streamSeekTableSize = 1 << 20
+
+// parseFootSeekTableStream parses the Foot format seek table that r is
+// positioned at, whose integrity field has already been read as footer
+func parseFootSeekTableStream(r io.Reader, footer []byte) (*SeekTable, error) {
+	header := make([]byte, SKIPPABLE_HEADER_SIZE)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint32(header[0:4])&skippableMagicMask != skippableMagicBase {
+		return nil, errors.New(ErrInvalidMagic)
+	}
+	if footer[4]&DESCRIPTOR_RESERVED_FLAGS != 0 {
+		return nil, errors.New(ErrCorrupted)
+	}
+	return readSeekTableEntries(r, footer)
+}
+
+// ReadHeadSeekTable parses the Head format seek table at the start of r,
+// restoring r's original position afterward. Frame offsets in it are
+// relative to the end of the table, where the compressed frames start. It
+// returns ErrInvalidMagic if r does not start with a seek table.
+func ReadHeadSeekTable(r io.ReadSeeker) (*SeekTable, error) {
+	st, _, err := readHeadSeekTable(r)
+	return st, err
+}
+
+// readHeadSeekTable parses a Head format seek table at the start of r, where
+// the integrity field directly follows the skippable header, and returns it
+// with its size: the compressed frames start right after it. r's position is
+// restored.
+func readHeadSeekTable(r io.ReadSeeker) (*SeekTable, int, error) {
+	pos, err := r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer r.Seek(pos, io.SeekStart)
+
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, 0, err
+	}
+	header := make([]byte, SKIPPABLE_HEADER_SIZE+SEEK_TABLE_FOOTER_SIZE)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, 0, err
+	}
+	if binary.LittleEndian.Uint32(header[0:4])&skippableMagicMask != skippableMagicBase {
+		return nil, 0, errors.New(ErrInvalidMagic)
+	}
+
+	seekTableSize, err := ParseSeekTableSize(header[SKIPPABLE_HEADER_SIZE:])
+	if err != nil {
+		return nil, 0, err
+	}
+	if seekTableSize > streamSeekTableSize {
+		st, err := ParseSeekTableStream(io.MultiReader(bytes.NewReader(header), r), seekTableSize)
+		if err != nil {
+			return nil, 0, err
+		}
+		return st, seekTableSize, nil
+	}
+	seekTableData := make([]byte, seekTableSize)
+	copy(seekTableData, header)
+	if _, err := io.ReadFull(r, seekTableData[len(header):]); err != nil {
+		return nil, 0, err
+	}
+
+	st, err := ParseSeekTable(seekTableData)
+	if err != nil {
+		return nil, 0, err
+	}
+	return st, seekTableSize, nil
+}
+
+// ArchiveFormat reports which seek table format the archive in r uses and
+// whether its entries carry per-frame checksums, from the descriptor byte. A
+// Foot format table ends with its integrity field at the end of r; a Head
+// format table starts r with the integrity field right after the skippable
+// header. Only the footer and header are read, and r's position is restored.
+func ArchiveFormat(r io.ReadSeeker) (Format, bool, error) {
+	footer, err := ReadSeekTableFooter(r)
+	if err != nil {
+		return 0, false, err
+	}
+	if binary.LittleEndian.Uint32(footer[5:9]) == SEEKABLE_MAGIC_NUMBER {
+		return FormatFoot, footer[4]&DESCRIPTOR_CHECKSUM_FLAG != 0, nil
+	}
+
+	pos, err := r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, false, err
+	}
+	defer r.Seek(pos, io.SeekStart)
+
+	header := make([]byte, SKIPPABLE_HEADER_SIZE+SEEK_TABLE_FOOTER_SIZE)
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return 0, false, err
+	}
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, false, err
+	}
+	integrity := header[SKIPPABLE_HEADER_SIZE:]
+	if binary.LittleEndian.Uint32(header[0:4])&skippableMagicMask == skippableMagicBase &&
+		binary.LittleEndian.Uint32(integrity[5:9]) == SEEKABLE_MAGIC_NUMBER {
+		return FormatHead, integrity[4]&DESCRIPTOR_CHECKSUM_FLAG != 0, nil
+	}
+
+	return 0, false, errors.New(ErrInvalidMagic)
+}
+
 // ParseSeekTableSize parses the seek table size from integrity bytes
 func ParseSeekTableSize(integrity []byte) (int, error) {
 	if len(integrity) != SEEK_TABLE_FOOTER_SIZE {
@@ -352,5 +948,15 @@ func ParseSeekTableSize(integrity []byte) (int, error) {
 		return 0, errors.New(ErrFrameIndexTooLarge)
 	}
 
-	return SKIPPABLE_HEADER_SIZE + SEEK_TABLE_FOOTER_SIZE + int(numFrames)*SIZE_PER_FRAME, nil
+	entrySize := entrySizeForDescriptor(integrity[4])
+	return SKIPPABLE_HEADER_SIZE + SEEK_TABLE_FOOTER_SIZE + int(numFrames)*entrySize, nil
+}
+
+// entrySizeForDescriptor returns the size of a seek table entry for the given
+// descriptor byte. Entries carry a trailing checksum when the checksum flag is set.
+func entrySizeForDescriptor(descriptor byte) int {
+	if descriptor&DESCRIPTOR_CHECKSUM_FLAG != 0 {
+		return SIZE_PER_FRAME_CRC
+	}
+	return SIZE_PER_FRAME
 }
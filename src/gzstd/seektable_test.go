@@ -1,7 +1,15 @@
 package gzstd
 
 import (
+	"bytes"
 	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -115,13 +123,29 @@ func TestSeekTable_MaxFrameSizeDecomp(t *testing.T) {
 	}
 }
 
+func TestSeekTable_Totals(t *testing.T) {
+	st := NewSeekTable()
+	if st.TotalCompressed() != 0 || st.TotalDecompressed() != 0 {
+		t.Errorf("Expected 0 totals for an empty table, got %d, %d", st.TotalCompressed(), st.TotalDecompressed())
+	}
+
+	st.LogFrame(1000, 2000)
+	st.LogFrame(1500, 3000)
+	if st.TotalCompressed() != 2500 || st.TotalDecompressed() != 5000 {
+		t.Errorf("Expected totals 2500, 5000, got %d, %d", st.TotalCompressed(), st.TotalDecompressed())
+	}
+}
+
 func TestSeekTable_Serialization(t *testing.T) {
 	st := NewSeekTable()
 	st.LogFrame(1000, 2000)
 	st.LogFrame(1500, 3000)
 	
 	// Test serialization with Foot format
-	serializer := st.NewSerializer(FormatFoot)
+	serializer, err := st.NewSerializer(FormatFoot)
+	if err != nil {
+		t.Fatalf("NewSerializer failed: %v", err)
+	}
 	
 	expectedLen := SKIPPABLE_HEADER_SIZE + SEEK_TABLE_FOOTER_SIZE + 2*SIZE_PER_FRAME
 	if serializer.EncodedLen() != expectedLen {
@@ -161,7 +185,10 @@ func TestParseSeekTable(t *testing.T) {
 	st.LogFrame(1500, 3000)
 	
 	// Serialize it
-	serializer := st.NewSerializer(FormatFoot)
+	serializer, err := st.NewSerializer(FormatFoot)
+	if err != nil {
+		t.Fatalf("NewSerializer failed: %v", err)
+	}
 	buf := make([]byte, serializer.EncodedLen())
 	totalWritten := 0
 	for {
@@ -254,3 +281,619 @@ func TestParseSeekTableSize(t *testing.T) {
 		t.Errorf("Expected size %d, got %d", expectedSize, size)
 	}
 }
+
+func TestParseSeekTableSize_EntrySize(t *testing.T) {
+	tests := []struct {
+		name       string
+		descriptor byte
+		entrySize  int
+	}{
+		{"without checksums", 0, SIZE_PER_FRAME},
+		{"with checksums", DESCRIPTOR_CHECKSUM_FLAG, SIZE_PER_FRAME_CRC},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			integrity := make([]byte, SEEK_TABLE_FOOTER_SIZE)
+			binary.LittleEndian.PutUint32(integrity[0:4], 3)
+			integrity[4] = tt.descriptor
+			binary.LittleEndian.PutUint32(integrity[5:9], SEEKABLE_MAGIC_NUMBER)
+
+			size, err := ParseSeekTableSize(integrity)
+			if err != nil {
+				t.Fatalf("ParseSeekTableSize failed: %v", err)
+			}
+
+			expectedSize := SKIPPABLE_HEADER_SIZE + SEEK_TABLE_FOOTER_SIZE + 3*tt.entrySize
+			if size != expectedSize {
+				t.Errorf("Expected size %d, got %d", expectedSize, size)
+			}
+		})
+	}
+}
+
+func TestVerifyFraming(t *testing.T) {
+	archive := createTestArchive(t, [][]byte{
+		[]byte("Frame 0"),
+		[]byte("Frame 1"),
+		[]byte("Frame 2"),
+	})
+
+	decoder, err := NewDecoder(bytes.NewReader(archive.Bytes()), nil)
+	if err != nil {
+		t.Fatalf("NewDecoder failed: %v", err)
+	}
+	expected := decoder.SeekTable()
+
+	if err := VerifyFraming(bytes.NewReader(archive.Bytes()), expected); err != nil {
+		t.Errorf("VerifyFraming against own table failed: %v", err)
+	}
+
+	// Mutate the second frame
+	mutated := NewSeekTable()
+	for i := uint32(0); i < expected.NumFrames(); i++ {
+		comp, _ := expected.FrameSizeComp(i)
+		decomp, _ := expected.FrameSizeDecomp(i)
+		if i == 1 {
+			decomp++
+		}
+		mutated.LogFrame(comp, decomp)
+	}
+
+	err = VerifyFraming(bytes.NewReader(archive.Bytes()), mutated)
+	if err == nil {
+		t.Fatal("Expected framing mismatch error")
+	}
+	if !strings.Contains(err.Error(), "frame 1") {
+		t.Errorf("Expected error to name frame 1, got %q", err)
+	}
+
+	// A nil expected table is rejected, not dereferenced
+	err = VerifyFraming(bytes.NewReader(archive.Bytes()), nil)
+	if err == nil || err.Error() != ErrNoExpectedTable {
+		t.Errorf("Expected %q for nil table, got %v", ErrNoExpectedTable, err)
+	}
+}
+
+func TestSeekTable_OffsetsFor(t *testing.T) {
+	st := NewSeekTable()
+	for i := uint32(1); i <= 20; i++ {
+		st.LogFrame(uint64(i)*10, uint64(i)*100)
+	}
+
+	indices := []uint32{17, 2, 9, 0, 19}
+	offsets, err := st.OffsetsFor(indices)
+	if err != nil {
+		t.Fatalf("OffsetsFor failed: %v", err)
+	}
+	if len(offsets) != len(indices) {
+		t.Fatalf("Expected %d offsets, got %d", len(indices), len(offsets))
+	}
+
+	for i, index := range indices {
+		comp, _ := st.FrameStartComp(index)
+		decomp, _ := st.FrameStartDecomp(index)
+		if offsets[i].CompressedOffset != comp || offsets[i].DecompressedOffset != decomp {
+			t.Errorf("Frame %d: got %+v, want {%d %d}", index, offsets[i], comp, decomp)
+		}
+	}
+
+	if _, err := st.OffsetsFor([]uint32{3, 20}); err == nil {
+		t.Error("Expected error for out-of-range index")
+	}
+}
+
+func TestNewSerializer_OversizedFrame(t *testing.T) {
+	st := &SeekTable{
+		entries: []Entry{
+			{CompressedOffset: 0, DecompressedOffset: 0},
+			{CompressedOffset: 100, DecompressedOffset: 200},
+			{CompressedOffset: 200, DecompressedOffset: 200 + math.MaxUint32 + 1},
+		},
+	}
+
+	_, err := st.NewSerializer(FormatFoot)
+	if err == nil {
+		t.Fatal("Expected error for oversized frame")
+	}
+	if !strings.HasPrefix(err.Error(), ErrFrameTooLarge) || !strings.Contains(err.Error(), "frame 1") {
+		t.Errorf("Expected %q error for frame 1, got %q", ErrFrameTooLarge, err)
+	}
+}
+
+func TestReadSeekTableFooter_TooSmall(t *testing.T) {
+	for _, size := range []int{0, 4, 8} {
+		t.Run(fmt.Sprintf("%d bytes", size), func(t *testing.T) {
+			r := bytes.NewReader(make([]byte, size))
+			r.Seek(int64(size/2), io.SeekStart)
+
+			_, err := ReadSeekTableFooter(r)
+			if err == nil || !strings.HasPrefix(err.Error(), ErrArchiveTooSmall) {
+				t.Errorf("Expected %q error, got %v", ErrArchiveTooSmall, err)
+			}
+
+			pos, _ := r.Seek(0, io.SeekCurrent)
+			if pos != int64(size/2) {
+				t.Errorf("Expected position %d to be restored, got %d", size/2, pos)
+			}
+
+			_, err = NewDecoder(bytes.NewReader(make([]byte, size)), nil)
+			if err == nil || !strings.HasPrefix(err.Error(), ErrArchiveTooSmall) {
+				t.Errorf("Expected NewDecoder to return %q, got %v", ErrArchiveTooSmall, err)
+			}
+		})
+	}
+}
+
+func TestArchiveFormat(t *testing.T) {
+	var archive bytes.Buffer
+	opts := DefaultEncoderOptions()
+	opts.ChecksumFlag = false
+	encoder, err := NewEncoder(&archive, opts)
+	if err != nil {
+		t.Fatalf("NewEncoder failed: %v", err)
+	}
+	encoder.Write([]byte("some data"))
+	if err := encoder.Finish(); err != nil {
+		t.Fatalf("Finish failed: %v", err)
+	}
+
+	serialize := func(format Format) []byte {
+		serializer, err := encoder.SeekTable().NewSerializer(format)
+		if err != nil {
+			t.Fatalf("NewSerializer failed: %v", err)
+		}
+		buf := make([]byte, serializer.EncodedLen())
+		serializer.WriteTo(buf)
+		return buf
+	}
+
+	withChecksums := bytes.Clone(archive.Bytes())
+	withChecksums[len(withChecksums)-5] |= DESCRIPTOR_CHECKSUM_FLAG
+
+	tests := []struct {
+		name         string
+		data         []byte
+		wantFormat   Format
+		wantChecksum bool
+	}{
+		{"foot", archive.Bytes(), FormatFoot, false},
+		{"foot with checksums", withChecksums, FormatFoot, true},
+		{"head", serialize(FormatHead), FormatHead, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			format, checksums, err := ArchiveFormat(bytes.NewReader(tt.data))
+			if err != nil {
+				t.Fatalf("ArchiveFormat failed: %v", err)
+			}
+			if format != tt.wantFormat || checksums != tt.wantChecksum {
+				t.Errorf("Expected (%v, %v), got (%v, %v)", tt.wantFormat, tt.wantChecksum, format, checksums)
+			}
+		})
+	}
+
+	if _, _, err := ArchiveFormat(bytes.NewReader(make([]byte, 64))); err == nil {
+		t.Error("Expected error for data without a seek table")
+	}
+}
+
+// testdata/reference.zst is testdata/reference.txt compressed by the zstd
+// contrib seekable_format library (v1.5.7) into three frames, with
+// per-frame checksums in its seek table; testdata/README.md records how.
+func TestReferenceArchive(t *testing.T) {
+	archive, err := os.ReadFile(filepath.Join("testdata", "reference.zst"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := os.ReadFile(filepath.Join("testdata", "reference.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoder, err := NewDecoder(bytes.NewReader(archive), nil)
+	if err != nil {
+		t.Fatalf("NewDecoder failed: %v", err)
+	}
+	if decoder.SeekTable().NumFrames() != 3 {
+		t.Fatalf("Expected 3 frames, got %d", decoder.SeekTable().NumFrames())
+	}
+	if !decoder.SeekTable().HasChecksums() {
+		t.Fatal("Expected the reference seek table to have checksums")
+	}
+	if frame, err := decoder.TestIntegrity(); err != nil {
+		t.Fatalf("TestIntegrity failed at frame %d: %v", frame, err)
+	}
+	if _, err := decoder.Seek(0, io.SeekStart); err != nil {
+		t.Fatalf("Seek failed: %v", err)
+	}
+
+	got, err := io.ReadAll(decoder)
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	if !bytes.Equal(got, expected) {
+		t.Error("Decompressed content differs from reference")
+	}
+
+	// Seek into the last frame
+	start, _ := decoder.SeekTable().FrameStartDecomp(2)
+	if _, err := decoder.Seek(int64(start)+6, io.SeekStart); err != nil {
+		t.Fatalf("Seek failed: %v", err)
+	}
+	tail, err := io.ReadAll(decoder)
+	if err != nil || !bytes.Equal(tail, expected[start+6:]) {
+		t.Errorf("Expected %q after seek, got %q (%v)", expected[start+6:], tail, err)
+	}
+
+	// Re-serializing the parsed table reproduces the reference bytes
+	serializer, err := decoder.SeekTable().NewSerializer(FormatFoot)
+	if err != nil {
+		t.Fatalf("NewSerializer failed: %v", err)
+	}
+	table := make([]byte, serializer.EncodedLen())
+	serializer.WriteTo(table)
+	if !bytes.Equal(table, archive[len(archive)-len(table):]) {
+		t.Errorf("Serialized seek table differs from reference:\n got %x\nwant %x", table, archive[len(archive)-len(table):])
+	}
+}
+
+func TestSeekTable_Checksums(t *testing.T) {
+	st := NewSeekTable()
+	st.LogFrameChecksum(100, 200, 0xDEADBEEF)
+	st.LogFrameChecksum(50, 80, 0x01020304)
+	if !st.HasChecksums() {
+		t.Fatal("Expected checksums")
+	}
+
+	serializer, err := st.NewSerializer(FormatFoot)
+	if err != nil {
+		t.Fatalf("NewSerializer failed: %v", err)
+	}
+	buf := make([]byte, serializer.EncodedLen())
+	serializer.WriteTo(buf)
+	if len(buf) != SKIPPABLE_HEADER_SIZE+SEEK_TABLE_FOOTER_SIZE+2*SIZE_PER_FRAME_CRC {
+		t.Errorf("Unexpected serialized length %d", len(buf))
+	}
+	if buf[len(buf)-5]&DESCRIPTOR_CHECKSUM_FLAG == 0 {
+		t.Error("Expected checksum flag in descriptor")
+	}
+
+	parsed, err := ParseSeekTable(buf)
+	if err != nil {
+		t.Fatalf("ParseSeekTable failed: %v", err)
+	}
+	if checksum, _ := parsed.FrameChecksum(1); checksum != 0x01020304 || !parsed.Equal(st) {
+		t.Errorf("Round trip lost checksums: frame 1 has %#x", checksum)
+	}
+
+	// A frame logged without a checksum drops them from the table
+	st.LogFrame(10, 10)
+	if st.HasChecksums() {
+		t.Error("Expected no checksums after LogFrame")
+	}
+	if _, err := st.FrameChecksum(0); err == nil {
+		t.Error("Expected error from FrameChecksum")
+	}
+}
+
+func TestSeekTable_LogFrameTooLarge(t *testing.T) {
+	st := NewSeekTable()
+	for _, sizes := range [][2]uint64{{5 << 30, 100}, {100, 5 << 30}, {math.MaxUint32 + 1, 1}} {
+		err := st.LogFrame(sizes[0], sizes[1])
+		if err == nil || !strings.HasPrefix(err.Error(), ErrFrameTooLarge) {
+			t.Errorf("Expected %q for %d -> %d bytes, got %v", ErrFrameTooLarge, sizes[0], sizes[1], err)
+		}
+	}
+	if st.NumFrames() != 0 {
+		t.Errorf("Expected rejected frames not to be logged, got %d frames", st.NumFrames())
+	}
+
+	if err := st.LogFrame(math.MaxUint32, math.MaxUint32); err != nil {
+		t.Errorf("LogFrame of the largest frame failed: %v", err)
+	}
+}
+
+func TestSeekTable_FrameAtOffset(t *testing.T) {
+	st := NewSeekTable()
+	st.LogFrame(10, 100) // comp [0,10)  decomp [0,100)
+	st.LogFrame(20, 0)   // comp [10,30) decomp empty
+	st.LogFrame(5, 50)   // comp [30,35) decomp [100,150)
+
+	tests := []struct {
+		offset     uint64
+		wantDecomp int64 // -1 for ErrFrameIndexTooLarge
+		wantComp   int64
+	}{
+		{0, 0, 0},
+		{9, 0, 0},
+		{10, 0, 1}, // start of frame 1
+		{29, 0, 1},
+		{30, 0, 2}, // start of frame 2
+		{34, 0, 2},
+		{35, 0, -1}, // end of compressed data
+		{99, 0, -1},
+		{100, 2, -1}, // start of frame 2, skipping empty frame 1
+		{149, 2, -1},
+		{150, -1, -1},
+		{1 << 40, -1, -1},
+	}
+	for _, tt := range tests {
+		frame, err := st.FrameAtDecompOffset(tt.offset)
+		checkFrameAt(t, "FrameAtDecompOffset", tt.offset, frame, err, tt.wantDecomp)
+		frame, err = st.FrameAtCompOffset(tt.offset)
+		checkFrameAt(t, "FrameAtCompOffset", tt.offset, frame, err, tt.wantComp)
+	}
+
+	if _, err := NewSeekTable().FrameAtDecompOffset(0); err == nil {
+		t.Error("Expected error for empty seek table")
+	}
+}
+
+func checkFrameAt(t *testing.T, name string, offset uint64, frame uint32, err error, want int64) {
+	t.Helper()
+	if want < 0 {
+		if err == nil || !strings.HasPrefix(err.Error(), ErrFrameIndexTooLarge) {
+			t.Errorf("%s(%d): expected %q, got frame %d, %v", name, offset, ErrFrameIndexTooLarge, frame, err)
+		}
+		return
+	}
+	if err != nil || int64(frame) != want {
+		t.Errorf("%s(%d) = %d, %v; expected %d", name, offset, frame, err, want)
+	}
+}
+
+func TestSeekTable_Append(t *testing.T) {
+	other := NewSeekTable()
+	other.LogFrameChecksum(100, 200, 1)
+	other.LogFrameChecksum(50, 80, 2)
+
+	// Onto an empty table
+	st := NewSeekTable()
+	if err := st.Append(other); err != nil {
+		t.Fatalf("Append failed: %v", err)
+	}
+	if !st.Equal(other) || !st.HasChecksums() {
+		t.Errorf("Expected a copy of other, got %+v", st.Entries())
+	}
+
+	// Onto a populated table, rebased onto its last entry
+	if err := st.Append(other); err != nil {
+		t.Fatalf("Append failed: %v", err)
+	}
+	want := []Entry{{0, 0}, {100, 200}, {150, 280}, {250, 480}, {300, 560}}
+	entries := st.Entries()
+	if len(entries) != len(want) {
+		t.Fatalf("Expected %d entries, got %d", len(want), len(entries))
+	}
+	for i := range want {
+		if entries[i] != want[i] {
+			t.Errorf("Entry %d: expected %+v, got %+v", i, want[i], entries[i])
+		}
+	}
+	if checksum, _ := st.FrameChecksum(3); checksum != 2 {
+		t.Errorf("Expected checksum 2 for frame 3, got %d", checksum)
+	}
+
+	// Entries is a copy
+	entries[1].CompressedOffset = 7
+	if start, _ := st.FrameStartComp(1); start != 100 {
+		t.Error("Modifying Entries changed the table")
+	}
+
+	// A table without checksums drops them
+	plain := NewSeekTable()
+	plain.LogFrame(10, 10)
+	if err := st.Append(plain); err != nil {
+		t.Fatalf("Append failed: %v", err)
+	}
+	if st.HasChecksums() || st.NumFrames() != 5 {
+		t.Errorf("Expected 5 frames without checksums, got %d (checksums %v)", st.NumFrames(), st.HasChecksums())
+	}
+}
+
+func TestSeekTable_AppendFrameLimit(t *testing.T) {
+	// Both tables share one zeroed backing array, which is never touched
+	half := SEEKABLE_MAX_FRAMES/2 + 1
+	entries := make([]Entry, half+1)
+	st := &SeekTable{entries: entries}
+	other := &SeekTable{entries: entries}
+
+	err := st.Append(other)
+	if err == nil || !strings.HasPrefix(err.Error(), ErrFrameIndexTooLarge) {
+		t.Fatalf("Expected %q, got %v", ErrFrameIndexTooLarge, err)
+	}
+	if st.NumFrames() != uint32(half) {
+		t.Errorf("Expected table unchanged, got %d frames", st.NumFrames())
+	}
+}
+
+func TestReadSeekTable(t *testing.T) {
+	opts := DefaultEncoderOptions()
+	opts.FramePolicy = UncompressedFrameSize{Size: 4000}
+	var buf bytes.Buffer
+	expected, err := CompressSeekable(&buf, bytes.Repeat([]byte("seek table "), 1000), opts)
+	if err != nil {
+		t.Fatalf("CompressSeekable failed: %v", err)
+	}
+
+	r := bytes.NewReader(buf.Bytes())
+	r.Seek(10, io.SeekStart)
+	st, err := ReadSeekTable(r)
+	if err != nil {
+		t.Fatalf("ReadSeekTable failed: %v", err)
+	}
+	if !st.Equal(expected) {
+		t.Error("Seek table differs from the one written")
+	}
+	if pos, _ := r.Seek(0, io.SeekCurrent); pos != 10 {
+		t.Errorf("Expected reader position restored to 10, got %d", pos)
+	}
+
+	_, err = ReadSeekTable(bytes.NewReader(make([]byte, SKIPPABLE_HEADER_SIZE)))
+	if err == nil || !strings.HasPrefix(err.Error(), ErrArchiveTooSmall) {
+		t.Errorf("Expected %q for a short file, got %v", ErrArchiveTooSmall, err)
+	}
+
+	corrupt := append([]byte(nil), buf.Bytes()...)
+	corrupt[len(corrupt)-1] ^= 0xFF
+	if _, err := ReadSeekTable(bytes.NewReader(corrupt)); err == nil || err.Error() != ErrInvalidMagic {
+		t.Errorf("Expected %q for a bad trailing magic, got %v", ErrInvalidMagic, err)
+	}
+}
+
+func TestSeekTable_Validate(t *testing.T) {
+	st := NewSeekTable()
+	st.LogFrame(100, 200)
+	st.LogFrame(150, 300)
+	if err := st.Validate(); err != nil {
+		t.Fatalf("Validate rejected a valid table: %v", err)
+	}
+
+	// Frame 1 ends before it starts
+	st = &SeekTable{entries: []Entry{{0, 0}, {100, 200}, {90, 500}, {200, 600}}}
+	err := st.Validate()
+	if err == nil || !strings.Contains(err.Error(), ErrCorrupted) || !strings.Contains(err.Error(), "frame 1") {
+		t.Errorf("Expected a corrupted frame 1 error, got %v", err)
+	}
+
+	st = &SeekTable{entries: []Entry{{0, 0}, {100, 200}, {200, 200 + MAX_FRAME_SIZE}}}
+	err = st.Validate()
+	if err == nil || !strings.Contains(err.Error(), ErrFrameTooLarge) || !strings.Contains(err.Error(), "frame 1") {
+		t.Errorf("Expected frame 1 to be too large, got %v", err)
+	}
+
+	st = &SeekTable{entries: []Entry{{10, 0}, {100, 200}}}
+	if err := st.Validate(); err == nil {
+		t.Error("Expected an error for a first entry not at offset zero")
+	}
+}
+
+func TestSeekTable_StringAndDump(t *testing.T) {
+	st := NewSeekTable()
+	if got := st.String(); got != "0 frames" {
+		t.Errorf("Empty table: got %q", got)
+	}
+	st.LogFrameChecksum(40, 100, 0x1a2b3c4d)
+	st.LogFrameChecksum(30, 100, 0xdeadbeef)
+	st.LogFrameChecksum(50, 7, 0x00000001)
+
+	if got, want := st.String(), "3 frames, 120 -> 207 bytes, frames 30-50 -> 7-100 bytes, checksums"; got != want {
+		t.Errorf("String() = %q, expected %q", got, want)
+	}
+
+	var buf bytes.Buffer
+	DumpSeekTable(&buf, st)
+	want := "" +
+		"   frame    comp_offset  comp_size  decomp_offset decomp_size checksum\n" +
+		"       0              0         40              0        100 1a2b3c4d\n" +
+		"       1             40         30            100        100 deadbeef\n" +
+		"       2             70         50            200          7 00000001\n"
+	if buf.String() != want {
+		t.Errorf("DumpSeekTable wrote:\n%s\nexpected:\n%s", buf.String(), want)
+	}
+
+	// Without checksums
+	st = NewSeekTable()
+	st.LogFrame(10, 20)
+	if got, want := st.String(), "1 frames, 10 -> 20 bytes, frames 10-10 -> 20-20 bytes"; got != want {
+		t.Errorf("String() = %q, expected %q", got, want)
+	}
+	buf.Reset()
+	DumpSeekTable(&buf, st)
+	if lines := strings.Split(buf.String(), "\n"); len(lines) != 3 || !strings.HasSuffix(lines[1], " -") {
+		t.Errorf("Unexpected dump without checksums:\n%s", buf.String())
+	}
+}
+
+func TestSeekTable_Bytes(t *testing.T) {
+	st := NewSeekTable()
+	st.LogFrameChecksum(1000, 2000, 0x11111111)
+	st.LogFrameChecksum(1500, 3000, 0x22222222)
+
+	for _, format := range []Format{FormatHead, FormatFoot} {
+		// Drive the serializer with a small buffer, as the encoder does
+		serializer, err := st.NewSerializer(format)
+		if err != nil {
+			t.Fatalf("NewSerializer failed: %v", err)
+		}
+		var want []byte
+		buf := make([]byte, 5)
+		for n := serializer.WriteTo(buf); n > 0; n = serializer.WriteTo(buf) {
+			want = append(want, buf[:n]...)
+		}
+
+		data := st.Bytes(format)
+		if !bytes.Equal(data, want) {
+			t.Errorf("Format %d: Bytes differs from the serializer output", format)
+		}
+
+		var out bytes.Buffer
+		n, err := st.WriteTo(&out, format)
+		if err != nil || n != int64(len(want)) || !bytes.Equal(out.Bytes(), want) {
+			t.Errorf("Format %d: WriteTo wrote %d bytes: %v", format, n, err)
+		}
+
+		parsed, err := ParseSeekTable(data)
+		if err != nil {
+			t.Fatalf("Format %d: ParseSeekTable failed: %v", format, err)
+		}
+		if !parsed.Equal(st) || !parsed.HasChecksums() {
+			t.Errorf("Format %d: round trip changed the seek table", format)
+		}
+	}
+}
+
+func TestParseSeekTableStream(t *testing.T) {
+	// Parse tables bigger than the threshold as streams
+	defer func(size int) { streamSeekTableSize = size }(streamSeekTableSize)
+	streamSeekTableSize = 1024
+
+	rng := rand.New(rand.NewSource(5))
+	for _, checksums := range []bool{false, true} {
+		st := NewSeekTable()
+		for i := 0; i < 3*seekTableChunkFrames+17; i++ {
+			comp, decomp := uint64(1+rng.Intn(1000)), uint64(1+rng.Intn(5000))
+			if checksums {
+				st.LogFrameChecksum(comp, decomp, rng.Uint32())
+			} else {
+				st.LogFrame(comp, decomp)
+			}
+		}
+
+		for _, format := range []Format{FormatHead, FormatFoot} {
+			data := st.Bytes(format)
+			name := fmt.Sprintf("format %d, checksums %v", format, checksums)
+
+			parsed, err := ParseSeekTableStream(bytes.NewReader(data), len(data))
+			if err != nil || !parsed.Equal(st) || parsed.HasChecksums() != checksums {
+				t.Errorf("%s: ParseSeekTableStream changed the table: %v", name, err)
+			}
+
+			// Without io.ReaderAt only Head format tables can be parsed
+			parsed, err = ParseSeekTableStream(struct{ io.Reader }{bytes.NewReader(data)}, len(data))
+			if format == FormatHead && (err != nil || !parsed.Equal(st)) {
+				t.Errorf("%s: streaming from a plain reader failed: %v", name, err)
+			}
+			if format == FormatFoot && err == nil {
+				t.Errorf("%s: expected an error streaming from a plain reader", name)
+			}
+
+			if _, err := ParseSeekTableStream(bytes.NewReader(data), len(data)-1); err == nil {
+				t.Errorf("%s: expected an error for the wrong size", name)
+			}
+		}
+
+		// The decoder's readers take the streaming path for large tables
+		if parsed, err := ReadSeekTable(bytes.NewReader(st.Bytes(FormatFoot))); err != nil || !parsed.Equal(st) {
+			t.Errorf("checksums %v: ReadSeekTable changed the table: %v", checksums, err)
+		}
+		head := st.Bytes(FormatHead)
+		if parsed, size, err := readHeadSeekTable(bytes.NewReader(head)); err != nil || !parsed.Equal(st) || size != len(head) {
+			t.Errorf("checksums %v: readHeadSeekTable changed the table: %v", checksums, err)
+		}
+		if parsed, err := ReadHeadSeekTable(bytes.NewReader(head)); err != nil || !parsed.Equal(st) {
+			t.Errorf("checksums %v: ReadHeadSeekTable changed the table: %v", checksums, err)
+		}
+	}
+}
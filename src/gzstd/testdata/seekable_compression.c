@@ -0,0 +1,72 @@
+/*
+ * Writes FILE.zst in the zstd seekable format with the contrib
+ * seekable_format library, as contrib/seekable_format/examples/
+ * seekable_compression.c does: compression level LEVEL, frames of at most
+ * FRAME_SIZE uncompressed bytes, and per-frame checksums in the seek table.
+ *
+ * usage: seekable_compression FILE LEVEL FRAME_SIZE
+ */
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include "zstd.h"
+#include "zstd_seekable.h"
+
+static void check(size_t ret, const char* what)
+{
+    if (ZSTD_isError(ret)) {
+        fprintf(stderr, "%s: %s\n", what, ZSTD_getErrorName(ret));
+        exit(1);
+    }
+}
+
+int main(int argc, char** argv)
+{
+    if (argc != 4) {
+        fprintf(stderr, "usage: %s FILE LEVEL FRAME_SIZE\n", argv[0]);
+        return 1;
+    }
+    const char* inName = argv[1];
+    int const level = atoi(argv[2]);
+    unsigned const frameSize = (unsigned)atoi(argv[3]);
+
+    FILE* const fin = fopen(inName, "rb");
+    if (!fin) { perror(inName); return 1; }
+    char outName[4096];
+    snprintf(outName, sizeof(outName), "%s.zst", inName);
+    FILE* const fout = fopen(outName, "wb");
+    if (!fout) { perror(outName); return 1; }
+
+    size_t const buffInSize = ZSTD_CStreamInSize();
+    size_t const buffOutSize = ZSTD_CStreamOutSize();
+    void* const buffIn = malloc(buffInSize);
+    void* const buffOut = malloc(buffOutSize);
+
+    ZSTD_seekable_CStream* const cstream = ZSTD_seekable_createCStream();
+    check(ZSTD_seekable_initCStream(cstream, level, 1, frameSize), "initCStream");
+
+    size_t read;
+    while ((read = fread(buffIn, 1, buffInSize, fin)) > 0) {
+        ZSTD_inBuffer input = { buffIn, read, 0 };
+        while (input.pos < input.size) {
+            ZSTD_outBuffer output = { buffOut, buffOutSize, 0 };
+            check(ZSTD_seekable_compressStream(cstream, &output, &input), "compressStream");
+            fwrite(buffOut, 1, output.pos, fout);
+        }
+    }
+
+    size_t remaining;
+    do {
+        ZSTD_outBuffer output = { buffOut, buffOutSize, 0 };
+        remaining = ZSTD_seekable_endStream(cstream, &output);
+        check(remaining, "endStream");
+        fwrite(buffOut, 1, output.pos, fout);
+    } while (remaining > 0);
+
+    ZSTD_seekable_freeCStream(cstream);
+    fclose(fin);
+    fclose(fout);
+    free(buffIn);
+    free(buffOut);
+    return 0;
+}
@@ -0,0 +1,130 @@
+package gzstd
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// XXH64, used for the per-frame checksums of the seekable format. Only the
+// low 32 bits of the digest are stored in a seek table entry.
+
+const (
+	xxhPrime1 uint64 = 11400714785074694791
+	xxhPrime2 uint64 = 14029467366897019727
+	xxhPrime3 uint64 = 1609587929392839161
+	xxhPrime4 uint64 = 9650029242287828579
+	xxhPrime5 uint64 = 2870177450012600261
+)
+
+// xxh64 is a streaming XXH64 digest with seed 0
+type xxh64 struct {
+	v1, v2, v3, v4 uint64
+	total          uint64
+	mem            [32]byte
+	n              int // bytes buffered in mem
+}
+
+func newXXH64() *xxh64 {
+	h := &xxh64{}
+	h.Reset()
+	return h
+}
+
+// Reset restores the digest to its initial state
+func (h *xxh64) Reset() {
+	prime1 := xxhPrime1 // wrapping arithmetic needs a variable
+	h.v1 = prime1 + xxhPrime2
+	h.v2 = xxhPrime2
+	h.v3 = 0
+	h.v4 = -prime1
+	h.total = 0
+	h.n = 0
+}
+
+// Write adds p to the digest. It never fails.
+func (h *xxh64) Write(p []byte) (int, error) {
+	n := len(p)
+	h.total += uint64(n)
+
+	if h.n+len(p) < 32 {
+		h.n += copy(h.mem[h.n:], p)
+		return n, nil
+	}
+
+	if h.n > 0 {
+		c := copy(h.mem[h.n:], p)
+		h.v1 = xxhRound(h.v1, binary.LittleEndian.Uint64(h.mem[0:8]))
+		h.v2 = xxhRound(h.v2, binary.LittleEndian.Uint64(h.mem[8:16]))
+		h.v3 = xxhRound(h.v3, binary.LittleEndian.Uint64(h.mem[16:24]))
+		h.v4 = xxhRound(h.v4, binary.LittleEndian.Uint64(h.mem[24:32]))
+		p = p[c:]
+		h.n = 0
+	}
+
+	for ; len(p) >= 32; p = p[32:] {
+		h.v1 = xxhRound(h.v1, binary.LittleEndian.Uint64(p[0:8]))
+		h.v2 = xxhRound(h.v2, binary.LittleEndian.Uint64(p[8:16]))
+		h.v3 = xxhRound(h.v3, binary.LittleEndian.Uint64(p[16:24]))
+		h.v4 = xxhRound(h.v4, binary.LittleEndian.Uint64(p[24:32]))
+	}
+	h.n = copy(h.mem[:], p)
+
+	return n, nil
+}
+
+// Sum64 returns the digest of the data written so far
+func (h *xxh64) Sum64() uint64 {
+	var acc uint64
+	if h.total >= 32 {
+		acc = bits.RotateLeft64(h.v1, 1) + bits.RotateLeft64(h.v2, 7) +
+			bits.RotateLeft64(h.v3, 12) + bits.RotateLeft64(h.v4, 18)
+		acc = xxhMergeRound(acc, h.v1)
+		acc = xxhMergeRound(acc, h.v2)
+		acc = xxhMergeRound(acc, h.v3)
+		acc = xxhMergeRound(acc, h.v4)
+	} else {
+		acc = xxhPrime5
+	}
+	acc += h.total
+
+	p := h.mem[:h.n]
+	for ; len(p) >= 8; p = p[8:] {
+		acc ^= xxhRound(0, binary.LittleEndian.Uint64(p))
+		acc = bits.RotateLeft64(acc, 27)*xxhPrime1 + xxhPrime4
+	}
+	if len(p) >= 4 {
+		acc ^= uint64(binary.LittleEndian.Uint32(p)) * xxhPrime1
+		acc = bits.RotateLeft64(acc, 23)*xxhPrime2 + xxhPrime3
+		p = p[4:]
+	}
+	for _, b := range p {
+		acc ^= uint64(b) * xxhPrime5
+		acc = bits.RotateLeft64(acc, 11) * xxhPrime1
+	}
+
+	acc ^= acc >> 33
+	acc *= xxhPrime2
+	acc ^= acc >> 29
+	acc *= xxhPrime3
+	acc ^= acc >> 32
+	return acc
+}
+
+// frameChecksum returns the seek table checksum of a frame's decompressed
+// content: the low 32 bits of its XXH64 digest
+func frameChecksum(p []byte) uint32 {
+	h := newXXH64()
+	h.Write(p)
+	return uint32(h.Sum64())
+}
+
+func xxhRound(acc, input uint64) uint64 {
+	acc += input * xxhPrime2
+	acc = bits.RotateLeft64(acc, 31)
+	return acc * xxhPrime1
+}
+
+func xxhMergeRound(acc, val uint64) uint64 {
+	acc ^= xxhRound(0, val)
+	return acc*xxhPrime1 + xxhPrime4
+}
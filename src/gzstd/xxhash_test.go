@@ -0,0 +1,54 @@
+package gzstd
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestXXH64(t *testing.T) {
+	for _, tc := range []struct {
+		input string
+		sum   uint64
+	}{
+		{"", 0xEF46DB3751D8E999},
+		{"a", 0xD24EC4F1A98C6E5B},
+		{"abc", 0x44BC2CF5AD770999},
+	} {
+		h := newXXH64()
+		h.Write([]byte(tc.input))
+		if got := h.Sum64(); got != tc.sum {
+			t.Errorf("XXH64(%q) = %#x, expected %#x", tc.input, got, tc.sum)
+		}
+	}
+
+	// zstd frames end with the low 32 bits of XXH64 of their content
+	rng := rand.New(rand.NewSource(1))
+	encoder, err := zstd.NewWriter(nil, zstd.WithEncoderCRC(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer encoder.Close()
+	for _, size := range []int{1, 7, 31, 32, 33, 100, 4096, 100003} {
+		data := make([]byte, size)
+		rng.Read(data)
+		frame := encoder.EncodeAll(data, nil)
+		expected := binary.LittleEndian.Uint32(frame[len(frame)-4:])
+		if got := frameChecksum(data); got != expected {
+			t.Errorf("frameChecksum of %d bytes = %#x, expected %#x", size, got, expected)
+		}
+
+		// Streaming in uneven pieces gives the same digest
+		h := newXXH64()
+		for p := data; len(p) > 0; {
+			n := min(rng.Intn(50)+1, len(p))
+			h.Write(p[:n])
+			p = p[n:]
+		}
+		if got := uint32(h.Sum64()); got != expected {
+			t.Errorf("Streamed checksum of %d bytes = %#x, expected %#x", size, got, expected)
+		}
+	}
+}